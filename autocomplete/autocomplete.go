@@ -21,6 +21,7 @@ import (
 	"github.com/lomik/graphite-clickhouse/helper/utils"
 	"github.com/lomik/graphite-clickhouse/logs"
 	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/coalesce"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
 	"github.com/lomik/graphite-clickhouse/pkg/where"
 )
@@ -50,6 +51,53 @@ func NewValues(config *config.Config) *Handler {
 	return h
 }
 
+// explainPlan is the response of the explain request
+type explainPlan struct {
+	Queries []clickhouse.LoggedQuery `json:"queries"`
+}
+
+type queryResult struct {
+	body        []byte
+	chReadRows  int64
+	chReadBytes int64
+}
+
+var queryGroup coalesce.Group[queryResult]
+
+// query sends the query to the tagged table, see queryTable
+func (h *Handler) query(ctx context.Context, sql string) ([]byte, int64, int64, error) {
+	return queryTable(ctx, h.config, h.config.ClickHouse.TaggedTable, sql)
+}
+
+// queryTable sends the query to the table. Identical concurrent queries are shared, see Common.CoalesceRequests.
+// The read stats are returned only to the caller, which has made the query
+func queryTable(ctx context.Context, cfg *config.Config, table string, sql string) ([]byte, int64, int64, error) {
+	query := func(ctx context.Context) (r queryResult, err error) {
+		r.body, r.chReadRows, r.chReadBytes, err = clickhouse.Query(
+			scope.WithTable(ctx, table),
+			cfg.ClickHouse.URL,
+			sql,
+			clickhouse.Options{
+				TLSConfig:      cfg.ClickHouse.TLSConfig,
+				Timeout:        cfg.ClickHouse.IndexTimeout,
+				ConnectTimeout: cfg.ClickHouse.ConnectTimeout,
+			},
+			nil,
+		)
+		return
+	}
+	if !cfg.Common.CoalesceRequests || clickhouse.Explaining(ctx) {
+		r, err := query(ctx)
+		return r.body, r.chReadRows, r.chReadBytes, err
+	}
+	r, shared, err := queryGroup.Do(ctx, scope.User(ctx)+";"+sql, query)
+	if shared {
+		scope.Logger(ctx).Debug("autocomplete", zap.Bool("coalesced", true))
+		return r.body, 0, 0, err
+	}
+	return r.body, r.chReadRows, r.chReadBytes, err
+}
+
 func dateString(autocompleteDays int, tm time.Time) (string, string) {
 	fromDate := date.FromTimeToDaysFormat(tm.AddDate(0, 0, -autocompleteDays))
 	untilDate := date.UntilTimeToDaysFormat(tm)
@@ -226,6 +274,12 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	r.ParseMultipartForm(1024 * 1024)
+	// explain requests get the query, which isn't sent to ClickHouse
+	explain := clickhouse.ExplainRequested(r)
+	var queryLog clickhouse.QueryLog
+	if explain {
+		r = r.WithContext(clickhouse.WithQueryLog(scope.WithDryRun(r.Context()), &queryLog))
+	}
 	tagPrefix := r.FormValue("tagPrefix")
 	limitStr := r.FormValue("limit")
 	limit := 10000
@@ -251,7 +305,7 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 	exprs := r.Form["expr"]
 	// params := taggedTagsQuery(exprs, tagPrefix, limit)
 
-	useCache := h.config.Common.FindCache != nil && h.config.Common.FindCacheConfig.FindTimeoutSec > 0 && !parser.TruthyBool(r.FormValue("noCache"))
+	useCache := h.config.Common.FindCache != nil && h.config.Common.FindCacheConfig.FindTimeoutSec > 0 && !parser.TruthyBool(r.FormValue("noCache")) && !explain
 	if useCache {
 		key, _ = taggedKey("tags;", h.config.Common.FindCacheConfig.FindTimeoutSec, fromDate, untilDate, "", exprs, tagPrefix, limit)
 		body, err = h.config.Common.FindCache.Get(key)
@@ -326,17 +380,7 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 			}()
 		}
 
-		body, chReadRows, chReadBytes, err = clickhouse.Query(
-			scope.WithTable(r.Context(), h.config.ClickHouse.TaggedTable),
-			h.config.ClickHouse.URL,
-			sql,
-			clickhouse.Options{
-				TLSConfig:      h.config.ClickHouse.TLSConfig,
-				Timeout:        h.config.ClickHouse.IndexTimeout,
-				ConnectTimeout: h.config.ClickHouse.ConnectTimeout,
-			},
-			nil,
-		)
+		body, chReadRows, chReadBytes, err = h.query(r.Context(), sql)
 
 		if entered {
 			// release early as possible
@@ -348,6 +392,10 @@ func (h *Handler) ServeTags(w http.ResponseWriter, r *http.Request) {
 			status, _ = clickhouse.HandleError(w, err)
 			return
 		}
+		if explain {
+			status = clickhouse.WriteExplain(w, explainPlan{Queries: queryLog.Queries()})
+			return
+		}
 		readBytes = int64(len(body))
 
 		if useCache {
@@ -473,6 +521,12 @@ func (h *Handler) ServeValues(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	r.ParseMultipartForm(1024 * 1024)
+	// explain requests get the query, which isn't sent to ClickHouse
+	explain := clickhouse.ExplainRequested(r)
+	var queryLog clickhouse.QueryLog
+	if explain {
+		r = r.WithContext(clickhouse.WithQueryLog(scope.WithDryRun(r.Context()), &queryLog))
+	}
 	tag := r.FormValue("tag")
 	if tag == "name" {
 		tag = "__name__"
@@ -498,7 +552,7 @@ func (h *Handler) ServeValues(w http.ResponseWriter, r *http.Request) {
 	// params := taggedValuesQuery(tag, exprs, valuePrefix, limit)
 
 	// taggedKey(tag, , "valuePrefix="+valuePrefix, limit)
-	useCache := h.config.Common.FindCache != nil && h.config.Common.FindCacheConfig.FindTimeoutSec > 0 && !parser.TruthyBool(r.FormValue("noCache"))
+	useCache := h.config.Common.FindCache != nil && h.config.Common.FindCacheConfig.FindTimeoutSec > 0 && !parser.TruthyBool(r.FormValue("noCache")) && !explain
 	if useCache {
 		// logger = logger.With(zap.String("use_cache", "true"))
 		key, _ = taggedValuesKey("values;", h.config.Common.FindCacheConfig.FindTimeoutSec, fromDate, untilDate, tag, exprs, valuePrefix, limit)
@@ -572,17 +626,7 @@ func (h *Handler) ServeValues(w http.ResponseWriter, r *http.Request) {
 			}()
 		}
 
-		body, chReadRows, chReadBytes, err = clickhouse.Query(
-			scope.WithTable(r.Context(), h.config.ClickHouse.TaggedTable),
-			h.config.ClickHouse.URL,
-			sql,
-			clickhouse.Options{
-				TLSConfig:      h.config.ClickHouse.TLSConfig,
-				Timeout:        h.config.ClickHouse.IndexTimeout,
-				ConnectTimeout: h.config.ClickHouse.ConnectTimeout,
-			},
-			nil,
-		)
+		body, chReadRows, chReadBytes, err = h.query(r.Context(), sql)
 
 		if entered {
 			// release early as possible
@@ -594,6 +638,10 @@ func (h *Handler) ServeValues(w http.ResponseWriter, r *http.Request) {
 			status, _ = clickhouse.HandleError(w, err)
 			return
 		}
+		if explain {
+			status = clickhouse.WriteExplain(w, explainPlan{Queries: queryLog.Queries()})
+			return
+		}
 
 		if useCache {
 			if metrics.FinderCacheMetrics != nil {
@@ -0,0 +1,416 @@
+package autocomplete
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-graphite/carbonapi/pkg/parser"
+	"github.com/msaf1980/go-stringutils"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/errs"
+	"github.com/lomik/graphite-clickhouse/helper/utils"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/logs"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/lomik/graphite-clickhouse/pkg/where"
+)
+
+// tagExpr is the tag of Tag1, the tag of the series name is returned as name like graphite-web does
+const tagExpr = "if(startsWith(Tag1, '__name__='), 'name', splitByChar('=', Tag1)[1])"
+
+// TagsHandler serves graphite-web tags API: the list of tags on /tags, the values of the tag with the count
+// of series on /tags/<tag> and the series matched by seriesByTag expressions on /tags/findSeries
+type TagsHandler struct {
+	config *config.Config
+}
+
+func NewTagsHandler(config *config.Config) *TagsHandler {
+	return &TagsHandler{
+		config: config,
+	}
+}
+
+// tagsStat is the stat of the request for the access log and metrics
+type tagsStat struct {
+	chReadRows    int64
+	chReadBytes   int64
+	readBytes     int64
+	metricsCount  int64
+	queueFail     bool
+	queueDuration time.Duration
+	findCache     bool
+}
+
+type tagInfo struct {
+	Tag string `json:"tag"`
+}
+
+type tagValue struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+type tagDetails struct {
+	Tag    string     `json:"tag"`
+	Values []tagValue `json:"values"`
+}
+
+func (h *TagsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := timeNow()
+	status := http.StatusOK
+	accessLogger := scope.LoggerWithHeaders(r.Context(), r, h.config.Common.HeadersToLog).Named("http")
+	logger := scope.LoggerWithHeaders(r.Context(), r, h.config.Common.HeadersToLog).Named("tags")
+	r = r.WithContext(scope.WithLogger(r.Context(), logger))
+
+	var st tagsStat
+
+	username := r.Header.Get("X-Forwarded-User")
+	limiter := h.config.GetUserTagsLimiter(username)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			status = http.StatusInternalServerError
+			logger.Error("panic during eval:",
+				zap.String("requestID", scope.String(r.Context(), "requestID")),
+				zap.Any("reason", rec),
+				zap.Stack("stack"),
+			)
+			answer := fmt.Sprintf("%v\nStack trace: %v", rec, zap.Stack("").String)
+			http.Error(w, answer, status)
+		}
+		d := time.Since(start)
+		dMS := d.Milliseconds()
+		logs.AccessLog(accessLogger, h.config, r, status, d, st.queueDuration, st.findCache, st.queueFail)
+		limiter.SendDuration(st.queueDuration.Milliseconds())
+		metrics.SendFindMetrics(metrics.TagsRequestMetric, status, dMS, 0, h.config.Metrics.ExtendedStat, st.metricsCount)
+		if !st.findCache && st.chReadRows > 0 && st.chReadBytes > 0 {
+			errored := status != http.StatusOK && status != http.StatusNotFound
+			metrics.SendQueryRead(metrics.AutocompleteQMetric, 0, 0, dMS, st.metricsCount, st.readBytes, st.chReadRows, st.chReadBytes, errored)
+		}
+	}()
+
+	if h.config.ClickHouse.TaggedTable == "" {
+		status = http.StatusNotImplemented
+		http.Error(w, "tags API requires tagged-table", status)
+		return
+	}
+
+	r.ParseMultipartForm(1024 * 1024)
+
+	var (
+		resp interface{}
+		err  error
+	)
+	switch tag := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tags"), "/"); tag {
+	case "":
+		resp, err = h.tagList(r, limiter, &st)
+	case "findSeries":
+		resp, err = h.findSeries(r, limiter, &st)
+	default:
+		resp, err = h.tagDetails(r, limiter, tag, &st)
+	}
+	if err != nil {
+		if st.queueFail {
+			status = http.StatusServiceUnavailable
+			http.Error(w, err.Error(), status)
+		} else {
+			status, _ = clickhouse.HandleError(w, err)
+		}
+		return
+	}
+
+	b, err := json.Marshal(resp)
+	if err != nil {
+		status = http.StatusInternalServerError
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if st.findCache {
+		w.Header().Set("X-Cached-Find", strconv.Itoa(int(h.config.Common.FindCacheConfig.FindTimeoutSec)))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// parseFilter returns the regular expression of filter parameter, which matches the start of the text like
+// re.match of graphite-web, or empty string, when filter isn't set
+func parseFilter(r *http.Request) (string, error) {
+	filter := r.FormValue("filter")
+	if filter == "" {
+		return "", nil
+	}
+	re := "^(?:" + filter + ")"
+	if _, err := regexp.Compile(re); err != nil {
+		return "", errs.NewErrorWithCode("invalid filter: "+err.Error(), http.StatusBadRequest)
+	}
+	return re, nil
+}
+
+func parseLimit(r *http.Request) (int, error) {
+	limit := 10000
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return 0, errs.NewErrorWithCode(fmt.Sprintf("invalid limit: %q", s), http.StatusBadRequest)
+		}
+	}
+	return limit, nil
+}
+
+// countTable returns the table with counts of Tag1 for the queries of tags and values. TagsCountTable is used,
+// if it's set, as it's much smaller than the tagged table
+func (h *TagsHandler) countTable() (table string, useCount bool) {
+	if h.config.ClickHouse.TagsCountTable != "" {
+		return h.config.ClickHouse.TagsCountTable, true
+	}
+	return h.config.ClickHouse.TaggedTable, false
+}
+
+// cacheKey returns the key of the find cache for the request or empty string, when the cache isn't used
+func (h *TagsHandler) cacheKey(r *http.Request, typ string, params ...string) string {
+	if h.config.Common.FindCache == nil || h.config.Common.FindCacheConfig.FindTimeoutSec <= 0 || parser.TruthyBool(r.FormValue("noCache")) {
+		return ""
+	}
+	ts := utils.TimestampTruncate(timeNow().Unix(), time.Duration(h.config.Common.FindCacheConfig.FindTimeoutSec)*time.Second)
+	return typ + ";" + strings.Join(params, ";") + ";ts=" + strconv.FormatInt(ts, 10)
+}
+
+// fetch returns the body made by fn through the find cache and the tags limiter. The cache isn't used for empty key
+func (h *TagsHandler) fetch(ctx context.Context, qlimiter limiter.ServerLimiter, key string, st *tagsStat, fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	logger := scope.Logger(ctx)
+	if key != "" {
+		body, err := h.config.Common.FindCache.Get(key)
+		if err == nil {
+			if metrics.FinderCacheMetrics != nil {
+				metrics.FinderCacheMetrics.CacheHits.Add(1)
+			}
+			st.findCache = true
+			logger.Info("finder", zap.String("get_cache", key), zap.Bool("find_cached", true),
+				zap.Int32("ttl", h.config.Common.FindCacheConfig.FindTimeoutSec))
+			return body, nil
+		}
+	}
+
+	if qlimiter.Enabled() {
+		limitCtx, cancel := context.WithTimeout(context.Background(), h.config.ClickHouse.IndexTimeout)
+		defer cancel()
+
+		start := time.Now()
+		err := qlimiter.Enter(limitCtx, "tags")
+		st.queueDuration = time.Since(start)
+		if err != nil {
+			st.queueFail = true
+			logger.Error(err.Error())
+			return nil, err
+		}
+		defer qlimiter.Leave(limitCtx, "tags")
+	}
+
+	body, err := fn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if key != "" {
+		if metrics.FinderCacheMetrics != nil {
+			metrics.FinderCacheMetrics.CacheMisses.Add(1)
+		}
+		h.config.Common.FindCache.Set(key, body, h.config.Common.FindCacheConfig.FindTimeoutSec)
+		logger.Info("finder", zap.String("set_cache", key), zap.Bool("find_cached", false),
+			zap.Int32("ttl", h.config.Common.FindCacheConfig.FindTimeoutSec))
+	}
+	return body, nil
+}
+
+// query returns fn for fetch, which sends sql to the table
+func (h *TagsHandler) query(table, sql string, st *tagsStat) func(ctx context.Context) ([]byte, error) {
+	return func(ctx context.Context) ([]byte, error) {
+		body, chReadRows, chReadBytes, err := queryTable(ctx, h.config, table, sql)
+		st.chReadRows, st.chReadBytes, st.readBytes = chReadRows, chReadBytes, int64(len(body))
+		return body, err
+	}
+}
+
+// tagList returns the tags sorted by name, the tags could be filtered by the regular expression
+func (h *TagsHandler) tagList(r *http.Request, qlimiter limiter.ServerLimiter, st *tagsStat) ([]tagInfo, error) {
+	filter, err := parseFilter(r)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := parseLimit(r)
+	if err != nil {
+		return nil, err
+	}
+	fromDate, untilDate := dateString(h.config.ClickHouse.TaggedAutocompleDays, timeNow())
+	table, _ := h.countTable()
+
+	w := where.New()
+	w.Andf("Date >= '%s' AND Date <= '%s'", fromDate, untilDate)
+	if filter != "" {
+		w.And(where.MatchRegexp(tagExpr, filter))
+	}
+	sql := fmt.Sprintf("SELECT %s AS value FROM %s %s GROUP BY value ORDER BY value LIMIT %d FORMAT TabSeparatedRaw",
+		tagExpr, table, w.SQL(), limit)
+
+	key := h.cacheKey(r, "tagList", fromDate, untilDate, "limit="+strconv.Itoa(limit), "filter="+filter)
+	body, err := h.fetch(r.Context(), qlimiter, key, st, h.query(table, sql, st))
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]tagInfo, 0)
+	for _, row := range strings.Split(stringutils.UnsafeString(body), "\n") {
+		if row != "" {
+			tags = append(tags, tagInfo{Tag: row})
+		}
+	}
+	st.metricsCount = int64(len(tags))
+	return tags, nil
+}
+
+// tagDetails returns the values of the tag with the count of series. The counts are taken from TagsCountTable,
+// if it's set, there the series are counted by days, so the max of the daily counts is used
+func (h *TagsHandler) tagDetails(r *http.Request, qlimiter limiter.ServerLimiter, tag string, st *tagsStat) (*tagDetails, error) {
+	filter, err := parseFilter(r)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := parseLimit(r)
+	if err != nil {
+		return nil, err
+	}
+	fromDate, untilDate := dateString(h.config.ClickHouse.TaggedAutocompleDays, timeNow())
+	table, useCount := h.countTable()
+
+	prefix := tag + "="
+	if tag == "name" {
+		prefix = "__name__="
+	}
+	valueExpr := fmt.Sprintf("substr(Tag1, %d)", len(prefix)+1)
+
+	w := where.New()
+	w.And(where.HasPrefix("Tag1", prefix))
+	w.Andf("Date >= '%s' AND Date <= '%s'", fromDate, untilDate)
+	if filter != "" {
+		w.And(where.MatchRegexp(valueExpr, filter))
+	}
+	var sql string
+	if useCount {
+		// the same series are counted every day, so the daily counts can't be summed
+		sql = fmt.Sprintf("SELECT value, max(daily) AS count FROM (SELECT %s AS value, sum(Count) AS daily FROM %s %s GROUP BY value, Date) GROUP BY value ORDER BY value LIMIT %d FORMAT TabSeparatedRaw",
+			valueExpr, table, w.SQL(), limit)
+	} else {
+		sql = fmt.Sprintf("SELECT %s AS value, uniqExact(Path) AS count FROM %s %s GROUP BY value ORDER BY value LIMIT %d FORMAT TabSeparatedRaw",
+			valueExpr, table, w.SQL(), limit)
+	}
+
+	key := h.cacheKey(r, "tagDetails", fromDate, untilDate, "limit="+strconv.Itoa(limit), "tag="+tag, "filter="+filter)
+	body, err := h.fetch(r.Context(), qlimiter, key, st, h.query(table, sql, st))
+	if err != nil {
+		return nil, err
+	}
+
+	details := &tagDetails{Tag: tag, Values: make([]tagValue, 0)}
+	for _, row := range strings.Split(stringutils.UnsafeString(body), "\n") {
+		if row == "" {
+			continue
+		}
+		// values could contain tabs, but counts don't
+		i := strings.LastIndexByte(row, '\t')
+		if i < 0 {
+			return nil, fmt.Errorf("no count of the tag value in %q", row)
+		}
+		count, err := strconv.ParseInt(row[i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("can't convert the count of the tag value in %q", row)
+		}
+		details.Values = append(details.Values, tagValue{Value: row[:i], Count: count})
+	}
+	st.metricsCount = int64(len(details.Values))
+	return details, nil
+}
+
+// findSeries returns the sorted series matched by all expr parameters, as seriesByTag does. The count of series
+// is capped by limit parameter and Common.MaxMetricsInFindAnswer
+func (h *TagsHandler) findSeries(r *http.Request, qlimiter limiter.ServerLimiter, st *tagsStat) ([]string, error) {
+	limit, err := parseLimit(r)
+	if err != nil {
+		return nil, err
+	}
+	if maxMetrics := h.config.Common.MaxMetricsInFindAnswer; maxMetrics > 0 {
+		limit = min(limit, maxMetrics)
+	}
+	exprs := make([]string, 0, len(r.Form["expr"]))
+	for _, expr := range r.Form["expr"] {
+		if expr != "" {
+			exprs = append(exprs, expr)
+		}
+	}
+	if len(exprs) == 0 {
+		return nil, errs.NewErrorWithCode("expr not set", http.StatusBadRequest)
+	}
+	terms, err := finder.ParseTaggedConditions(exprs, h.config, false)
+	if err == finder.ErrCostlySeriesByTag {
+		return nil, err
+	} else if err != nil {
+		return nil, errs.NewErrorWithCode(err.Error(), http.StatusBadRequest)
+	}
+	finder.SetCosts(terms, h.config.ClickHouse.TaggedCosts)
+	finder.SortTaggedTermsByCost(terms)
+
+	now := timeNow()
+	from, until := now.AddDate(0, 0, -h.config.ClickHouse.TaggedAutocompleDays).Unix(), now.Unix()
+	fromDate, untilDate := dateString(h.config.ClickHouse.TaggedAutocompleDays, now)
+
+	params := []string{fromDate, untilDate}
+	for _, expr := range exprs {
+		params = append(params, "expr='"+expr+"'")
+	}
+	key := h.cacheKey(r, "findSeries", params...)
+	body, err := h.fetch(r.Context(), qlimiter, key, st, func(ctx context.Context) ([]byte, error) {
+		var stat finder.FinderStat
+		result, err := finder.FindTagged(ctx, h.config, terms, from, until, &stat)
+		st.chReadRows, st.chReadBytes, st.readBytes = stat.ChReadRows, stat.ChReadBytes, stat.ReadBytes
+		if err != nil {
+			return nil, err
+		}
+		rows := result.Series()
+		series := make([]string, 0, len(rows))
+		for _, row := range rows {
+			if len(row) > 0 {
+				series = append(series, string(finder.TaggedDecode(result.Abs(row))))
+			}
+		}
+		slices.Sort(series)
+		// the decoded series are cached
+		return []byte(strings.Join(slices.Compact(series), "\n")), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the cached series aren't limited, so the requests with other limits share them
+	series := make([]string, 0)
+	for _, row := range strings.Split(stringutils.UnsafeString(body), "\n") {
+		if len(series) == limit {
+			break
+		}
+		if row != "" {
+			series = append(series, row)
+		}
+	}
+	st.metricsCount = int64(len(series))
+	return series, nil
+}
@@ -0,0 +1,157 @@
+package autocomplete
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	chtest "github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+	"github.com/lomik/graphite-clickhouse/metrics"
+)
+
+func TestTagsHandler(t *testing.T) {
+	timeNow = func() time.Time {
+		return time.Unix(1669714247, 0)
+	}
+	metrics.DisableMetrics()
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	cfg, _ := config.DefaultConfig()
+	cfg.ClickHouse.URL = srv.URL
+	h := NewTagsHandler(cfg)
+
+	fromDate, untilDate := dateString(cfg.ClickHouse.TaggedAutocompleDays, timeNow())
+	dates := "Date >= '" + fromDate + "' AND Date <= '" + untilDate + "'"
+
+	srv.AddResponce(
+		"SELECT "+tagExpr+" AS value FROM graphite_tagged WHERE "+dates+" GROUP BY value ORDER BY value LIMIT 10000 FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("dc\nhost\nname\n")},
+	)
+	srv.AddResponce(
+		"SELECT "+tagExpr+" AS value FROM graphite_tagged WHERE ("+dates+") AND (match("+tagExpr+", '^(?:h|n)')) GROUP BY value ORDER BY value LIMIT 1 FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("host\n")},
+	)
+	srv.AddResponce(
+		"SELECT substr(Tag1, 6) AS value, uniqExact(Path) AS count FROM graphite_tagged WHERE (Tag1 LIKE 'host=%') AND ("+dates+") GROUP BY value ORDER BY value LIMIT 10000 FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("a\t2\nb\t1\n")},
+	)
+	srv.AddResponce(
+		"SELECT substr(Tag1, 10) AS value, uniqExact(Path) AS count FROM graphite_tagged WHERE ((Tag1 LIKE '\\\\_\\\\_name\\\\_\\\\_=%') AND ("+dates+")) AND (match(substr(Tag1, 10), '^(?:cpu)')) GROUP BY value ORDER BY value LIMIT 10000 FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("cpu.load\t3\n")},
+	)
+
+	tests := []struct {
+		url  string
+		code int
+		want string
+	}{
+		{url: "/tags", code: http.StatusOK, want: `[{"tag":"dc"},{"tag":"host"},{"tag":"name"}]`},
+		{url: "/tags/?filter=h%7Cn&limit=1", code: http.StatusOK, want: `[{"tag":"host"}]`},
+		{url: "/tags/host", code: http.StatusOK, want: `{"tag":"host","values":[{"value":"a","count":2},{"value":"b","count":1}]}`},
+		{url: "/tags/name/?filter=cpu", code: http.StatusOK, want: `{"tag":"name","values":[{"value":"cpu.load","count":3}]}`},
+		{url: "/tags?filter=%28", code: http.StatusBadRequest},
+		{url: "/tags/host?limit=x", code: http.StatusBadRequest},
+		{url: "/tags/findSeries", code: http.StatusBadRequest},
+		{url: "/tags/findSeries?expr=host", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+			require.Equal(t, tt.code, w.Code, w.Body.String())
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.want, w.Body.String())
+				assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+
+	cfg.ClickHouse.TaggedTable = ""
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/tags", nil))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestTagsHandlerCountTable(t *testing.T) {
+	timeNow = func() time.Time {
+		return time.Unix(1669714247, 0)
+	}
+	metrics.DisableMetrics()
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	cfg, _ := config.DefaultConfig()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.ClickHouse.TagsCountTable = "tag1_count_per_day"
+	cfg.Common.FindCacheConfig = config.CacheConfig{
+		Type:           "mem",
+		Size:           8192,
+		FindTimeoutSec: 60,
+	}
+	var err error
+	cfg.Common.FindCache, err = config.CreateCache("tags", &cfg.Common.FindCacheConfig)
+	require.NoError(t, err)
+	h := NewTagsHandler(cfg)
+
+	fromDate, untilDate := dateString(cfg.ClickHouse.TaggedAutocompleDays, timeNow())
+	srv.AddResponce(
+		"SELECT value, max(daily) AS count FROM (SELECT substr(Tag1, 6) AS value, sum(Count) AS daily FROM tag1_count_per_day WHERE (Tag1 LIKE 'host=%') AND (Date >= '"+fromDate+"' AND Date <= '"+untilDate+"') GROUP BY value, Date) GROUP BY value ORDER BY value LIMIT 10000 FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("a\t20\n")},
+	)
+
+	for i, cached := range []string{"", "60"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/tags/host", nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, `{"tag":"host","values":[{"value":"a","count":20}]}`, w.Body.String())
+		assert.Equal(t, cached, w.Header().Get("X-Cached-Find"), i)
+	}
+	assert.Equal(t, uint64(1), srv.Queries())
+}
+
+func TestTagsHandlerFindSeries(t *testing.T) {
+	timeNow = func() time.Time {
+		return time.Unix(1669714247, 0)
+	}
+	metrics.DisableMetrics()
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+
+	cfg, _ := config.DefaultConfig()
+	cfg.ClickHouse.URL = srv.URL
+	h := NewTagsHandler(cfg)
+
+	srv.AddResponce(
+		"SELECT Path FROM graphite_tagged  WHERE ((Tag1='dc=east') AND (arrayExists((x) -> x LIKE 'host=%' AND match(x, '^host=.*.*'), Tags))) AND (Date >='2022-11-22' AND Date <= '2022-11-29') GROUP BY Path FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("cpu?host=c&dc=east\ncpu?host=b&dc=east\ncpu?host=a&dc=east\ncpu?host=b&dc=east\n")},
+	)
+
+	tests := []struct {
+		params     string
+		maxMetrics int
+		want       string
+	}{
+		// the series are sorted and de-duplicated
+		{params: "", want: `["cpu;dc=east;host=a","cpu;dc=east;host=b","cpu;dc=east;host=c"]`},
+		{params: "&limit=2", want: `["cpu;dc=east;host=a","cpu;dc=east;host=b"]`},
+		{params: "&limit=2", maxMetrics: 1, want: `["cpu;dc=east;host=a"]`},
+		{params: "", maxMetrics: 2, want: `["cpu;dc=east;host=a","cpu;dc=east;host=b"]`},
+	}
+	for _, tt := range tests {
+		cfg.Common.MaxMetricsInFindAnswer = tt.maxMetrics
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/tags/findSeries?expr=host%3D~.%2A&expr=dc%3Deast"+tt.params, nil))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, tt.want, w.Body.String(), tt)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/tags/findSeries?expr=host%3D~.%2A&limit=0", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
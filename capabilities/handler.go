@@ -67,13 +67,20 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			hostname = "(unknown)"
 		}
+		// points in milliseconds are returned only by tables with high-precision-time
+		highPrecisionTimestamps := false
+		for _, t := range h.config.DataTable {
+			if t.HighPrecisionTime != "" {
+				highPrecisionTimestamps = true
+			}
+		}
 		pvResponse := v3pb.CapabilityResponse{
 			SupportedProtocols:        []string{"carbonapi_v3_pb", "carbonapi_v2_pb", "graphite-web-pickle"},
 			Name:                      hostname,
-			HighPrecisionTimestamps:   false,
-			SupportFilteringFunctions: false,
+			HighPrecisionTimestamps:   highPrecisionTimestamps,
+			SupportFilteringFunctions: true,
 			LikeSplittedRequests:      false,
-			SupportStreaming:          false,
+			SupportStreaming:          true,
 		}
 
 		var data []byte
@@ -99,6 +99,9 @@ type Common struct {
 	MaxMetricsInFindAnswer int              `toml:"max-metrics-in-find-answer" json:"max-metrics-in-find-answer" comment:"limit number of results from find query, 0=unlimited"`
 	MaxMetricsPerTarget    int              `toml:"max-metrics-per-target"     json:"max-metrics-per-target"     comment:"limit numbers of queried metrics per target in /render requests, 0 or negative = unlimited"`
 	AppendEmptySeries      bool             `toml:"append-empty-series"        json:"append-empty-series"        comment:"if true, always return points for all metrics, replacing empty results with list of NaN"`
+	EvaluateFunctions      bool             `toml:"evaluate-functions"         json:"evaluate-functions"         comment:"if true, graphite functions of /render targets are evaluated by graphite-clickhouse"`
+	PartialResults         bool             `toml:"partial-results"            json:"partial-results"            comment:"if true, /render returns the series of succeeded targets when other targets are failed, could be overridden by 'partialResults' request parameter"`
+	CoalesceRequests       bool             `toml:"coalesce-requests"          json:"coalesce-requests"          comment:"if true, identical concurrent finder, render and tags autocomplete queries share one query to ClickHouse"`
 	TargetBlacklist        []string         `toml:"target-blacklist"           json:"target-blacklist"           comment:"daemon returns empty response if query matches any of regular expressions"                  commented:"true"`
 	Blacklist              []*regexp.Regexp `toml:"-"                          json:"-"` // compiled TargetBlacklist
 	MemoryReturnInterval   time.Duration    `toml:"memory-return-interval"     json:"memory-return-interval"     comment:"daemon will return the freed memory to the OS when it>0"`
@@ -113,9 +116,11 @@ type Common struct {
 	SDDc             []string      `toml:"service-discovery-ds"   json:"service-discovery-ds"   comment:"service discovery datacenters (first - is primary, in other register as backup)"`
 	SDExpire         time.Duration `toml:"service-discovery-expire"   json:"service-discovery-expire"   comment:"service discovery expire duration for cleanup (minimum is 24h, if enabled)"`
 
-	FindCacheConfig CacheConfig `toml:"find-cache"      json:"find-cache"             comment:"find/tags cache config"`
+	FindCacheConfig   CacheConfig `toml:"find-cache"      json:"find-cache"             comment:"find/tags cache config"`
+	RenderCacheConfig CacheConfig `toml:"render-cache"    json:"render-cache"           comment:"render cache config (fetched datapoints)"`
 
-	FindCache cache.BytesCache `toml:"-" json:"-"`
+	FindCache   cache.BytesCache `toml:"-" json:"-"`
+	RenderCache cache.BytesCache `toml:"-" json:"-"`
 }
 
 // FeatureFlags contains feature flags that significantly change how gch responds to some requests
@@ -162,6 +167,9 @@ type UserLimits struct {
 	ConcurrentQueries int `toml:"concurrent-queries" json:"concurrent-queries" comment:"Concurrent queries to fetch data"`
 	AdaptiveQueries   int `toml:"adaptive-queries" json:"adaptive-queries" comment:"Adaptive queries (based on load average) for increase/decrease concurrent queries"`
 
+	MaxEstimatedRows  int64 `toml:"max-estimated-rows"  json:"max-estimated-rows"  comment:"reject queries with more rows estimated by EXPLAIN ESTIMATE, 0 = the value of query params"`
+	MaxEstimatedMarks int64 `toml:"max-estimated-marks" json:"max-estimated-marks" comment:"reject queries with more marks estimated by EXPLAIN ESTIMATE, 0 = the value of query params"`
+
 	Limiter limiter.ServerLimiter `toml:"-" json:"-"`
 }
 
@@ -174,6 +182,9 @@ type QueryParam struct {
 	ConcurrentQueries int `toml:"concurrent-queries" json:"concurrent-queries" comment:"Concurrent queries to fetch data"`
 	AdaptiveQueries   int `toml:"adaptive-queries" json:"adaptive-queries" comment:"Adaptive queries (based on load average) for increase/decrease concurrent queries"`
 
+	MaxEstimatedRows  int64 `toml:"max-estimated-rows"  json:"max-estimated-rows"  comment:"reject data queries with more rows estimated by EXPLAIN ESTIMATE, 0 = the value of [clickhouse]"`
+	MaxEstimatedMarks int64 `toml:"max-estimated-marks" json:"max-estimated-marks" comment:"reject data queries with more marks estimated by EXPLAIN ESTIMATE, 0 = the value of [clickhouse]"`
+
 	Limiter limiter.ServerLimiter `toml:"-" json:"-"`
 }
 
@@ -227,6 +238,9 @@ type ClickHouse struct {
 	TagsMinInQuery        int  `toml:"tags-min-in-query" json:"tags-min-in-query" comment:"Minimum tags in seriesByTag query"`
 	TagsMinInAutocomplete int  `toml:"tags-min-in-autocomplete" json:"tags-min-in-autocomplete" comment:"Minimum tags in autocomplete query"`
 
+	MaxEstimatedRows  int64 `toml:"max-estimated-rows"  json:"max-estimated-rows"  comment:"reject finder and data queries with more rows estimated by EXPLAIN ESTIMATE before the execution, 0 = unlimited"`
+	MaxEstimatedMarks int64 `toml:"max-estimated-marks" json:"max-estimated-marks" comment:"reject finder and data queries with more marks estimated by EXPLAIN ESTIMATE before the execution, 0 = unlimited"`
+
 	UserLimits           map[string]UserLimits `toml:"user-limits"              json:"user-limits"              comment:"customized query limiter for some users"                                                                                        commented:"true"`
 	DateFormat           string                `toml:"date-format"              json:"date-format"              comment:"Date format (default, utc, both)"`
 	IndexTable           string                `toml:"index-table"              json:"index-table"              comment:"see doc/index-table.md"`
@@ -254,13 +268,17 @@ type ClickHouse struct {
 	MaxDataPoints    int    `toml:"max-data-points"          json:"max-data-points"          comment:"max points per metric when internal-aggregation=true"`
 	// InternalAggregation controls if ClickHouse itself or graphite-clickhouse aggregates points to proper retention
 	InternalAggregation bool `toml:"internal-aggregation"     json:"internal-aggregation"     comment:"ClickHouse-side aggregation, see doc/aggregation.md"`
+	// StitchDataTables splits time frames at max-age/min-age boundaries of data tables and queries every part from its own table
+	StitchDataTables bool `toml:"stitch-data-tables"       json:"stitch-data-tables"       comment:"query parts of the time frame from the data tables with matching max-age/min-age and merge them, requires internal-aggregation=true"`
 
-	TLSParams config.TLS  `toml:"tls"                      json:"tls"                      comment:"mTLS HTTPS configuration for connecting to clickhouse server"                                                                         commented:"true"`
-	TLSConfig *tls.Config `toml:"-"                        json:"-"`
+	Transport clickhouse.Transport `toml:"transport"                json:"transport"                comment:"HTTP transport (connections pool) settings, shared by queries to the same host"`
+	Replicas  clickhouse.Replicas  `toml:"replicas"                 json:"replicas"                 comment:"load balancing and failover for urls with several comma-separated hosts, like http://host1:8123,host2:8123/?params"`
+	TLSParams config.TLS           `toml:"tls"                      json:"tls"                      comment:"mTLS HTTPS configuration for connecting to clickhouse server"                                                                         commented:"true"`
+	TLSConfig *tls.Config          `toml:"-"                        json:"-"`
 }
 
 func clickhouseURLValidate(chURL string) (*url.URL, error) {
-	u, err := url.Parse(chURL)
+	u, _, err := clickhouse.ParseURL(chURL)
 	if err != nil {
 		return nil, fmt.Errorf("error %q in url %q", err.Error(), chURL)
 	} else if u.Scheme != "http" && u.Scheme != "https" {
@@ -302,6 +320,17 @@ type Prometheus struct {
 	PageTitle                  string        `toml:"page-title"                    json:"page-title"`
 	LookbackDelta              time.Duration `toml:"lookback-delta"                json:"lookback-delta"`
 	RemoteReadConcurrencyLimit int           `toml:"remote-read-concurrency-limit" json:"remote-read-concurrency-limit" comment:"concurrently handled remote read requests"`
+	RemoteWrite                RemoteWrite   `toml:"remote-write"                  json:"remote-write"                  comment:"remote write receiver on /api/v1/write"`
+}
+
+// RemoteWrite config for Prometheus remote write receiver
+type RemoteWrite struct {
+	Enabled       bool          `toml:"enabled"        json:"enabled"        comment:"write samples to the first data-table with prometheus context and series to tagged-table"`
+	BatchSize     int           `toml:"batch-size"     json:"batch-size"     comment:"max samples in one insert"`
+	FlushInterval time.Duration `toml:"flush-interval" json:"flush-interval" comment:"max time for collecting samples before insert"`
+	QueueSize     int           `toml:"queue-size"     json:"queue-size"     comment:"max samples, waiting for insert. Requests wait for free space in queue"`
+	QueueTimeout  time.Duration `toml:"queue-timeout"  json:"queue-timeout"  comment:"max wait time for free space in queue, after that request is failed and should be retried by sender"`
+	Timeout       time.Duration `toml:"timeout"        json:"timeout"        comment:"total timeout for insert"`
 }
 
 const (
@@ -316,6 +345,19 @@ var knownDataTableContext = map[string]bool{
 	ContextPrometheus: true,
 }
 
+const (
+	// HighPrecisionTimeDateTime64 is the Time column of DateTime64(3) type
+	HighPrecisionTimeDateTime64 = "DateTime64"
+	// HighPrecisionTimeUInt64 is the Time column with unix timestamps in milliseconds
+	HighPrecisionTimeUInt64 = "UInt64"
+)
+
+var knownHighPrecisionTime = map[string]bool{
+	"":                          true,
+	HighPrecisionTimeDateTime64: true,
+	HighPrecisionTimeUInt64:     true,
+}
+
 // DataTable configs
 type DataTable struct {
 	Table                  string                `toml:"table"                    json:"table"                    comment:"data table from carbon-clickhouse"`
@@ -334,6 +376,7 @@ type DataTable struct {
 	RollupDefaultPrecision uint32                `toml:"rollup-default-precision" json:"rollup-default-precision" comment:"is used when none of rules match"`
 	RollupDefaultFunction  string                `toml:"rollup-default-function"  json:"rollup-default-function"  comment:"is used when none of rules match"`
 	RollupUseReverted      bool                  `toml:"rollup-use-reverted"      json:"rollup-use-reverted"      comment:"should be set to true if you don't have reverted regexps in rollup-conf for reversed tables"`
+	HighPrecisionTime      string                `toml:"high-precision-time"      json:"high-precision-time"      comment:"type of Time column with milliseconds: 'DateTime64' or 'UInt64', empty for seconds"`
 	Context                []string              `toml:"context"                  json:"context"                  comment:"valid values are 'graphite' of 'prometheus'"`
 	ContextMap             map[string]bool       `toml:"-"                        json:"-"`
 	Rollup                 *rollup.Rollup        `toml:"-"                        json:"rollup-conf"`
@@ -382,6 +425,11 @@ func New() *Config {
 				ShortTimeoutSec:   0,
 				FindTimeoutSec:    0,
 			},
+			RenderCacheConfig: CacheConfig{
+				Type:              "null",
+				DefaultTimeoutSec: 0,
+				ShortTimeoutSec:   0,
+			},
 			DegragedMultiply: 4.0,
 			DegragedLoad:     1.0,
 		},
@@ -398,12 +446,23 @@ func New() *Config {
 			TaggedAutocompleDays: 7,
 			ExtraPrefix:          "",
 			ConnectTimeout:       time.Second,
-			DataTableLegacy:      "",
-			RollupConfLegacy:     "auto",
-			MaxDataPoints:        1048576,
-			InternalAggregation:  true,
-			FindLimiter:          limiter.NoopLimiter{},
-			TagsLimiter:          limiter.NoopLimiter{},
+			Transport: clickhouse.Transport{
+				MaxIdleConns:        100,
+				MaxIdleConnsPerHost: 10,
+				IdleConnTimeout:     90 * time.Second,
+				HTTP2:               true,
+			},
+			Replicas: clickhouse.Replicas{
+				Policy:       clickhouse.ReplicaPolicyRoundRobin,
+				EjectTimeout: 10 * time.Second,
+				Retries:      1,
+			},
+			DataTableLegacy:     "",
+			RollupConfLegacy:    "auto",
+			MaxDataPoints:       1048576,
+			InternalAggregation: true,
+			FindLimiter:         limiter.NoopLimiter{},
+			TagsLimiter:         limiter.NoopLimiter{},
 		},
 		Tags: Tags{
 			Threads:     1,
@@ -422,6 +481,13 @@ func New() *Config {
 			Listen:                     ":9092",
 			LookbackDelta:              5 * time.Minute,
 			RemoteReadConcurrencyLimit: 10,
+			RemoteWrite: RemoteWrite{
+				BatchSize:     100000,
+				FlushInterval: time.Second,
+				QueueSize:     1000000,
+				QueueTimeout:  10 * time.Second,
+				Timeout:       time.Minute,
+			},
 		},
 		Debug: Debug{
 			Directory:        "",
@@ -595,6 +661,12 @@ func Unmarshal(body []byte, exactConfig bool) (cfg *Config, warns []zap.Field, e
 			// reuse default url
 			cfg.ClickHouse.QueryParams[i].URL = cfg.ClickHouse.URL
 		}
+		if cfg.ClickHouse.QueryParams[i].MaxEstimatedRows == 0 {
+			cfg.ClickHouse.QueryParams[i].MaxEstimatedRows = cfg.ClickHouse.MaxEstimatedRows
+		}
+		if cfg.ClickHouse.QueryParams[i].MaxEstimatedMarks == 0 {
+			cfg.ClickHouse.QueryParams[i].MaxEstimatedMarks = cfg.ClickHouse.MaxEstimatedMarks
+		}
 		if _, err = clickhouseURLValidate(cfg.ClickHouse.QueryParams[i].URL); err != nil {
 			return nil, nil, err
 		}
@@ -604,7 +676,8 @@ func Unmarshal(body []byte, exactConfig bool) (cfg *Config, warns []zap.Field, e
 		[]QueryParam{{
 			URL: cfg.ClickHouse.URL, DataTimeout: cfg.ClickHouse.DataTimeout,
 			MaxQueries: cfg.ClickHouse.RenderMaxQueries, ConcurrentQueries: cfg.ClickHouse.RenderConcurrentQueries,
-			AdaptiveQueries: cfg.ClickHouse.RenderAdaptiveQueries,
+			AdaptiveQueries:  cfg.ClickHouse.RenderAdaptiveQueries,
+			MaxEstimatedRows: cfg.ClickHouse.MaxEstimatedRows, MaxEstimatedMarks: cfg.ClickHouse.MaxEstimatedMarks,
 		}},
 		cfg.ClickHouse.QueryParams...,
 	)
@@ -651,6 +724,14 @@ func Unmarshal(body []byte, exactConfig bool) (cfg *Config, warns []zap.Field, e
 		return nil, nil, err
 	}
 
+	if cfg.Common.RenderCache, err = CreateCache("render", &cfg.Common.RenderCacheConfig); err == nil {
+		if cfg.Common.RenderCacheConfig.Type != "null" {
+			warns = append(warns, zap.Any("enable render cache", zap.String("type", cfg.Common.RenderCacheConfig.Type)))
+		}
+	} else {
+		return nil, nil, err
+	}
+
 	l := len(cfg.Common.TargetBlacklist)
 	if l > 0 {
 		cfg.Common.Blacklist = make([]*regexp.Regexp, l)
@@ -696,6 +777,12 @@ func Unmarshal(body []byte, exactConfig bool) (cfg *Config, warns []zap.Field, e
 		warns = append(warns, zap.Errors("config deprecations", deprecationList))
 	}
 
+	clickhouse.SetTransport(cfg.ClickHouse.Transport)
+	if err = cfg.ClickHouse.Replicas.Validate(); err != nil {
+		return nil, nil, err
+	}
+	clickhouse.SetReplicas(cfg.ClickHouse.Replicas)
+
 	switch strings.ToLower(cfg.ClickHouse.DateFormat) {
 	case "utc":
 		date.SetUTC()
@@ -849,6 +936,10 @@ func (c *Config) ProcessDataTables() (err error) {
 				c.DataTable[i].ContextMap[ctx] = true
 			}
 		}
+
+		if !knownHighPrecisionTime[c.DataTable[i].HighPrecisionTime] {
+			return fmt.Errorf("unknown high-precision-time %#v", c.DataTable[i].HighPrecisionTime)
+		}
 	}
 	return nil
 }
@@ -983,3 +1074,26 @@ func GetQueryParam(a []QueryParam, duration time.Duration) int {
 		return indx
 	}
 }
+
+// GetEstimateLimits returns the thresholds of EXPLAIN ESTIMATE for the user. The non-zero values of the user limits
+// override maxRows and maxMarks
+func GetEstimateLimits(userLimits map[string]UserLimits, username string, maxRows, maxMarks int64) clickhouse.EstimateLimits {
+	limits := clickhouse.EstimateLimits{MaxRows: maxRows, MaxMarks: maxMarks}
+	if username == "" {
+		return limits
+	}
+	if u, ok := userLimits[username]; ok {
+		if u.MaxEstimatedRows != 0 {
+			limits.MaxRows = u.MaxEstimatedRows
+		}
+		if u.MaxEstimatedMarks != 0 {
+			limits.MaxMarks = u.MaxEstimatedMarks
+		}
+	}
+	return limits
+}
+
+// FindEstimateLimits returns the thresholds of EXPLAIN ESTIMATE for the finder queries of the user
+func (c *ClickHouse) FindEstimateLimits(username string) clickhouse.EstimateLimits {
+	return GetEstimateLimits(c.UserLimits, username, c.MaxEstimatedRows, c.MaxEstimatedMarks)
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
 	"github.com/lomik/graphite-clickhouse/limiter"
 	"github.com/lomik/graphite-clickhouse/metrics"
 )
@@ -191,6 +192,16 @@ func TestProcessDataTables(t *testing.T) {
 				fmt.Errorf("unknown context \"unexpected\""),
 			},
 		},
+		{
+			name: "unknown high-precision-time",
+			in: in{
+				table: DataTable{Table: "graphite.data", HighPrecisionTime: "DateTime"},
+			},
+			out: out{
+				nil,
+				fmt.Errorf("unknown high-precision-time \"DateTime\""),
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -262,6 +273,18 @@ index-timeout = "4s"
 tree-timeout = "5s"
 connect-timeout = "2s"
 
+[clickhouse.transport]
+max-idle-conns = 50
+max-idle-conns-per-host = 5
+max-conns-per-host = 20
+idle-conn-timeout = "30s"
+http2 = false
+
+[clickhouse.replicas]
+policy = "least-inflight"
+eject-timeout = "30s"
+retries = 2
+
 # DataTable is tested in TestProcessDataTables
 # [[data-table]]
 # table = "another_data"
@@ -292,6 +315,14 @@ external-url = "https://server:3456/uri"
 page-title = "Prometheus Time Series"
 lookback-delta = "5m"
 
+[prometheus.remote-write]
+enabled = true
+batch-size = 5000
+flush-interval = "2s"
+queue-size = 20000
+queue-timeout = "5s"
+timeout = "30s"
+
 [debug]
 directory = "tests_tmp"
 directory-perm = 0o755
@@ -339,6 +370,11 @@ sample-thereafter = 12
 			DefaultTimeoutSec: 0,
 			ShortTimeoutSec:   0,
 		},
+		RenderCacheConfig: CacheConfig{
+			Type:              "null",
+			DefaultTimeoutSec: 0,
+			ShortTimeoutSec:   0,
+		},
 		DegragedMultiply: 4.0,
 		DegragedLoad:     1.0,
 	}
@@ -377,10 +413,21 @@ sample-thereafter = 12
 		TagTable:             "tag_table",
 		ExtraPrefix:          "tum.pu-dum",
 		ConnectTimeout:       2000000000,
-		DataTableLegacy:      "data",
-		RollupConfLegacy:     "none",
-		MaxDataPoints:        8000,
-		InternalAggregation:  true,
+		Transport: clickhouse.Transport{
+			MaxIdleConns:        50,
+			MaxIdleConnsPerHost: 5,
+			MaxConnsPerHost:     20,
+			IdleConnTimeout:     30 * time.Second,
+		},
+		Replicas: clickhouse.Replicas{
+			Policy:       clickhouse.ReplicaPolicyLeastInflight,
+			EjectTimeout: 30 * time.Second,
+			Retries:      2,
+		},
+		DataTableLegacy:     "data",
+		RollupConfLegacy:    "none",
+		MaxDataPoints:       8000,
+		InternalAggregation: true,
 	}
 	expected.ClickHouse.IndexReverses[0] = &IndexReverseRule{"suf", "pref", "", nil, "direct"}
 	r, _ = regexp.Compile("^reg$")
@@ -396,7 +443,21 @@ sample-thereafter = 12
 	assert.Equal(t, expected.Carbonlink, config.Carbonlink)
 
 	// Prometheus
-	expected.Prometheus = Prometheus{Listen: ":9092", ExternalURLRaw: "https://server:3456/uri", PageTitle: "Prometheus Time Series", LookbackDelta: 5 * time.Minute, RemoteReadConcurrencyLimit: 10}
+	expected.Prometheus = Prometheus{
+		Listen:                     ":9092",
+		ExternalURLRaw:             "https://server:3456/uri",
+		PageTitle:                  "Prometheus Time Series",
+		LookbackDelta:              5 * time.Minute,
+		RemoteReadConcurrencyLimit: 10,
+		RemoteWrite: RemoteWrite{
+			Enabled:       true,
+			BatchSize:     5000,
+			FlushInterval: 2 * time.Second,
+			QueueSize:     20000,
+			QueueTimeout:  5 * time.Second,
+			Timeout:       30 * time.Second,
+		},
+	}
 	u, _ := url.Parse(expected.Prometheus.ExternalURLRaw)
 	expected.Prometheus.ExternalURL = u
 	assert.Equal(t, expected.Prometheus, config.Prometheus)
@@ -577,6 +638,11 @@ sample-thereafter = 12
 			DefaultTimeoutSec: 0,
 			ShortTimeoutSec:   0,
 		},
+		RenderCacheConfig: CacheConfig{
+			Type:              "null",
+			DefaultTimeoutSec: 0,
+			ShortTimeoutSec:   0,
+		},
 		DegragedMultiply: 4.0,
 		DegragedLoad:     1.0,
 	}
@@ -665,10 +731,21 @@ sample-thereafter = 12
 		TagTable:             "tag_table",
 		ExtraPrefix:          "tum.pu-dum",
 		ConnectTimeout:       2000000000,
-		DataTableLegacy:      "data",
-		RollupConfLegacy:     "none",
-		MaxDataPoints:        8000,
-		InternalAggregation:  true,
+		Transport: clickhouse.Transport{
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeout:     90 * time.Second,
+			HTTP2:               true,
+		},
+		Replicas: clickhouse.Replicas{
+			Policy:       clickhouse.ReplicaPolicyRoundRobin,
+			EjectTimeout: 10 * time.Second,
+			Retries:      1,
+		},
+		DataTableLegacy:     "data",
+		RollupConfLegacy:    "none",
+		MaxDataPoints:       8000,
+		InternalAggregation: true,
 	}
 	expected.ClickHouse.IndexReverses[0] = &IndexReverseRule{"suf", "pref", "", nil, "direct"}
 	r, _ = regexp.Compile("^reg$")
@@ -702,7 +779,20 @@ sample-thereafter = 12
 	assert.Equal(t, expected.Carbonlink, config.Carbonlink)
 
 	// Prometheus
-	expected.Prometheus = Prometheus{Listen: ":9092", ExternalURLRaw: "https://server:3456/uri", PageTitle: "Prometheus Time Series", LookbackDelta: 5 * time.Minute, RemoteReadConcurrencyLimit: 10}
+	expected.Prometheus = Prometheus{
+		Listen:                     ":9092",
+		ExternalURLRaw:             "https://server:3456/uri",
+		PageTitle:                  "Prometheus Time Series",
+		LookbackDelta:              5 * time.Minute,
+		RemoteReadConcurrencyLimit: 10,
+		RemoteWrite: RemoteWrite{
+			BatchSize:     100000,
+			FlushInterval: time.Second,
+			QueueSize:     1000000,
+			QueueTimeout:  10 * time.Second,
+			Timeout:       time.Minute,
+		},
+	}
 	u, _ := url.Parse(expected.Prometheus.ExternalURLRaw)
 	expected.Prometheus.ExternalURL = u
 	assert.Equal(t, expected.Prometheus, config.Prometheus)
@@ -893,6 +983,11 @@ sample-thereafter = 12
 			DefaultTimeoutSec: 0,
 			ShortTimeoutSec:   0,
 		},
+		RenderCacheConfig: CacheConfig{
+			Type:              "null",
+			DefaultTimeoutSec: 0,
+			ShortTimeoutSec:   0,
+		},
 		DegragedMultiply: 4.0,
 		DegragedLoad:     1.0,
 	}
@@ -986,10 +1081,21 @@ sample-thereafter = 12
 		TagTable:             "tag_table",
 		ExtraPrefix:          "tum.pu-dum",
 		ConnectTimeout:       2000000000,
-		DataTableLegacy:      "data",
-		RollupConfLegacy:     "none",
-		MaxDataPoints:        8000,
-		InternalAggregation:  true,
+		Transport: clickhouse.Transport{
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 10,
+			IdleConnTimeout:     90 * time.Second,
+			HTTP2:               true,
+		},
+		Replicas: clickhouse.Replicas{
+			Policy:       clickhouse.ReplicaPolicyRoundRobin,
+			EjectTimeout: 10 * time.Second,
+			Retries:      1,
+		},
+		DataTableLegacy:     "data",
+		RollupConfLegacy:    "none",
+		MaxDataPoints:       8000,
+		InternalAggregation: true,
 	}
 	expected.ClickHouse.IndexReverses[0] = &IndexReverseRule{"suf", "pref", "", nil, "direct"}
 	r, _ = regexp.Compile("^reg$")
@@ -1023,7 +1129,20 @@ sample-thereafter = 12
 	assert.Equal(t, expected.Carbonlink, config.Carbonlink)
 
 	// Prometheus
-	expected.Prometheus = Prometheus{Listen: ":9092", ExternalURLRaw: "https://server:3456/uri", PageTitle: "Prometheus Time Series", LookbackDelta: 5 * time.Minute, RemoteReadConcurrencyLimit: 10}
+	expected.Prometheus = Prometheus{
+		Listen:                     ":9092",
+		ExternalURLRaw:             "https://server:3456/uri",
+		PageTitle:                  "Prometheus Time Series",
+		LookbackDelta:              5 * time.Minute,
+		RemoteReadConcurrencyLimit: 10,
+		RemoteWrite: RemoteWrite{
+			BatchSize:     100000,
+			FlushInterval: time.Second,
+			QueueSize:     1000000,
+			QueueTimeout:  10 * time.Second,
+			Timeout:       time.Minute,
+		},
+	}
 	u, _ := url.Parse(expected.Prometheus.ExternalURLRaw)
 	expected.Prometheus.ExternalURL = u
 	assert.Equal(t, expected.Prometheus, config.Prometheus)
@@ -1273,6 +1392,41 @@ func TestGetQueryParam(t *testing.T) {
 	}
 }
 
+func TestGetEstimateLimits(t *testing.T) {
+	config, _, err := Unmarshal([]byte(`
+[clickhouse]
+url = "http://localhost:8123/"
+max-estimated-rows = 1000000
+max-estimated-marks = 1000
+query-params = [
+  {
+    duration = "72h",
+    max-estimated-rows = 10000000
+  },
+]
+[clickhouse.user-limits.alice]
+max-estimated-marks = 10
+[clickhouse.user-limits.bob]
+max-queries = 10
+`), false)
+	require.NoError(t, err)
+	ch := &config.ClickHouse
+
+	assert.Equal(t, clickhouse.EstimateLimits{MaxRows: 1000000, MaxMarks: 1000}, ch.FindEstimateLimits(""))
+	assert.Equal(t, clickhouse.EstimateLimits{MaxRows: 1000000, MaxMarks: 10}, ch.FindEstimateLimits("alice"))
+	assert.Equal(t, clickhouse.EstimateLimits{MaxRows: 1000000, MaxMarks: 1000}, ch.FindEstimateLimits("bob"))
+
+	// the query params inherit unset limits
+	require.Len(t, ch.QueryParams, 2)
+	qp := ch.QueryParams[GetQueryParam(ch.QueryParams, 72*time.Hour)]
+	assert.Equal(t, int64(10000000), qp.MaxEstimatedRows)
+	assert.Equal(t, int64(1000), qp.MaxEstimatedMarks)
+	assert.Equal(t, clickhouse.EstimateLimits{MaxRows: 10000000, MaxMarks: 10}, GetEstimateLimits(ch.UserLimits, "alice", qp.MaxEstimatedRows, qp.MaxEstimatedMarks))
+	qp = ch.QueryParams[GetQueryParam(ch.QueryParams, time.Hour)]
+	assert.Equal(t, int64(1000000), qp.MaxEstimatedRows)
+	assert.Equal(t, int64(1000), qp.MaxEstimatedMarks)
+}
+
 func TestClickHouse_Validate(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -3,6 +3,9 @@ package config
 import (
 	"encoding/json"
 	"net/url"
+	"strings"
+
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
 )
 
 func (c *ClickHouse) MarshalJSON() ([]byte, error) {
@@ -11,13 +14,14 @@ func (c *ClickHouse) MarshalJSON() ([]byte, error) {
 	// make copy
 	a := *c
 
-	u, err := url.Parse(a.URL)
+	u, hosts, err := clickhouse.ParseURL(a.URL)
 	if err != nil {
 		a.URL = "<parse error>"
 	} else {
 		if _, isSet := u.User.Password(); isSet {
 			u.User = url.UserPassword(u.User.Username(), "xxxxxx")
 		}
+		u.Host = strings.Join(hosts, ",")
 		a.URL = u.String()
 	}
 
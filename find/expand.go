@@ -0,0 +1,264 @@
+package find
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-graphite/carbonapi/date"
+	"github.com/go-graphite/carbonapi/pkg/parser"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/pickle"
+	"github.com/lomik/graphite-clickhouse/logs"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// ExpandHandler serves graphite-web /metrics/expand requests. The globs are found like /metrics/find ones,
+// through the same finders, finder cache and find limiter
+type ExpandHandler struct {
+	find *Handler
+}
+
+func NewExpandHandler(find *Handler) *ExpandHandler {
+	return &ExpandHandler{
+		find: find,
+	}
+}
+
+func (h *ExpandHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := http.StatusOK
+	config := h.find.config
+	accessLogger := scope.LoggerWithHeaders(r.Context(), r, config.Common.HeadersToLog).Named("http")
+	logger := scope.LoggerWithHeaders(r.Context(), r, config.Common.HeadersToLog).Named("metrics-expand")
+	r = r.WithContext(scope.WithLogger(r.Context(), logger))
+
+	var (
+		metricsCount  int64
+		stat          finder.FinderStat
+		queueFail     bool
+		queueDuration time.Duration
+		findCache     bool
+	)
+
+	username := r.Header.Get("X-Forwarded-User")
+	limiter := config.GetUserTagsLimiter(username)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			status = http.StatusInternalServerError
+			logger.Error("panic during eval:",
+				zap.String("requestID", scope.String(r.Context(), "requestID")),
+				zap.Any("reason", rec),
+				zap.Stack("stack"),
+			)
+			answer := fmt.Sprintf("%v\nStack trace: %v", rec, zap.Stack("").String)
+			http.Error(w, answer, status)
+		}
+		d := time.Since(start)
+		dMS := d.Milliseconds()
+		logs.AccessLog(accessLogger, config, r, status, d, queueDuration, findCache, queueFail)
+		limiter.SendDuration(queueDuration.Milliseconds())
+		metrics.SendFindMetrics(metrics.FindRequestMetric, status, dMS, 0, config.Metrics.ExtendedStat, metricsCount)
+		if stat.ChReadRows > 0 && stat.ChReadBytes > 0 {
+			errored := status != http.StatusOK && status != http.StatusNotFound
+			metrics.SendQueryRead(metrics.FindQMetric, 0, 0, dMS, metricsCount, stat.ReadBytes, stat.ChReadRows, stat.ChReadBytes, errored)
+		}
+	}()
+
+	r.ParseMultipartForm(1024 * 1024)
+
+	format := r.FormValue("format")
+	switch format {
+	case "":
+		format = "json"
+	case "json", "pickle":
+	default:
+		status = http.StatusBadRequest
+		http.Error(w, "Failed to parse request: unsupported formatter", status)
+		return
+	}
+
+	queries := r.Form["query"]
+	if len(queries) == 0 || slices.Contains(queries, "") {
+		status = http.StatusBadRequest
+		http.Error(w, "Query not set", status)
+		return
+	}
+	// repeated globs are found once
+	queries = slices.Compact(slices.Sorted(slices.Values(queries)))
+	leavesOnly := parser.TruthyBool(r.FormValue("leavesOnly"))
+	groupByExpr := parser.TruthyBool(r.FormValue("groupByExpr"))
+	tz := r.FormValue("tz")
+	from := date.DateParamToEpoch(r.FormValue("from"), tz, 0, time.Local)
+	until := date.DateParamToEpoch(r.FormValue("until"), tz, 0, time.Local)
+
+	if clickhouse.ExplainRequested(r) {
+		status = h.find.explain(w, r, queries, from, until)
+		return
+	}
+
+	useCache := config.Common.FindCache != nil && config.Common.FindCacheConfig.FindTimeoutSec > 0 && !parser.TruthyBool(r.FormValue("noCache"))
+
+	globs := make([]glob, len(queries))
+	var wg sync.WaitGroup
+	for i, query := range queries {
+		globs[i].query = query
+		wg.Add(1)
+		go func(g *glob) {
+			defer wg.Done()
+			h.find.findGlob(r.Context(), limiter, g, from, until, useCache)
+		}(&globs[i])
+	}
+	wg.Wait()
+
+	var (
+		failed []*glob
+		cached int
+	)
+	for i := range globs {
+		g := &globs[i]
+		queueDuration += g.queueDuration
+		stat.ReadBytes += g.stat.ReadBytes
+		stat.ChReadRows += g.stat.ChReadRows
+		stat.ChReadBytes += g.stat.ChReadBytes
+		if g.err != nil {
+			queueFail = queueFail || g.queueFail
+			failed = append(failed, g)
+			continue
+		}
+		if g.cached {
+			cached++
+		}
+	}
+
+	if len(failed) == len(globs) {
+		if failed[0].queueFail {
+			status = http.StatusServiceUnavailable
+			http.Error(w, failed[0].err.Error(), status)
+		} else {
+			status, _ = clickhouse.HandleError(w, failed[0].err)
+		}
+		return
+	}
+	for _, g := range failed {
+		// header values can't contain line breaks
+		w.Header().Add(partialErrorsHeader, g.query+": "+strings.Join(strings.Fields(g.err.Error()), " "))
+	}
+	if cached == len(globs) {
+		findCache = true
+		w.Header().Set("X-Cached-Find", strconv.Itoa(int(config.Common.FindCacheConfig.FindTimeoutSec)))
+	}
+
+	maxMetrics := config.Common.MaxMetricsInFindAnswer
+	var results expandResults
+	if groupByExpr {
+		results.groups = make(map[string][]string, len(globs))
+		for i := range globs {
+			paths := expandPaths(maxMetrics, leavesOnly, globs[i:i+1]...)
+			metricsCount += int64(len(paths))
+			results.groups[globs[i].query] = paths
+		}
+	} else {
+		results.paths = expandPaths(maxMetrics, leavesOnly, globs...)
+		metricsCount = int64(len(results.paths))
+	}
+
+	switch format {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		body, err := results.MarshalJSON()
+		if err != nil {
+			status = http.StatusInternalServerError
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Write(body)
+	case "pickle":
+		results.writePickle(w)
+	}
+}
+
+// expandPaths returns the sorted unique paths found by the globs, the failed globs are skipped.
+// The count of paths is capped by maxMetrics, if it's set
+func expandPaths(maxMetrics int, leavesOnly bool, globs ...glob) []string {
+	paths := make([]string, 0)
+	for i := range globs {
+		if globs[i].err != nil {
+			continue
+		}
+		for _, row := range globs[i].find.result.List() {
+			if len(row) == 0 {
+				continue
+			}
+			path, isLeaf := finder.Leaf(row)
+			if leavesOnly && !isLeaf {
+				continue
+			}
+			paths = append(paths, string(path))
+		}
+	}
+	slices.Sort(paths)
+	paths = slices.Compact(paths)
+	if maxMetrics > 0 && len(paths) > maxMetrics {
+		paths = paths[:maxMetrics]
+	}
+	return paths
+}
+
+// expandResults is the response of the expand request: the list of paths of all globs
+// or the lists of every glob, when the results are grouped by the glob
+type expandResults struct {
+	paths  []string
+	groups map[string][]string
+}
+
+func (e *expandResults) MarshalJSON() ([]byte, error) {
+	if e.groups != nil {
+		return json.Marshal(map[string]map[string][]string{"results": e.groups})
+	}
+	return json.Marshal(map[string][]string{"results": e.paths})
+}
+
+func (e *expandResults) writePickle(w io.Writer) {
+	p := pickle.NewWriter(w)
+
+	writeList := func(paths []string) {
+		p.List()
+		for _, path := range paths {
+			p.String(path)
+			p.Append()
+		}
+	}
+
+	p.Dict()
+	p.String("results")
+	if e.groups != nil {
+		queries := make([]string, 0, len(e.groups))
+		for query := range e.groups {
+			queries = append(queries, query)
+		}
+		slices.Sort(queries)
+
+		p.Dict()
+		for _, query := range queries {
+			p.String(query)
+			writeList(e.groups[query])
+			p.SetItem()
+		}
+	} else {
+		writeList(e.paths)
+	}
+	p.SetItem()
+	p.Stop()
+}
@@ -0,0 +1,84 @@
+package find
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pickle "github.com/lomik/og-rek"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/metrics"
+)
+
+func TestExpand(t *testing.T) {
+	metrics.DisableMetrics()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		query := string(body)
+		switch {
+		case strings.Contains(query, "'a.%'"):
+			w.Write([]byte("a.b\na.c.\n"))
+		case strings.Contains(query, "'x.%'"):
+			w.Write([]byte("a.b\nx.y\n"))
+		case strings.Contains(query, "'b.%'"):
+			http.Error(w, "Code: 241, DB::Exception: Memory limit exceeded", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+	handler := NewExpandHandler(NewHandler(cfg))
+
+	request := func(params string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/metrics/expand/?"+params, nil))
+		return w
+	}
+
+	w := request("query=a.%2A&query=x.%2A&query=b.%2A")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, `{"results":["a.b","a.c","x.y"]}`, w.Body.String())
+	errors := w.Header().Values(partialErrorsHeader)
+	require.Len(t, errors, 1)
+	assert.True(t, strings.HasPrefix(errors[0], "b.*: "), errors[0])
+
+	w = request("query=a.%2A&query=x.%2A&query=a.%2A&groupByExpr=1&leavesOnly=1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, `{"results":{"a.*":["a.b"],"x.*":["a.b","x.y"]}}`, w.Body.String())
+
+	w = request("query=a.%2A&query=x.%2A&groupByExpr=1&format=pickle")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	p, err := pickle.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+	require.NoError(t, err)
+	assert.Equal(t, map[interface{}]interface{}{
+		"results": map[interface{}]interface{}{
+			"a.*": []interface{}{"a.b", "a.c"},
+			"x.*": []interface{}{"a.b", "x.y"},
+		},
+	}, p)
+
+	w = request("query=a.%2A&format=pickle")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	p, err = pickle.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+	require.NoError(t, err)
+	assert.Equal(t, map[interface{}]interface{}{"results": []interface{}{"a.b", "a.c"}}, p)
+
+	cfg.Common.MaxMetricsInFindAnswer = 1
+	w = request("query=a.%2A")
+	assert.Equal(t, `{"results":["a.b"]}`, w.Body.String())
+
+	w = request("query=b.%2A")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	for _, params := range []string{"", "query=", "query=a.%2A&format=protobuf"} {
+		w = request(params)
+		assert.Equal(t, http.StatusBadRequest, w.Code, params)
+	}
+}
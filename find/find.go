@@ -2,6 +2,7 @@ package find
 
 import (
 	"context"
+	"encoding/base64"
 	"io"
 
 	"github.com/gogo/protobuf/proto"
@@ -19,6 +20,37 @@ type Find struct {
 	context context.Context
 	query   string // original query
 	result  finder.Result
+	next    string // cursor of the next page, if there are more results
+}
+
+// pageResult is the result with only the rows of the page
+type pageResult struct {
+	finder.Result
+	rows [][]byte
+}
+
+func (r *pageResult) List() [][]byte {
+	return r.rows
+}
+
+// EncodeCursor returns the opaque cursor of the page, which starts after the path
+func EncodeCursor(path []byte) string {
+	return base64.RawURLEncoding.EncodeToString(path)
+}
+
+// DecodeCursor returns the path, which the page starts after
+func DecodeCursor(cursor string) (string, error) {
+	path, err := base64.RawURLEncoding.DecodeString(cursor)
+	return string(path), err
+}
+
+// paginate leaves only the rows of the page in the result and sets the cursor of the next page
+func (f *Find) paginate(p *finder.Page) {
+	rows, more := p.Apply(f.result.List())
+	f.result = &pageResult{Result: f.result, rows: rows}
+	if more {
+		f.next = EncodeCursor(rows[len(rows)-1])
+	}
 }
 
 func NewCached(config *config.Config, body []byte) *Find {
@@ -28,8 +60,9 @@ func NewCached(config *config.Config, body []byte) *Find {
 	}
 }
 
-func New(config *config.Config, ctx context.Context, query string, stat *finder.FinderStat) (*Find, error) {
-	res, err := finder.Find(config, ctx, query, 0, 0, stat)
+// New finds the metrics of the query. The daily index is used, when from and until are set
+func New(config *config.Config, ctx context.Context, query string, from, until int64, stat *finder.FinderStat) (*Find, error) {
+	res, err := finder.Find(config, ctx, query, from, until, stat)
 	if err != nil {
 		return nil, err
 	}
@@ -141,12 +174,46 @@ func (f *Find) WriteProtobuf(w io.Writer) error {
 }
 
 func (f *Find) WriteProtobufV3(w io.Writer) error {
-	rows := f.result.List()
-
-	if len(rows) == 0 { // empty
+	response := f.globResponseV3()
+	if len(response.Matches) == 0 { // empty
 		return nil
 	}
 
+	multiGlobResponse := v3pb.MultiGlobResponse{
+		Metrics: []v3pb.GlobResponse{
+			response,
+		},
+	}
+	body, err := proto.Marshal(&multiGlobResponse)
+	if err != nil {
+		return err
+	}
+
+	w.Write(body)
+
+	return nil
+}
+
+// WriteMultiGlobV3 writes one response for all queries of the multi-glob request.
+// Every query has its entry, the failed ones are without matches
+func WriteMultiGlobV3(w io.Writer, finds []*Find) error {
+	multiGlobResponse := v3pb.MultiGlobResponse{
+		Metrics: make([]v3pb.GlobResponse, 0, len(finds)),
+	}
+	for _, f := range finds {
+		multiGlobResponse.Metrics = append(multiGlobResponse.Metrics, f.globResponseV3())
+	}
+	body, err := proto.Marshal(&multiGlobResponse)
+	if err != nil {
+		return err
+	}
+
+	w.Write(body)
+
+	return nil
+}
+
+func (f *Find) globResponseV3() v3pb.GlobResponse {
 	// message GlobMatch {
 	//     required string path = 1;
 	//     required bool isLeaf = 2;
@@ -157,8 +224,12 @@ func (f *Find) WriteProtobufV3(w io.Writer) error {
 	//     repeated GlobMatch matches = 2;
 	// }
 
-	var response v3pb.GlobResponse
-	response.Name = f.query
+	response := v3pb.GlobResponse{Name: f.query}
+	if f.result == nil { // failed query
+		return response
+	}
+
+	rows := f.result.List()
 
 	var numResults = 0
 
@@ -180,19 +251,7 @@ func (f *Find) WriteProtobufV3(w io.Writer) error {
 		}
 	}
 
-	multiGlobResponse := v3pb.MultiGlobResponse{
-		Metrics: []v3pb.GlobResponse{
-			response,
-		},
-	}
-	body, err := proto.Marshal(&multiGlobResponse)
-	if err != nil {
-		return err
-	}
-
-	w.Write(body)
-
-	return nil
+	return response
 }
 
 func (f *Find) WriteJSON(w io.Writer) error {
@@ -2,24 +2,38 @@ package find
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/go-graphite/carbonapi/date"
 	"github.com/go-graphite/carbonapi/pkg/parser"
 	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
 	"github.com/lomik/graphite-clickhouse/config"
 	"github.com/lomik/graphite-clickhouse/finder"
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	chdate "github.com/lomik/graphite-clickhouse/helper/date"
 	"github.com/lomik/graphite-clickhouse/helper/utils"
+	"github.com/lomik/graphite-clickhouse/limiter"
 	"github.com/lomik/graphite-clickhouse/logs"
 	"github.com/lomik/graphite-clickhouse/metrics"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
 	"go.uber.org/zap"
 )
 
+const (
+	// partialErrorsHeader reports the failed queries of the multi-glob request
+	partialErrorsHeader = "X-Partial-Errors"
+	// NextCursorHeader contains the cursor of the next page, when there are more results
+	NextCursorHeader = "X-Gch-Next-Cursor"
+)
+
 type Handler struct {
 	config  *config.Config
 	qMetric *metrics.QueryMetrics
@@ -45,7 +59,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		queueFail     bool
 		queueDuration time.Duration
 		findCache     bool
-		query         string
+		queries       []string
+		from, until   int64
 	)
 
 	username := r.Header.Get("X-Forwarded-User")
@@ -91,15 +106,10 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if len(pv3Request.Metrics) != 1 {
-			status = http.StatusBadRequest
-			http.Error(w, fmt.Sprintf("Multiple metrics in same find request is not supported yet: %v", err), status)
-			return
-		}
-
-		query = pv3Request.Metrics[0]
+		queries = pv3Request.Metrics
+		from, until = pv3Request.StartTime, pv3Request.StopTime
 		q := r.URL.Query()
-		q.Set("query", query)
+		q["query"] = queries
 		r.URL.RawQuery = q.Encode()
 	} else {
 		switch r.FormValue("format") {
@@ -112,93 +122,260 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Failed to parse request: unsupported formatter", status)
 			return
 		}
-		query = r.FormValue("query")
+		if query := r.FormValue("query"); query != "" {
+			queries = []string{query}
+		}
+		tz := r.FormValue("tz")
+		from = date.DateParamToEpoch(r.FormValue("from"), tz, 0, time.Local)
+		until = date.DateParamToEpoch(r.FormValue("until"), tz, 0, time.Local)
 	}
-	if len(query) == 0 {
+	if len(queries) == 0 || slices.Contains(queries, "") {
 		status = http.StatusBadRequest
 		http.Error(w, "Query not set", status)
 		return
 	}
 
-	var key string
-	// params := []string{query}
+	page, err := h.parsePage(r)
+	if err == nil && page != nil && len(queries) > 1 {
+		err = errors.New("pagination of multi-glob requests is not supported")
+	}
+	if err != nil {
+		status = http.StatusBadRequest
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if page != nil {
+		r = r.WithContext(finder.WithPage(r.Context(), page))
+	}
+
+	if clickhouse.ExplainRequested(r) {
+		status = h.explain(w, r, queries, from, until)
+		return
+	}
+
 	useCache := h.config.Common.FindCache != nil && h.config.Common.FindCacheConfig.FindTimeoutSec > 0 && !parser.TruthyBool(r.FormValue("noCache"))
+
+	// globs of the multi-glob request are found concurrently
+	globs := make([]glob, len(queries))
+	var wg sync.WaitGroup
+	for i, query := range queries {
+		globs[i].query = query
+		wg.Add(1)
+		go func(g *glob) {
+			defer wg.Done()
+			h.findGlob(r.Context(), limiter, g, from, until, useCache)
+		}(&globs[i])
+	}
+	wg.Wait()
+
+	var (
+		finds  = make([]*Find, 0, len(globs))
+		failed []*glob
+		cached int
+	)
+	for i := range globs {
+		g := &globs[i]
+		if g.err == nil && page != nil {
+			g.find.paginate(page)
+			if g.find.next != "" {
+				w.Header().Set(NextCursorHeader, g.find.next)
+			}
+		}
+		queueDuration += g.queueDuration
+		stat.ReadBytes += g.stat.ReadBytes
+		stat.ChReadRows += g.stat.ChReadRows
+		stat.ChReadBytes += g.stat.ChReadBytes
+		if g.err != nil {
+			queueFail = queueFail || g.queueFail
+			failed = append(failed, g)
+			finds = append(finds, &Find{config: h.config, query: g.query})
+			continue
+		}
+		if g.cached {
+			cached++
+		}
+		metricsCount += int64(len(g.find.result.List()))
+		finds = append(finds, g.find)
+	}
+
+	if len(failed) == len(globs) {
+		if failed[0].queueFail {
+			status = http.StatusServiceUnavailable
+			http.Error(w, failed[0].err.Error(), status)
+		} else {
+			status, _ = clickhouse.HandleError(w, failed[0].err)
+		}
+		return
+	}
+	for _, g := range failed {
+		// header values can't contain line breaks
+		w.Header().Add(partialErrorsHeader, g.query+": "+strings.Join(strings.Fields(g.err.Error()), " "))
+	}
+	if cached == len(globs) {
+		findCache = true
+		w.Header().Set("X-Cached-Find", strconv.Itoa(int(h.config.Common.FindCacheConfig.FindTimeoutSec)))
+	}
+
+	if len(finds) == 1 {
+		status = h.Reply(w, r, finds[0])
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	if err := WriteMultiGlobV3(w, finds); err != nil {
+		status = http.StatusInternalServerError
+		http.Error(w, err.Error(), status)
+	}
+}
+
+// glob is the query of the find request with its result
+type glob struct {
+	query         string
+	find          *Find
+	cached        bool
+	err           error
+	stat          finder.FinderStat
+	queueDuration time.Duration
+	queueFail     bool
+}
+
+// parsePage returns the page of the results, requested by limit, cursor, leavesOnly and branchesOnly parameters.
+// It returns nil, when the results aren't paginated. The limit is capped by Common.MaxMetricsInFindAnswer
+func (h *Handler) parsePage(r *http.Request) (*finder.Page, error) {
+	limit, cursor := r.FormValue("limit"), r.FormValue("cursor")
+	leavesOnly, branchesOnly := parser.TruthyBool(r.FormValue("leavesOnly")), parser.TruthyBool(r.FormValue("branchesOnly"))
+	if limit == "" && cursor == "" && !leavesOnly && !branchesOnly {
+		return nil, nil
+	}
+	if leavesOnly && branchesOnly {
+		return nil, errors.New("leavesOnly and branchesOnly are mutually exclusive")
+	}
+	p := &finder.Page{LeavesOnly: leavesOnly, BranchesOnly: branchesOnly}
+	if limit != "" {
+		var err error
+		if p.Limit, err = strconv.Atoi(limit); err != nil || p.Limit <= 0 {
+			return nil, fmt.Errorf("invalid limit: %q", limit)
+		}
+	}
+	if maxMetrics := h.config.Common.MaxMetricsInFindAnswer; maxMetrics > 0 && (p.Limit == 0 || p.Limit > maxMetrics) {
+		p.Limit = maxMetrics
+	}
+	if cursor != "" {
+		var err error
+		if p.After, err = DecodeCursor(cursor); err != nil {
+			return nil, fmt.Errorf("invalid cursor: %q", cursor)
+		}
+	}
+	return p, nil
+}
+
+// findCacheKey returns the key of the finder cache, the days of from and until are used for the daily index
+func findCacheKey(query string, from, until, ts int64, page *finder.Page) string {
+	days := "1970-02-12"
+	if from > 0 && until > 0 {
+		days = chdate.FromTimestampToDaysFormat(from) + ";" + chdate.UntilTimestampToDaysFormat(until)
+	}
+	return days + page.Key() + ";query=" + query + ";ts=" + strconv.FormatInt(ts, 10)
+}
+
+// findGlob finds the metrics of the glob through the finder cache and the find limiter
+func (h *Handler) findGlob(ctx context.Context, qlimiter limiter.ServerLimiter, g *glob, from, until int64, useCache bool) {
+	logger := scope.Logger(ctx)
+
+	var key string
 	if useCache {
 		ts := utils.TimestampTruncate(time.Now().Unix(), time.Duration(h.config.Common.FindCacheConfig.FindTimeoutSec)*time.Second)
-		key = "1970-02-12;query=" + query + ";ts=" + strconv.FormatInt(ts, 10)
+		key = findCacheKey(g.query, from, until, ts, finder.PageFromContext(ctx))
 		body, err := h.config.Common.FindCache.Get(key)
 		if err == nil {
 			if metrics.FinderCacheMetrics != nil {
 				metrics.FinderCacheMetrics.CacheHits.Add(1)
 			}
-			findCache = true
-			w.Header().Set("X-Cached-Find", strconv.Itoa(int(h.config.Common.FindCacheConfig.FindTimeoutSec)))
-			f := NewCached(h.config, body)
-			metricsCount = int64(len(f.result.List()))
+			g.cached = true
+			g.find = NewCached(h.config, body)
+			g.find.query = g.query
 			logger.Info("finder", zap.String("get_cache", key),
-				zap.Int64("metrics", metricsCount), zap.Bool("find_cached", true),
+				zap.Int("metrics", len(g.find.result.List())), zap.Bool("find_cached", true),
 				zap.Int32("ttl", h.config.Common.FindCacheConfig.FindTimeoutSec))
-
-			h.Reply(w, r, f)
 			return
 		}
 	}
 
 	var (
-		entered bool
-		ctx     context.Context
-		cancel  context.CancelFunc
+		entered  bool
+		limitCtx context.Context
+		cancel   context.CancelFunc
 	)
-	if limiter.Enabled() {
-		ctx, cancel = context.WithTimeout(context.Background(), h.config.ClickHouse.IndexTimeout)
+	if qlimiter.Enabled() {
+		limitCtx, cancel = context.WithTimeout(context.Background(), h.config.ClickHouse.IndexTimeout)
 		defer cancel()
 
-		err := limiter.Enter(ctx, "find")
-		queueDuration = time.Since(start)
+		start := time.Now()
+		err := qlimiter.Enter(limitCtx, "find")
+		g.queueDuration = time.Since(start)
 		if err != nil {
-			status = http.StatusServiceUnavailable
-			queueFail = true
 			logger.Error(err.Error())
-			http.Error(w, err.Error(), status)
+			g.err = err
+			g.queueFail = true
 			return
 		}
-		queueDuration = time.Since(start)
 		entered = true
 		defer func() {
 			if entered {
-				limiter.Leave(ctx, "find")
+				qlimiter.Leave(limitCtx, "find")
 				entered = false
 			}
 		}()
 	}
 
-	f, err := New(h.config, r.Context(), query, &stat)
+	g.find, g.err = New(h.config, ctx, g.query, from, until, &g.stat)
 
 	if entered {
 		// release early as possible
-		limiter.Leave(ctx, "find")
+		qlimiter.Leave(limitCtx, "find")
 		entered = false
 	}
 
-	if err != nil {
-		status, _ = clickhouse.HandleError(w, err)
+	if g.err != nil {
+		logger.Error("find", zap.String("query", g.query), zap.Error(g.err))
 		return
 	}
 
 	if useCache {
-		if body, err := f.result.Bytes(); err == nil {
+		if body, err := g.find.result.Bytes(); err == nil {
 			if metrics.FinderCacheMetrics != nil {
 				metrics.FinderCacheMetrics.CacheMisses.Add(1)
 			}
 			h.config.Common.FindCache.Set(key, body, h.config.Common.FindCacheConfig.FindTimeoutSec)
 			logger.Info("finder", zap.String("set_cache", key),
-				zap.Int("metrics", len(f.result.List())), zap.Bool("find_cached", false),
+				zap.Int("metrics", len(g.find.result.List())), zap.Bool("find_cached", false),
 				zap.Int32("ttl", h.config.Common.FindCacheConfig.FindTimeoutSec))
 		}
 	}
+}
+
+// explainPlan is the response of the explain request
+type explainPlan struct {
+	Finder  *finder.Plan             `json:"finder"`
+	Queries []clickhouse.LoggedQuery `json:"queries"`
+}
 
-	metricsCount = int64(len(f.result.List()))
-	status = h.Reply(w, r, f)
+// explain writes the plans of the finder for the queries, the queries aren't sent to ClickHouse.
+// The plans of the multi-glob request are written as a list
+func (h *Handler) explain(w http.ResponseWriter, r *http.Request, queries []string, from, until int64) (status int) {
+	plans := make([]explainPlan, 0, len(queries))
+	for _, query := range queries {
+		var queryLog clickhouse.QueryLog
+		plan, err := finder.Explain(clickhouse.WithQueryLog(r.Context(), &queryLog), h.config, query, from, until)
+		if err != nil {
+			status, _ = clickhouse.HandleError(w, err)
+			return
+		}
+		plans = append(plans, explainPlan{Finder: plan, Queries: queryLog.Queries()})
+	}
+	if len(plans) == 1 {
+		return clickhouse.WriteExplain(w, plans[0])
+	}
+	return clickhouse.WriteExplain(w, plans)
 }
 
 func (h *Handler) Reply(w http.ResponseWriter, r *http.Request, f *Find) (status int) {
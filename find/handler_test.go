@@ -1,12 +1,26 @@
 package find
 
 import (
+	"bytes"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	v2pb "github.com/go-graphite/protocol/carbonapi_v2_pb"
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/metrics"
 )
 
 type clickhouseMock struct {
@@ -62,3 +76,215 @@ func TestFind(t *testing.T) {
 		"SELECT Path FROM graphite_index WHERE ((Level=20002) AND (Path LIKE 'host.%' AND match(Path, '^host[.][^.]cpu[.]?$'))) AND (Date='1970-02-12') GROUP BY Path FORMAT TabSeparatedRaw",
 	)
 }
+
+func TestFindExplain(t *testing.T) {
+	requestLog := make(chan []byte, 1)
+	srv := httptest.NewServer(&clickhouseMock{requestLog: requestLog})
+	defer srv.Close()
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+
+	handler := NewHandler(cfg)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://localhost/metrics/find/?format=json&explain=1&query=%2A.cpu.host", nil)
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, requestLog, "the query must not be executed")
+
+	var plan explainPlan
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &plan))
+	assert.Equal(t, &finder.Plan{Query: "*.cpu.host", Finders: []string{"index"}, Table: "graphite_index", Index: "reversed"}, plan.Finder)
+	require.Len(t, plan.Queries, 1)
+	assert.Equal(t, clickhouse.LoggedQuery{
+		Table: "graphite_index",
+		Query: "SELECT Path FROM graphite_index WHERE ((Level=30003) AND (Path LIKE 'host.cpu.%')) AND (Date='1970-02-12') GROUP BY Path FORMAT TabSeparatedRaw",
+	}, plan.Queries[0])
+}
+
+func TestFindMultiGlob(t *testing.T) {
+	metrics.DisableMetrics()
+	var (
+		lock    sync.Mutex
+		queries []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		query := string(body)
+		lock.Lock()
+		queries = append(queries, query)
+		lock.Unlock()
+		switch {
+		case strings.Contains(query, "'a.%'"):
+			w.Write([]byte("a.b\na.c.\n"))
+		case strings.Contains(query, "'b.%'"):
+			http.Error(w, "Code: 241, DB::Exception: Memory limit exceeded", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+	handler := NewHandler(cfg)
+
+	now := time.Now().Unix()
+	request := func(globs ...string) *httptest.ResponseRecorder {
+		req := v3pb.MultiGlobRequest{Metrics: globs, StartTime: now - 3600, StopTime: now}
+		body, err := req.Marshal()
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "http://localhost/metrics/find/?format=carbonapi_v3_pb", bytes.NewReader(body)))
+		return w
+	}
+
+	w := request("a.*", "b.*", "c.*")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp v3pb.MultiGlobResponse
+	require.NoError(t, resp.Unmarshal(w.Body.Bytes()))
+	assert.Equal(t, []v3pb.GlobResponse{
+		{Name: "a.*", Matches: []v3pb.GlobMatch{{Path: "a.b", IsLeaf: true}, {Path: "a.c", IsLeaf: false}}},
+		{Name: "b.*"},
+		{Name: "c.*"},
+	}, resp.Metrics)
+	errors := w.Header().Values(partialErrorsHeader)
+	require.Len(t, errors, 1)
+	assert.True(t, strings.HasPrefix(errors[0], "b.*: "), errors[0])
+
+	// the daily index is used for the time range of the request
+	require.Len(t, queries, 3)
+	for _, q := range queries {
+		assert.Contains(t, q, "Date >=")
+		assert.NotContains(t, q, "1970-02-12")
+	}
+
+	// the request fails, when all globs are failed
+	w = request("b.*")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestFindPaginated(t *testing.T) {
+	metrics.DisableMetrics()
+	requestLog := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requestLog <- string(body)
+		w.Write([]byte("a.b\na.c.\na.d\n"))
+	}))
+	defer srv.Close()
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+	handler := NewHandler(cfg)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/metrics/find/?format=json&query=a.%2A&limit=2", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, <-requestLog, "GROUP BY Path ORDER BY Path LIMIT 3 ")
+	assert.Equal(t, "[{path=\"a.b\",leaf=1},{path=\"a.c\"}]\r\n", w.Body.String())
+	cursor := w.Header().Get(NextCursorHeader)
+	require.NotEmpty(t, cursor)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/metrics/find/?format=json&query=a.%2A&limit=2&leavesOnly=1&cursor="+cursor, nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, <-requestLog, "(Path>'a.c.')) AND (NOT Path LIKE '%.')")
+	assert.Empty(t, w.Header().Get(NextCursorHeader), "the last page")
+
+	for _, params := range []string{"limit=0", "limit=x", "cursor=%21%21", "leavesOnly=1&branchesOnly=1"} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/metrics/find/?format=json&query=a.%2A&"+params, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, params)
+	}
+}
+
+func TestFindPaginatedFormats(t *testing.T) {
+	metrics.DisableMetrics()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("a.b\na.c.\na.d\n"))
+	}))
+	defer srv.Close()
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+	handler := NewHandler(cfg)
+
+	// the bodies have the fixed schemas of graphite-web and carbonapi, the header is the only signal of the next page
+	tests := []struct {
+		format  string
+		request func() *http.Request
+		paths   func(t *testing.T, body []byte) []string
+	}{
+		{
+			format: "json",
+			request: func() *http.Request {
+				return httptest.NewRequest("GET", "http://localhost/metrics/find/?format=json&query=a.%2A&limit=2", nil)
+			},
+			paths: func(t *testing.T, body []byte) []string {
+				require.Equal(t, "[{path=\"a.b\",leaf=1},{path=\"a.c\"}]\r\n", string(body))
+				return []string{"a.b", "a.c"}
+			},
+		},
+		{
+			format: "pickle",
+			request: func() *http.Request {
+				return httptest.NewRequest("GET", "http://localhost/metrics/find/?format=pickle&query=a.%2A&limit=2", nil)
+			},
+			paths: func(t *testing.T, body []byte) []string {
+				var paths []string
+				for _, path := range []string{"a.b", "a.c", "a.d"} {
+					if bytes.Contains(body, []byte(path)) {
+						paths = append(paths, path)
+					}
+				}
+				return paths
+			},
+		},
+		{
+			format: "protobuf",
+			request: func() *http.Request {
+				return httptest.NewRequest("GET", "http://localhost/metrics/find/?format=protobuf&query=a.%2A&limit=2", nil)
+			},
+			paths: func(t *testing.T, body []byte) []string {
+				var resp v2pb.GlobResponse
+				require.NoError(t, resp.Unmarshal(body))
+				var paths []string
+				for _, m := range resp.Matches {
+					paths = append(paths, m.Path)
+				}
+				return paths
+			},
+		},
+		{
+			format: "carbonapi_v3_pb",
+			request: func() *http.Request {
+				req := v3pb.MultiGlobRequest{Metrics: []string{"a.*"}}
+				body, err := req.Marshal()
+				require.NoError(t, err)
+				return httptest.NewRequest("POST", "http://localhost/metrics/find/?format=carbonapi_v3_pb&limit=2", bytes.NewReader(body))
+			},
+			paths: func(t *testing.T, body []byte) []string {
+				var resp v3pb.MultiGlobResponse
+				require.NoError(t, resp.Unmarshal(body))
+				require.Len(t, resp.Metrics, 1)
+				var paths []string
+				for _, m := range resp.Metrics[0].Matches {
+					paths = append(paths, m.Path)
+				}
+				return paths
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, tt.request())
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			assert.Equal(t, []string{"a.b", "a.c"}, tt.paths(t, w.Body.Bytes()))
+			cursor := w.Header().Get(NextCursorHeader)
+			require.NotEmpty(t, cursor)
+			path, err := DecodeCursor(cursor)
+			require.NoError(t, err)
+			assert.Equal(t, "a.c.", path)
+		})
+	}
+}
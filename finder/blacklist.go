@@ -20,6 +20,8 @@ func WrapBlacklist(f Finder, blacklist []*regexp.Regexp) *BlacklistFinder {
 	}
 }
 
+// Execute rejects the whole query, when it's matched by the blacklist. The results of the wrapped finder
+// aren't filtered, so the page of the wrapped finder is returned as is
 func (p *BlacklistFinder) Execute(ctx context.Context, config *config.Config, query string, from int64, until int64, stat *FinderStat) (err error) {
 	for i := 0; i < len(p.blacklist); i++ {
 		if p.blacklist[i].MatchString(query) {
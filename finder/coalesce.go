@@ -0,0 +1,59 @@
+package finder
+
+import (
+	"context"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/date"
+	"github.com/lomik/graphite-clickhouse/pkg/coalesce"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+type findResult struct {
+	result Result
+	stat   FinderStat
+}
+
+var findGroup coalesce.Group[findResult]
+
+// findKey identifies the finder queries, they depend only on the days of from and until
+func findKey(ctx context.Context, query string, from int64, until int64) string {
+	var sb strings.Builder
+	if from > 0 && until > 0 {
+		sb.WriteString(date.FromTimestampToDaysFormat(from))
+		sb.WriteString(";")
+		sb.WriteString(date.UntilTimestampToDaysFormat(until))
+	} else {
+		sb.WriteString("-;-")
+	}
+	sb.WriteString(";user=")
+	sb.WriteString(scope.User(ctx))
+	sb.WriteString(PageFromContext(ctx).Key())
+	sb.WriteString(";")
+	sb.WriteString(query)
+	return sb.String()
+}
+
+// findShared is Find, which is shared by the concurrent callers with the same query, see Common.CoalesceRequests.
+// The read stats are returned only to the caller, which has made the query
+func findShared(config *config.Config, ctx context.Context, query string, from int64, until int64, stat *FinderStat) (Result, error) {
+	r, shared, err := findGroup.Do(ctx, findKey(ctx, query, from, until), func(ctx context.Context) (findResult, error) {
+		var r findResult
+		var err error
+		r.result, err = find(config, ctx, query, from, until, &r.stat)
+		return r, err
+	})
+	if shared {
+		stat.Table = r.stat.Table
+		scope.Logger(ctx).Debug("find", zap.String("query", query), zap.Bool("coalesced", true))
+	} else {
+		*stat = r.stat
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.result, nil
+}
@@ -0,0 +1,85 @@
+package finder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+)
+
+func TestFindKey(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().Unix()
+	// the queries depend only on days
+	assert.Equal(t, findKey(ctx, "a.*", now-3600, now), findKey(ctx, "a.*", now-3601, now-1))
+	assert.NotEqual(t, findKey(ctx, "a.*", now-3600, now), findKey(ctx, "a.*", now-7*86400, now))
+	assert.NotEqual(t, findKey(ctx, "a.*", now-3600, now), findKey(ctx, "a.*", 0, 0))
+	assert.NotEqual(t, findKey(ctx, "a.*", 0, 0), findKey(ctx, "b.*", 0, 0))
+}
+
+func TestFindCoalesced(t *testing.T) {
+	var requests int32
+	received := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			close(received)
+		}
+		<-release
+		w.Write([]byte("a.b\na.c\n"))
+	}))
+	defer srv.Close()
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.Common.CoalesceRequests = true
+
+	var (
+		wg    sync.WaitGroup
+		stats [2]FinderStat
+		lists [2][][]byte
+	)
+	find := func(n int) {
+		defer wg.Done()
+		res, err := Find(cfg, context.Background(), "a.*", 0, 0, &stats[n])
+		require.NoError(t, err)
+		lists[n] = res.List()
+	}
+	wg.Add(2)
+	go find(0)
+	<-received
+	go find(1)
+	// the second caller joins the query in flight
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.Equal(t, [][]byte{[]byte("a.b"), []byte("a.c")}, lists[0])
+	assert.Equal(t, lists[0], lists[1])
+	assert.Equal(t, stats[0].Table, stats[1].Table)
+	assert.Equal(t, stats[0].ReadBytes+stats[1].ReadBytes, int64(len("a.b\na.c\n")), "read stats are returned only once")
+
+	// the cancellation of the waiter doesn't affect the shared query
+	received = make(chan struct{})
+	release = make(chan struct{})
+	atomic.StoreInt32(&requests, 0)
+	wg.Add(1)
+	go find(0)
+	<-received
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var stat FinderStat
+	_, err := Find(cfg, ctx, "a.*", 0, 0, &stat)
+	assert.ErrorIs(t, err, context.Canceled)
+	close(release)
+	wg.Wait()
+	assert.Len(t, lists[0], 2)
+}
@@ -0,0 +1,96 @@
+package finder
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// Plan describes the finders chosen for the query and their decisions, it's returned by explain requests
+type Plan struct {
+	Query string `json:"query"`
+	// Finders are the names of the chosen finders, from the outer wrapper to the one querying the table
+	Finders []string `json:"finders"`
+	Table   string   `json:"table,omitempty"`
+	// Index is the direction of the index query, direct or reversed
+	Index string `json:"index,omitempty"`
+	Daily bool   `json:"daily,omitempty"`
+	// Split contains the parts of the query split by the split index finder
+	Split []string `json:"split,omitempty"`
+}
+
+// Explain runs the finder for the query without sending queries to ClickHouse and returns its plan
+func Explain(ctx context.Context, config *config.Config, query string, from int64, until int64) (*Plan, error) {
+	ctx = scope.WithDryRun(ctx)
+	f := newPlainFinder(ctx, config, query, from, until, false)
+	var stat FinderStat
+	if err := f.Execute(ctx, config, query, from, until, &stat); err != nil {
+		return nil, err
+	}
+	p := &Plan{Query: query, Table: stat.Table}
+	p.describe(f, from, until)
+	return p, nil
+}
+
+func indexDirection(reverse bool) string {
+	if reverse {
+		return "reversed"
+	}
+	return "direct"
+}
+
+// describe walks through the wrapped finders and adds their decisions to the plan
+func (p *Plan) describe(f Finder, from, until int64) {
+	for f != nil {
+		switch t := f.(type) {
+		case *BlacklistFinder:
+			p.Finders = append(p.Finders, "blacklist")
+			f = t.wrapped
+		case *PrefixFinder:
+			p.Finders = append(p.Finders, "prefix")
+			f = t.wrapped
+		case *TagFinder:
+			p.Finders = append(p.Finders, "tag")
+			f = t.wrapped
+		case *ReverseFinder:
+			if t.isUsed {
+				p.Finders = append(p.Finders, "reverse")
+				p.Index = indexDirection(true)
+				return
+			}
+			f = t.wrapped
+		case *SplitIndexFinder:
+			if t.useWrapped {
+				f = t.wrapped
+				continue
+			}
+			p.Finders = append(p.Finders, "split")
+			p.Index = indexDirection(t.useReverse)
+			p.Daily = useDaily(t.dailyEnabled, from, until)
+			p.Split = t.splitQueries
+			return
+		case *IndexFinder:
+			p.Finders = append(p.Finders, "index")
+			// the direction is chosen only when the index is queried
+			if t.reverse != queryAuto {
+				p.Index = indexDirection(t.reverse == queryReversed)
+			}
+			p.Daily = t.useDaily
+			return
+		case *DateFinder, *DateFinderV3:
+			p.Finders = append(p.Finders, "date")
+			return
+		case *BaseFinder:
+			p.Finders = append(p.Finders, "tree")
+			return
+		case *TaggedFinder:
+			p.Finders = append(p.Finders, "tagged")
+			return
+		default:
+			p.Finders = append(p.Finders, fmt.Sprintf("%T", f))
+			return
+		}
+	}
+}
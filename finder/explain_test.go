@@ -0,0 +1,60 @@
+package finder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+)
+
+func TestExplain(t *testing.T) {
+	cfg := config.New()
+	// the dry-run finder doesn't connect to ClickHouse
+	cfg.ClickHouse.URL = "http://localhost:1/"
+
+	tests := []struct {
+		query       string
+		trySplit    bool
+		taggedTable string
+		want        Plan
+	}{
+		{
+			query: "host.top.cpu.*",
+			want:  Plan{Query: "host.top.cpu.*", Finders: []string{"index"}, Table: "graphite_index", Index: "direct"},
+		},
+		{
+			query: "*.cpu.host",
+			want:  Plan{Query: "*.cpu.host", Finders: []string{"index"}, Table: "graphite_index", Index: "reversed"},
+		},
+		{
+			query:    "{a,b}.cpu.host",
+			trySplit: true,
+			want: Plan{
+				Query: "{a,b}.cpu.host", Finders: []string{"split"}, Table: "graphite_index", Index: "direct",
+				Split: []string{"a.cpu.host", "b.cpu.host"},
+			},
+		},
+		{
+			query:    "host.cpu.*",
+			trySplit: true,
+			want:     Plan{Query: "host.cpu.*", Finders: []string{"index"}, Table: "graphite_index", Index: "direct"},
+		},
+		{
+			query:       "seriesByTag('name=cpu')",
+			taggedTable: "graphite_tagged",
+			want:        Plan{Query: "seriesByTag('name=cpu')", Finders: []string{"tagged"}, Table: "graphite_tagged"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			cfg.ClickHouse.TrySplitQuery = tt.trySplit
+			cfg.ClickHouse.TaggedTable = tt.taggedTable
+			p, err := Explain(context.Background(), cfg, tt.query, 0, 0)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, *p)
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
 
 	"github.com/lomik/graphite-clickhouse/config"
 )
@@ -33,6 +34,7 @@ func newPlainFinder(ctx context.Context, config *config.Config, query string, fr
 		TLSConfig:      config.ClickHouse.TLSConfig,
 		Timeout:        config.ClickHouse.IndexTimeout,
 		ConnectTimeout: config.ClickHouse.ConnectTimeout,
+		Estimate:       config.ClickHouse.FindEstimateLimits(scope.User(ctx)),
 	}
 
 	var f Finder
@@ -109,6 +111,13 @@ func newPlainFinder(ctx context.Context, config *config.Config, query string, fr
 }
 
 func Find(config *config.Config, ctx context.Context, query string, from int64, until int64, stat *FinderStat) (Result, error) {
+	if config.Common.CoalesceRequests && !clickhouse.Explaining(ctx) {
+		return findShared(config, ctx, query, from, until, stat)
+	}
+	return find(config, ctx, query, from, until, stat)
+}
+
+func find(config *config.Config, ctx context.Context, query string, from int64, until int64, stat *FinderStat) (Result, error) {
 	fnd := newPlainFinder(ctx, config, query, from, until, config.Common.FindCache != nil)
 	err := fnd.Execute(ctx, config, query, from, until, stat)
 	if err != nil {
@@ -131,6 +140,7 @@ func FindTagged(ctx context.Context, config *config.Config, terms []TaggedTerm,
 		Timeout:        config.ClickHouse.IndexTimeout,
 		ConnectTimeout: config.ClickHouse.ConnectTimeout,
 		TLSConfig:      config.ClickHouse.TLSConfig,
+		Estimate:       config.ClickHouse.FindEstimateLimits(scope.User(ctx)),
 	}
 
 	useCache := config.Common.FindCache != nil
@@ -191,11 +191,18 @@ func (idx *IndexFinder) Execute(ctx context.Context, config *config.Config, quer
 	}
 	w := idx.whereFilter(query, from, until)
 
+	var order string
+	// reversed paths are ordered in other way, so the page is selected from all results later
+	if p := PageFromContext(ctx); p != nil && !idx.useReverse(query) {
+		p.where(w)
+		order = " ORDER BY Path" + p.limit()
+	}
+
 	idx.body, stat.ChReadRows, stat.ChReadBytes, err = clickhouse.Query(
 		scope.WithTable(ctx, idx.table),
 		idx.url,
 		// TODO: consider consistent query generator
-		fmt.Sprintf("SELECT Path FROM %s WHERE %s GROUP BY Path FORMAT TabSeparatedRaw", idx.table, w),
+		fmt.Sprintf("SELECT Path FROM %s WHERE %s GROUP BY Path%s FORMAT TabSeparatedRaw", idx.table, w, order),
 		idx.opts,
 		nil,
 	)
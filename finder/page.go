@@ -0,0 +1,94 @@
+package finder
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strconv"
+
+	"github.com/lomik/graphite-clickhouse/pkg/where"
+)
+
+// Page selects the part of the find results ordered by path. Branches are the paths with the trailing dot
+type Page struct {
+	// Limit is the max count of the results, 0 is unlimited
+	Limit int
+	// After is the last path of the previous page, the results start after it
+	After        string
+	LeavesOnly   bool
+	BranchesOnly bool
+}
+
+type pageKey struct{}
+
+// WithPage returns the context, where the finders return only the page of results. The page is pushed down
+// to the queries by IndexFinder, other finders return all results and they must be paged by Page.Apply
+func WithPage(ctx context.Context, p *Page) context.Context {
+	return context.WithValue(ctx, pageKey{}, p)
+}
+
+// PageFromContext returns the page set by WithPage or nil
+func PageFromContext(ctx context.Context) *Page {
+	p, _ := ctx.Value(pageKey{}).(*Page)
+	return p
+}
+
+// Apply returns the rows of the page sorted by path and true, when there are more rows after the page
+func (p *Page) Apply(rows [][]byte) ([][]byte, bool) {
+	page := make([][]byte, 0, len(rows))
+	for _, row := range rows {
+		if len(row) == 0 {
+			continue
+		}
+		if p.After != "" && bytes.Compare(row, []byte(p.After)) <= 0 {
+			continue
+		}
+		branch := row[len(row)-1] == '.'
+		if (p.LeavesOnly && branch) || (p.BranchesOnly && !branch) {
+			continue
+		}
+		page = append(page, row)
+	}
+	slices.SortFunc(page, bytes.Compare)
+	page = slices.CompactFunc(page, bytes.Equal)
+	if p.Limit > 0 && len(page) > p.Limit {
+		return page[:p.Limit], true
+	}
+	return page, false
+}
+
+// where adds the conditions of the page to the index query, paths must be sorted by the query
+func (p *Page) where(w *where.Where) {
+	if p.After != "" {
+		w.And(where.Gt("Path", p.After))
+	}
+	if p.LeavesOnly {
+		w.And("NOT " + where.Like("Path", "%."))
+	}
+	if p.BranchesOnly {
+		w.And(where.Like("Path", "%."))
+	}
+}
+
+// limit returns the LIMIT clause of the index query, one more row is read to know there are more results
+func (p *Page) limit() string {
+	if p.Limit <= 0 {
+		return ""
+	}
+	return " LIMIT " + strconv.Itoa(p.Limit+1)
+}
+
+// Key identifies the page in the cache keys, it's empty for nil page
+func (p *Page) Key() string {
+	if p == nil {
+		return ""
+	}
+	key := ";page=" + strconv.Itoa(p.Limit)
+	if p.LeavesOnly {
+		key += ",leaves"
+	}
+	if p.BranchesOnly {
+		key += ",branches"
+	}
+	return key + ";after=" + p.After
+}
@@ -0,0 +1,129 @@
+package finder
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	chtest "github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+)
+
+func rows(paths ...string) [][]byte {
+	r := make([][]byte, 0, len(paths))
+	for _, p := range paths {
+		r = append(r, []byte(p))
+	}
+	return r
+}
+
+func TestPageApply(t *testing.T) {
+	all := rows("a.d", "a.b.", "a.c", "a.b", "", "a.c")
+	tests := []struct {
+		name string
+		page Page
+		want [][]byte
+		more bool
+	}{
+		{name: "sorted and uniq", page: Page{}, want: rows("a.b", "a.b.", "a.c", "a.d")},
+		{name: "limit", page: Page{Limit: 2}, want: rows("a.b", "a.b."), more: true},
+		{name: "last page", page: Page{Limit: 2, After: "a.b."}, want: rows("a.c", "a.d")},
+		{name: "leaves", page: Page{LeavesOnly: true}, want: rows("a.b", "a.c", "a.d")},
+		{name: "branches", page: Page{BranchesOnly: true}, want: rows("a.b.")},
+		{name: "after the last", page: Page{After: "a.d"}, want: rows()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, more := tt.page.Apply(all)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.more, more)
+		})
+	}
+}
+
+func TestIndexFinderPage(t *testing.T) {
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+	srv.AddResponce(
+		"SELECT Path FROM graphite_index WHERE ((((Level=20002) AND (Path LIKE 'a.%')) AND (Date='1970-02-12')) AND (Path>'a.b')) AND (NOT Path LIKE '%.') GROUP BY Path ORDER BY Path LIMIT 3 FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("a.c\na.d\na.e\n")},
+	)
+	srv.AddResponce(
+		"SELECT Path FROM graphite_index WHERE ((Level=30002) AND (Path LIKE 'b.%')) AND (Date='1970-02-12') GROUP BY Path FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("b.a\nc.a\n")},
+	)
+
+	opts := clickhouse.Options{Timeout: time.Second, ConnectTimeout: time.Second}
+	page := &Page{Limit: 2, After: "a.b", LeavesOnly: true}
+	ctx := WithPage(context.Background(), page)
+
+	f := NewIndex(srv.URL, "graphite_index", false, "", nil, opts, false)
+	var stat FinderStat
+	require.NoError(t, f.Execute(ctx, config.New(), "a.*", 0, 0, &stat))
+	got, more := page.Apply(f.List())
+	assert.Equal(t, rows("a.c", "a.d"), got)
+	assert.True(t, more)
+
+	// the page isn't pushed down to the reversed query
+	f = NewIndex(srv.URL, "graphite_index", false, "", nil, opts, false)
+	require.NoError(t, f.Execute(ctx, config.New(), "*.b", 0, 0, &stat))
+	got, more = page.Apply(f.List())
+	assert.Equal(t, rows("a.c"), got)
+	assert.False(t, more)
+}
+
+func TestIndexFinderPageWrapped(t *testing.T) {
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+	srv.AddResponce(
+		"SELECT Path FROM graphite_index WHERE (((Level=20002) AND (Path LIKE 'a.%')) AND (Date='1970-02-12')) AND (Path>'a.b') GROUP BY Path ORDER BY Path LIMIT 2 FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("a.c\na.d\n")},
+	)
+	srv.AddResponce(
+		"SELECT Path FROM graphite_index WHERE ((Level=20002) AND (Path LIKE 'a.%')) AND (Date='1970-02-12') GROUP BY Path ORDER BY Path LIMIT 2 FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("a.b\na.c\n")},
+	)
+
+	opts := clickhouse.Options{Timeout: time.Second, ConnectTimeout: time.Second}
+	blacklist := []*regexp.Regexp{regexp.MustCompile(`^ch\.data\.secret\.`)}
+	newFinder := func() Finder {
+		return WrapBlacklist(WrapPrefix(NewIndex(srv.URL, "graphite_index", false, "", nil, opts, false), "ch.data"), blacklist)
+	}
+
+	tests := []struct {
+		name    string
+		after   string
+		want    [][]byte
+		more    bool
+		queries uint64
+	}{
+		// the cursor contains the prefix, but the indexed paths don't
+		{name: "cursor with prefix", after: "ch.data.a.b", want: rows("ch.data.a.c"), more: true, queries: 1},
+		{name: "cursor before prefix", after: "ch.aaa", want: rows("ch.data.a.b"), more: true, queries: 1},
+		{name: "cursor after prefix", after: "ch.zzz", want: rows(), queries: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page := &Page{Limit: 1, After: tt.after}
+			before := srv.Queries()
+			f := newFinder()
+			var stat FinderStat
+			require.NoError(t, f.Execute(WithPage(context.Background(), page), config.New(), "ch.data.a.*", 0, 0, &stat))
+			got, more := page.Apply(f.List())
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.more, more)
+			assert.Equal(t, tt.queries, srv.Queries()-before)
+		})
+	}
+
+	// blacklisted queries are rejected as a whole, the rows of the page are never filtered
+	f := newFinder()
+	var stat FinderStat
+	require.NoError(t, f.Execute(WithPage(context.Background(), &Page{Limit: 1}), config.New(), "ch.data.secret.*", 0, 0, &stat))
+	assert.Empty(t, f.List())
+}
@@ -73,6 +73,23 @@ func (p *PrefixFinder) Execute(ctx context.Context, config *config.Config, query
 
 	p.matched = PrefixMatched
 
+	// paths of the wrapped finder are without the prefix, so the cursor of the page is stripped too
+	if page := PageFromContext(ctx); page != nil && page.After != "" {
+		stripped := *page
+		prefix := string(p.prefixBytes)
+		switch {
+		case strings.HasPrefix(page.After, prefix):
+			stripped.After = page.After[len(prefix):]
+		case page.After < prefix:
+			stripped.After = ""
+		default:
+			// all paths with the prefix are before the cursor
+			p.matched = PrefixNotMatched
+			return nil
+		}
+		ctx = WithPage(ctx, &stripped)
+	}
+
 	return p.wrapped.Execute(ctx, config, strings.Join(qs[len(ps):], "."), from, until, stat)
 }
 
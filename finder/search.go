@@ -0,0 +1,244 @@
+package finder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/errs"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/lomik/graphite-clickhouse/pkg/where"
+)
+
+// Kinds of the search queries
+const (
+	// SearchSubstring matches metrics containing the query
+	SearchSubstring = "substring"
+	// SearchRegex matches metrics by the re2 regular expression
+	SearchRegex = "regex"
+	// SearchTokens matches metrics containing all whitespace separated tokens of the query
+	SearchTokens = "tokens"
+)
+
+// reversedPath restores the metric name from the path of the reversed index
+const reversedPath = "arrayStringConcat(arrayReverse(splitByChar('.', Path)), '.')"
+
+// SearchFinder finds metrics in the index table by substrings or regular expression instead of globs.
+// Only metrics are returned, the paths of nodes with children are skipped
+type SearchFinder struct {
+	url          string             // clickhouse dsn
+	table        string             // graphite_index table
+	opts         clickhouse.Options // timeout, connectTimeout
+	dailyEnabled bool
+	confReverse  uint8
+	kind         string
+	body         []byte // clickhouse response body
+	rows         [][]byte
+	reverse      bool
+	useDaily     bool
+}
+
+func NewSearch(url string, table string, dailyEnabled bool, reverse string, kind string, opts clickhouse.Options) *SearchFinder {
+	return &SearchFinder{
+		url:          url,
+		table:        table,
+		opts:         opts,
+		dailyEnabled: dailyEnabled,
+		confReverse:  config.IndexReverse[reverse],
+		kind:         kind,
+	}
+}
+
+// Search finds metrics by the query of the kind in IndexTable, the results could be paged with WithPage
+func Search(ctx context.Context, config *config.Config, kind string, query string, from int64, until int64, stat *FinderStat) (Result, error) {
+	if config.ClickHouse.IndexTable == "" {
+		return nil, errs.NewErrorWithCode("search requires index-table", http.StatusNotImplemented)
+	}
+	opts := clickhouse.Options{
+		TLSConfig:      config.ClickHouse.TLSConfig,
+		Timeout:        config.ClickHouse.IndexTimeout,
+		ConnectTimeout: config.ClickHouse.ConnectTimeout,
+		Estimate:       config.ClickHouse.FindEstimateLimits(scope.User(ctx)),
+	}
+	var f Finder = NewSearch(
+		config.ClickHouse.URL,
+		config.ClickHouse.IndexTable,
+		config.ClickHouse.IndexUseDaily,
+		config.ClickHouse.IndexReverse,
+		kind,
+		opts,
+	)
+	if len(config.Common.Blacklist) > 0 {
+		f = WrapBlacklist(f, config.Common.Blacklist)
+	}
+	if err := f.Execute(ctx, config, query, from, until, stat); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// regexAffixes returns the literal prefix and suffix of the regular expression, which are anchored
+// to the start and the end of the text
+func regexAffixes(re *syntax.Regexp) (prefix, suffix string) {
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+	literal := func(r *syntax.Regexp) bool {
+		return r.Op == syntax.OpLiteral && r.Flags&syntax.FoldCase == 0
+	}
+	if len(subs) > 1 && subs[0].Op == syntax.OpBeginText {
+		var sb strings.Builder
+		for i := 1; i < len(subs) && literal(subs[i]); i++ {
+			sb.WriteString(string(subs[i].Rune))
+		}
+		prefix = sb.String()
+	}
+	if n := len(subs); n > 1 && subs[n-1].Op == syntax.OpEndText {
+		i := n - 2
+		for i >= 0 && literal(subs[i]) {
+			i--
+		}
+		var sb strings.Builder
+		for _, r := range subs[i+1 : n-1] {
+			sb.WriteString(string(r.Rune))
+		}
+		suffix = sb.String()
+	}
+	return
+}
+
+// fullNodes returns the nodes of the literal suffix, which are known completely
+func fullNodes(suffix string) string {
+	if i := strings.IndexByte(suffix, '.'); i >= 0 {
+		return suffix[i+1:]
+	}
+	return ""
+}
+
+// useReverse chooses the index like IndexFinder.useReverse: the reversed index is used, when the regular
+// expression has more known nodes at the end than at the start
+func (s *SearchFinder) useReverse(prefix, suffix string) bool {
+	switch s.confReverse {
+	case queryDirect:
+		return false
+	case queryReversed:
+		return true
+	}
+	suffixNodes := fullNodes(suffix)
+	if suffixNodes == "" {
+		return false
+	}
+	return strings.Count(suffixNodes, ".")+1 > strings.Count(prefix, ".")
+}
+
+// whereFilter returns the conditions of the query and the expression of the metric name
+func (s *SearchFinder) whereFilter(query string, from, until int64) (*where.Where, string, error) {
+	var (
+		prefix, suffix string
+		re             *syntax.Regexp
+	)
+	switch s.kind {
+	case SearchSubstring:
+		if query == "" {
+			return nil, "", errs.NewErrorWithCode("empty search query", http.StatusBadRequest)
+		}
+	case SearchTokens:
+		if len(strings.Fields(query)) == 0 {
+			return nil, "", errs.NewErrorWithCode("empty search query", http.StatusBadRequest)
+		}
+	case SearchRegex:
+		var err error
+		re, err = syntax.Parse(query, syntax.Perl)
+		if err != nil {
+			return nil, "", errs.NewErrorWithCode("invalid search regex: "+err.Error(), http.StatusBadRequest)
+		}
+		prefix, suffix = regexAffixes(re)
+	default:
+		return nil, "", errs.NewErrorWithCode(fmt.Sprintf("unknown search type %q", s.kind), http.StatusBadRequest)
+	}
+
+	s.reverse = s.useReverse(prefix, suffix)
+	s.useDaily = useDaily(s.dailyEnabled, from, until)
+	levelOffset := calculateIndexLevelOffset(s.useDaily, s.reverse)
+
+	w := where.New()
+	// every kind of the index rows takes 10000 levels
+	w.Andf("Level > %d AND Level < %d", levelOffset, levelOffset+10000)
+	addDatesToWhere(w, s.useDaily, from, until)
+	// nodes with children are in the tree only
+	w.And("NOT " + where.Like("Path", "%."))
+
+	path := "Path"
+	if s.reverse {
+		path = reversedPath
+		if nodes := fullNodes(suffix); nodes != "" {
+			w.And(where.HasPrefix("Path", ReverseString(nodes)))
+		}
+	} else if prefix != "" {
+		w.And(where.HasPrefix("Path", prefix))
+	}
+
+	switch s.kind {
+	case SearchSubstring:
+		w.And(where.Contains(path, query))
+	case SearchTokens:
+		for _, token := range strings.Fields(query) {
+			w.And(where.Contains(path, token))
+		}
+	case SearchRegex:
+		w.And(where.MatchRegexp(path, query))
+	}
+	return w, path, nil
+}
+
+func (s *SearchFinder) Execute(ctx context.Context, config *config.Config, query string, from int64, until int64, stat *FinderStat) (err error) {
+	w, path, err := s.whereFilter(query, from, until)
+	if err != nil {
+		return err
+	}
+
+	var order string
+	if p := PageFromContext(ctx); p != nil {
+		if p.After != "" {
+			w.And(where.Gt(path, p.After))
+		}
+		order = " ORDER BY Metric" + p.limit()
+	}
+
+	s.body, stat.ChReadRows, stat.ChReadBytes, err = clickhouse.Query(
+		scope.WithTable(ctx, s.table),
+		s.url,
+		fmt.Sprintf("SELECT %s AS Metric FROM %s WHERE %s GROUP BY Metric%s FORMAT TabSeparatedRaw", path, s.table, w, order),
+		s.opts,
+		nil,
+	)
+	stat.Table = s.table
+	if err == nil {
+		stat.ReadBytes = int64(len(s.body))
+		// names are restored by the query, so the rows are never reversed
+		_, s.rows, _ = splitIndexBody(s.body, false, false)
+	}
+
+	return
+}
+
+func (s *SearchFinder) List() [][]byte {
+	return makeList(s.rows, false)
+}
+
+func (s *SearchFinder) Series() [][]byte {
+	return makeList(s.rows, true)
+}
+
+func (s *SearchFinder) Abs(v []byte) []byte {
+	return v
+}
+
+func (s *SearchFinder) Bytes() ([]byte, error) {
+	return s.body, nil
+}
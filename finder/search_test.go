@@ -0,0 +1,116 @@
+package finder
+
+import (
+	"context"
+	"regexp/syntax"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	chtest "github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+)
+
+func TestRegexAffixes(t *testing.T) {
+	tests := []struct {
+		re     string
+		prefix string
+		suffix string
+	}{
+		{re: `cpu`},
+		{re: `^a\.b\..*`, prefix: "a.b."},
+		{re: `.*\.cpu\.idle$`, suffix: ".cpu.idle"},
+		{re: `^a\..*\.idle$`, prefix: "a.", suffix: ".idle"},
+		{re: `^(?i)a\.b`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.re, func(t *testing.T) {
+			re, err := syntax.Parse(tt.re, syntax.Perl)
+			require.NoError(t, err)
+			prefix, suffix := regexAffixes(re)
+			assert.Equal(t, tt.prefix, prefix)
+			assert.Equal(t, tt.suffix, suffix)
+		})
+	}
+}
+
+func TestSearchFinderWhere(t *testing.T) {
+	const dates = "(Date >='2022-11-11' AND Date <= '2022-11-11')"
+	tests := []struct {
+		kind    string
+		query   string
+		reverse string
+		where   string
+		path    string
+	}{
+		{
+			kind: SearchSubstring, query: "cpu", reverse: "auto",
+			where: "(((Level > 0 AND Level < 10000) AND " + dates + ") AND (NOT Path LIKE '%.')) AND (position(Path, 'cpu') > 0)",
+			path:  "Path",
+		},
+		{
+			kind: SearchTokens, query: " cpu  idle", reverse: "auto",
+			where: "((((Level > 0 AND Level < 10000) AND " + dates + ") AND (NOT Path LIKE '%.')) AND (position(Path, 'cpu') > 0)) AND (position(Path, 'idle') > 0)",
+			path:  "Path",
+		},
+		{
+			kind: SearchRegex, query: `^a\.b\..*`, reverse: "auto",
+			where: "((((Level > 0 AND Level < 10000) AND " + dates + ") AND (NOT Path LIKE '%.')) AND (Path LIKE 'a.b.%')) AND (match(Path, '^a\\\\.b\\\\..*'))",
+			path:  "Path",
+		},
+		{
+			kind: SearchRegex, query: `.*\.cpu\.idle$`, reverse: "auto",
+			where: "((((Level > 10000 AND Level < 20000) AND " + dates + ") AND (NOT Path LIKE '%.')) AND (Path LIKE 'idle.cpu%')) AND (match(" + reversedPath + ", '.*\\\\.cpu\\\\.idle$'))",
+			path:  reversedPath,
+		},
+		{
+			kind: SearchRegex, query: `.*\.cpu\.idle$`, reverse: "direct",
+			where: "(((Level > 0 AND Level < 10000) AND " + dates + ") AND (NOT Path LIKE '%.')) AND (match(Path, '.*\\\\.cpu\\\\.idle$'))",
+			path:  "Path",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind+" "+tt.query+" "+tt.reverse, func(t *testing.T) {
+			s := NewSearch("", "graphite_index", true, tt.reverse, tt.kind, clickhouse.Options{})
+			w, path, err := s.whereFilter(tt.query, 1668124800, 1668124810)
+			require.NoError(t, err)
+			assert.Equal(t, tt.where, w.String())
+			assert.Equal(t, tt.path, path)
+		})
+	}
+
+	for _, tt := range []struct{ kind, query string }{
+		{SearchSubstring, ""},
+		{SearchTokens, "  "},
+		{SearchRegex, "("},
+		{"glob", "a.*"},
+	} {
+		s := NewSearch("", "graphite_index", true, "auto", tt.kind, clickhouse.Options{})
+		_, _, err := s.whereFilter(tt.query, 0, 0)
+		assert.Error(t, err, tt.kind)
+	}
+}
+
+func TestSearchFinderPage(t *testing.T) {
+	srv := chtest.NewTestServer()
+	defer srv.Close()
+	srv.AddResponce(
+		"SELECT Path AS Metric FROM graphite_index WHERE ((((Level > 20000 AND Level < 30000) AND (Date='1970-02-12')) AND (NOT Path LIKE '%.')) AND (position(Path, 'cpu') > 0)) AND (Path>'a.cpu') GROUP BY Metric ORDER BY Metric LIMIT 3 FORMAT TabSeparatedRaw",
+		&chtest.TestResponse{Body: []byte("b.cpu\nc.cpu\nd.cpu\n")},
+	)
+
+	opts := clickhouse.Options{Timeout: time.Second, ConnectTimeout: time.Second}
+	page := &Page{Limit: 2, After: "a.cpu", LeavesOnly: true}
+	ctx := WithPage(context.Background(), page)
+
+	f := NewSearch(srv.URL, "graphite_index", false, "auto", SearchSubstring, opts)
+	var stat FinderStat
+	require.NoError(t, f.Execute(ctx, config.New(), "cpu", 0, 0, &stat))
+	got, more := page.Apply(f.List())
+	assert.Equal(t, rows("b.cpu", "c.cpu"), got)
+	assert.True(t, more)
+	assert.Equal(t, "graphite_index", stat.Table)
+}
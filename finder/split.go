@@ -32,7 +32,9 @@ type SplitIndexFinder struct {
 	body    []byte
 	rows    [][]byte
 	// useWrapped indicated if we should use wrapped Finder.
-	useWrapped          bool
+	useWrapped bool
+	// splitQueries contains the parts of the split query
+	splitQueries        []string
 	useReverse          bool
 	wildcardMinDistance int
 }
@@ -97,6 +99,7 @@ func (splitFinder *SplitIndexFinder) Execute(
 		splitFinder.useWrapped = true
 		return splitFinder.wrapped.Execute(ctx, config, query, from, until, stat)
 	}
+	splitFinder.splitQueries = splitQueries
 
 	w, err := splitFinder.whereFilter(splitQueries, from, until)
 	if err != nil {
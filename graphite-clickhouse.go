@@ -35,6 +35,7 @@ import (
 	"github.com/lomik/graphite-clickhouse/prometheus"
 	"github.com/lomik/graphite-clickhouse/render"
 	"github.com/lomik/graphite-clickhouse/sd"
+	"github.com/lomik/graphite-clickhouse/search"
 	"github.com/lomik/graphite-clickhouse/tagger"
 )
 
@@ -56,6 +57,12 @@ func (w *LogResponseWriter) WriteHeader(status int) {
 	w.ResponseWriter.WriteHeader(status)
 }
 
+func (w *LogResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (w *LogResponseWriter) Status() int {
 	if w.status == 0 {
 		return http.StatusOK
@@ -283,9 +290,16 @@ func sdClean(name string, args []string) {
 func printMatchedRollupRules(metric string, age uint32, rollupRules *rollup.Rules) {
 	// check metric rollup rules
 	prec, aggr, aggrPattern, retentionPattern := rollupRules.Lookup(metric, age, true)
-	fmt.Printf("  metric %q, age %d -> precision=%d, aggr=%s\n", metric, age, prec, aggr.Name())
+	fmt.Printf("  metric %q, age %d -> precision=%d, aggr=%s", metric, age, prec, aggr.Name())
+	if xff := aggr.XFilesFactor(); xff > 0 {
+		fmt.Printf(", xFilesFactor=%g", xff)
+	}
+	fmt.Print("\n")
 	if aggrPattern != nil {
 		fmt.Printf("    aggr pattern: type=%s, regexp=%q, function=%s", aggrPattern.RuleType.String(), aggrPattern.Regexp, aggrPattern.Function)
+		if aggrPattern.XFilesFactor > 0 {
+			fmt.Printf(", xFilesFactor=%g", aggrPattern.XFilesFactor)
+		}
 		if len(aggrPattern.Retention) > 0 {
 			fmt.Print(", retentions:\n")
 			for i := range aggrPattern.Retention {
@@ -526,11 +540,18 @@ func main() {
 
 	mux := http.NewServeMux()
 	mux.Handle("/_internal/capabilities/", app.Handler(capabilities.NewHandler(cfg)))
-	mux.Handle("/metrics/find/", app.Handler(find.NewHandler(cfg)))
+	findHandler := find.NewHandler(cfg)
+	mux.Handle("/metrics/find/", app.Handler(findHandler))
+	mux.Handle("/metrics/expand/", app.Handler(find.NewExpandHandler(findHandler)))
+	mux.Handle("/metrics/search/", app.Handler(search.NewHandler(cfg)))
 	mux.Handle("/metrics/index.json", app.Handler(index.NewHandler(cfg)))
 	mux.Handle("/render/", app.Handler(render.NewHandler(cfg)))
 	mux.Handle("/tags/autoComplete/tags", app.Handler(autocomplete.NewTags(cfg)))
 	mux.Handle("/tags/autoComplete/values", app.Handler(autocomplete.NewValues(cfg)))
+	tagsHandler := app.Handler(autocomplete.NewTagsHandler(cfg))
+	mux.Handle("/tags", tagsHandler)
+	mux.Handle("/tags/", tagsHandler)
+	mux.Handle("/api/v1/read", app.Handler(prometheus.NewReadHandler(cfg)))
 	mux.HandleFunc("/alive", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		io.WriteString(w, "Graphite-clickhouse is alive.\n")
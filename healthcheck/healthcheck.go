@@ -6,10 +6,12 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
 	"github.com/msaf1980/go-stringutils"
 	"go.uber.org/zap"
@@ -20,6 +22,9 @@ type Handler struct {
 	config *config.Config
 	last   int64
 	failed int32
+
+	lock           sync.RWMutex
+	replicasFailed []int32
 }
 
 // NewHandler generates new *Handler
@@ -60,47 +65,37 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			logger := scope.LoggerWithHeaders(r.Context(), r, h.config.Common.HeadersToLog).Named("healthcheck")
 
-			client := http.Client{
-				Timeout: 2 * time.Second,
-			}
-			var u string
-			if pos := strings.Index(h.config.ClickHouse.URL, "/?"); pos > 0 {
-				u = h.config.ClickHouse.URL[:pos+2] + "query=" + url.QueryEscape(query)
-			} else {
-				u = h.config.ClickHouse.URL + "/?query=" + url.QueryEscape(query)
-			}
-
-			req, _ := http.NewRequest("GET", u, nil)
-			resp, err := client.Do(req)
+			urls, err := clickhouse.ReplicaURLs(h.config.ClickHouse.URL)
 			if err != nil {
 				logger.Error("healthcheck error",
 					zap.Error(err),
 				)
+				atomic.StoreInt32(&h.failed, failed)
+				break
+			}
+
+			replicasFailed := make([]int32, len(urls))
+			var wg sync.WaitGroup
+			for i := range urls {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					replicasFailed[i] = check(urls[i], query, logger)
+				}(i)
 			}
+			wg.Wait()
 
-			if resp.Body != nil {
-				if body, err := io.ReadAll(resp.Body); err == nil {
-					if resp.StatusCode == http.StatusOK {
-						failed = 0
-					} else {
-						failed = 1
-						logger.Error("healthcheck error",
-							zap.String("error", stringutils.UnsafeString(body)),
-						)
-					}
-				} else {
-					failed = 1
-					logger.Error("healthcheck error",
-						zap.Error(err),
-					)
+			// storage is alive while at least one replica is alive
+			for i := range replicasFailed {
+				if replicasFailed[i] == 0 {
+					failed = 0
+					break
 				}
-				resp.Body.Close()
-			} else {
-				failed = 1
-				logger.Error("healthcheck error",
-					zap.Error(err),
-				)
 			}
+
+			h.lock.Lock()
+			h.replicasFailed = replicasFailed
+			h.lock.Unlock()
 			atomic.StoreInt32(&h.failed, failed)
 			break
 		}
@@ -111,4 +106,69 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "Graphite-clickhouse is alive.\n")
 	}
+	h.writeReplicas(w)
+}
+
+// writeReplicas writes the state of every replica, when url contains several replicas hosts
+func (h *Handler) writeReplicas(w io.Writer) {
+	states, err := clickhouse.ReplicasState(h.config.ClickHouse.URL)
+	if err != nil || len(states) < 2 {
+		return
+	}
+
+	h.lock.RLock()
+	replicasFailed := h.replicasFailed
+	h.lock.RUnlock()
+
+	for i, state := range states {
+		status := "unknown"
+		if i < len(replicasFailed) {
+			if replicasFailed[i] > 0 {
+				status = "failed"
+			} else {
+				status = "ok"
+			}
+		}
+		if state.Ejected {
+			status += ", ejected"
+		}
+		fmt.Fprintf(w, "replica %s: %s, inflight %d\n", state.Host, status, state.Inflight)
+	}
+}
+
+// check queries the replica and returns 1 on fail
+func check(u, query string, logger *zap.Logger) int32 {
+	client := http.Client{
+		Timeout: 2 * time.Second,
+	}
+	if pos := strings.Index(u, "/?"); pos > 0 {
+		u = u[:pos+2] + "query=" + url.QueryEscape(query)
+	} else {
+		u = u + "/?query=" + url.QueryEscape(query)
+	}
+
+	req, _ := http.NewRequest("GET", u, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Error("healthcheck error",
+			zap.Error(err),
+		)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		logger.Error("healthcheck error",
+			zap.Error(err),
+		)
+		return 1
+	}
+	if resp.StatusCode != http.StatusOK {
+		logger.Error("healthcheck error",
+			zap.String("error", stringutils.UnsafeString(body)),
+		)
+		return 1
+	}
+	return 0
 }
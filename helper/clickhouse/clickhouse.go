@@ -1,6 +1,7 @@
 package clickhouse
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
@@ -12,6 +13,7 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"sort"
 	"strconv"
@@ -146,6 +148,8 @@ type Options struct {
 	TLSConfig      *tls.Config
 	Timeout        time.Duration
 	ConnectTimeout time.Duration
+	// Estimate rejects SELECT queries with too high cost, estimated before the execution
+	Estimate EstimateLimits
 }
 
 type LoggedReader struct {
@@ -156,6 +160,7 @@ type LoggedReader struct {
 	queryID    string
 	read_rows  int64
 	read_bytes int64
+	replica    *replica
 }
 
 func (r *LoggedReader) Read(p []byte) (int, error) {
@@ -169,6 +174,10 @@ func (r *LoggedReader) Read(p []byte) (int, error) {
 
 func (r *LoggedReader) Close() error {
 	err := r.reader.Close()
+	if r.replica != nil {
+		r.replica.inflight.Add(-1)
+		r.replica = nil
+	}
 	if !r.finished {
 		r.finished = true
 		r.logger.Info("query", zap.String("query_id", r.queryID), zap.Duration("time", time.Since(r.start)))
@@ -239,11 +248,23 @@ func reader(ctx context.Context, dsn string, query string, postBody io.Reader, e
 		}
 	}()
 
-	p, err := url.Parse(dsn)
+	p, hosts, err := ParseURL(dsn)
 	if err != nil {
 		return
 	}
 
+	logQuery(ctx, query, extData)
+	if scope.DryRun(ctx) {
+		logger.Debug("query is not executed in dry-run mode")
+		return &LoggedReader{reader: io.NopCloser(bytes.NewReader(nil)), logger: logger, start: start, finished: true}, nil
+	}
+
+	if opts.Estimate.Enabled() && postBody == nil && isIdempotent(query) {
+		if err = checkEstimate(ctx, dsn, query, opts, extData); err != nil {
+			return
+		}
+	}
+
 	var b [8]byte
 	binary.LittleEndian.PutUint64(b[:], rand.Uint64())
 	queryID := fmt.Sprintf("%x", b)
@@ -256,57 +277,92 @@ func reader(ctx context.Context, dsn string, query string, postBody io.Reader, e
 	q.Set("http_headers_progress_interval_ms", "10000")
 	p.RawQuery = q.Encode()
 
-	var contentHeader string
+	var (
+		contentHeader string
+		newBody       func() io.Reader
+		// only SELECT with rebuildable body can be retried on another replica
+		retry bool
+	)
 	if postBody != nil {
 		q := p.Query()
 		q.Set("query", query)
 		p.RawQuery = q.Encode()
+		newBody = func() io.Reader { return postBody }
 	} else if extData != nil {
 		q := p.Query()
 		q.Set("query", query)
 		p.RawQuery = q.Encode()
-		postBody, contentHeader, err = extData.buildBody(ctx, p)
+		var extBody *bytes.Buffer
+		extBody, contentHeader, err = extData.buildBody(ctx, p)
 		if err != nil {
 			return
 		}
+		data := extBody.Bytes()
+		newBody = func() io.Reader { return bytes.NewReader(data) }
+		retry = isIdempotent(query)
 	} else {
-		postBody = strings.NewReader(query)
-	}
-
-	url := p.String()
-
-	req, err := http.NewRequestWithContext(ctx, "POST", url, postBody)
-	if err != nil {
-		return
-	}
-
-	req.Header.Add("User-Agent", scope.ClickhouseUserAgent(ctx))
-	if contentHeader != "" {
-		req.Header.Add("Content-Type", contentHeader)
+		newBody = func() io.Reader { return strings.NewReader(query) }
+		retry = isIdempotent(query)
 	}
 
+	var contentEncoding string
 	switch encoding {
 	case ContentEncodingNone:
 		// no encoding
 	case ContentEncodingGzip:
-		req.Header.Add("Content-Encoding", "gzip")
+		contentEncoding = "gzip"
 	case ContentEncodingZstd:
-		req.Header.Add("Content-Encoding", "zstd")
+		contentEncoding = "zstd"
 	default:
 		return nil, fmt.Errorf("unknown encoding: %s", encoding)
 	}
 
-	client := &http.Client{
-		Timeout: opts.Timeout,
-		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout: opts.ConnectTimeout,
-			}).Dial,
-			TLSClientConfig:   opts.TLSConfig,
-			DisableKeepAlives: true,
-		},
-	}
-	resp, err := client.Do(req)
+	replicasLock.RLock()
+	settings := replicasSettings
+	replicasLock.RUnlock()
+
+	replicas := getReplicaSet(p.Scheme, hosts).order(settings.Policy)
+	attempts := 1
+	if retry {
+		attempts += settings.Retries
+	}
+	if attempts > len(replicas) {
+		attempts = len(replicas)
+	}
+
+	var (
+		resp *http.Response
+		r    *replica
+	)
+	for i := 0; i < attempts; i++ {
+		r = replicas[i]
+		p.Host = r.host
+		r.inflight.Add(1)
+		resp, err = send(ctx, p, newBody(), contentHeader, contentEncoding, opts)
+		if err == nil && (resp.StatusCode <= 500 || resp.StatusCode >= 512) {
+			r.restore()
+			break
+		}
+		if ctx.Err() != nil || (err != nil && !isReplicaError(err)) {
+			break
+		}
+		r.eject()
+		if i == attempts-1 {
+			break
+		}
+		r.inflight.Add(-1)
+		if err == nil {
+			err = errs.NewErrorWithCode("clickhouse response status "+strconv.Itoa(resp.StatusCode), resp.StatusCode)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		logger.Warn("query failed, retry on another replica", zap.String("replica", r.host), zap.Error(err))
+	}
+	defer func() {
+		if bodyReader == nil {
+			r.inflight.Add(-1)
+		}
+	}()
 	if err != nil {
 		return
 	}
@@ -362,11 +418,46 @@ func reader(ctx context.Context, dsn string, query string, postBody io.Reader, e
 		queryID:    chQueryID,
 		read_rows:  read_rows,
 		read_bytes: read_bytes,
+		replica:    r,
 	}
 
 	return
 }
 
+func send(ctx context.Context, p *url.URL, body io.Reader, contentHeader, contentEncoding string, opts Options) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, connTrace), "POST", p.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("User-Agent", scope.ClickhouseUserAgent(ctx))
+	if contentHeader != "" {
+		req.Header.Add("Content-Type", contentHeader)
+	}
+	if contentEncoding != "" {
+		req.Header.Add("Content-Encoding", contentEncoding)
+	}
+
+	client := &http.Client{
+		Timeout:   opts.Timeout,
+		Transport: getTransport(p, opts),
+	}
+	return client.Do(req)
+}
+
+// isReplicaError checks if the request error is caused by the replica (connection errors), not by the query timeout
+func isReplicaError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	return true
+}
+
 func do(ctx context.Context, dsn string, query string, postBody io.Reader, encoding ContentEncoding, opts Options, extData *ExternalData) ([]byte, int64, int64, error) {
 	bodyReader, err := reader(ctx, dsn, query, postBody, encoding, opts, extData)
 	if err != nil {
@@ -0,0 +1,105 @@
+package clickhouse
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/helper/errs"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// EstimateLimits are the thresholds for the cost of SELECT queries, estimated by ClickHouse with EXPLAIN ESTIMATE
+// before the query is executed. Zero values are unlimited
+type EstimateLimits struct {
+	MaxRows  int64
+	MaxMarks int64
+}
+
+// Enabled returns true if any threshold is set
+func (l EstimateLimits) Enabled() bool {
+	return l.MaxRows > 0 || l.MaxMarks > 0
+}
+
+// Check returns the error with 403 code, if the estimate exceeds the thresholds
+func (l EstimateLimits) Check(e Estimate) error {
+	if l.MaxRows > 0 && e.Rows > l.MaxRows {
+		return errs.NewErrorWithCode(fmt.Sprintf("query is too expensive: estimated rows to read %d > %d", e.Rows, l.MaxRows), http.StatusForbidden)
+	}
+	if l.MaxMarks > 0 && e.Marks > l.MaxMarks {
+		return errs.NewErrorWithCode(fmt.Sprintf("query is too expensive: estimated marks to read %d > %d", e.Marks, l.MaxMarks), http.StatusForbidden)
+	}
+	return nil
+}
+
+// Estimate is the cost of the query returned by EXPLAIN ESTIMATE, summed for all read tables
+type Estimate struct {
+	Parts int64
+	Rows  int64
+	Marks int64
+}
+
+var formatRe = regexp.MustCompile(`(?is)\s+FORMAT\s+\w+\s*;?\s*$`)
+
+// explainQuery returns EXPLAIN ESTIMATE for the query, the output format of the query is replaced
+func explainQuery(query string) string {
+	return "EXPLAIN ESTIMATE " + formatRe.ReplaceAllString(query, "") + " FORMAT TabSeparated"
+}
+
+// parseEstimate parses the rows of database, table, parts, rows and marks columns
+func parseEstimate(body []byte) (Estimate, error) {
+	var e Estimate
+	for _, line := range bytes.Split(body, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		fields := bytes.Split(line, []byte{'\t'})
+		if len(fields) != 5 {
+			return e, NewErrWithDescr("malformed EXPLAIN ESTIMATE response", string(line))
+		}
+		var values [3]int64
+		for i := range values {
+			v, err := strconv.ParseInt(string(fields[i+2]), 10, 64)
+			if err != nil {
+				return e, NewErrWithDescr("malformed EXPLAIN ESTIMATE response", string(line))
+			}
+			values[i] = v
+		}
+		e.Parts += values[0]
+		e.Rows += values[1]
+		e.Marks += values[2]
+	}
+	return e, nil
+}
+
+// Explain returns the cost of the SELECT query estimated by ClickHouse
+func Explain(ctx context.Context, dsn string, query string, opts Options, extData *ExternalData) (Estimate, error) {
+	opts.Estimate = EstimateLimits{}
+	body, _, _, err := do(ctx, dsn, explainQuery(query), nil, ContentEncodingNone, opts, extData)
+	if err != nil {
+		return Estimate{}, err
+	}
+	return parseEstimate(body)
+}
+
+// checkEstimate rejects the query, if its estimated cost exceeds opts.Estimate
+func checkEstimate(ctx context.Context, dsn string, query string, opts Options, extData *ExternalData) error {
+	e, err := Explain(ctx, dsn, query, opts, extData)
+	if err != nil {
+		return err
+	}
+	table := scope.Table(ctx)
+	metrics.SendQueryEstimate(table, e.Rows, e.Marks)
+	err = opts.Estimate.Check(e)
+	if err != nil {
+		scope.Logger(ctx).Warn("estimate", zap.String("table", table), zap.Int64("parts", e.Parts),
+			zap.Int64("rows", e.Rows), zap.Int64("marks", e.Marks), zap.Error(err))
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package clickhouse
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/helper/errs"
+)
+
+func TestExplainQuery(t *testing.T) {
+	assert.Equal(t,
+		"EXPLAIN ESTIMATE SELECT Path FROM graphite_index WHERE Level=20002 GROUP BY Path FORMAT TabSeparated",
+		explainQuery("SELECT Path FROM graphite_index WHERE Level=20002 GROUP BY Path FORMAT TabSeparatedRaw"),
+	)
+	assert.Equal(t,
+		"EXPLAIN ESTIMATE SELECT Path\nFROM graphite_data\nGROUP BY Path FORMAT TabSeparated",
+		explainQuery("SELECT Path\nFROM graphite_data\nGROUP BY Path\nFORMAT RowBinary"),
+	)
+	assert.Equal(t, "EXPLAIN ESTIMATE SELECT 1 FORMAT TabSeparated", explainQuery("SELECT 1"))
+}
+
+func TestParseEstimate(t *testing.T) {
+	e, err := parseEstimate([]byte("default\tgraphite_data\t3\t81920\t10\ndefault\tgraphite_index\t1\t8192\t1\n"))
+	require.NoError(t, err)
+	assert.Equal(t, Estimate{Parts: 4, Rows: 90112, Marks: 11}, e)
+
+	e, err = parseEstimate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, Estimate{}, e)
+
+	_, err = parseEstimate([]byte("default\tgraphite_data\t3\n"))
+	assert.Error(t, err)
+}
+
+func TestEstimateLimitsCheck(t *testing.T) {
+	e := Estimate{Parts: 4, Rows: 90112, Marks: 11}
+	assert.NoError(t, EstimateLimits{}.Check(e))
+	assert.NoError(t, EstimateLimits{MaxRows: 90112, MaxMarks: 11}.Check(e))
+
+	err := EstimateLimits{MaxRows: 90000}.Check(e)
+	require.Error(t, err)
+	assert.Equal(t, "query is too expensive: estimated rows to read 90112 > 90000", err.Error())
+	assert.Equal(t, http.StatusForbidden, err.(errs.ErrorWithCode).Code)
+
+	err = EstimateLimits{MaxMarks: 10}.Check(e)
+	require.Error(t, err)
+	assert.Equal(t, "query is too expensive: estimated marks to read 11 > 10", err.Error())
+}
+
+func TestQueryEstimate(t *testing.T) {
+	var queries int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		atomic.AddInt64(&queries, 1)
+		if strings.HasPrefix(string(body), "EXPLAIN ESTIMATE ") {
+			w.Write([]byte("default\tgraphite_index\t2\t16384\t2\n"))
+			return
+		}
+		w.Write([]byte("a.b.c\n"))
+	}))
+	defer srv.Close()
+
+	query := "SELECT Path FROM graphite_index GROUP BY Path FORMAT TabSeparatedRaw"
+
+	body, _, _, err := Query(context.Background(), srv.URL, query, Options{Estimate: EstimateLimits{MaxRows: 16384}}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "a.b.c\n", string(body))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&queries))
+
+	_, _, _, err = Query(context.Background(), srv.URL, query, Options{Estimate: EstimateLimits{MaxRows: 10000}}, nil)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, err.(errs.ErrorWithCode).Code)
+	assert.Equal(t, int64(3), atomic.LoadInt64(&queries), "the query must not be executed")
+
+	// no pre-flight step without limits
+	_, _, _, err = Query(context.Background(), srv.URL, query, Options{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), atomic.LoadInt64(&queries))
+}
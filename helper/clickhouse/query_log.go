@@ -0,0 +1,95 @@
+package clickhouse
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// ExplainHeader requests the plan of the request instead of its result, like explain=1 parameter
+const ExplainHeader = "X-Gch-Explain"
+
+type queryLogKey struct{}
+
+// QueryLog collects the queries to ClickHouse, which are made during the request. It's used by explain requests
+type QueryLog struct {
+	lock    sync.Mutex
+	queries []LoggedQuery
+}
+
+// LoggedQuery is the query to ClickHouse with the size of its external data
+type LoggedQuery struct {
+	Table             string `json:"table"`
+	Query             string `json:"query"`
+	ExternalDataBytes int    `json:"external_data_bytes,omitempty"`
+	// Executed is false, when the query isn't sent to ClickHouse in the dry-run mode
+	Executed bool `json:"executed"`
+}
+
+// WithQueryLog returns the context, where all queries to ClickHouse are added to l. Nil l disables the log
+func WithQueryLog(ctx context.Context, l *QueryLog) context.Context {
+	return context.WithValue(ctx, queryLogKey{}, l)
+}
+
+// Queries returns the logged queries in the order they are made
+func (l *QueryLog) Queries() []LoggedQuery {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	queries := make([]LoggedQuery, len(l.queries))
+	copy(queries, l.queries)
+	return queries
+}
+
+// Explaining returns true, when the queries of ctx are logged or aren't executed. Such queries can't be shared
+// with other requests
+func Explaining(ctx context.Context) bool {
+	l, _ := ctx.Value(queryLogKey{}).(*QueryLog)
+	return l != nil || scope.DryRun(ctx)
+}
+
+// logQuery adds the query to the log of ctx, if it's set
+func logQuery(ctx context.Context, query string, extData *ExternalData) {
+	l, _ := ctx.Value(queryLogKey{}).(*QueryLog)
+	if l == nil {
+		return
+	}
+	q := LoggedQuery{
+		Table:    scope.Table(ctx),
+		Query:    formatSQL(query),
+		Executed: !scope.DryRun(ctx),
+	}
+	if extData != nil {
+		for _, t := range extData.Tables {
+			q.ExternalDataBytes += len(t.Data)
+		}
+	}
+	l.lock.Lock()
+	l.queries = append(l.queries, q)
+	l.lock.Unlock()
+}
+
+// ExplainRequested returns true if the plan of the request is requested by explain parameter or X-Gch-Explain header
+func ExplainRequested(r *http.Request) bool {
+	v := r.FormValue("explain")
+	if v == "" {
+		v = r.Header.Get(ExplainHeader)
+	}
+	explain, _ := strconv.ParseBool(v)
+	return explain
+}
+
+// WriteExplain writes the plan of the request as JSON and returns the status code
+func WriteExplain(w http.ResponseWriter, plan interface{}) int {
+	b, err := json.Marshal(plan)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+	return http.StatusOK
+}
@@ -0,0 +1,56 @@
+package clickhouse
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+func TestQueryLog(t *testing.T) {
+	var queries int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&queries, 1)
+		w.Write([]byte("a.b.c\n"))
+	}))
+	defer srv.Close()
+
+	var queryLog QueryLog
+	ctx := scope.WithTable(WithQueryLog(context.Background(), &queryLog), "graphite_index")
+
+	body, _, _, err := Query(ctx, srv.URL, "SELECT Path\nFROM graphite_index", Options{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "a.b.c\n", string(body))
+
+	extData := NewExternalData(ExternalTable{Name: "metrics_list", Format: "TSV", Data: []byte("a.b.c\n")})
+	body, _, _, err = Query(scope.WithDryRun(ctx), srv.URL, "SELECT Path FROM graphite_data", Options{}, extData)
+	require.NoError(t, err)
+	assert.Empty(t, body)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&queries), "the query must not be executed in dry-run mode")
+
+	assert.Equal(t, []LoggedQuery{
+		{Table: "graphite_index", Query: "SELECT Path FROM graphite_index", Executed: true},
+		{Table: "graphite_index", Query: "SELECT Path FROM graphite_data", ExternalDataBytes: 6},
+	}, queryLog.Queries())
+
+	// queries aren't logged without the log
+	_, _, _, err = Query(WithQueryLog(ctx, nil), srv.URL, "SELECT 1", Options{}, nil)
+	require.NoError(t, err)
+	assert.Len(t, queryLog.Queries(), 2)
+}
+
+func TestExplainRequested(t *testing.T) {
+	r := httptest.NewRequest("GET", "/render/?explain=1", nil)
+	assert.True(t, ExplainRequested(r))
+
+	r = httptest.NewRequest("GET", "/render/", nil)
+	assert.False(t, ExplainRequested(r))
+	r.Header.Set(ExplainHeader, "true")
+	assert.True(t, ExplainRequested(r))
+}
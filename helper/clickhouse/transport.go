@@ -0,0 +1,103 @@
+package clickhouse
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/lomik/graphite-clickhouse/metrics"
+)
+
+// Transport contains settings of the HTTP transport, shared by all queries to the same ClickHouse host
+type Transport struct {
+	DisableKeepAlives   bool          `toml:"disable-keep-alives"     json:"disable-keep-alives"     comment:"open a new connection for every query (the old behavior)"`
+	MaxIdleConns        int           `toml:"max-idle-conns"          json:"max-idle-conns"          comment:"max idle (keep-alive) connections across all hosts, 0 means no limit"`
+	MaxIdleConnsPerHost int           `toml:"max-idle-conns-per-host" json:"max-idle-conns-per-host" comment:"max idle (keep-alive) connections per host"`
+	MaxConnsPerHost     int           `toml:"max-conns-per-host"      json:"max-conns-per-host"      comment:"max connections per host (dialing, active and idle), 0 means no limit"`
+	IdleConnTimeout     time.Duration `toml:"idle-conn-timeout"       json:"idle-conn-timeout"       comment:"close idle connections after this timeout, 0 means no limit"`
+	HTTP2               bool          `toml:"http2"                   json:"http2"                   comment:"try to negotiate HTTP/2 for https urls"`
+}
+
+type transportKey struct {
+	host           string
+	connectTimeout time.Duration
+	tlsConfig      *tls.Config
+}
+
+var (
+	transportLock     sync.Mutex
+	transportSettings = Transport{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		HTTP2:               true,
+	}
+	transports = make(map[transportKey]*http.Transport)
+)
+
+// SetTransport replaces the settings for HTTP transports. Already opened idle connections are closed.
+func SetTransport(t Transport) {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+
+	transportSettings = t
+	for k, tr := range transports {
+		tr.CloseIdleConnections()
+		delete(transports, k)
+	}
+}
+
+func newTransport(t Transport, opts Options) *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: opts.ConnectTimeout,
+		}).DialContext,
+		TLSClientConfig:     opts.TLSConfig,
+		DisableKeepAlives:   t.DisableKeepAlives,
+		MaxIdleConns:        t.MaxIdleConns,
+		MaxIdleConnsPerHost: t.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     t.MaxConnsPerHost,
+		IdleConnTimeout:     t.IdleConnTimeout,
+		ForceAttemptHTTP2:   t.HTTP2,
+	}
+}
+
+// getTransport returns the shared transport for ClickHouse host from u
+func getTransport(u *url.URL, opts Options) *http.Transport {
+	key := transportKey{
+		host:           u.Scheme + "://" + u.Host,
+		connectTimeout: opts.ConnectTimeout,
+		tlsConfig:      opts.TLSConfig,
+	}
+
+	transportLock.Lock()
+	defer transportLock.Unlock()
+
+	if transportSettings.DisableKeepAlives {
+		return newTransport(transportSettings, opts)
+	}
+
+	tr, ok := transports[key]
+	if !ok {
+		tr = newTransport(transportSettings, opts)
+		transports[key] = tr
+	}
+	return tr
+}
+
+var connTrace = &httptrace.ClientTrace{
+	GotConn: func(info httptrace.GotConnInfo) {
+		if metrics.ClickHouseConnMetrics == nil {
+			return
+		}
+		if info.Reused {
+			metrics.ClickHouseConnMetrics.Reused.Add(1)
+		} else {
+			metrics.ClickHouseConnMetrics.New.Add(1)
+		}
+	},
+}
@@ -0,0 +1,59 @@
+package clickhouse
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/metrics"
+)
+
+func TestTransportReuse(t *testing.T) {
+	metrics.InitMetrics(nil, false, false)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("1\n"))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		transport  Transport
+		wantNew    uint64
+		wantReused uint64
+	}{
+		{
+			name:       "keep-alive",
+			transport:  Transport{MaxIdleConnsPerHost: 2, IdleConnTimeout: time.Minute},
+			wantNew:    1,
+			wantReused: 2,
+		},
+		{
+			name:      "disable keep-alives",
+			transport: Transport{DisableKeepAlives: true},
+			wantNew:   3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetTransport(tt.transport)
+			metrics.ClickHouseConnMetrics.New.Clear()
+			metrics.ClickHouseConnMetrics.Reused.Clear()
+
+			opts := Options{Timeout: time.Second, ConnectTimeout: time.Second}
+			for i := 0; i < 3; i++ {
+				body, _, _, err := Query(context.Background(), srv.URL, "SELECT 1", opts, nil)
+				require.NoError(t, err)
+				assert.Equal(t, "1\n", string(body))
+			}
+
+			assert.Equal(t, tt.wantNew, metrics.ClickHouseConnMetrics.New.Count())
+			assert.Equal(t, tt.wantReused, metrics.ClickHouseConnMetrics.Reused.Count())
+		})
+	}
+}
@@ -50,7 +50,7 @@ func Uniq(points []Point) []Point {
 
 // FillNulls accepts an ordered []Point for one metric and returns a generator that will return all points for specific
 // interval. Generator returns EmptyPoint when it's finished
-func FillNulls(points []Point, from, until, step uint32) (start, stop, count uint32, getter GetValueOrNaN) {
+func FillNulls(points []Point, from, until, step int64) (start, stop, count int64, getter GetValueOrNaN) {
 	start = from - (from % step)
 	if start < from {
 		start += step
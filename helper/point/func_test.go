@@ -106,15 +106,15 @@ func TestCleanUp(t *testing.T) {
 func TestFillNulls(t *testing.T) {
 	type in struct {
 		points []Point
-		from   uint32
-		until  uint32
-		step   uint32
+		from   int64
+		until  int64
+		step   int64
 	}
 	type expected struct {
 		values []float64
-		start  uint32
-		stop   uint32
-		count  uint32
+		start  int64
+		stop   int64
+		count  int64
 		err    error
 	}
 	tests := []struct {
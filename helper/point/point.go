@@ -5,7 +5,7 @@ import "fmt"
 type Point struct {
 	MetricID  uint32
 	Value     float64
-	Time      uint32
+	Time      int64  // seconds or milliseconds for tables with high-precision-time
 	Timestamp uint32 // keep max if metric and time equal on two points
 }
 
@@ -13,6 +13,8 @@ type Points struct {
 	steps   []uint32
 	aggs    []*string
 	uniqAgg []string
+	xffs    []float32
+	xffSet  []bool
 }
 
 // NextMetric returns the list of points for one metric name
@@ -28,7 +30,7 @@ func NewPoints() *Points {
 }
 
 // AppendPoint creates a Point with given values and appends it to list
-func (pp *Points) AppendPoint(metricID uint32, value float64, time uint32, version uint32) {
+func (pp *Points) AppendPoint(metricID uint32, value float64, time int64, version uint32) {
 	pp.list = append(pp.list, Point{
 		MetricID:  metricID,
 		Value:     value,
@@ -101,7 +103,7 @@ func (pp *Points) SetSteps(steps map[uint32][]string) {
 // GetAggregation returns string function for given metric id.
 func (pp *Points) GetAggregation(id uint32) (string, error) {
 	i := int(id)
-	if i < 1 || len(pp.aggs) < i {
+	if i < 1 || len(pp.aggs) < i || pp.aggs[i-1] == nil {
 		return "", fmt.Errorf("wrong id %d for given functions %d: %w", i, len(pp.aggs), ErrWrongMetricID)
 	}
 	return *pp.aggs[i-1], nil
@@ -123,6 +125,29 @@ func (pp *Points) SetAggregations(functions map[string][]string) {
 	}
 }
 
+// GetXFilesFactor returns xFilesFactor for given metric id.
+func (pp *Points) GetXFilesFactor(id uint32) (float32, error) {
+	i := int(id)
+	if i < 1 || len(pp.xffs) < i || !pp.xffSet[i-1] {
+		return 0, fmt.Errorf("wrong id %d for given xFilesFactors %d: %w", i, len(pp.xffs), ErrWrongMetricID)
+	}
+	return pp.xffs[i-1], nil
+}
+
+// SetXFilesFactors accepts map of xFilesFactor as keys and metric names as values and sets slice of xFilesFactors for existing metrics in Data.Points
+func (pp *Points) SetXFilesFactors(xFilesFactors map[float32][]string) {
+	pp.xffs = make([]float32, len(pp.metrics))
+	pp.xffSet = make([]bool, len(pp.metrics))
+	for xff, mm := range xFilesFactors {
+		for _, m := range mm {
+			if id, ok := pp.idMap[m]; ok {
+				pp.xffs[id-1] = xff
+				pp.xffSet[id-1] = true
+			}
+		}
+	}
+}
+
 func (pp *Points) Len() int {
 	return len(pp.list)
 }
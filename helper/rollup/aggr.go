@@ -1,21 +1,102 @@
 package rollup
 
 import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
 	"github.com/lomik/graphite-clickhouse/helper/point"
 )
 
+// from, until, step, time
+// The aggregating function of ClickHouse with -Resample combinator groups values by the time intervals
+const resampleFormat = `%sResample(%%[1]d, %%[2]d, %%[3]d)(Value, %%[4]s)`
+
 var AggrMap = map[string]*Aggr{
-	"avg":     &Aggr{"avg", AggrAvg},
-	"max":     &Aggr{"max", AggrMax},
-	"min":     &Aggr{"min", AggrMin},
-	"sum":     &Aggr{"sum", AggrSum},
-	"any":     &Aggr{"any", AggrAny},
-	"anyLast": &Aggr{"anyLast", AggrAnyLast},
+	"avg":      &Aggr{name: "avg", f: AggrAvg},
+	"max":      &Aggr{name: "max", f: AggrMax},
+	"min":      &Aggr{name: "min", f: AggrMin},
+	"sum":      &Aggr{name: "sum", f: AggrSum},
+	"any":      &Aggr{name: "any", f: AggrAny},
+	"anyLast":  &Aggr{name: "anyLast", f: AggrAnyLast},
+	"first":    &Aggr{name: "first", f: AggrAny, resample: fmt.Sprintf(resampleFormat, "any")},
+	"last":     &Aggr{name: "last", f: AggrAnyLast, resample: fmt.Sprintf(resampleFormat, "anyLast")},
+	"median":   &Aggr{name: "median", f: AggrMedian, resample: quantileResample(0.5)},
+	"count":    &Aggr{name: "count", f: AggrCount, resample: `arrayMap(x->toFloat64(x), countResample(%[1]d, %[2]d, %[3]d)(Value, %[4]s))`},
+	"stddev":   &Aggr{name: "stddev", f: AggrStddev, resample: fmt.Sprintf(resampleFormat, "stddevPop")},
+	"range":    &Aggr{name: "range", f: AggrRange, resample: `arrayMap((a,b)->a-b, maxResample(%[1]d, %[2]d, %[3]d)(Value, %[4]s), minResample(%[1]d, %[2]d, %[3]d)(Value, %[4]s))`},
+	"multiply": &Aggr{name: "multiply", f: AggrMultiply, resample: `arrayMap(a->arrayProduct(a), groupArrayResample(%[1]d, %[2]d, %[3]d)(Value, %[4]s))`},
 }
 
 type Aggr struct {
 	name string
 	f    func(points []point.Point) (r float64)
+	// resample is ClickHouse expression with from, until, step and time arguments, which aggregates Value of the
+	// intervals like f. The function with the same name and -Resample combinator is used, if it's empty
+	resample string
+	// xFilesFactor is the minimal ratio of known points in the aggregated interval
+	xFilesFactor float32
+}
+
+// GetAggr returns the aggregating function by name. Besides AggrMap, percentiles like p50 or p99.9 are
+// supported
+func GetAggr(name string) (*Aggr, bool) {
+	if ag, ok := AggrMap[name]; ok {
+		return ag, true
+	}
+	if percent, ok := strings.CutPrefix(name, "p"); ok {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err == nil && 0 <= p && p <= 100 {
+			return &Aggr{name: name, f: aggrPercentile(p), resample: quantileResample(p / 100)}, true
+		}
+	}
+	return nil, false
+}
+
+// quantileResample returns ClickHouse expression for the interpolated quantile, the same as aggrPercentile.
+// The level is rounded to avoid values like 0.9990000000000001 for p99.9
+func quantileResample(level float64) string {
+	return `quantileExactInclusiveResample(` + strconv.FormatFloat(level, 'g', 12, 64) + `, %[1]d, %[2]d, %[3]d)(Value, %[4]s)`
+}
+
+// withXFilesFactor returns the copy of the function with xFilesFactor, the functions of AggrMap are shared
+func (ag *Aggr) withXFilesFactor(xFilesFactor float32) *Aggr {
+	if ag == nil || ag.xFilesFactor == xFilesFactor {
+		return ag
+	}
+	c := *ag
+	c.xFilesFactor = xFilesFactor
+	return &c
+}
+
+// Resample returns ClickHouse expression, which returns the array of Value aggregated by the intervals of step
+// from `from` to `until`. The time is the expression for the Time column in the same units
+func (ag *Aggr) Resample(from, until, step int64, time string) string {
+	if ag.resample == "" {
+		return fmt.Sprintf(fmt.Sprintf(resampleFormat, ag.name), from, until, step, time)
+	}
+	return fmt.Sprintf(ag.resample, from, until, step, time)
+}
+
+// XFilesFactor returns the minimal ratio of known points in the aggregated interval, 0 means no limit
+func (ag *Aggr) XFilesFactor() float32 {
+	if ag == nil {
+		return 0
+	}
+	return ag.xFilesFactor
+}
+
+// MinPoints returns the minimal count of points in the interval of step seconds, which satisfies xFilesFactor.
+// The expected count of points is calculated with the precision of the stored points
+func MinPoints(xFilesFactor float32, step, precision uint32) int {
+	if xFilesFactor <= 0 || precision == 0 || step <= precision {
+		return 0
+	}
+	expected := float64(step) / float64(precision)
+	// float32 ratio like 0.3 is a bit bigger than float64 one
+	return int(math.Ceil(float64(xFilesFactor)*expected - 1e-6))
 }
 
 func (ag *Aggr) Name() string {
@@ -32,6 +113,18 @@ func (ag *Aggr) String() string {
 	return ag.name
 }
 
+// keepsSingle returns true, if the function of the single point is the value of the point
+func (ag *Aggr) keepsSingle() bool {
+	if ag == nil {
+		return true
+	}
+	switch ag.name {
+	case "avg", "min", "max", "sum", "any", "anyLast", "first", "last":
+		return true
+	}
+	return false
+}
+
 func (ag *Aggr) Do(points []point.Point) (r float64) {
 	if ag == nil || ag.f == nil {
 		return 0
@@ -91,3 +184,62 @@ func AggrAnyLast(points []point.Point) (r float64) {
 	}
 	return
 }
+
+func AggrCount(points []point.Point) (r float64) {
+	return float64(len(points))
+}
+
+func AggrRange(points []point.Point) (r float64) {
+	return AggrMax(points) - AggrMin(points)
+}
+
+func AggrMultiply(points []point.Point) (r float64) {
+	if len(points) == 0 {
+		return
+	}
+	r = 1
+	for _, p := range points {
+		r *= p.Value
+	}
+	return
+}
+
+// AggrStddev returns the population standard deviation like graphite stddev
+func AggrStddev(points []point.Point) (r float64) {
+	if len(points) == 0 {
+		return
+	}
+	avg := AggrAvg(points)
+	for _, p := range points {
+		r += (p.Value - avg) * (p.Value - avg)
+	}
+	return math.Sqrt(r / float64(len(points)))
+}
+
+func AggrMedian(points []point.Point) (r float64) {
+	return percentile(points, 50)
+}
+
+func aggrPercentile(percent float64) func(points []point.Point) float64 {
+	return func(points []point.Point) float64 {
+		return percentile(points, percent)
+	}
+}
+
+// percentile returns the percentile of values, interpolated between the closest ranks like graphite does
+func percentile(points []point.Point, percent float64) (r float64) {
+	if len(points) == 0 {
+		return
+	}
+	values := make([]float64, len(points))
+	for i := range points {
+		values[i] = points[i].Value
+	}
+	sort.Float64s(values)
+	k := float64(len(values)-1) * percent / 100
+	i := int(k)
+	if i+1 >= len(values) {
+		return values[len(values)-1]
+	}
+	return values[i] + (values[i+1]-values[i])*(k-float64(i))
+}
@@ -0,0 +1,123 @@
+package rollup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/helper/point"
+)
+
+func TestAggrFunctions(t *testing.T) {
+	// the same points and results are checked in tests/consolidateBy_functions for the ClickHouse functions
+	points := []point.Point{
+		{MetricID: 1, Time: 1000, Value: 3},
+		{MetricID: 1, Time: 1010, Value: 0},
+		{MetricID: 1, Time: 1020, Value: 1},
+		{MetricID: 1, Time: 1030, Value: 2},
+	}
+	// the intervals with one point are aggregated like in ClickHouse
+	single := []point.Point{
+		{MetricID: 1, Time: 1000, Value: 7},
+		{MetricID: 1, Time: 1020, Value: 7},
+		{MetricID: 1, Time: 1030, Value: 5},
+	}
+	tests := []struct {
+		name     string
+		expected []float64
+		single   []float64
+	}{
+		{"avg", []float64{1.5, 1.5}, []float64{7, 6}},
+		{"sum", []float64{3, 3}, []float64{7, 12}},
+		{"min", []float64{0, 1}, []float64{7, 5}},
+		{"max", []float64{3, 2}, []float64{7, 7}},
+		{"first", []float64{3, 1}, []float64{7, 7}},
+		{"last", []float64{0, 2}, []float64{7, 5}},
+		{"median", []float64{1.5, 1.5}, []float64{7, 6}},
+		{"p90", []float64{2.7, 1.9}, []float64{7, 6.8}},
+		{"count", []float64{2, 2}, []float64{1, 2}},
+		{"stddev", []float64{1.5, 0.5}, []float64{0, 1}},
+		{"range", []float64{3, 1}, []float64{0, 2}},
+		{"multiply", []float64{0, 2}, []float64{7, 35}},
+	}
+	rollup := func(ag *Aggr, points []point.Point) []float64 {
+		result := doMetricPrecision(append([]point.Point(nil), points...), 20, 10, ag)
+		values := make([]float64, 0, len(result))
+		for _, p := range result {
+			values = append(values, p.Value)
+		}
+		return values
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ag, ok := GetAggr(tt.name)
+			require.True(t, ok)
+			assert.Equal(t, tt.name, ag.Name())
+			assert.InDeltaSlice(t, tt.expected, rollup(ag, points), 1e-9)
+			assert.InDeltaSlice(t, tt.single, rollup(ag, single), 1e-9)
+		})
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	values := func(vv ...float64) []point.Point {
+		points := make([]point.Point, 0, len(vv))
+		for _, v := range vv {
+			points = append(points, point.Point{Value: v})
+		}
+		return points
+	}
+	assert.Equal(t, 0.0, percentile(nil, 50))
+	assert.Equal(t, 5.0, percentile(values(5), 99))
+	assert.Equal(t, 3.0, AggrMedian(values(5, 1, 3)))
+	assert.Equal(t, 2.5, AggrMedian(values(4, 1, 3, 2)))
+	assert.Equal(t, 4.0, percentile(values(4, 1, 3, 2), 100))
+	assert.Equal(t, 1.0, percentile(values(4, 1, 3, 2), 0))
+	assert.InDelta(t, 3.97, percentile(values(4, 1, 3, 2), 99), 1e-9)
+}
+
+func TestGetAggr(t *testing.T) {
+	ag, ok := GetAggr("avg")
+	assert.True(t, ok)
+	assert.Same(t, AggrMap["avg"], ag)
+
+	ag, ok = GetAggr("p99.9")
+	require.True(t, ok)
+	assert.Equal(t, "p99.9", ag.Name())
+
+	for _, name := range []string{"", "unknown", "p", "p101", "p-1", "pNaN1"} {
+		_, ok = GetAggr(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestAggrResample(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"avg", "avgResample(10, 40, 20)(Value, Time)"},
+		{"anyLast", "anyLastResample(10, 40, 20)(Value, Time)"},
+		{"first", "anyResample(10, 40, 20)(Value, Time)"},
+		{"last", "anyLastResample(10, 40, 20)(Value, Time)"},
+		{"median", "quantileExactInclusiveResample(0.5, 10, 40, 20)(Value, Time)"},
+		{"p99.9", "quantileExactInclusiveResample(0.999, 10, 40, 20)(Value, Time)"},
+		{"count", "arrayMap(x->toFloat64(x), countResample(10, 40, 20)(Value, Time))"},
+		{"stddev", "stddevPopResample(10, 40, 20)(Value, Time)"},
+		{"range", "arrayMap((a,b)->a-b, maxResample(10, 40, 20)(Value, Time), minResample(10, 40, 20)(Value, Time))"},
+		{"multiply", "arrayMap(a->arrayProduct(a), groupArrayResample(10, 40, 20)(Value, Time))"},
+	}
+	for _, tt := range tests {
+		ag, ok := GetAggr(tt.name)
+		require.True(t, ok, tt.name)
+		assert.Equal(t, tt.expected, ag.Resample(10, 40, 20, "Time"), tt.name)
+		// xFilesFactor doesn't change the function
+		assert.Equal(t, tt.expected, ag.withXFilesFactor(0.5).Resample(10, 40, 20, "Time"), tt.name)
+	}
+	// the time expression is used for tables with high-precision-time
+	assert.Equal(
+		t, "maxResample(10000, 40000, 20000)(Value, toUnixTimestamp64Milli(Time))",
+		AggrMap["max"].Resample(10000, 40000, 20000, "toUnixTimestamp64Milli(Time)"),
+	)
+}
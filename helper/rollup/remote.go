@@ -15,12 +15,13 @@ import (
 )
 
 type rollupRulesResponseRecord struct {
-	RuleType  RuleType `json:"rule_type"`
-	Regexp    string   `json:"regexp"`
-	Function  string   `json:"function"`
-	Age       string   `json:"age"`
-	Precision string   `json:"precision"`
-	IsDefault int      `json:"is_default"`
+	RuleType     RuleType `json:"rule_type"`
+	Regexp       string   `json:"regexp"`
+	Function     string   `json:"function"`
+	XFilesFactor float32  `json:"xFilesFactor"`
+	Age          string   `json:"age"`
+	Precision    string   `json:"precision"`
+	IsDefault    int      `json:"is_default"`
 }
 type rollupRulesResponse struct {
 	Data []rollupRulesResponseRecord `json:"data"`
@@ -59,6 +60,7 @@ func parseJson(body []byte) (*Rules, error) {
 	}
 
 	defaultFunction := ""
+	var defaultXFilesFactor float32
 	defaultRetention := make([]Retention, 0)
 
 	// var last *Pattern
@@ -66,6 +68,7 @@ func parseJson(body []byte) (*Rules, error) {
 		if d.IsDefault == 1 {
 			if d.Function != "" {
 				defaultFunction = d.Function
+				defaultXFilesFactor = d.XFilesFactor
 			}
 			if d.Age != "" && d.Precision != "" && d.Precision != "0" {
 				rt, err := makeRetention(&d)
@@ -75,12 +78,13 @@ func parseJson(body []byte) (*Rules, error) {
 				defaultRetention = append(defaultRetention, rt)
 			}
 		} else {
-			if last() == nil || last().Regexp != d.Regexp || last().Function != d.Function {
+			if last() == nil || last().Regexp != d.Regexp || last().Function != d.Function || last().XFilesFactor != d.XFilesFactor {
 				r.Pattern = append(r.Pattern, Pattern{
-					RuleType:  d.RuleType,
-					Retention: make([]Retention, 0),
-					Regexp:    d.Regexp,
-					Function:  d.Function,
+					RuleType:     d.RuleType,
+					Retention:    make([]Retention, 0),
+					Regexp:       d.Regexp,
+					Function:     d.Function,
+					XFilesFactor: d.XFilesFactor,
 				})
 			}
 			if d.Age != "" && d.Precision != "" && d.Precision != "0" {
@@ -95,9 +99,10 @@ func parseJson(body []byte) (*Rules, error) {
 
 	if defaultFunction != "" || len(defaultRetention) != 0 {
 		r.Pattern = append(r.Pattern, Pattern{
-			Regexp:    "",
-			Function:  defaultFunction,
-			Retention: defaultRetention,
+			Regexp:       "",
+			Function:     defaultFunction,
+			XFilesFactor: defaultXFilesFactor,
+			Retention:    defaultRetention,
 		})
 	}
 
@@ -106,6 +111,23 @@ func parseJson(body []byte) (*Rules, error) {
 
 var timeoutRulesLoad = 10 * time.Second
 
+// rollupOptionalColumns are columns of system.graphite_retentions, which are absent in some ClickHouse versions
+var rollupOptionalColumns = map[string]bool{"rule_type": true, "xFilesFactor": true}
+
+// missingOptionalColumn returns the index of the optional column, which caused the query error, or -1
+func missingOptionalColumn(err error, columns []string) int {
+	if err == nil {
+		return -1
+	}
+	errStr := err.Error()
+	for i, column := range columns {
+		if rollupOptionalColumns[column] && (strings.Contains(errStr, "'"+column+"'") || strings.Contains(errStr, "`"+column+"`")) {
+			return i
+		}
+	}
+	return -1
+}
+
 func RemoteLoad(addr string, tlsConf *tls.Config, table string) (*Rules, error) {
 	var db string
 	arr := strings.SplitN(table, ".", 2)
@@ -115,13 +137,14 @@ func RemoteLoad(addr string, tlsConf *tls.Config, table string) (*Rules, error)
 		db, table = arr[0], arr[1]
 	}
 
-	query := `SELECT
-	    rule_type,
-	    regexp,
-	    function,
-	    age,
-	    precision,
-	    is_default
+	columns := []string{"rule_type", "regexp", "function", "xFilesFactor", "age", "precision", "is_default"}
+	var (
+		body []byte
+		err  error
+	)
+	for {
+		query := `SELECT
+	    ` + strings.Join(columns, ",\n\t    ") + `
 	FROM system.graphite_retentions
 	ARRAY JOIN Tables AS table
 	WHERE (table.database = '` + db + `') AND (table.table = '` + table + `')
@@ -132,35 +155,6 @@ func RemoteLoad(addr string, tlsConf *tls.Config, table string) (*Rules, error)
 		age ASC
 	FORMAT JSON`
 
-	body, _, _, err := clickhouse.Query(
-		scope.New(context.Background()).WithLogger(zapwriter.Logger("rollup")).WithTable("system.graphite_retentions"),
-		addr,
-		query,
-		clickhouse.Options{
-			Timeout:        timeoutRulesLoad,
-			ConnectTimeout: timeoutRulesLoad,
-			TLSConfig:      tlsConf,
-		},
-		nil,
-	)
-	if err != nil && strings.Contains(err.Error(), " Missing columns: 'rule_type' ") {
-		// for old version
-		query = `SELECT
-			regexp,
-			function,
-			age,
-			precision,
-			is_default
-		FROM system.graphite_retentions
-		ARRAY JOIN Tables AS table
-		WHERE (table.database = '` + db + `') AND (table.table = '` + table + `')
-		ORDER BY
-			is_default ASC,
-			priority ASC,
-			regexp ASC,
-			age ASC
-		FORMAT JSON`
-
 		body, _, _, err = clickhouse.Query(
 			scope.New(context.Background()).WithLogger(zapwriter.Logger("rollup")).WithTable("system.graphite_retentions"),
 			addr,
@@ -172,6 +166,12 @@ func RemoteLoad(addr string, tlsConf *tls.Config, table string) (*Rules, error)
 			},
 			nil,
 		)
+		// for old versions and versions without xFilesFactor the query is repeated without the missing column
+		missing := missingOptionalColumn(err, columns)
+		if missing < 0 {
+			break
+		}
+		columns = append(columns[:missing], columns[missing+1:]...)
 	}
 
 	if err != nil {
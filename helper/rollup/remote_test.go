@@ -2,6 +2,7 @@ package rollup
 
 import (
 	"encoding/json"
+	"errors"
 	"regexp"
 	"testing"
 
@@ -392,3 +393,32 @@ func TestParseJsonTyped(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(expected, r)
 }
+
+func TestParseJsonXFilesFactor(t *testing.T) {
+	response := `{
+	"data":
+	[
+		{"regexp": "^hourly", "function": "avg", "xFilesFactor": 0.5, "age": "0", "precision": "60", "is_default": 0},
+		{"regexp": "^hourly", "function": "avg", "xFilesFactor": 0.5, "age": "3600", "precision": "600", "is_default": 0},
+		{"regexp": "^hourly", "function": "avg", "xFilesFactor": 0.2, "age": "0", "precision": "0", "is_default": 0},
+		{"regexp": "", "function": "max", "xFilesFactor": 0.1, "age": "0", "precision": "60", "is_default": 1}
+	]
+}`
+	r, err := parseJson([]byte(response))
+	assert.NoError(t, err)
+	if assert.Len(t, r.Pattern, 3) {
+		assert.Equal(t, float32(0.5), r.Pattern[0].XFilesFactor)
+		assert.Len(t, r.Pattern[0].Retention, 2)
+		assert.Equal(t, float32(0.2), r.Pattern[1].XFilesFactor)
+		assert.Equal(t, float32(0.1), r.Pattern[2].XFilesFactor)
+	}
+}
+
+func TestMissingOptionalColumn(t *testing.T) {
+	columns := []string{"rule_type", "regexp", "function", "xFilesFactor", "age", "precision", "is_default"}
+	assert.Equal(t, -1, missingOptionalColumn(nil, columns))
+	assert.Equal(t, 0, missingOptionalColumn(errors.New("Code: 47, e.displayText() = DB::Exception: Missing columns: 'rule_type' while processing query"), columns))
+	assert.Equal(t, 3, missingOptionalColumn(errors.New("Code: 47. DB::Exception: Unknown expression identifier `xFilesFactor` in scope SELECT"), columns))
+	assert.Equal(t, -1, missingOptionalColumn(errors.New("Missing columns: 'regexp'"), columns))
+	assert.Equal(t, -1, missingOptionalColumn(errors.New("connection refused"), columns))
+}
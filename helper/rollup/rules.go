@@ -133,12 +133,13 @@ func buildTaggedRegex(regexpStr string) string {
 }
 
 type Pattern struct {
-	RuleType  RuleType    `json:"rule_type"`
-	Regexp    string      `json:"regexp"`
-	Function  string      `json:"function"`
-	Retention []Retention `json:"retention"`
-	aggr      *Aggr
-	re        *regexp.Regexp
+	RuleType     RuleType    `json:"rule_type"`
+	Regexp       string      `json:"regexp"`
+	Function     string      `json:"function"`
+	XFilesFactor float32     `json:"xFilesFactor,omitempty"`
+	Retention    []Retention `json:"retention"`
+	aggr         *Aggr
+	re           *regexp.Regexp
 }
 
 type Rules struct {
@@ -185,13 +186,19 @@ func (p *Pattern) compile() error {
 		p.re = nil
 	}
 
+	if p.XFilesFactor < 0 || p.XFilesFactor > 1 {
+		return fmt.Errorf("xFilesFactor %v is out of [0, 1] range", p.XFilesFactor)
+	}
+
 	if p.Function != "" {
 		var exists bool
-		p.aggr, exists = AggrMap[p.Function]
+		p.aggr, exists = GetAggr(p.Function)
 
 		if !exists {
 			return fmt.Errorf("unknown function %#v", p.Function)
 		}
+		// xFilesFactor is applied with the aggregating function of the pattern
+		p.aggr = p.aggr.withXFilesFactor(p.XFilesFactor)
 	}
 
 	if len(p.Retention) > 0 {
@@ -239,7 +246,7 @@ func (r *Rules) compile() (*Rules, error) {
 }
 
 func (r *Rules) prepare(defaultPrecision uint32, defaultFunction string) (*Rules, error) {
-	defaultAggr := AggrMap[defaultFunction]
+	defaultAggr, _ := GetAggr(defaultFunction)
 	if defaultFunction != "" && defaultAggr == nil {
 		return r, fmt.Errorf("unknown function %#v", defaultFunction)
 	}
@@ -351,7 +358,9 @@ func (r *Rules) LookupBytes(metric []byte, age uint32, verbose bool) (precision
 	return r.Lookup(dry.UnsafeString(metric), age, verbose)
 }
 
-func doMetricPrecision(points []point.Point, precision uint32, aggr *Aggr) []point.Point {
+// doMetricPrecision aggregates points to precision. Intervals with less points than required by xFilesFactor
+// of aggr are removed, the expected count of points is calculated with precision of the stored points
+func doMetricPrecision(points []point.Point, precision, storedPrecision uint32, aggr *Aggr) []point.Point {
 	l := len(points)
 	var i, n int
 	// i - current position of iterator
@@ -361,28 +370,36 @@ func doMetricPrecision(points []point.Point, precision uint32, aggr *Aggr) []poi
 		return points
 	}
 
+	minPoints := MinPoints(aggr.XFilesFactor(), precision, storedPrecision)
+	aggregate := func(n, i int) {
+		if i-n < minPoints {
+			points[n].MetricID = 0
+			return
+		}
+		// functions like count or stddev of the single point differ from its value
+		if i > n+1 || !aggr.keepsSingle() {
+			points[n].Value = aggr.Do(points[n:i])
+		}
+	}
+
 	// set first point time
 	t := points[0].Time
-	t = t - (t % precision)
+	t = t - (t % int64(precision))
 	points[0].Time = t
 
 	for i = 1; i < l; i++ {
 		t = points[i].Time
-		t = t - (t % precision)
+		t = t - (t % int64(precision))
 		points[i].Time = t
 
 		if points[n].Time == t {
 			points[i].MetricID = 0
 		} else {
-			if i > n+1 {
-				points[n].Value = aggr.Do(points[n:i])
-			}
+			aggregate(n, i)
 			n = i
 		}
 	}
-	if i > n+1 {
-		points[n].Value = aggr.Do(points[n:i])
-	}
+	aggregate(n, i)
 
 	return point.CleanUp(points)
 }
@@ -396,7 +413,9 @@ func (r *Rules) RollupMetricAge(metricName string, age uint32, points []point.Po
 	}
 
 	precision, ag, _, _ := r.Lookup(metricName, age, false)
-	points = doMetricPrecision(points, precision, ag)
+	// points are stored with the precision of the first retention
+	storedPrecision, _, _, _ := r.Lookup(metricName, 0, false)
+	points = doMetricPrecision(points, precision, storedPrecision, ag)
 
 	return points, precision, nil
 }
@@ -414,6 +433,7 @@ func (r *Rules) RollupMetric(metricName string, from uint32, points []point.Poin
 
 // RollupPoints groups sorted Points by metric name and apply rollup one by one.
 // If the `step` parameter is 0, it will be got from the current *Rules, otherwise it will be used directly.
+// The points are aggregated to the step by the function and xFilesFactor of the points, if they are set, or of the rules.
 func (r *Rules) RollupPoints(pp *point.Points, from int64, step int64) error {
 	if from < 0 || step < 0 {
 		return fmt.Errorf("from and step must be >= 0: %v, %v", from, step)
@@ -440,8 +460,18 @@ func (r *Rules) RollupPoints(pp *point.Points, from int64, step int64) error {
 		if step == 0 {
 			p, _, err = r.RollupMetricAge(metricName, uint32(age), p)
 		} else {
-			_, agg, _, _ := r.Lookup(metricName, uint32(from), false)
-			p = doMetricPrecision(p, uint32(step), agg)
+			precision, agg, _, _ := r.Lookup(metricName, uint32(age), false)
+			// aggregation and xFilesFactor of the points override the rules ones, e.g. they are set by
+			// consolidateBy and setXFilesFactor functions
+			if function, err := pp.GetAggregation(p[0].MetricID); err == nil {
+				if ag, ok := GetAggr(function); ok {
+					agg = ag.withXFilesFactor(agg.XFilesFactor())
+				}
+			}
+			if xFilesFactor, err := pp.GetXFilesFactor(p[0].MetricID); err == nil {
+				agg = agg.withXFilesFactor(xFilesFactor)
+			}
+			p = doMetricPrecision(p, uint32(step), precision, agg)
 		}
 		for i := range p {
 			p[i].MetricID = p[0].MetricID
@@ -28,7 +28,7 @@ func TestMetricPrecision(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		result := doMetricPrecision(test[0], 60, AggrMap["sum"])
+		result := doMetricPrecision(test[0], 60, 60, AggrMap["sum"])
 		assert.Equal(t, test[1], result)
 	}
 }
@@ -340,6 +340,25 @@ func TestRules_RollupPoints(t *testing.T) {
 		return pp
 	}
 
+	withAggregations := func(pp *point.Points) *point.Points {
+		pp.SetAggregations(map[string][]string{"sum": {"10sec"}})
+		return pp
+	}
+
+	pointsTo60SecSum := func() *point.Points {
+		pp := point.NewPoints()
+
+		id10Sec := pp.MetricID("10sec")
+		pp.AppendPoint(id10Sec, 6.0, 0, 0)
+		pp.AppendPoint(id10Sec, 13.0, 60, 0)
+
+		idDefault := pp.MetricID("default")
+		pp.AppendPoint(idDefault, 4.0, 0, 0)
+		pp.AppendPoint(idDefault, 8.0, 60, 0)
+
+		return withAggregations(pp)
+	}
+
 	tests := []struct {
 		name    string
 		pp      *point.Points
@@ -372,6 +391,12 @@ func TestRules_RollupPoints(t *testing.T) {
 			from: int64(10), step: int64(60),
 			want: pointsTo60Sec(),
 		},
+		{
+			name: "with step 60 and aggregation of points",
+			pp:   withAggregations(newPoints()),
+			from: int64(10), step: int64(60),
+			want: pointsTo60SecSum(),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -844,3 +869,62 @@ func BenchmarkLookupDefaultTaggedSeparated(b *testing.B) {
 		_ = ag
 	}
 }
+
+func TestMetricPrecisionXFilesFactor(t *testing.T) {
+	points := []point.Point{
+		{MetricID: 1, Time: 1200, Value: 1},
+		{MetricID: 1, Time: 1210, Value: 2},
+		{MetricID: 1, Time: 1220, Value: 3},
+		{MetricID: 1, Time: 1260, Value: 4},
+		{MetricID: 1, Time: 1270, Value: 5},
+		{MetricID: 1, Time: 1320, Value: 6},
+		{MetricID: 1, Time: 1330, Value: 7},
+		{MetricID: 1, Time: 1340, Value: 8},
+		{MetricID: 1, Time: 1350, Value: 9},
+	}
+	// 6 points are expected in 60 seconds with 10 seconds precision, 3 of them are required
+	result := doMetricPrecision(points, 60, 10, AggrMap["sum"].withXFilesFactor(0.5))
+	assert.Equal(t, []point.Point{
+		{MetricID: 1, Time: 1200, Value: 6},
+		{MetricID: 1, Time: 1320, Value: 30},
+	}, result)
+}
+
+func TestRollupMetricAgeXFilesFactor(t *testing.T) {
+	r, err := NewMockRules([]Pattern{
+		{Regexp: "^sparse", Function: "sum", XFilesFactor: 0.5, Retention: []Retention{{Age: 0, Precision: 10}, {Age: 3600, Precision: 60}}},
+	}, 10, "avg")
+	require.NoError(t, err)
+
+	points := []point.Point{
+		{MetricID: 1, Time: 1200, Value: 1},
+		{MetricID: 1, Time: 1210, Value: 2},
+		{MetricID: 1, Time: 1220, Value: 3},
+		{MetricID: 1, Time: 1260, Value: 4},
+		{MetricID: 1, Time: 1270, Value: 5},
+	}
+	// the points are rolled up to 60 seconds, 3 points of 10 seconds precision are required
+	result, precision, err := r.RollupMetricAge("sparse.metric", 7200, points)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(60), precision)
+	assert.Equal(t, []point.Point{{MetricID: 1, Time: 1200, Value: 6}}, result)
+}
+
+func TestMinPoints(t *testing.T) {
+	tests := []struct {
+		xFilesFactor    float32
+		step, precision uint32
+		want            int
+	}{
+		{0, 60, 10, 0},
+		{0.5, 60, 60, 0},
+		{0.5, 60, 0, 0},
+		{0.5, 60, 10, 3},
+		{0.3, 100, 10, 3},
+		{0.1, 60, 10, 1},
+		{1, 3600, 60, 60},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, MinPoints(tt.xFilesFactor, tt.step, tt.precision), "%v %d/%d", tt.xFilesFactor, tt.step, tt.precision)
+	}
+}
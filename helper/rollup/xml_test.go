@@ -303,3 +303,42 @@ func TestParseXMLTyped(t *testing.T) {
 		assert.Equal(expected, r)
 	})
 }
+
+func TestParseXMLXFilesFactor(t *testing.T) {
+	config := `
+<graphite_rollup>
+	<pattern>
+		<regexp>^hourly</regexp>
+		<function>avg</function>
+		<xFilesFactor>0.5</xFilesFactor>
+		<retention>
+			<age>0</age>
+			<precision>60</precision>
+		</retention>
+	</pattern>
+	<default>
+		<function>max</function>
+		<retention>
+			<age>0</age>
+			<precision>60</precision>
+		</retention>
+	</default>
+</graphite_rollup>
+`
+	r, err := parseXML([]byte(config))
+	require.NoError(t, err)
+	require.Len(t, r.Pattern, 2)
+	assert.Equal(t, float32(0.5), r.Pattern[0].XFilesFactor)
+
+	_, ag, _, _ := r.Lookup("hourly.metric", 0, false)
+	assert.Equal(t, "avg", ag.Name())
+	assert.Equal(t, float32(0.5), ag.XFilesFactor())
+	// functions of AggrMap are not changed
+	assert.Equal(t, float32(0), AggrMap["avg"].XFilesFactor())
+
+	_, ag, _, _ = r.Lookup("other.metric", 0, false)
+	assert.Equal(t, float32(0), ag.XFilesFactor())
+
+	_, err = parseXML([]byte(`<graphite_rollup><pattern><regexp>^a</regexp><function>avg</function><xFilesFactor>1.5</xFilesFactor></pattern></graphite_rollup>`))
+	assert.Error(t, err)
+}
@@ -39,6 +39,17 @@ var FinderCacheMetrics *CacheMetric
 var ShortCacheMetrics *CacheMetric
 var DefaultCacheMetrics *CacheMetric
 
+var RenderShortCacheMetrics *CacheMetric
+var RenderDefaultCacheMetrics *CacheMetric
+
+// ConnMetric counts connections, used for ClickHouse queries
+type ConnMetric struct {
+	New    metrics.Counter
+	Reused metrics.Counter
+}
+
+var ClickHouseConnMetrics *ConnMetric
+
 // var WaitMetrics []WaitMetric
 
 type ReqMetric struct {
@@ -110,6 +121,7 @@ type FindMetrics struct {
 type RenderMetric struct {
 	ReqMetric
 	FinderH metrics.Histogram
+	Partial metrics.Counter // responses without the failed targets
 }
 
 type RenderMetrics struct {
@@ -148,6 +160,36 @@ func initFindCacheMetrics(c *Config) {
 	}
 }
 
+func initRenderCacheMetrics(c *Config) {
+	RenderShortCacheMetrics = &CacheMetric{
+		CacheHits:   metrics.NewCounter(),
+		CacheMisses: metrics.NewCounter(),
+	}
+	RenderDefaultCacheMetrics = &CacheMetric{
+		CacheHits:   metrics.NewCounter(),
+		CacheMisses: metrics.NewCounter(),
+	}
+
+	if c != nil && Graphite != nil {
+		metrics.Register("render_short_cache_hits", RenderShortCacheMetrics.CacheHits)
+		metrics.Register("render_short_cache_misses", RenderShortCacheMetrics.CacheMisses)
+		metrics.Register("render_default_cache_hits", RenderDefaultCacheMetrics.CacheHits)
+		metrics.Register("render_default_cache_misses", RenderDefaultCacheMetrics.CacheMisses)
+	}
+}
+
+func initConnMetrics(c *Config) {
+	ClickHouseConnMetrics = &ConnMetric{
+		New:    metrics.NewCounter(),
+		Reused: metrics.NewCounter(),
+	}
+
+	if c != nil && Graphite != nil {
+		metrics.Register("clickhouse_conns_new", ClickHouseConnMetrics.New)
+		metrics.Register("clickhouse_conns_reused", ClickHouseConnMetrics.Reused)
+	}
+}
+
 func initFindMetrics(scope string, c *Config, waitQueue bool) *FindMetrics {
 	requestMetric := &FindMetrics{
 		ReqMetric: ReqMetric{
@@ -242,6 +284,7 @@ func initRenderMetrics(scope string, c *Config) *RenderMetrics {
 				MetricsCountName: scope + ".all.metrics",
 				PointsCountName:  scope + ".all.points",
 			},
+			Partial: metrics.NewCounter(),
 		},
 	}
 
@@ -273,6 +316,7 @@ func initRenderMetrics(scope string, c *Config) *RenderMetrics {
 		metrics.Register(scope+".all.requests", requestMetric.RequestsH)
 		metrics.Register(scope+".all.requests_finder", requestMetric.FinderH)
 		metrics.Register(scope+".all.errors", requestMetric.Errors)
+		metrics.Register(scope+".all.partial", requestMetric.Partial)
 		if c.ExtendedStat {
 			metrics.Register(scope+".all.requests_status_code.200", requestMetric.Requests200)
 			metrics.Register(scope+".all.requests_status_code.400", requestMetric.Requests400)
@@ -292,11 +336,13 @@ func initRenderMetrics(scope string, c *Config) *RenderMetrics {
 				requestMetric.RangeMetrics[i].RequestsH = metrics.NewVSumHistogram(c.BucketsWidth, c.BucketsLabels).SetNameTotal("")
 				requestMetric.RangeMetrics[i].FinderH = metrics.NewVSumHistogram(c.BucketsWidth, c.BucketsLabels).SetNameTotal("")
 				requestMetric.RangeMetrics[i].Errors = metrics.NewCounter()
+				requestMetric.RangeMetrics[i].Partial = metrics.NewCounter()
 				requestMetric.RangeMetrics[i].MetricsCountName = scope + "." + requestMetric.RangeNames[i] + ".metrics"
 				requestMetric.RangeMetrics[i].PointsCountName = scope + "." + requestMetric.RangeNames[i] + ".points"
 				metrics.Register(scope+"."+c.RangeNames[i]+".requests", requestMetric.RangeMetrics[i].RequestsH)
 				metrics.Register(scope+"."+c.RangeNames[i]+".requests_finder", requestMetric.RangeMetrics[i].FinderH)
 				metrics.Register(scope+"."+c.RangeNames[i]+".errors", requestMetric.RangeMetrics[i].Errors)
+				metrics.Register(scope+"."+c.RangeNames[i]+".partial", requestMetric.RangeMetrics[i].Partial)
 				if c.ExtendedStat {
 					requestMetric.RangeMetrics[i].Requests200 = metrics.NewCounter()
 					requestMetric.RangeMetrics[i].Requests400 = metrics.NewCounter()
@@ -421,11 +467,19 @@ func SendFindMetrics(r *FindMetrics, statusCode int, durationMs, untilFromS int6
 	}
 }
 
-func SendRenderMetrics(r *RenderMetrics, statusCode int, start, fetch, end time.Time, untilFromS int64, extended bool, metricsCount, points int64) {
+// SendRenderMetrics sends the metrics of the render request, partial is true if some targets are failed and
+// dropped from the response
+func SendRenderMetrics(r *RenderMetrics, statusCode int, start, fetch, end time.Time, untilFromS int64, extended, partial bool, metricsCount, points int64) {
 	fromPos := -1
 	if len(r.RangeS) > 0 {
 		fromPos = metrics.SearchInt64Le(r.RangeS, untilFromS)
 	}
+	if partial {
+		r.Partial.Add(1)
+		if fromPos >= 0 {
+			r.RangeMetrics[fromPos].Partial.Add(1)
+		}
+	}
 	startMs := start.UnixMilli()
 	endMs := end.UnixMilli()
 	var (
@@ -615,6 +669,8 @@ func InitMetrics(c *Config, findWaitQueue, tagsWaitQueue bool) {
 		}
 	}
 	initFindCacheMetrics(c)
+	initRenderCacheMetrics(c)
+	initConnMetrics(c)
 	FindRequestMetric = initFindMetrics("find", c, findWaitQueue)
 	TagsRequestMetric = initFindMetrics("tags", c, tagsWaitQueue)
 	RenderRequestMetric = initRenderMetrics("render", c)
@@ -487,6 +487,7 @@ func TestInitMetrics(t *testing.T) {
 			// RenderRequestH
 			compareInterface(t, "render.all.requests", RenderRequestMetric.RequestsH, true)
 			compareInterface(t, "render.all.requests_finder", RenderRequestMetric.FinderH, true)
+			compareInterface(t, "render.all.partial", RenderRequestMetric.Partial, true)
 			// RenderRequestCount
 			compareInterface(t, "render.all.requests_status_code.200", RenderRequestMetric.Requests200, c.ExtendedStat)
 			compareInterface(t, "render.all.requests_status_code.400", RenderRequestMetric.Requests400, c.ExtendedStat)
@@ -506,6 +507,7 @@ func TestInitMetrics(t *testing.T) {
 					// FindRequestH
 					compareInterface(t, "render."+c.RangeNames[i]+".requests", RenderRequestMetric.RangeMetrics[i].RequestsH, true)
 					compareInterface(t, "render."+c.RangeNames[i]+".requests_finder", RenderRequestMetric.RangeMetrics[i].FinderH, true)
+					compareInterface(t, "render."+c.RangeNames[i]+".partial", RenderRequestMetric.RangeMetrics[i].Partial, true)
 					// FindRequestCount
 					compareInterface(t, "render."+c.RangeNames[i]+".requests_status_code.200", RenderRequestMetric.RangeMetrics[i].Requests200, c.ExtendedStat)
 					compareInterface(t, "render."+c.RangeNames[i]+".requests_status_code.400", RenderRequestMetric.RangeMetrics[i].Requests400, c.ExtendedStat)
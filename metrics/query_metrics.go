@@ -9,6 +9,9 @@ type QueryMetric struct {
 	ReadBytesName   string
 	ChReadRowsName  string
 	ChReadBytesName string
+	// EXPLAIN ESTIMATE of the queries
+	EstimatedRowsName  string
+	EstimatedMarksName string
 }
 
 type QueryMetrics struct {
@@ -39,6 +42,9 @@ func InitQueryMetrics(table string, c *Config) *QueryMetrics {
 			ReadBytesName:   "query." + table + ".all.read_bytes",
 			ChReadRowsName:  "query." + table + ".all.ch_read_rows",
 			ChReadBytesName: "query." + table + ".all.ch_read_bytes",
+
+			EstimatedRowsName:  "query." + table + ".all.estimated_rows",
+			EstimatedMarksName: "query." + table + ".all.estimated_marks",
 		},
 	}
 
@@ -108,3 +114,11 @@ func SendQueryReadByTable(table string, from, until, durationMs, read_rows, read
 		SendQueryRead(r, from, until, durationMs, read_rows, read_bytes, ch_read_rows, ch_read_bytes, err)
 	}
 }
+
+// SendQueryEstimate sends the rows and marks of the table estimated by EXPLAIN ESTIMATE
+func SendQueryEstimate(table string, rows, marks int64) {
+	if r, ok := QMetrics[table]; ok {
+		Gstatsd.Timing(r.EstimatedRowsName, rows, 1.0)
+		Gstatsd.Timing(r.EstimatedMarksName, marks, 1.0)
+	}
+}
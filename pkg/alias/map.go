@@ -65,6 +65,20 @@ func (m *Map) MergeTarget(r finder.Result, target string, saveCache bool) []byte
 	}
 }
 
+// Add appends values for the metric into aliases map
+func (m *Map) Add(metric string, values ...Value) {
+	m.lock.Lock()
+	m.data[metric] = append(m.data[metric], values...)
+	m.lock.Unlock()
+}
+
+// Delete removes the metric from aliases map
+func (m *Map) Delete(metric string) {
+	m.lock.Lock()
+	delete(m.data, metric)
+	m.lock.Unlock()
+}
+
 // Len returns count of keys
 func (m *Map) Len() int {
 	m.lock.RLock()
@@ -112,6 +112,14 @@ func TestLen(t *testing.T) {
 	assert.Equal(t, 5, am.Len())
 }
 
+func TestDelete(t *testing.T) {
+	am := createAM()
+	am.Delete("5_sec.name.max")
+	am.Delete("unknown.metric")
+	assert.Equal(t, 3, am.Len())
+	assert.Nil(t, am.Get("5_sec.name.max"))
+}
+
 func TestSize(t *testing.T) {
 	am := createAM()
 	assert.Equal(t, 4, am.Size())
@@ -0,0 +1,68 @@
+package coalesce
+
+import (
+	"context"
+	"sync"
+)
+
+// Group deduplicates the concurrent executions with the same key: the first caller starts the execution
+// and the others wait for its result
+type Group[T any] struct {
+	lock  sync.Mutex
+	calls map[string]*Call[T]
+}
+
+// Call is the execution shared by the callers with the same key
+type Call[T any] struct {
+	done chan struct{}
+	val  T
+	err  error
+}
+
+// Start returns the in-flight call for the key. If there is no such call, fn is started in a new goroutine
+// and started is true. fn gets ctx without its cancellation and deadline, so the execution isn't broken
+// when the starting caller is gone, but other callers still wait for it
+func (g *Group[T]) Start(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (c *Call[T], started bool) {
+	g.lock.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		return c, false
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*Call[T])
+	}
+	c = &Call[T]{done: make(chan struct{})}
+	g.calls[key] = c
+	g.lock.Unlock()
+
+	go func() {
+		defer func() {
+			g.lock.Lock()
+			delete(g.calls, key)
+			g.lock.Unlock()
+			close(c.done)
+		}()
+		c.val, c.err = fn(context.WithoutCancel(ctx))
+	}()
+	return c, true
+}
+
+// Wait returns the result of the call. It stops waiting with ctx error, when ctx is done before the call
+// is finished, the call itself is continued for other callers
+func (c *Call[T]) Wait(ctx context.Context) (T, error) {
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		var v T
+		return v, ctx.Err()
+	}
+}
+
+// Do starts or joins the call for the key and waits for its result, see Start and Wait.
+// shared is true, when the result is taken from the call started by another caller
+func (g *Group[T]) Do(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (v T, shared bool, err error) {
+	c, started := g.Start(ctx, key, fn)
+	v, err = c.Wait(ctx)
+	return v, !started, err
+}
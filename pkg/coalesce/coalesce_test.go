@@ -0,0 +1,83 @@
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupDo(t *testing.T) {
+	var (
+		g       Group[int]
+		calls   int32
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+	fn := func(ctx context.Context) (int, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return 42, nil
+	}
+
+	c, started := g.Start(context.Background(), "key", fn)
+	require.True(t, started)
+
+	for i := 0; i < 10; i++ {
+		joined, started := g.Start(context.Background(), "key", fn)
+		require.False(t, started)
+		require.Same(t, c, joined)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := joined.Wait(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, 42, v)
+		}()
+	}
+	close(release)
+	wg.Wait()
+
+	v, err := c.Wait(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 42, v)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	assert.Empty(t, g.calls, "finished calls are removed")
+
+	// the next call is executed again
+	v, s, err := g.Do(context.Background(), "key", func(ctx context.Context) (int, error) { return 1, errors.New("failed") })
+	assert.EqualError(t, err, "failed")
+	assert.Equal(t, 1, v)
+	assert.False(t, s)
+}
+
+func TestGroupWaitCanceled(t *testing.T) {
+	var g Group[int]
+	release := make(chan struct{})
+	done := make(chan error, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c, started := g.Start(ctx, "key", func(ctx context.Context) (int, error) {
+		<-release
+		// the execution isn't canceled with the starting caller
+		done <- ctx.Err()
+		return 1, nil
+	})
+	require.True(t, started)
+	cancel()
+	_, err := c.Wait(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// other callers still get the result
+	joined, started := g.Start(context.Background(), "key", nil)
+	assert.False(t, started)
+	close(release)
+	v, err := joined.Wait(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, v)
+	assert.NoError(t, <-done)
+}
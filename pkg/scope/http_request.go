@@ -45,6 +45,10 @@ func HttpRequest(r *http.Request) *http.Request {
 		r.Header.Set("X-Forwarded-For", fmt.Sprintf("%s, %s", xff, clientIP))
 	}
 
+	if user := r.Header.Get("X-Forwarded-User"); user != "" {
+		ctx = WithUser(ctx, user)
+	}
+
 	for _, h := range passHeaders {
 		hv := r.Header.Get(h)
 		if hv != "" {
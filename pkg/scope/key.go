@@ -39,6 +39,26 @@ func RequestID(ctx context.Context) string {
 	return String(ctx, "requestID")
 }
 
+// WithUser returns the context with the name of the user, which is used to select the user limits
+func WithUser(ctx context.Context, user string) context.Context {
+	return With(ctx, "user", user)
+}
+
+// User returns the name of the user from X-Forwarded-User header
+func User(ctx context.Context) string {
+	return String(ctx, "user")
+}
+
+// WithDryRun returns the context, where queries aren't sent to ClickHouse, see explain requests
+func WithDryRun(ctx context.Context) context.Context {
+	return With(ctx, "dry-run", true)
+}
+
+// DryRun returns true if queries shouldn't be sent to ClickHouse
+func DryRun(ctx context.Context) bool {
+	return Bool(ctx, "dry-run")
+}
+
 // WithTable ...
 func WithTable(ctx context.Context, table string) context.Context {
 	return With(ctx, "table", table)
@@ -159,6 +159,18 @@ func Eq(field, value interface{}) string {
 	return fmt.Sprintf("%s=%s", field, quote(value))
 }
 
+func Gt(field, value interface{}) string {
+	return fmt.Sprintf("%s>%s", field, quote(value))
+}
+
+func Contains(field, substr string) string {
+	return fmt.Sprintf("position(%s, %s) > 0", field, quote(substr))
+}
+
+func MatchRegexp(field, re string) string {
+	return fmt.Sprintf("match(%s, %s)", field, quote(re))
+}
+
 func HasPrefix(field, prefix string) string {
 	return fmt.Sprintf("%s LIKE '%s%%'", field, likeEscape(prefix))
 }
@@ -0,0 +1,47 @@
+//go:build !noprom
+// +build !noprom
+
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/errs"
+	"github.com/lomik/graphite-clickhouse/limiter"
+)
+
+// storageError converts the error to the promql error types, so the API returns the proper error type:
+// limiter errors and deadlines are returned as timeout (503), ClickHouse errors as internal (500).
+// Other errors, like invalid matchers, are returned as is.
+func storageError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, limiter.ErrOverflow) || errors.Is(err, limiter.ErrTimeout) {
+		return promql.ErrQueryTimeout("storage queue: " + err.Error())
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return promql.ErrQueryTimeout("storage read")
+	}
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	var (
+		chErr   *clickhouse.ErrWithDescr
+		codeErr errs.ErrorWithCode
+		netErr  net.Error
+	)
+	if errors.As(err, &chErr) || errors.As(err, &codeErr) || errors.As(err, &netErr) ||
+		errors.Is(err, clickhouse.ErrClickHouseResponse) ||
+		errors.Is(err, clickhouse.ErrUvarintRead) || errors.Is(err, clickhouse.ErrUvarintOverflow) {
+		return promql.ErrStorage{Err: err}
+	}
+
+	return err
+}
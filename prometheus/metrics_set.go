@@ -12,8 +12,9 @@ import (
 
 // SeriesSet contains a set of series.
 type metricsSet struct {
-	metrics []string
-	current int
+	metrics  []string
+	current  int
+	warnings annotations.Annotations
 }
 
 type metric struct {
@@ -48,9 +49,9 @@ func (ms *metricsSet) Next() bool {
 	return ms.current < len(ms.metrics)
 }
 
-func newMetricsSet(metrics []string) storage.SeriesSet {
-	return &metricsSet{metrics: metrics, current: -1}
+func newMetricsSet(metrics []string, warnings annotations.Annotations) storage.SeriesSet {
+	return &metricsSet{metrics: metrics, current: -1, warnings: warnings}
 }
 
-// Warnings ...
-func (s *metricsSet) Warnings() annotations.Annotations { return nil }
+// Warnings returns warnings, collected during the query
+func (s *metricsSet) Warnings() annotations.Annotations { return s.warnings }
@@ -7,13 +7,14 @@ import (
 	"context"
 	"fmt"
 	"strings"
-	"time"
 
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/util/annotations"
 
 	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/finder"
 	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/date"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
 	"github.com/lomik/graphite-clickhouse/pkg/where"
 	"github.com/prometheus/prometheus/model/labels"
@@ -33,66 +34,99 @@ func (q *Querier) Close() error {
 
 // LabelValues returns all potential values for a label name.
 func (q *Querier) LabelValues(ctx context.Context, label string, hints *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
-	// @TODO: support matchers
-	w := where.New()
-	w.And(where.HasPrefix("Tag1", label+"="))
+	w, pw, err := q.labelsWhere(matchers)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	fromDate := timeNow().AddDate(0, 0, -q.config.ClickHouse.TaggedAutocompleDays)
-	w.Andf("Date >= '%s'", fromDate.Format("2006-01-02"))
+	var valueSQL string
+	if len(matchers) == 0 {
+		valueSQL = "splitByChar('=', Tag1)[2] AS value"
+		w.And(where.HasPrefix("Tag1", label+"="))
+	} else {
+		prefixSelector := where.HasPrefix("x", label+"=")
+		valueSQL = fmt.Sprintf("substr(arrayFilter(x -> %s, Tags)[1], %d) AS value", prefixSelector, len(label)+2)
+		w.And("arrayExists(x -> " + prefixSelector + ", Tags)")
+	}
 
-	sql := fmt.Sprintf("SELECT splitByChar('=', Tag1)[2] as value FROM %s %s GROUP BY value ORDER BY value",
-		q.config.ClickHouse.TaggedTable,
-		w.SQL(),
-	)
+	rows, err := q.labelsQuery(ctx, valueSQL, w, pw, hints)
+	if err != nil {
+		return nil, nil, storageError(err)
+	}
 
-	body, _, _, err := clickhouse.Query(
-		scope.WithTable(ctx, q.config.ClickHouse.TaggedTable),
-		q.config.ClickHouse.URL,
-		sql,
-		clickhouse.Options{
-			TLSConfig:      q.config.ClickHouse.TLSConfig,
-			Timeout:        q.config.ClickHouse.IndexTimeout,
-			ConnectTimeout: q.config.ClickHouse.ConnectTimeout,
-		},
-		nil,
-	)
+	return rows, nil, nil
+}
+
+// LabelNames returns all the unique label names present in the block in sorted order.
+func (q *Querier) LabelNames(ctx context.Context, hints *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	w, pw, err := q.labelsWhere(matchers)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	rows := strings.Split(string(body), "\n")
-	if len(rows) > 0 && rows[len(rows)-1] == "" {
-		rows = rows[:len(rows)-1]
+	valueSQL := "splitByChar('=', Tag1)[1] AS value"
+	if len(matchers) > 0 {
+		valueSQL = "splitByChar('=', arrayJoin(Tags))[1] AS value"
+	}
+
+	rows, err := q.labelsQuery(ctx, valueSQL, w, pw, hints)
+	if err != nil {
+		return nil, nil, storageError(err)
 	}
 
 	return rows, nil, nil
 }
 
-// LabelNames returns all the unique label names present in the block in sorted order.
-func (q *Querier) LabelNames(ctx context.Context, hints *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
-	// @TODO support matchers
+// labelsWhere translates matchers to the tagged table conditions, limited by the querier time range
+func (q *Querier) labelsWhere(matchers []*labels.Matcher) (*where.Where, *where.Where, error) {
 	w := where.New()
-	fromDate := time.Now().AddDate(0, 0, -q.config.ClickHouse.TaggedAutocompleDays).UTC()
-	w.Andf("Date >= '%s'", fromDate.Format("2006-01-02"))
+	pw := where.New()
+
+	terms, err := makeTaggedFromPromQL(matchers)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(terms) > 0 {
+		w, pw, err = finder.TaggedWhere(terms, q.config.FeatureFlags.UseCarbonBehavior, q.config.FeatureFlags.DontMatchMissingTags)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	from, until := q.timeRange(nil)
+	w.Andf(
+		"Date >= '%s' AND Date <= '%s'",
+		date.FromTimestampToDaysFormat(from),
+		date.UntilTimestampToDaysFormat(until),
+	)
+
+	return w, pw, nil
+}
 
-	sql := fmt.Sprintf("SELECT splitByChar('=', Tag1)[1] as value FROM %s %s GROUP BY value ORDER BY value",
+func (q *Querier) labelsQuery(ctx context.Context, valueSQL string, w, pw *where.Where, hints *storage.LabelHints) ([]string, error) {
+	sql := fmt.Sprintf("SELECT %s FROM %s %s %s GROUP BY value ORDER BY value",
+		valueSQL,
 		q.config.ClickHouse.TaggedTable,
+		pw.PreWhereSQL(),
 		w.SQL(),
 	)
+	if hints != nil && hints.Limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", hints.Limit)
+	}
 
 	body, _, _, err := clickhouse.Query(
 		scope.WithTable(ctx, q.config.ClickHouse.TaggedTable),
 		q.config.ClickHouse.URL,
 		sql,
 		clickhouse.Options{
+			TLSConfig:      q.config.ClickHouse.TLSConfig,
 			Timeout:        q.config.ClickHouse.IndexTimeout,
 			ConnectTimeout: q.config.ClickHouse.ConnectTimeout,
-			TLSConfig:      q.config.ClickHouse.TLSConfig,
 		},
 		nil,
 	)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	rows := strings.Split(string(body), "\n")
@@ -100,5 +134,5 @@ func (q *Querier) LabelNames(ctx context.Context, hints *storage.LabelHints, mat
 		rows = rows[:len(rows)-1]
 	}
 
-	return rows, nil, nil
+	return rows, nil
 }
@@ -5,6 +5,8 @@ package prometheus
 
 import (
 	"context"
+	"fmt"
+	"sort"
 	"time"
 
 	"github.com/lomik/graphite-clickhouse/config"
@@ -14,17 +16,15 @@ import (
 	"github.com/lomik/graphite-clickhouse/render/data"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/util/annotations"
 )
 
 // override in unit tests for stable results
 var timeNow = time.Now
 
-func (q *Querier) lookup(ctx context.Context, from, until int64, qlimiter limiter.ServerLimiter, queueDuration *time.Duration, labelsMatcher ...*labels.Matcher) (*alias.Map, error) {
-	terms, err := makeTaggedFromPromQL(labelsMatcher)
-	if err != nil {
-		return nil, err
-	}
+func (q *Querier) lookup(ctx context.Context, from, until int64, qlimiter limiter.ServerLimiter, queueDuration *time.Duration, terms []finder.TaggedTerm) (*alias.Map, error) {
 	var (
+		err      error
 		stat     finder.FinderStat
 		limitCtx context.Context
 		cancel   context.CancelFunc
@@ -89,25 +89,35 @@ func (q *Querier) timeRange(hints *storage.SelectHints) (int64, int64) {
 func (q *Querier) Select(ctx context.Context, sortSeries bool, hints *storage.SelectHints, labelsMatcher ...*labels.Matcher) storage.SeriesSet {
 	var (
 		queueDuration time.Duration
+		warnings      annotations.Annotations
 	)
 	from, until := q.timeRange(hints)
 	qlimiter := data.GetQueryLimiterFrom("", q.config, from, until)
-	am, err := q.lookup(ctx, from, until, qlimiter, &queueDuration, labelsMatcher...)
+	terms, err := makeTaggedFromPromQL(labelsMatcher)
+	if err != nil {
+		return storage.ErrSeriesSet(err)
+	}
+	am, err := q.lookup(ctx, from, until, qlimiter, &queueDuration, terms)
 	if err != nil {
-		return nil //, nil, err @TODO
+		return storage.ErrSeriesSet(storageError(err))
 	}
 
 	if am.Len() == 0 {
 		return emptySeriesSet()
 	}
 
+	if hints != nil && hints.Limit > 0 && am.Len() > hints.Limit {
+		am = truncateAliases(am, hints.Limit)
+		warnings.Add(fmt.Errorf("results truncated due to limit %d", hints.Limit))
+	}
+
 	if hints != nil && hints.Func == "series" {
 		// /api/v1/series?match[]=...
-		return newMetricsSet(am.DisplayNames()) //, nil, nil
+		return newMetricsSet(am.DisplayNames(), warnings)
 	}
 
 	var step int64 = 60000
-	if hints.Step != 0 {
+	if hints != nil && hints.Step != 0 {
 		step = hints.Step
 	}
 
@@ -122,17 +132,28 @@ func (q *Querier) Select(ctx context.Context, sortSeries bool, hints *storage.Se
 	}
 	reply, err := multiTarget.Fetch(ctx, q.config, config.ContextPrometheus, qlimiter, &queueDuration)
 	if err != nil {
-		return nil // , nil, err @TODO
+		return storage.ErrSeriesSet(storageError(err))
 	}
 
 	if len(reply) == 0 {
-		return emptySeriesSet() //, nil, nil
+		return emptySeriesSet()
 	}
 
-	ss, err := makeSeriesSet(reply[0].Data, step)
+	ss, err := makeSeriesSet(reply[0].Data, step, warnings)
 	if err != nil {
-		return nil // , nil, err @TODO
+		return storage.ErrSeriesSet(storageError(err))
 	}
 
-	return ss //, nil, nil
+	return ss
+}
+
+// truncateAliases returns the map with the first limit series in the sorted order
+func truncateAliases(am *alias.Map, limit int) *alias.Map {
+	series := am.Series(false)
+	sort.Strings(series)
+	truncated := alias.New()
+	for _, s := range series[:limit] {
+		truncated.Add(s, am.Get(s)...)
+	}
+	return truncated
 }
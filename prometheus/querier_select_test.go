@@ -4,11 +4,20 @@
 package prometheus
 
 import (
+	"context"
+	"net/http"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -76,7 +85,8 @@ func TestQuerier_timeRange(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			s := newStorage(cfg)
+			s, err := newStorage(cfg)
+			require.NoError(t, err)
 
 			// Querier returns a new Querier on the storage.
 			sq, err := s.Querier(tt.mint, tt.maxt)
@@ -93,3 +103,132 @@ func TestQuerier_timeRange(t *testing.T) {
 		})
 	}
 }
+
+func newSelectQuerier(t *testing.T, url string, qlimiter limiter.ServerLimiter) *Querier {
+	cfg, _ := config.DefaultConfig()
+	cfg.ClickHouse.URL = url
+	cfg.ClickHouse.IndexTimeout = 100 * time.Millisecond
+	cfg.ClickHouse.QueryParams = []config.QueryParam{
+		{URL: url, DataTimeout: time.Second, Limiter: qlimiter},
+	}
+
+	s, err := newStorage(cfg)
+	require.NoError(t, err)
+	sq, err := s.Querier(1669453200000, 1669626000000)
+	require.NoError(t, err)
+	return sq.(*Querier)
+}
+
+func TestQuerier_Select(t *testing.T) {
+	metrics.DisableMetrics()
+	srv := clickhouse.NewTestServer()
+	defer srv.Close()
+
+	srv.AddResponce(
+		"SELECT Path FROM graphite_tagged  WHERE (Tag1='__name__=up') AND (Date >='2022-11-26' AND Date <= '2022-11-28') GROUP BY Path FORMAT TabSeparatedRaw",
+		&clickhouse.TestResponse{
+			Body: []byte("up?job=a\nup?job=b\nup?job=c\n"),
+		})
+	srv.AddResponce(
+		"SELECT Path FROM graphite_tagged  WHERE (Tag1='__name__=down') AND (Date >='2022-11-26' AND Date <= '2022-11-28') GROUP BY Path FORMAT TabSeparatedRaw",
+		&clickhouse.TestResponse{
+			Body: []byte("Code: 241. DB::Exception: Memory limit (total) exceeded"),
+			Code: http.StatusInternalServerError,
+		})
+
+	tests := []struct {
+		name    string
+		metric  string
+		limit   int
+		want    []string
+		warning string
+		wantErr func(t *testing.T, err error)
+	}{
+		{
+			name:   "series",
+			metric: "up",
+			want:   []string{"up?job=a", "up?job=b", "up?job=c"},
+		},
+		{
+			name:    "series with limit",
+			metric:  "up",
+			limit:   2,
+			want:    []string{"up?job=a", "up?job=b"},
+			warning: "results truncated due to limit 2",
+		},
+		{
+			name:   "clickhouse error",
+			metric: "down",
+			wantErr: func(t *testing.T, err error) {
+				var es promql.ErrStorage
+				assert.ErrorAs(t, err, &es)
+				assert.Contains(t, err.Error(), "Memory limit (total) exceeded")
+			},
+		},
+		{
+			name:   "query not added",
+			metric: "unknown",
+			wantErr: func(t *testing.T, err error) {
+				var es promql.ErrStorage
+				assert.ErrorAs(t, err, &es)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newSelectQuerier(t, srv.URL, limiter.NoopLimiter{})
+			hints := &storage.SelectHints{
+				Start: 1669453200000,
+				End:   1669626000000,
+				Func:  "series",
+				Limit: tt.limit,
+			}
+			ss := q.Select(context.Background(), false, hints, labels.MustNewMatcher(labels.MatchEqual, "__name__", tt.metric))
+			require.NotNil(t, ss)
+
+			var got []string
+			for ss.Next() {
+				got = append(got, ss.At().Labels().String())
+			}
+			if tt.wantErr != nil {
+				assert.False(t, ss.Next())
+				tt.wantErr(t, ss.Err())
+				return
+			}
+			require.NoError(t, ss.Err())
+
+			want := make([]string, len(tt.want))
+			for i := range tt.want {
+				want[i] = Labels(tt.want[i]).String()
+			}
+			sort.Strings(got)
+			assert.Equal(t, want, got)
+
+			if tt.warning == "" {
+				assert.Empty(t, ss.Warnings())
+			} else {
+				warnings, _ := ss.Warnings().AsStrings("", 0, 0)
+				assert.Equal(t, []string{tt.warning}, warnings)
+			}
+		})
+	}
+}
+
+func TestQuerier_SelectLimiter(t *testing.T) {
+	metrics.DisableMetrics()
+	srv := clickhouse.NewTestServer()
+	defer srv.Close()
+
+	qlimiter := limiter.NewLimiter(1, false, "", "")
+	require.NoError(t, qlimiter.Enter(context.Background(), "render"))
+	defer qlimiter.Leave(context.Background(), "render")
+
+	q := newSelectQuerier(t, srv.URL, qlimiter)
+	ss := q.Select(context.Background(), false, nil, labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"))
+	require.NotNil(t, ss)
+	assert.False(t, ss.Next())
+
+	var et promql.ErrQueryTimeout
+	assert.ErrorAs(t, ss.Err(), &et)
+	assert.Equal(t, uint64(0), srv.Queries())
+}
@@ -0,0 +1,108 @@
+//go:build !noprom
+// +build !noprom
+
+package prometheus
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/helper/tests/clickhouse"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/metrics"
+)
+
+func TestQuerier_LabelValues(t *testing.T) {
+	metrics.DisableMetrics()
+	srv := clickhouse.NewTestServer()
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		label    string
+		hints    *storage.LabelHints
+		matchers []*labels.Matcher
+		query    string
+		want     []string
+	}{
+		{
+			name:  "without matchers",
+			label: "instance",
+			query: "SELECT splitByChar('=', Tag1)[2] AS value FROM graphite_tagged  WHERE (Date >= '2022-11-26' AND Date <= '2022-11-28') AND (Tag1 LIKE 'instance=%') GROUP BY value ORDER BY value",
+			want:  []string{"host1", "host2", "host3"},
+		},
+		{
+			name:  "with matchers and limit",
+			label: "instance",
+			hints: &storage.LabelHints{Limit: 2},
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"),
+				labels.MustNewMatcher(labels.MatchEqual, "job", "node"),
+			},
+			query: "SELECT substr(arrayFilter(x -> x LIKE 'instance=%', Tags)[1], 10) AS value FROM graphite_tagged  WHERE (((Tag1='__name__=up') AND (has(Tags, 'job=node'))) AND (Date >= '2022-11-26' AND Date <= '2022-11-28')) AND (arrayExists(x -> x LIKE 'instance=%', Tags)) GROUP BY value ORDER BY value LIMIT 2",
+			want:  []string{"host1", "host2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := ""
+			for _, v := range tt.want {
+				body += v + "\n"
+			}
+			srv.AddResponce(tt.query, &clickhouse.TestResponse{Body: []byte(body)})
+
+			q := newSelectQuerier(t, srv.URL, limiter.NoopLimiter{})
+			got, _, err := q.LabelValues(context.Background(), tt.label, tt.hints, tt.matchers...)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestQuerier_LabelNames(t *testing.T) {
+	metrics.DisableMetrics()
+	srv := clickhouse.NewTestServer()
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		hints    *storage.LabelHints
+		matchers []*labels.Matcher
+		query    string
+		want     []string
+	}{
+		{
+			name:  "without matchers",
+			query: "SELECT splitByChar('=', Tag1)[1] AS value FROM graphite_tagged  WHERE Date >= '2022-11-26' AND Date <= '2022-11-28' GROUP BY value ORDER BY value",
+			want:  []string{"__name__", "instance", "job"},
+		},
+		{
+			name:  "with matchers and limit",
+			hints: &storage.LabelHints{Limit: 2},
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchEqual, "job", "node"),
+			},
+			query: "SELECT splitByChar('=', arrayJoin(Tags))[1] AS value FROM graphite_tagged  WHERE (Tag1='job=node') AND (Date >= '2022-11-26' AND Date <= '2022-11-28') GROUP BY value ORDER BY value LIMIT 2",
+			want:  []string{"__name__", "instance"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := ""
+			for _, v := range tt.want {
+				body += v + "\n"
+			}
+			srv.AddResponce(tt.query, &clickhouse.TestResponse{Body: []byte(body)})
+
+			q := newSelectQuerier(t, srv.URL, limiter.NoopLimiter{})
+			got, _, err := q.LabelNames(context.Background(), tt.hints, tt.matchers...)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,208 @@
+//go:build !noprom
+// +build !noprom
+
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/remote"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/logs"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/lomik/graphite-clickhouse/render/data"
+)
+
+const (
+	// the same defaults as in Prometheus
+	remoteReadSampleLimit  = 50000000
+	remoteReadBytesInFrame = 1048576
+)
+
+// ReadHandler serves Prometheus remote read requests with raw samples from the tagged and data tables
+type ReadHandler struct {
+	config      *config.Config
+	gate        limiter.ServerLimiter
+	marshalPool *sync.Pool
+}
+
+// NewReadHandler returns the handler for /api/v1/read, concurrent requests are limited by remote-read-concurrency-limit
+func NewReadHandler(config *config.Config) *ReadHandler {
+	return &ReadHandler{
+		config:      config,
+		gate:        limiter.NewLimiter(config.Prometheus.RemoteReadConcurrencyLimit, false, "", ""),
+		marshalPool: &sync.Pool{},
+	}
+}
+
+func (h *ReadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	accessLogger := scope.LoggerWithHeaders(r.Context(), r, h.config.Common.HeadersToLog).Named("http")
+	logger := scope.LoggerWithHeaders(r.Context(), r, h.config.Common.HeadersToLog).Named("remote-read")
+	r = r.WithContext(scope.WithLogger(r.Context(), logger))
+
+	var (
+		status        = http.StatusOK
+		queueFail     bool
+		queueDuration time.Duration
+	)
+	start := time.Now()
+	defer func() {
+		d := time.Since(start)
+		logs.AccessLog(accessLogger, h.config, r, status, d, queueDuration, false, queueFail)
+	}()
+
+	req, err := remote.DecodeReadRequest(r)
+	if err != nil {
+		status = http.StatusBadRequest
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	responseType, err := remote.NegotiateResponseType(req.AcceptedResponseTypes)
+	if err != nil {
+		status = http.StatusBadRequest
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if h.gate.Enabled() {
+		err = h.gate.Enter(r.Context(), "remote-read")
+		queueDuration = time.Since(start)
+		if err != nil {
+			status = http.StatusServiceUnavailable
+			queueFail = true
+			http.Error(w, err.Error(), status)
+			return
+		}
+		defer h.gate.Leave(r.Context(), "remote-read")
+	}
+
+	username := r.Header.Get("X-Forwarded-User")
+	switch responseType {
+	case prompb.ReadRequest_STREAMED_XOR_CHUNKS:
+		status, queueFail = h.serveStreamedXORChunks(w, r, req, username, &queueDuration)
+	default:
+		status, queueFail = h.serveSamples(w, r, req, username, &queueDuration)
+	}
+}
+
+func (h *ReadHandler) serveSamples(w http.ResponseWriter, r *http.Request, req *prompb.ReadRequest, username string, queueDuration *time.Duration) (int, bool) {
+	resp := &prompb.ReadResponse{
+		Results: make([]*prompb.QueryResult, len(req.Queries)),
+	}
+	for i, query := range req.Queries {
+		ss, err := h.query(r.Context(), query, username, queueDuration)
+		if err != nil {
+			return clickhouse.HandleError(w, err)
+		}
+		resp.Results[i], _, err = remote.ToQueryResult(ss, remoteReadSampleLimit)
+		if err != nil {
+			return remoteReadError(w, err), false
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	if err := remote.EncodeReadResponse(resp, w); err != nil {
+		return remoteReadError(w, err), false
+	}
+	return http.StatusOK, false
+}
+
+func (h *ReadHandler) serveStreamedXORChunks(w http.ResponseWriter, r *http.Request, req *prompb.ReadRequest, username string, queueDuration *time.Duration) (int, bool) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		status := http.StatusInternalServerError
+		http.Error(w, "internal http.ResponseWriter does not implement http.Flusher interface", status)
+		return status, false
+	}
+	w.Header().Set("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+
+	for i, query := range req.Queries {
+		ss, err := h.query(r.Context(), query, username, queueDuration)
+		if err != nil {
+			return clickhouse.HandleError(w, err)
+		}
+		_, err = remote.StreamChunkedReadResponses(
+			remote.NewChunkedWriter(w, f),
+			int64(i),
+			storage.NewSeriesSetToChunkSet(ss),
+			nil,
+			remoteReadBytesInFrame,
+			h.marshalPool,
+		)
+		if err != nil {
+			return remoteReadError(w, err), false
+		}
+	}
+	return http.StatusOK, false
+}
+
+// query finds series by matchers in the tagged table and fetches raw samples for them, series are sorted by labels
+func (h *ReadHandler) query(ctx context.Context, query *prompb.Query, username string, queueDuration *time.Duration) (storage.SeriesSet, error) {
+	terms, err := makeTaggedFromPromPB(query.Matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	from := query.StartTimestampMs / 1000
+	until := (query.EndTimestampMs + 999) / 1000
+	qlimiter := data.GetQueryLimiterFrom(username, h.config, from, until)
+
+	q := &Querier{config: h.config, mint: query.StartTimestampMs, maxt: query.EndTimestampMs}
+	am, err := q.lookup(ctx, from, until, qlimiter, queueDuration, terms)
+	if err != nil {
+		return nil, err
+	}
+	if am.Len() == 0 {
+		return emptySeriesSet(), nil
+	}
+
+	targets := data.NewTargets([]string{}, am)
+	targets.Raw = true
+	multiTarget := data.MultiTarget{
+		data.TimeFrame{
+			From:  from,
+			Until: until,
+		}: targets,
+	}
+	reply, err := multiTarget.Fetch(ctx, h.config, config.ContextPrometheus, qlimiter, queueDuration)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) == 0 {
+		return emptySeriesSet(), nil
+	}
+
+	// zero step: no points are added after the last stored one
+	ss, err := makeSeriesSet(reply[0].Data, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	// the streamed response requires sorted series
+	s := ss.(*seriesSet)
+	sort.Slice(s.series, func(i, j int) bool {
+		return labels.Compare(s.series[i].Labels(), s.series[j].Labels()) < 0
+	})
+
+	return s, nil
+}
+
+func remoteReadError(w http.ResponseWriter, err error) int {
+	status := http.StatusInternalServerError
+	if httpErr, ok := err.(remote.HTTPError); ok {
+		status = httpErr.Status()
+	}
+	http.Error(w, err.Error(), status)
+	return status
+}
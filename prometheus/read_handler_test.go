@@ -0,0 +1,210 @@
+//go:build !noprom
+// +build !noprom
+
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/RowBinary"
+	"github.com/lomik/graphite-clickhouse/helper/rollup"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/metrics"
+)
+
+type readPoint struct {
+	time      uint32
+	value     float64
+	timestamp uint32
+}
+
+// newReadServer answers the tagged table lookup with paths and the data table query with points for them
+func newReadServer(t *testing.T, points map[string][]readPoint) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		query := r.URL.Query().Get("query")
+		if query == "" {
+			query = string(body)
+		}
+		switch {
+		case strings.Contains(query, "FROM graphite_tagged"):
+			for path := range points {
+				io.WriteString(w, path+"\n")
+			}
+		case strings.Contains(query, "FROM graphite_data"):
+			var buf bytes.Buffer
+			enc := RowBinary.NewEncoder(&buf)
+			for path, pp := range points {
+				var (
+					times, timestamps []uint32
+					values            []float64
+				)
+				for _, p := range pp {
+					times = append(times, p.time)
+					values = append(values, p.value)
+					timestamps = append(timestamps, p.timestamp)
+				}
+				enc.String(path)
+				enc.Uint32List(times)
+				enc.Float64List(values)
+				enc.Uint32List(timestamps)
+			}
+			w.Write(buf.Bytes())
+		default:
+			t.Errorf("unexpected query: %s", query)
+			http.Error(w, "unexpected query", http.StatusInternalServerError)
+		}
+	}))
+}
+
+func readConfig(t *testing.T, url string) *config.Config {
+	cfg := config.New()
+	cfg.ClickHouse.URL = url
+	cfg.ClickHouse.TaggedTable = "graphite_tagged"
+	cfg.ClickHouse.QueryParams = []config.QueryParam{{URL: url, DataTimeout: cfg.ClickHouse.DataTimeout, Limiter: limiter.NoopLimiter{}}}
+	r, err := rollup.NewDefault(60, "avg")
+	require.NoError(t, err)
+	cfg.DataTable = []config.DataTable{
+		{
+			Table:        "graphite_data",
+			ContextMap:   map[string]bool{config.ContextPrometheus: true},
+			Rollup:       r,
+			QueryMetrics: metrics.InitQueryMetrics("graphite_data", &cfg.Metrics),
+		},
+	}
+	return cfg
+}
+
+func readRequest(t *testing.T, responseType prompb.ReadRequest_ResponseType) *http.Request {
+	req := &prompb.ReadRequest{
+		Queries: []*prompb.Query{
+			{
+				StartTimestampMs: 1669453200000,
+				EndTimestampMs:   1669453260000,
+				Matchers: []*prompb.LabelMatcher{
+					{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+				},
+			},
+		},
+		AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{responseType},
+	}
+	b, err := proto.Marshal(req)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/read", bytes.NewReader(snappy.Encode(nil, b)))
+	r.Header.Set("Content-Encoding", "snappy")
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	return r
+}
+
+func TestReadHandler(t *testing.T) {
+	metrics.DisableMetrics()
+	srv := newReadServer(t, map[string][]readPoint{
+		"up?job=a": {
+			{time: 1669453210, value: 1, timestamp: 1},
+			{time: 1669453200, value: 0, timestamp: 1},
+			// the latest version is used for the same time
+			{time: 1669453210, value: 2, timestamp: 2},
+			{time: 1669453220, value: 3, timestamp: 1},
+		},
+		"up?job=b": {
+			{time: 1669453230, value: 4, timestamp: 1},
+		},
+	})
+	defer srv.Close()
+
+	h := NewReadHandler(readConfig(t, srv.URL))
+
+	// raw samples are returned without rollup to the 60s precision
+	want := []*prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "a"}},
+			Samples: []prompb.Sample{{Timestamp: 1669453200000, Value: 0}, {Timestamp: 1669453210000, Value: 2}, {Timestamp: 1669453220000, Value: 3}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "b"}},
+			Samples: []prompb.Sample{{Timestamp: 1669453230000, Value: 4}},
+		},
+	}
+
+	t.Run("samples", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, readRequest(t, prompb.ReadRequest_SAMPLES))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		b, err := snappy.Decode(nil, w.Body.Bytes())
+		require.NoError(t, err)
+		var resp prompb.ReadResponse
+		require.NoError(t, proto.Unmarshal(b, &resp))
+		require.Len(t, resp.Results, 1)
+		assert.Equal(t, want, resp.Results[0].Timeseries)
+	})
+
+	t.Run("streamed xor chunks", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, readRequest(t, prompb.ReadRequest_STREAMED_XOR_CHUNKS))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse", w.Header().Get("Content-Type"))
+
+		var got []*prompb.TimeSeries
+		reader := remote.NewChunkedReader(w.Body, 1048576, nil)
+		for {
+			var resp prompb.ChunkedReadResponse
+			err := reader.NextProto(&resp)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			for _, s := range resp.ChunkedSeries {
+				ts := &prompb.TimeSeries{Labels: s.Labels}
+				for _, c := range s.Chunks {
+					require.Equal(t, prompb.Chunk_XOR, c.Type)
+					chk, err := chunkenc.FromData(chunkenc.EncXOR, c.Data)
+					require.NoError(t, err)
+					it := chk.Iterator(nil)
+					for it.Next() == chunkenc.ValFloat {
+						tm, v := it.At()
+						ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: tm, Value: v})
+					}
+				}
+				got = append(got, ts)
+			}
+		}
+		assert.Equal(t, want, got)
+	})
+}
+
+func TestReadHandlerConcurrencyLimit(t *testing.T) {
+	metrics.DisableMetrics()
+	cfg := readConfig(t, "http://localhost:1")
+	cfg.Prometheus.RemoteReadConcurrencyLimit = 1
+	h := NewReadHandler(cfg)
+
+	// occupy the only slot
+	require.NoError(t, h.gate.Enter(context.Background(), "test"))
+	defer h.gate.Leave(context.Background(), "test")
+
+	r := readRequest(t, prompb.ReadRequest_SAMPLES)
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Millisecond)
+	defer cancel()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r.WithContext(ctx))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
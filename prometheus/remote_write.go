@@ -0,0 +1,388 @@
+//go:build !noprom
+// +build !noprom
+
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lomik/zapwriter"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/metadata"
+	"github.com/prometheus/prometheus/storage"
+	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/RowBinary"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+var ErrWriteQueueFull = errors.New("remote write queue is full")
+
+type remoteSeries struct {
+	path string
+	tags []string
+}
+
+type remoteSample struct {
+	series    *remoteSeries
+	timestamp int64 // milliseconds
+	value     float64
+}
+
+// seriesPath builds the tagged path like name?label1=value1&label2=value2 and the list of tags for the tagged table
+func seriesPath(l labels.Labels) *remoteSeries {
+	name := l.Get(labels.MetricName)
+	s := &remoteSeries{tags: make([]string, 0, l.Len())}
+	s.tags = append(s.tags, labels.MetricName+"="+name)
+
+	var path strings.Builder
+	path.WriteString(name)
+	first := true
+	l.Range(func(lb labels.Label) {
+		if lb.Name == labels.MetricName {
+			return
+		}
+		if first {
+			path.WriteByte('?')
+			first = false
+		} else {
+			path.WriteByte('&')
+		}
+		path.WriteString(url.QueryEscape(lb.Name))
+		path.WriteByte('=')
+		path.WriteString(url.QueryEscape(lb.Value))
+		s.tags = append(s.tags, lb.Name+"="+lb.Value)
+	})
+	s.path = path.String()
+
+	return s
+}
+
+type remoteBatch struct {
+	samples []remoteSample
+	timer   *time.Timer
+	done    chan struct{}
+	err     error
+}
+
+// remoteWriter collects samples from concurrent appenders into batches and inserts them to ClickHouse
+type remoteWriter struct {
+	config *config.Config
+	table  string
+	queue  *semaphore.Weighted
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	current *remoteBatch
+
+	// series, already written to the tagged table today
+	seriesMu  sync.Mutex
+	seriesDay uint16
+	series    map[string]struct{}
+}
+
+func newRemoteWriter(cfg *config.Config) (*remoteWriter, error) {
+	rw := cfg.Prometheus.RemoteWrite
+	if rw.BatchSize <= 0 || rw.QueueSize <= 0 {
+		return nil, fmt.Errorf("remote write: batch-size and queue-size must be positive")
+	}
+	if cfg.ClickHouse.TaggedTable == "" {
+		return nil, fmt.Errorf("remote write: tagged-table is not set")
+	}
+
+	w := &remoteWriter{
+		config: cfg,
+		queue:  semaphore.NewWeighted(int64(rw.QueueSize)),
+		logger: zapwriter.Logger("remote-write"),
+		series: make(map[string]struct{}),
+	}
+	for i := range cfg.DataTable {
+		if cfg.DataTable[i].ContextMap[config.ContextPrometheus] && !cfg.DataTable[i].Reverse {
+			w.table = cfg.DataTable[i].Table
+			break
+		}
+	}
+	if w.table == "" {
+		return nil, fmt.Errorf("remote write: data-table with prometheus context is not found")
+	}
+
+	return w, nil
+}
+
+// push adds samples to the current batch and waits until the batch is written
+func (w *remoteWriter) push(ctx context.Context, samples []remoteSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	rw := w.config.Prometheus.RemoteWrite
+
+	n := int64(len(samples))
+	if n > int64(rw.QueueSize) {
+		n = int64(rw.QueueSize)
+	}
+	queueCtx, cancel := context.WithTimeout(ctx, rw.QueueTimeout)
+	err := w.queue.Acquire(queueCtx, n)
+	cancel()
+	if err != nil {
+		return ErrWriteQueueFull
+	}
+	defer w.queue.Release(n)
+
+	w.mu.Lock()
+	b := w.current
+	if b == nil {
+		b = &remoteBatch{done: make(chan struct{})}
+		b.timer = time.AfterFunc(rw.FlushInterval, func() { w.flush(b) })
+		w.current = b
+	}
+	b.samples = append(b.samples, samples...)
+	full := len(b.samples) >= rw.BatchSize
+	if full {
+		w.current = nil
+	}
+	w.mu.Unlock()
+
+	if full {
+		b.timer.Stop()
+		w.write(b)
+	}
+
+	select {
+	case <-b.done:
+		return b.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush writes the batch by the flush-interval timer, if it's not written yet
+func (w *remoteWriter) flush(b *remoteBatch) {
+	w.mu.Lock()
+	if w.current != b {
+		w.mu.Unlock()
+		return
+	}
+	w.current = nil
+	w.mu.Unlock()
+
+	w.write(b)
+}
+
+func (w *remoteWriter) write(b *remoteBatch) {
+	defer close(b.done)
+
+	rw := w.config.Prometheus.RemoteWrite
+	ctx, cancel := context.WithTimeout(context.Background(), rw.Timeout)
+	defer cancel()
+	opts := clickhouse.Options{
+		TLSConfig:      w.config.ClickHouse.TLSConfig,
+		Timeout:        rw.Timeout,
+		ConnectTimeout: w.config.ClickHouse.ConnectTimeout,
+	}
+
+	version := uint32(time.Now().Unix())
+	taggedBody, newSeries, err := w.encodeSeries(b.samples, version)
+	if err != nil {
+		b.err = err
+		return
+	}
+	if len(newSeries) > 0 {
+		_, _, _, b.err = clickhouse.Post(
+			scope.New(ctx).WithLogger(w.logger).WithTable(w.config.ClickHouse.TaggedTable),
+			w.config.ClickHouse.URL,
+			"INSERT INTO "+w.config.ClickHouse.TaggedTable+" (Date,Version,Path,Tags,Tag1) FORMAT RowBinary",
+			taggedBody,
+			opts,
+			nil,
+		)
+		if b.err != nil {
+			return
+		}
+	}
+
+	dataBody, err := encodeSamples(b.samples, version)
+	if err != nil {
+		b.err = err
+		return
+	}
+	_, _, _, b.err = clickhouse.Post(
+		scope.New(ctx).WithLogger(w.logger).WithTable(w.table),
+		w.config.ClickHouse.URL,
+		"INSERT INTO "+w.table+" (Path,Value,Time,Date,Timestamp) FORMAT RowBinary",
+		dataBody,
+		opts,
+		nil,
+	)
+	if b.err != nil {
+		return
+	}
+
+	w.seriesMu.Lock()
+	for _, key := range newSeries {
+		w.series[key] = struct{}{}
+	}
+	w.seriesMu.Unlock()
+}
+
+// encodeSeries encodes series, not written to the tagged table today, in the same layout as tagger does: the series row is repeated for every tag with Tag1
+func (w *remoteWriter) encodeSeries(samples []remoteSample, version uint32) (*bytes.Buffer, []string, error) {
+	today := RowBinary.DateToUint16(time.Now())
+
+	w.seriesMu.Lock()
+	if w.seriesDay != today {
+		w.seriesDay = today
+		w.series = make(map[string]struct{})
+	}
+	var newSeries []string
+	seen := make(map[string]*remoteSeries)
+	for i := range samples {
+		key := samples[i].series.path
+		if _, ok := w.series[key]; ok {
+			continue
+		}
+		if _, ok := seen[key]; !ok {
+			seen[key] = samples[i].series
+			newSeries = append(newSeries, key)
+		}
+	}
+	w.seriesMu.Unlock()
+
+	sort.Strings(newSeries)
+
+	body := new(bytes.Buffer)
+	encoder := RowBinary.NewEncoder(body)
+	seriesBuffer := new(bytes.Buffer)
+	seriesEncoder := RowBinary.NewEncoder(seriesBuffer)
+	for _, key := range newSeries {
+		s := seen[key]
+		seriesBuffer.Reset()
+
+		// Date
+		if err := seriesEncoder.Uint16(today); err != nil {
+			return nil, nil, err
+		}
+		// Version
+		if err := seriesEncoder.Uint32(version); err != nil {
+			return nil, nil, err
+		}
+		// Path
+		if err := seriesEncoder.String(s.path); err != nil {
+			return nil, nil, err
+		}
+		// Tags
+		if err := seriesEncoder.StringList(s.tags); err != nil {
+			return nil, nil, err
+		}
+
+		for _, tag := range s.tags {
+			if _, err := body.Write(seriesBuffer.Bytes()); err != nil {
+				return nil, nil, err
+			}
+			// Tag1
+			if err := encoder.String(tag); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return body, newSeries, nil
+}
+
+// encodeSamples encodes samples for the data table
+func encodeSamples(samples []remoteSample, version uint32) (*bytes.Buffer, error) {
+	body := new(bytes.Buffer)
+	body.Grow(len(samples) * 64)
+	encoder := RowBinary.NewEncoder(body)
+	for i := range samples {
+		t := time.UnixMilli(samples[i].timestamp)
+		// Path
+		if err := encoder.String(samples[i].series.path); err != nil {
+			return nil, err
+		}
+		// Value
+		if err := encoder.Float64(samples[i].value); err != nil {
+			return nil, err
+		}
+		// Time
+		if err := encoder.Uint32(uint32(t.Unix())); err != nil {
+			return nil, err
+		}
+		// Date
+		if err := encoder.Uint16(RowBinary.DateToUint16(t)); err != nil {
+			return nil, err
+		}
+		// Timestamp
+		if err := encoder.Uint32(version); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// appender collects samples of one remote write request, they are written on Commit
+type appender struct {
+	ctx     context.Context
+	writer  *remoteWriter
+	series  []*remoteSeries
+	samples []remoteSample
+}
+
+var _ storage.Appender = &appender{}
+
+// Append adds a sample. Returned reference is valid only within the appender
+func (a *appender) Append(ref storage.SeriesRef, l labels.Labels, t int64, v float64) (storage.SeriesRef, error) {
+	if ref == 0 || int(ref) > len(a.series) {
+		a.series = append(a.series, seriesPath(l))
+		ref = storage.SeriesRef(len(a.series))
+	}
+	a.samples = append(a.samples, remoteSample{series: a.series[ref-1], timestamp: t, value: v})
+	return ref, nil
+}
+
+// Commit writes the collected samples and waits for the insert
+func (a *appender) Commit() error {
+	err := a.writer.push(a.ctx, a.samples)
+	a.series = nil
+	a.samples = nil
+	return err
+}
+
+// Rollback drops the collected samples
+func (a *appender) Rollback() error {
+	a.series = nil
+	a.samples = nil
+	return nil
+}
+
+// AppendExemplar is not supported, exemplars are dropped
+func (a *appender) AppendExemplar(ref storage.SeriesRef, l labels.Labels, e exemplar.Exemplar) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+// AppendHistogram is not supported, native histograms are dropped
+func (a *appender) AppendHistogram(ref storage.SeriesRef, l labels.Labels, t int64, h *histogram.Histogram, fh *histogram.FloatHistogram) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+// UpdateMetadata is not supported, metadata is dropped
+func (a *appender) UpdateMetadata(ref storage.SeriesRef, l labels.Labels, m metadata.Metadata) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+// AppendCTZeroSample is not supported, created timestamps are dropped
+func (a *appender) AppendCTZeroSample(ref storage.SeriesRef, l labels.Labels, t, ct int64) (storage.SeriesRef, error) {
+	return ref, nil
+}
@@ -0,0 +1,180 @@
+//go:build !noprom
+// +build !noprom
+
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/RowBinary"
+)
+
+func Test_seriesPath(t *testing.T) {
+	tests := []struct {
+		labels   labels.Labels
+		wantPath string
+		wantTags []string
+	}{
+		{
+			labels:   labels.FromStrings("__name__", "up"),
+			wantPath: "up",
+			wantTags: []string{"__name__=up"},
+		},
+		{
+			labels:   labels.FromStrings("__name__", "http_requests_total", "job", "api server", "code", "200"),
+			wantPath: "http_requests_total?code=200&job=api+server",
+			wantTags: []string{"__name__=http_requests_total", "code=200", "job=api server"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wantPath, func(t *testing.T) {
+			s := seriesPath(tt.labels)
+			assert.Equal(t, tt.wantPath, s.path)
+			assert.Equal(t, tt.wantTags, s.tags)
+			assert.Equal(t, tt.labels, Labels(s.path))
+		})
+	}
+}
+
+type insertRequest struct {
+	query string
+	body  []byte
+}
+
+func newInsertServer() (*httptest.Server, func() []insertRequest) {
+	var (
+		lock     sync.Mutex
+		requests []insertRequest
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		requests = append(requests, insertRequest{query: r.URL.Query().Get("query"), body: body})
+		lock.Unlock()
+	}))
+	return srv, func() []insertRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests
+	}
+}
+
+func remoteWriteConfig(url string) *config.Config {
+	cfg := config.New()
+	cfg.ClickHouse.URL = url
+	cfg.ClickHouse.TaggedTable = "graphite_tagged"
+	cfg.DataTable = []config.DataTable{
+		{Table: "graphite_reverse", Reverse: true, ContextMap: map[string]bool{config.ContextPrometheus: true}},
+		{Table: "graphite_data", ContextMap: map[string]bool{config.ContextPrometheus: true}},
+	}
+	cfg.Prometheus.RemoteWrite.Enabled = true
+	cfg.Prometheus.RemoteWrite.FlushInterval = 10 * time.Millisecond
+	return cfg
+}
+
+func TestRemoteWrite(t *testing.T) {
+	srv, requests := newInsertServer()
+	defer srv.Close()
+
+	s, err := newStorage(remoteWriteConfig(srv.URL))
+	require.NoError(t, err)
+
+	ts := time.Now().Truncate(time.Second)
+	l := labels.FromStrings("__name__", "up", "job", "node")
+
+	app := s.Appender(context.Background())
+	ref, err := app.Append(0, l, ts.UnixMilli(), 1)
+	require.NoError(t, err)
+	_, err = app.Append(ref, l, ts.Add(time.Second).UnixMilli(), 0)
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+
+	reqs := requests()
+	require.Len(t, reqs, 2)
+	assert.Equal(t, "INSERT INTO graphite_tagged (Date,Version,Path,Tags,Tag1) FORMAT RowBinary", reqs[0].query)
+	assert.Equal(t, "INSERT INTO graphite_data (Path,Value,Time,Date,Timestamp) FORMAT RowBinary", reqs[1].query)
+
+	// series row is repeated for every tag
+	var series bytes.Buffer
+	enc := RowBinary.NewEncoder(&series)
+	enc.Uint16(RowBinary.DateToUint16(time.Now()))
+	version := reqs[0].body[2:6]
+	series.Write(version)
+	enc.String("up?job=node")
+	enc.StringList([]string{"__name__=up", "job=node"})
+	var tagged bytes.Buffer
+	enc = RowBinary.NewEncoder(&tagged)
+	tagged.Write(series.Bytes())
+	enc.String("__name__=up")
+	tagged.Write(series.Bytes())
+	enc.String("job=node")
+	assert.Equal(t, tagged.Bytes(), reqs[0].body)
+
+	var data bytes.Buffer
+	enc = RowBinary.NewEncoder(&data)
+	for i, v := range []float64{1, 0} {
+		pt := ts.Add(time.Duration(i) * time.Second)
+		enc.String("up?job=node")
+		enc.Float64(v)
+		enc.Uint32(uint32(pt.Unix()))
+		enc.Uint16(RowBinary.DateToUint16(pt))
+		data.Write(version)
+	}
+	assert.Equal(t, data.Bytes(), reqs[1].body)
+
+	// known series is not written to the tagged table again
+	app = s.Appender(context.Background())
+	_, err = app.Append(0, l, ts.Add(2*time.Second).UnixMilli(), 1)
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+
+	reqs = requests()
+	require.Len(t, reqs, 3)
+	assert.Equal(t, "INSERT INTO graphite_data (Path,Value,Time,Date,Timestamp) FORMAT RowBinary", reqs[2].query)
+}
+
+func TestRemoteWriteQueueFull(t *testing.T) {
+	srv, requests := newInsertServer()
+	defer srv.Close()
+
+	cfg := remoteWriteConfig(srv.URL)
+	cfg.Prometheus.RemoteWrite.QueueSize = 2
+	cfg.Prometheus.RemoteWrite.QueueTimeout = 10 * time.Millisecond
+	s, err := newStorage(cfg)
+	require.NoError(t, err)
+
+	// occupy the queue
+	require.NoError(t, s.writer.queue.Acquire(context.Background(), 2))
+
+	app := s.Appender(context.Background())
+	_, err = app.Append(0, labels.FromStrings("__name__", "up"), time.Now().UnixMilli(), 1)
+	require.NoError(t, err)
+	assert.ErrorIs(t, app.Commit(), ErrWriteQueueFull)
+	assert.Empty(t, requests())
+
+	s.writer.queue.Release(2)
+}
+
+func TestRemoteWriteConfig(t *testing.T) {
+	cfg := remoteWriteConfig("http://localhost:8123")
+	cfg.DataTable = cfg.DataTable[:1]
+	_, err := newStorage(cfg)
+	assert.Error(t, err)
+
+	cfg = remoteWriteConfig("http://localhost:8123")
+	cfg.ClickHouse.TaggedTable = ""
+	_, err = newStorage(cfg)
+	assert.Error(t, err)
+}
@@ -33,7 +33,10 @@ func Run(config *config.Config) error {
 		z: zapwriter.Logger("prometheus"),
 	}
 
-	storage := newStorage(config)
+	storage, err := newStorage(config)
+	if err != nil {
+		return err
+	}
 
 	corsOrigin, err := regexp.Compile("^$")
 	if err != nil {
@@ -78,6 +81,8 @@ func Run(config *config.Config) error {
 		PageTitle:                  config.Prometheus.PageTitle,
 		LookbackDelta:              config.Prometheus.LookbackDelta,
 		RemoteReadConcurrencyLimit: config.Prometheus.RemoteReadConcurrencyLimit,
+		EnableRemoteWriteReceiver:  config.Prometheus.RemoteWrite.Enabled,
+		AcceptRemoteWriteProtoMsgs: []promConfig.RemoteWriteProtoMsg{promConfig.RemoteWriteProtoMsgV1},
 	})
 
 	promHandler.ApplyConfig(&promConfig.Config{})
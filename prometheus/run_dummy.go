@@ -4,9 +4,15 @@
 package prometheus
 
 import (
+	"net/http"
+
 	"github.com/lomik/graphite-clickhouse/config"
 )
 
 func Run(config *config.Config) error {
 	return nil
 }
+
+func NewReadHandler(config *config.Config) http.Handler {
+	return http.NotFoundHandler()
+}
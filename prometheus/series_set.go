@@ -34,14 +34,15 @@ type series struct {
 
 // SeriesSet contains a set of series.
 type seriesSet struct {
-	series  []series
-	current int
+	series   []series
+	current  int
+	warnings annotations.Annotations
 }
 
 var _ storage.SeriesSet = &seriesSet{}
 
-func makeSeriesSet(data *data.Data, step int64) (storage.SeriesSet, error) {
-	ss := &seriesSet{series: make([]series, 0), current: -1}
+func makeSeriesSet(data *data.Data, step int64, warnings annotations.Annotations) (storage.SeriesSet, error) {
+	ss := &seriesSet{series: make([]series, 0), current: -1, warnings: warnings}
 	if data == nil {
 		return ss, nil
 	}
@@ -77,7 +78,7 @@ func emptySeriesSet() storage.SeriesSet {
 // Seek advances the iterator forward to the value at or after
 // the given timestamp.
 func (sit *seriesIterator) Seek(t int64) chunkenc.ValueType {
-	tt := uint32(t / 1000)
+	tt := t / 1000
 	if t%1000 != 0 {
 		tt++
 	}
@@ -97,14 +98,14 @@ func (sit *seriesIterator) Seek(t int64) chunkenc.ValueType {
 func (sit *seriesIterator) At() (t int64, v float64) {
 	index := sit.current
 	if index == len(sit.points) {
-		return int64(sit.points[len(sit.points)-1].Time)*1000 + sit.step, math.NaN()
+		return sit.points[len(sit.points)-1].Time*1000 + sit.step, math.NaN()
 	}
 	if index < 0 || index >= len(sit.points) {
 		index = 0
 	}
 	p := sit.points[index]
 	// sit.logger().Debug("seriesIterator.At", zap.Int64("t", int64(p.Time)*1000), zap.Float64("v", p.Value))
-	return int64(p.Time) * 1000, p.Value
+	return p.Time * 1000, p.Value
 }
 
 // AtHistogram returns the current timestamp/value pair if the value is
@@ -173,9 +174,9 @@ func (ss *seriesSet) Next() bool {
 	return true
 }
 
-// Warnings ...
+// Warnings returns warnings, collected during the query
 func (s *seriesSet) Warnings() annotations.Annotations {
-	return nil
+	return s.warnings
 }
 
 // Iterator returns a new iterator of the data of the series.
@@ -12,12 +12,20 @@ import (
 
 type storageImpl struct {
 	config *config.Config
+	writer *remoteWriter
 }
 
 var _ storage.Storage = &storageImpl{}
 
-func newStorage(config *config.Config) *storageImpl {
-	return &storageImpl{config: config}
+func newStorage(config *config.Config) (*storageImpl, error) {
+	s := &storageImpl{config: config}
+	if config.Prometheus.RemoteWrite.Enabled {
+		var err error
+		if s.writer, err = newRemoteWriter(config); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 // Querier returns a new Querier on the storage.
@@ -34,9 +42,12 @@ func (s *storageImpl) ChunkQuerier(mint, maxt int64) (storage.ChunkQuerier, erro
 	return nil, nil
 }
 
-// Appender ...
+// Appender returns the appender for remote write receiver, nil if remote write is disabled
 func (s *storageImpl) Appender(ctx context.Context) storage.Appender {
-	return nil
+	if s.writer == nil {
+		return nil
+	}
+	return &appender{ctx: ctx, writer: s.writer}
 }
 
 // StartTime ...
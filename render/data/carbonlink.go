@@ -45,10 +45,11 @@ func setCarbonlinkClient(config *config.Carbonlink) {
 	return
 }
 
-// queryCarbonlink returns callable result fetcher
-func queryCarbonlink(parentCtx context.Context, carbonlink *carbonlinkClient, metrics []string) func() *point.Points {
+// queryCarbonlink returns callable result fetcher. Carbonlink returns timestamps in seconds, they are multiplied by
+// timeUnit to match points of the table
+func queryCarbonlink(parentCtx context.Context, carbonlink *carbonlinkClient, metrics []string, timeUnit int64) func() *point.Points {
 	logger := scope.Logger(parentCtx)
-	if carbonlink == nil {
+	if carbonlink == nil || scope.DryRun(parentCtx) {
 		return func() *point.Points { return nil }
 	}
 
@@ -77,7 +78,7 @@ func queryCarbonlink(parentCtx context.Context, carbonlink *carbonlinkClient, me
 			for metric, points := range res {
 				metricID := result.MetricID(metric)
 				for _, p := range points {
-					result.AppendPoint(metricID, p.Value, uint32(p.Timestamp), tm)
+					result.AppendPoint(metricID, p.Value, p.Timestamp*timeUnit, tm)
 				}
 			}
 		}
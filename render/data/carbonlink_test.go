@@ -56,7 +56,7 @@ func TestQueryCarbonlink(t *testing.T) {
 	carbonlink = &carbonlinkClient{testGrCarbonlinkClient, time.Duration(0)}
 
 	now := uint32(time.Now().Unix())
-	points := queryCarbonlink(context.Background(), carbonlink, metrics)()
+	points := queryCarbonlink(context.Background(), carbonlink, metrics, 1)()
 	// Result points.metrics are not ordered
 	pMetrics := []string{points.MetricName(1), points.MetricName(2)}
 	i := 0
@@ -65,7 +65,7 @@ func TestQueryCarbonlink(t *testing.T) {
 			// There is a tiny chance that point will have greated Timestamp than now. Here we test it's at most the next second
 			assert.GreaterOrEqual(t, uint32(1), (points.List()[i].Timestamp - now), "difference between now and point.Timestamp is greater than 1")
 
-			expectedPoint := point.Point{MetricID: points.MetricID(m), Value: dp.Value, Time: uint32(dp.Timestamp), Timestamp: points.List()[i].Timestamp}
+			expectedPoint := point.Point{MetricID: points.MetricID(m), Value: dp.Value, Time: dp.Timestamp, Timestamp: points.List()[i].Timestamp}
 			assert.Equal(t, expectedPoint, points.List()[i], "point is not correct")
 			i++
 		}
@@ -75,6 +75,6 @@ func TestQueryCarbonlink(t *testing.T) {
 	assert.Equal(t, metrics, pMetrics, "sorted points.metrics is not the same as in request")
 
 	carbonlink = nil
-	emptyPoints := queryCarbonlink(context.Background(), carbonlink, metrics)()
+	emptyPoints := queryCarbonlink(context.Background(), carbonlink, metrics, 1)()
 	assert.Nil(t, emptyPoints, "points are not nil")
 }
@@ -18,6 +18,11 @@ type CHResponse struct {
 	// if true, return points for all metrics, replacing empty results with list of NaN
 	AppendOutEmptySeries bool
 	AppliedFunctions     map[string][]string
+	// MaxDataPoints is set when the step is not adjusted by ClickHouse, so the values should be consolidated
+	// by formatters supporting it
+	MaxDataPoints int64
+	// HighPrecisionTimestamps is set when From, Until, steps and points are in milliseconds
+	HighPrecisionTimestamps bool
 }
 
 // CHResponses is a slice of CHResponse
@@ -32,8 +37,7 @@ func (c *CHResponse) ToMultiFetchResponseV2() (*v2pb.MultiFetchResponse, error)
 	data := c.Data
 
 	addResponse := func(name string, step uint32, points []point.Point) error {
-		from, until := uint32(c.From), uint32(c.Until)
-		start, stop, count, getValue := point.FillNulls(points, from, until, step)
+		start, stop, count, getValue := point.FillNulls(points, c.From, c.Until, int64(step))
 		values := make([]float64, 0, count)
 		isAbsent := make([]bool, 0, count)
 		for {
@@ -117,9 +121,8 @@ func (cc *CHResponses) ToMultiFetchResponseV2() (*v2pb.MultiFetchResponse, error
 func (c *CHResponse) ToMultiFetchResponseV3() (*v3pb.MultiFetchResponse, error) {
 	mfr := &v3pb.MultiFetchResponse{Metrics: make([]v3pb.FetchResponse, 0)}
 	data := c.Data
-	addResponse := func(name, function string, step uint32, points []point.Point) error {
-		from, until := uint32(c.From), uint32(c.Until)
-		start, stop, count, getValue := point.FillNulls(points, from, until, step)
+	addResponse := func(name, function string, xFilesFactor float32, step uint32, points []point.Point) error {
+		start, stop, count, getValue := point.FillNulls(points, c.From, c.Until, int64(step))
 		values := make([]float64, 0, count)
 		for {
 			value, err := getValue()
@@ -137,11 +140,11 @@ func (c *CHResponse) ToMultiFetchResponseV3() (*v3pb.MultiFetchResponse, error)
 				Name:                    a.DisplayName,
 				PathExpression:          a.Target,
 				ConsolidationFunc:       function,
-				StartTime:               int64(start),
-				StopTime:                int64(stop),
+				StartTime:               start,
+				StopTime:                stop,
 				StepTime:                int64(step),
-				XFilesFactor:            0,
-				HighPrecisionTimestamps: false,
+				XFilesFactor:            xFilesFactor,
+				HighPrecisionTimestamps: c.HighPrecisionTimestamps,
 				Values:                  values,
 				AppliedFunctions:        c.AppliedFunctions[a.Target],
 				RequestStartTime:        c.From,
@@ -171,7 +174,9 @@ func (c *CHResponse) ToMultiFetchResponseV3() (*v3pb.MultiFetchResponse, error)
 		if err != nil {
 			return nil, err
 		}
-		if err := addResponse(name, consolidationFunc, step, points); err != nil {
+		// xFilesFactor is optional, it's 0 when it isn't set
+		xFilesFactor, _ := data.GetXFilesFactor(id)
+		if err := addResponse(name, consolidationFunc, xFilesFactor, step, points); err != nil {
 			return nil, err
 		}
 	}
@@ -179,7 +184,7 @@ func (c *CHResponse) ToMultiFetchResponseV3() (*v3pb.MultiFetchResponse, error)
 	if c.AppendOutEmptySeries && len(writtenMetrics) < data.AM.Len() && data.CommonStep > 0 {
 		for _, metricName := range data.AM.Series(false) {
 			if _, done := writtenMetrics[metricName]; !done {
-				err := addResponse(metricName, "any", uint32(data.CommonStep), []point.Point{})
+				err := addResponse(metricName, "any", 0, uint32(data.CommonStep), []point.Point{})
 				if err != nil {
 					return nil, err
 				}
@@ -0,0 +1,262 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/lomik/graphite-clickhouse/helper/RowBinary"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+)
+
+// chResponseCacheVersion is increased on any incompatible change of the cached CHResponse layout
+const chResponseCacheVersion uint8 = 3
+
+// ErrCachedResponse is returned when the cached body could not be decoded to CHResponse
+var ErrCachedResponse = errors.New("malformed cached response")
+
+// Bytes encodes CHResponse to the binary form for storing in the render cache.
+// The layout is:
+//   - version, From, Until, CommonStep, AppendOutEmptySeries, HighPrecisionTimestamps
+//   - AppliedFunctions: target -> list of functions
+//   - AM: metric -> list of (Target, DisplayName)
+//   - metrics from Points with step, aggregating function and xFilesFactor
+//   - points
+func (c *CHResponse) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	data := c.Data
+	buf.Grow(data.Len()*24 + data.AM.Len()*64)
+	w := RowBinary.NewEncoder(&buf)
+
+	w.Uint8(chResponseCacheVersion)
+	w.Uint64(uint64(c.From))
+	w.Uint64(uint64(c.Until))
+	w.Uint64(uint64(data.CommonStep))
+	if c.AppendOutEmptySeries {
+		w.Uint8(1)
+	} else {
+		w.Uint8(0)
+	}
+	if c.HighPrecisionTimestamps {
+		w.Uint8(1)
+	} else {
+		w.Uint8(0)
+	}
+
+	w.Uint32(uint32(len(c.AppliedFunctions)))
+	for target, functions := range c.AppliedFunctions {
+		w.String(target)
+		w.StringList(functions)
+	}
+
+	series := data.AM.Series(false)
+	w.Uint32(uint32(len(series)))
+	for _, metric := range series {
+		w.String(metric)
+		values := data.AM.Get(metric)
+		w.Uint32(uint32(len(values)))
+		for _, v := range values {
+			w.String(v.Target)
+			w.String(v.DisplayName)
+		}
+	}
+
+	// metric IDs start from 1 and are sequential
+	var metricsCount uint32
+	for data.MetricName(metricsCount+1) != "" {
+		metricsCount++
+	}
+	w.Uint32(metricsCount)
+	for id := uint32(1); id <= metricsCount; id++ {
+		w.String(data.MetricName(id))
+		step, _ := data.Points.GetStep(id)
+		w.Uint32(step)
+		function, _ := data.Points.GetAggregation(id)
+		w.String(function)
+		xFilesFactor, _ := data.Points.GetXFilesFactor(id)
+		w.Uint32(math.Float32bits(xFilesFactor))
+	}
+
+	list := data.List()
+	w.Uint32(uint32(len(list)))
+	for i := range list {
+		w.Uint32(list[i].MetricID)
+		w.Uint64(uint64(list[i].Time))
+		w.Float64(list[i].Value)
+		if err := w.Uint32(list[i].Timestamp); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// cacheDecoder reads values written by RowBinary.Encoder and remembers the first error
+type cacheDecoder struct {
+	body []byte
+	err  error
+}
+
+func (d *cacheDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.body) < n {
+		d.err = ErrCachedResponse
+		return nil
+	}
+	b := d.body[:n]
+	d.body = d.body[n:]
+	return b
+}
+
+func (d *cacheDecoder) uint8() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *cacheDecoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *cacheDecoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *cacheDecoder) float64() float64 {
+	return math.Float64frombits(d.uint64())
+}
+
+// check validates the length of the next value, every item takes at least one byte of the rest of the body
+func (d *cacheDecoder) check(l uint64) int {
+	if d.err != nil {
+		return 0
+	}
+	if l > uint64(len(d.body)) {
+		d.err = ErrCachedResponse
+		return 0
+	}
+	return int(l)
+}
+
+// count reads the count of the next items
+func (d *cacheDecoder) count() uint32 {
+	return uint32(d.check(uint64(d.uint32())))
+}
+
+// length reads the uvarint length of the next value
+func (d *cacheDecoder) length() int {
+	if d.err != nil {
+		return 0
+	}
+	l, n, err := clickhouse.ReadUvarint(d.body)
+	if err != nil {
+		d.err = ErrCachedResponse
+		return 0
+	}
+	d.body = d.body[n:]
+	return d.check(l)
+}
+
+func (d *cacheDecoder) string() string {
+	return string(d.next(d.length()))
+}
+
+func (d *cacheDecoder) stringList() []string {
+	l := d.length()
+	if d.err != nil {
+		return nil
+	}
+	list := make([]string, 0, l)
+	for i := 0; i < l && d.err == nil; i++ {
+		list = append(list, d.string())
+	}
+	return list
+}
+
+// NewCachedCHResponse decodes CHResponse from the body, produced by CHResponse.Bytes
+func NewCachedCHResponse(body []byte) (CHResponse, error) {
+	d := &cacheDecoder{body: body}
+
+	if d.uint8() != chResponseCacheVersion {
+		return CHResponse{}, ErrCachedResponse
+	}
+
+	c := CHResponse{
+		Data: &Data{Points: point.NewPoints(), AM: alias.New()},
+	}
+	c.From = int64(d.uint64())
+	c.Until = int64(d.uint64())
+	c.Data.CommonStep = int64(d.uint64())
+	c.AppendOutEmptySeries = d.uint8() == 1
+	c.HighPrecisionTimestamps = d.uint8() == 1
+
+	n := d.count()
+	if n > 0 {
+		c.AppliedFunctions = make(map[string][]string, n)
+	}
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		target := d.string()
+		c.AppliedFunctions[target] = d.stringList()
+	}
+
+	n = d.count()
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		metric := d.string()
+		valuesCount := d.count()
+		values := make([]alias.Value, 0, valuesCount)
+		for j := uint32(0); j < valuesCount && d.err == nil; j++ {
+			values = append(values, alias.Value{Target: d.string(), DisplayName: d.string()})
+		}
+		c.Data.AM.Add(metric, values...)
+	}
+
+	n = d.count()
+	steps := make(map[uint32][]string)
+	aggregations := make(map[string][]string)
+	xFilesFactors := make(map[float32][]string)
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		metric := d.string()
+		c.Data.Points.MetricID(metric)
+		if step := d.uint32(); step > 0 {
+			steps[step] = append(steps[step], metric)
+		}
+		if function := d.string(); function != "" {
+			aggregations[function] = append(aggregations[function], metric)
+		}
+		if xff := math.Float32frombits(d.uint32()); xff > 0 {
+			xFilesFactors[xff] = append(xFilesFactors[xff], metric)
+		}
+	}
+	c.Data.Points.SetSteps(steps)
+	c.Data.Points.SetAggregations(aggregations)
+	c.Data.Points.SetXFilesFactors(xFilesFactors)
+
+	n = d.count()
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		id := d.uint32()
+		time := int64(d.uint64())
+		value := d.float64()
+		c.Data.Points.AppendPoint(id, value, time, d.uint32())
+	}
+
+	if d.err != nil {
+		return CHResponse{}, d.err
+	}
+	if len(d.body) != 0 {
+		return CHResponse{}, ErrCachedResponse
+	}
+
+	return c, nil
+}
@@ -0,0 +1,144 @@
+package data
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+)
+
+func TestCHResponseCache(t *testing.T) {
+	am := alias.New()
+	am.Add("test.metric1", alias.Value{Target: "test.*", DisplayName: "test.metric1"})
+	am.Add("test.metric2", alias.Value{Target: "test.*", DisplayName: "test.metric2"}, alias.Value{Target: "*.metric2", DisplayName: "test.metric2"})
+	am.Add("test.metric3", alias.Value{Target: "test.*", DisplayName: "test.metric3"})
+
+	pp := point.NewPoints()
+	id1 := pp.MetricID("test.metric1")
+	id2 := pp.MetricID("test.metric2")
+	pp.AppendPoint(id1, 1.5, 1688990040, 1688990041)
+	pp.AppendPoint(id1, 2.5, 1688990100, 1688990101)
+	pp.AppendPoint(id2, 3, 1688990040, 1688990042)
+	pp.SetSteps(map[uint32][]string{60: {"test.metric1"}, 120: {"test.metric2"}})
+	pp.SetAggregations(map[string][]string{"avg": {"test.metric1"}, "anyLast": {"test.metric2"}})
+	pp.SetXFilesFactors(map[float32][]string{0.5: {"test.metric2"}})
+
+	hpp := point.NewPoints()
+	hpp.AppendPoint(hpp.MetricID("test.metric1"), 1.5, 1688990040500, 1688990041)
+
+	tests := []struct {
+		name string
+		in   CHResponse
+	}{
+		{
+			name: "empty",
+			in:   CHResponse{Data: &Data{Points: point.NewPoints(), AM: alias.New()}, From: 1, Until: 2},
+		},
+		{
+			name: "points with steps",
+			in: CHResponse{
+				Data:             &Data{Points: pp, AM: am},
+				From:             1688990000,
+				Until:            1688990460,
+				AppliedFunctions: map[string][]string{"test.*": {"consolidateBy"}},
+			},
+		},
+		{
+			name: "points with common step",
+			in: CHResponse{
+				Data:                 &Data{Points: pp, AM: am, CommonStep: 60},
+				From:                 1688990000,
+				Until:                1688990460,
+				AppendOutEmptySeries: true,
+			},
+		},
+		{
+			name: "points in milliseconds",
+			in: CHResponse{
+				Data:                    &Data{Points: hpp, AM: am, CommonStep: 500},
+				From:                    1688990000000,
+				Until:                   1688990460999,
+				HighPrecisionTimestamps: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := tt.in.Bytes()
+			require.NoError(t, err)
+
+			got, err := NewCachedCHResponse(body)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.in.From, got.From)
+			assert.Equal(t, tt.in.Until, got.Until)
+			assert.Equal(t, tt.in.AppendOutEmptySeries, got.AppendOutEmptySeries)
+			assert.Equal(t, tt.in.HighPrecisionTimestamps, got.HighPrecisionTimestamps)
+			assert.Equal(t, tt.in.AppliedFunctions, got.AppliedFunctions)
+			assert.Equal(t, tt.in.Data.CommonStep, got.Data.CommonStep)
+			assert.Equal(t, tt.in.Data.List(), got.Data.List())
+
+			wantSeries := tt.in.Data.AM.Series(false)
+			gotSeries := got.Data.AM.Series(false)
+			sort.Strings(wantSeries)
+			sort.Strings(gotSeries)
+			require.Equal(t, wantSeries, gotSeries)
+			for _, metric := range wantSeries {
+				assert.Equal(t, tt.in.Data.AM.Get(metric), got.Data.AM.Get(metric), metric)
+			}
+
+			for _, p := range tt.in.Data.List() {
+				assert.Equal(t, tt.in.Data.MetricName(p.MetricID), got.Data.MetricName(p.MetricID))
+				wantStep, wantErr := tt.in.Data.GetStep(p.MetricID)
+				gotStep, gotErr := got.Data.GetStep(p.MetricID)
+				assert.Equal(t, wantStep, gotStep)
+				assert.Equal(t, wantErr == nil, gotErr == nil)
+				wantAgg, _ := tt.in.Data.GetAggregation(p.MetricID)
+				gotAgg, _ := got.Data.GetAggregation(p.MetricID)
+				assert.Equal(t, wantAgg, gotAgg)
+				wantXFilesFactor, _ := tt.in.Data.GetXFilesFactor(p.MetricID)
+				gotXFilesFactor, _ := got.Data.GetXFilesFactor(p.MetricID)
+				assert.Equal(t, wantXFilesFactor, gotXFilesFactor)
+			}
+
+			_, err = NewCachedCHResponse(body[:len(body)-1])
+			assert.ErrorIs(t, err, ErrCachedResponse)
+		})
+	}
+}
+
+func TestCHResponseCacheCorrupted(t *testing.T) {
+	in := CHResponse{
+		Data:             &Data{Points: point.NewPoints(), AM: alias.New()},
+		AppliedFunctions: map[string][]string{"test.*": {"consolidateBy"}},
+	}
+	body, err := in.Bytes()
+	require.NoError(t, err)
+
+	for i := range body {
+		_, err = NewCachedCHResponse(body[:i])
+		assert.ErrorIs(t, err, ErrCachedResponse, "truncated to %d bytes", i)
+	}
+
+	// version, from, until, step and flags
+	header := body[:27]
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"negative string length", []byte{1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"huge string length", []byte{1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0x0f}},
+		{"huge list length", []byte{1, 0, 0, 0, 1, 'a', 0xff, 0xff, 0xff, 0xff, 0x0f}},
+		{"huge count", []byte{0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewCachedCHResponse(append(append([]byte(nil), header...), tt.body...))
+			assert.ErrorIs(t, err, ErrCachedResponse)
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package data
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/pkg/coalesce"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+type fetchResult struct {
+	responses     CHResponses
+	failed        []TargetError
+	queueDuration time.Duration
+}
+
+var fetchGroup coalesce.Group[fetchResult]
+
+// coalesceKey identifies the fetch by time frames, targets with their filtering functions, context and user
+func (m *MultiTarget) coalesceKey(chContext, user string, partial bool) string {
+	tfs := make([]TimeFrame, 0, len(*m))
+	for tf := range *m {
+		tfs = append(tfs, tf)
+	}
+	slices.SortFunc(tfs, func(a, b TimeFrame) int {
+		if c := cmp.Compare(a.From, b.From); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.Until, b.Until); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.MaxDataPoints, b.MaxDataPoints)
+	})
+
+	var sb strings.Builder
+	sb.WriteString(chContext)
+	sb.WriteString(";user=")
+	sb.WriteString(user)
+	if partial {
+		sb.WriteString(";partial")
+	}
+	for _, tf := range tfs {
+		targets := (*m)[tf]
+		sb.WriteString(";")
+		sb.WriteString(strconv.FormatInt(tf.From, 10))
+		sb.WriteString(":")
+		sb.WriteString(strconv.FormatInt(tf.Until, 10))
+		sb.WriteString(":")
+		sb.WriteString(strconv.FormatInt(tf.MaxDataPoints, 10))
+		if targets.Raw {
+			sb.WriteString(":raw")
+		}
+		if targets.HighPrecisionTimestamps {
+			sb.WriteString(":hp")
+		}
+		for _, target := range targets.List {
+			sb.WriteString(";")
+			sb.WriteString(target)
+			for _, f := range targets.GetFilteringFunctions(target) {
+				sb.WriteString("|")
+				sb.WriteString(f.GetName())
+				sb.WriteString("(")
+				sb.WriteString(strings.Join(f.GetArguments(), ","))
+				sb.WriteString(")")
+			}
+		}
+	}
+	return sb.String()
+}
+
+// fetchShared is fetch, which is shared by the concurrent callers with the same time frames and targets,
+// see Common.CoalesceRequests. The waiting callers hold a slot of their own limiter, like they do for their
+// own fetch. Every caller gets its own copy of the responses list, but the Data of responses is shared and
+// must not be modified
+func (m *MultiTarget) fetchShared(ctx context.Context, cfg *config.Config, chContext string, qlimiter limiter.ServerLimiter, queueDuration *time.Duration, partial bool) (CHResponses, []TargetError, error) {
+	c, started := fetchGroup.Start(ctx, m.coalesceKey(chContext, scope.User(ctx), partial), func(ctx context.Context) (fetchResult, error) {
+		var r fetchResult
+		query, failed, err := m.fetch(ctx, cfg, chContext, qlimiter, &r.queueDuration, nil, partial)
+		r.failed = failed
+		if query != nil {
+			r.responses = query.CHResponses
+		}
+		return r, err
+	})
+	if !started {
+		scope.Logger(ctx).Debug("data fetch", zap.Bool("coalesced", true))
+		if qlimiter.Enabled() {
+			limitCtx, cancel := context.WithTimeout(ctx, getDataTimeout(cfg, m))
+			defer cancel()
+			start := time.Now()
+			err := qlimiter.Enter(limitCtx, "render")
+			*queueDuration += time.Since(start)
+			if err != nil {
+				return nil, nil, err
+			}
+			defer qlimiter.Leave(limitCtx, "render")
+		}
+	}
+	r, err := c.Wait(ctx)
+	if started {
+		*queueDuration += r.queueDuration
+	}
+	return slices.Clone(r.responses), slices.Clone(r.failed), err
+}
@@ -0,0 +1,106 @@
+package data
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+)
+
+func TestCoalesceKey(t *testing.T) {
+	tf := TimeFrame{From: 1000, Until: 2000, MaxDataPoints: 100}
+	newMultiTarget := func(tf TimeFrame, target string) MultiTarget {
+		return MultiTarget{tf: NewTargetsOne(target, 1, alias.New())}
+	}
+	m := newMultiTarget(tf, "a.*")
+	key := m.coalesceKey(config.ContextGraphite, "", false)
+	same := newMultiTarget(tf, "a.*")
+	assert.Equal(t, key, same.coalesceKey(config.ContextGraphite, "", false))
+
+	other := newMultiTarget(TimeFrame{From: 1000, Until: 2000, MaxDataPoints: 200}, "a.*")
+	assert.NotEqual(t, key, other.coalesceKey(config.ContextGraphite, "", false))
+	other = newMultiTarget(tf, "b.*")
+	assert.NotEqual(t, key, other.coalesceKey(config.ContextGraphite, "", false))
+	assert.NotEqual(t, key, m.coalesceKey(config.ContextGraphite, "user", false))
+	assert.NotEqual(t, key, m.coalesceKey(config.ContextGraphite, "", true))
+	assert.NotEqual(t, key, m.coalesceKey(config.ContextPrometheus, "", false))
+}
+
+func TestFetchCoalesced(t *testing.T) {
+	metrics.DisableMetrics()
+	var requests int32
+	received := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			close(received)
+		}
+		<-release
+	}))
+	defer srv.Close()
+
+	cfg := stitchConfig(t, srv.URL)
+	cfg.ClickHouse.StitchDataTables = false
+	cfg.Common.CoalesceRequests = true
+	now := time.Now().Unix()
+	tf := TimeFrame{From: now - 3600, Until: now, MaxDataPoints: 1000}
+	newMultiTarget := func() MultiTarget {
+		targets := NewTargetsOne("metric", 1, alias.New())
+		targets.AM.MergeTarget(finder.NewMockFinder([][]byte{[]byte("metric")}), "metric", false)
+		return MultiTarget{tf: targets}
+	}
+
+	var (
+		wg      sync.WaitGroup
+		replies [2]CHResponses
+	)
+	fetch := func(n int, m MultiTarget) {
+		defer wg.Done()
+		var queueDuration time.Duration
+		reply, err := m.Fetch(context.Background(), cfg, config.ContextGraphite, limiter.NoopLimiter{}, &queueDuration)
+		require.NoError(t, err)
+		replies[n] = reply
+	}
+	wg.Add(2)
+	go fetch(0, newMultiTarget())
+	<-received
+	go fetch(1, newMultiTarget())
+	// the second caller joins the fetch in flight
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	require.Len(t, replies[0], 1)
+	assert.Equal(t, replies[0], replies[1])
+	// the callers append to their responses, so the lists aren't shared
+	assert.NotSame(t, &replies[0][0], &replies[1][0])
+
+	// the canceled waiter returns without waiting for the shared fetch
+	received = make(chan struct{})
+	release = make(chan struct{})
+	atomic.StoreInt32(&requests, 0)
+	wg.Add(1)
+	go fetch(0, newMultiTarget())
+	<-received
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	m := newMultiTarget()
+	var queueDuration time.Duration
+	_, err := m.Fetch(ctx, cfg, config.ContextGraphite, limiter.NoopLimiter{}, &queueDuration)
+	assert.ErrorIs(t, err, context.Canceled)
+	close(release)
+	wg.Wait()
+	require.Len(t, replies[0], 1)
+}
@@ -40,9 +40,13 @@ func contextIsValid(ctx context.Context) error {
 	}
 }
 
-// GetStep returns the commonStep for all points or, if unset, step for metric ID id
+// GetStep returns the commonStep for all points or, if unset, step for metric ID id.
+// Functions evaluated by ClickHouse could change the commonStep for some metrics.
 func (d *Data) GetStep(id uint32) (uint32, error) {
 	if 0 < d.CommonStep {
+		if step, err := d.Points.GetStep(id); err == nil && step > 0 {
+			return step, nil
+		}
 		return uint32(d.CommonStep), nil
 	}
 	return d.Points.GetStep(id)
@@ -54,13 +58,18 @@ func (d *Data) GetAggregation(id uint32) (string, error) {
 	if err != nil {
 		return function, err
 	}
+	return graphiteAggregation(function), nil
+}
+
+// graphiteAggregation converts ClickHouse aggregating function to the whisper compatible name
+func graphiteAggregation(function string) string {
 	switch function {
 	case "any":
-		return "first", nil
+		return "first"
 	case "anyLast":
-		return "last", nil
+		return "last"
 	default:
-		return function, nil
+		return function
 	}
 }
 
@@ -131,12 +140,29 @@ func prepareData(ctx context.Context, targets int, fetcher func() *point.Points)
 // setSteps sets commonStep for aggregated requests and per-metric step for non-aggregated
 func (d *data) setSteps(cond *conditions) {
 	if cond.aggregated {
+		d.CommonStep = cond.step
+		d.Points.SetSteps(cond.pushdownSteps)
+		return
+	}
+	// milliseconds are rolled up to the step in whole seconds, see conditions.minStep
+	if cond.minStep() != 1 {
 		d.CommonStep = cond.step
 		return
 	}
 	d.Points.SetSteps(cond.steps)
 }
 
+// timeToSeconds converts times and the common step from milliseconds to seconds. The step and times must be
+// multiples of 1000, except raw points, whose duplicates are removed
+func (d *Data) timeToSeconds() {
+	list := d.Points.List()
+	for i := range list {
+		list[i].Time /= 1000
+	}
+	d.CommonStep /= 1000
+	d.Points.Uniq()
+}
+
 // Error handler for data splitting functions
 func splitErrorHandler(data *[]byte, atEOF bool, tokenLen int, err error) (int, []byte, error) {
 	if err == clickhouse.ErrUvarintRead {
@@ -152,83 +178,94 @@ func splitErrorHandler(data *[]byte, atEOF bool, tokenLen int, err error) (int,
 	return 0, nil, nil
 }
 
-// dataSplitAggregated is a split function for bufio.Scanner for read row binary response for queries of aggregated data
-func dataSplitAggregated(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if len(data) == 0 && atEOF {
-		// stop
-		return 0, nil, nil
-	}
+// dataSplitAggregated returns a split function for bufio.Scanner for read row binary response for queries of
+// aggregated data. timeSize is the size of the times in bytes
+func dataSplitAggregated(timeSize int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if len(data) == 0 && atEOF {
+			// stop
+			return 0, nil, nil
+		}
 
-	nameLen, readBytes, err := ReadUvarint(data)
-	tokenLen := int(readBytes) + int(nameLen)
-	if err != nil || len(data) < tokenLen {
-		return splitErrorHandler(&data, atEOF, tokenLen, err)
-	}
+		nameLen, readBytes, err := ReadUvarint(data)
+		tokenLen := int(readBytes) + int(nameLen)
+		if err != nil || len(data) < tokenLen {
+			return splitErrorHandler(&data, atEOF, tokenLen, err)
+		}
 
-	timeLen, readBytes, err := ReadUvarint(data[tokenLen:])
-	tokenLen += int(readBytes) + int(timeLen)*4
-	if err != nil || len(data) < tokenLen {
-		return splitErrorHandler(&data, atEOF, tokenLen, err)
-	}
+		timeLen, readBytes, err := ReadUvarint(data[tokenLen:])
+		tokenLen += int(readBytes) + int(timeLen)*timeSize
+		if err != nil || len(data) < tokenLen {
+			return splitErrorHandler(&data, atEOF, tokenLen, err)
+		}
 
-	valueLen, readBytes, err := ReadUvarint(data[tokenLen:])
-	tokenLen += int(readBytes) + int(valueLen)*8
-	if err != nil || len(data) < tokenLen {
-		return splitErrorHandler(&data, atEOF, tokenLen, err)
-	}
+		valueLen, readBytes, err := ReadUvarint(data[tokenLen:])
+		tokenLen += int(readBytes) + int(valueLen)*8
+		if err != nil || len(data) < tokenLen {
+			return splitErrorHandler(&data, atEOF, tokenLen, err)
+		}
 
-	if timeLen != valueLen {
-		return 0, nil, clickhouse.NewErrWithDescr(errClickHouseResponse.Error()+": Different amount of Times and Values", string(data))
-	}
+		if timeLen != valueLen {
+			return 0, nil, clickhouse.NewErrWithDescr(errClickHouseResponse.Error()+": Different amount of Times and Values", string(data))
+		}
 
-	return tokenLen, data[:tokenLen], nil
+		return tokenLen, data[:tokenLen], nil
+	}
 }
 
-// dataSplitUnaggregated is a split function for bufio.Scanner for read row binary response for queries of unaggregated data
-func dataSplitUnaggregated(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if len(data) == 0 && atEOF {
-		// stop
-		return 0, nil, nil
-	}
+// dataSplitUnaggregated returns a split function for bufio.Scanner for read row binary response for queries of
+// unaggregated data. timeSize is the size of the times in bytes
+func dataSplitUnaggregated(timeSize int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if len(data) == 0 && atEOF {
+			// stop
+			return 0, nil, nil
+		}
 
-	nameLen, readBytes, err := ReadUvarint(data)
-	tokenLen := int(readBytes) + int(nameLen)
-	if err != nil || len(data) < tokenLen {
-		return splitErrorHandler(&data, atEOF, tokenLen, err)
-	}
+		nameLen, readBytes, err := ReadUvarint(data)
+		tokenLen := int(readBytes) + int(nameLen)
+		if err != nil || len(data) < tokenLen {
+			return splitErrorHandler(&data, atEOF, tokenLen, err)
+		}
 
-	timeLen, readBytes, err := ReadUvarint(data[tokenLen:])
-	tokenLen += int(readBytes) + int(timeLen)*4
-	if err != nil || len(data) < tokenLen {
-		return splitErrorHandler(&data, atEOF, tokenLen, err)
-	}
+		timeLen, readBytes, err := ReadUvarint(data[tokenLen:])
+		tokenLen += int(readBytes) + int(timeLen)*timeSize
+		if err != nil || len(data) < tokenLen {
+			return splitErrorHandler(&data, atEOF, tokenLen, err)
+		}
 
-	valueLen, readBytes, err := ReadUvarint(data[tokenLen:])
-	tokenLen += int(readBytes) + int(valueLen)*8
-	if err != nil || len(data) < tokenLen {
-		return splitErrorHandler(&data, atEOF, tokenLen, err)
-	}
+		valueLen, readBytes, err := ReadUvarint(data[tokenLen:])
+		tokenLen += int(readBytes) + int(valueLen)*8
+		if err != nil || len(data) < tokenLen {
+			return splitErrorHandler(&data, atEOF, tokenLen, err)
+		}
 
-	timestampLen, readBytes, err := ReadUvarint(data[tokenLen:])
-	tokenLen += int(readBytes) + int(timestampLen)*4
-	if err != nil || len(data) < tokenLen {
-		return splitErrorHandler(&data, atEOF, tokenLen, err)
-	}
+		timestampLen, readBytes, err := ReadUvarint(data[tokenLen:])
+		tokenLen += int(readBytes) + int(timestampLen)*4
+		if err != nil || len(data) < tokenLen {
+			return splitErrorHandler(&data, atEOF, tokenLen, err)
+		}
 
-	if timeLen != valueLen || timeLen != timestampLen {
-		return 0, nil, clickhouse.NewErrWithDescr(errClickHouseResponse.Error()+": Different amount of Values, Times and Timestamps", string(data))
-	}
+		if timeLen != valueLen || timeLen != timestampLen {
+			return 0, nil, clickhouse.NewErrWithDescr(errClickHouseResponse.Error()+": Different amount of Values, Times and Timestamps", string(data))
+		}
 
-	return tokenLen, data[:tokenLen], nil
+		return tokenLen, data[:tokenLen], nil
+	}
 }
 
 // readResponse reads the ClickHouse body into *Data and merges with extraPoints.
 // Expected, that on error the context will be cancelled on the upper level.
 func (d *data) parseResponse(ctx context.Context, bodyReader io.ReadCloser, cond *conditions) error {
 	pp := d.Points
-	dataSplit := dataSplitUnaggregated
+	// times of tables with high-precision-time are 64-bit milliseconds
+	timeSize := 4
+	if cond.timeUnit() != 1 {
+		timeSize = 8
+	}
+	dataSplit := dataSplitUnaggregated(timeSize)
 	if cond.aggregated {
-		dataSplit = dataSplitAggregated
+		dataSplit = dataSplitAggregated(timeSize)
 	}
 
 	// Prevent starting parser if context is done
@@ -277,9 +314,7 @@ func (d *data) parseResponse(ctx context.Context, bodyReader io.ReadCloser, cond
 		row = row[int(nameLen):]
 
 		if cond.isReverse {
-			metricID = pp.MetricIDBytes(reverse.Bytes(name))
-		} else {
-			metricID = pp.MetricIDBytes(name)
+			name = reverse.Bytes(name)
 		}
 
 		arrayLen, readBytes, err := ReadUvarint(row)
@@ -287,13 +322,17 @@ func (d *data) parseResponse(ctx context.Context, bodyReader io.ReadCloser, cond
 			return errClickHouseResponse
 		}
 
-		times := make([]uint32, 0, arrayLen)
+		times := make([]int64, 0, arrayLen)
 		values := make([]float64, 0, arrayLen)
 
 		row = row[int(readBytes):]
 		for i := uint64(0); i < arrayLen; i++ {
-			times = append(times, binary.LittleEndian.Uint32(row[:4]))
-			row = row[4:]
+			if timeSize == 8 {
+				times = append(times, int64(binary.LittleEndian.Uint64(row[:8])))
+			} else {
+				times = append(times, int64(binary.LittleEndian.Uint32(row[:4])))
+			}
+			row = row[timeSize:]
 		}
 
 		row = row[int(readBytes):]
@@ -302,9 +341,13 @@ func (d *data) parseResponse(ctx context.Context, bodyReader io.ReadCloser, cond
 			row = row[8:]
 		}
 
-		timestamps := times
-		if !cond.aggregated {
-			timestamps = make([]uint32, 0, arrayLen)
+		// aggregated points use the time as the version
+		timestamps := make([]uint32, 0, arrayLen)
+		if cond.aggregated {
+			for i := range times {
+				timestamps = append(timestamps, uint32(times[i]))
+			}
+		} else {
 			row = row[int(readBytes):]
 			for i := uint64(0); i < arrayLen; i++ {
 				timestamps = append(timestamps, binary.LittleEndian.Uint32(row[:4]))
@@ -312,6 +355,14 @@ func (d *data) parseResponse(ctx context.Context, bodyReader io.ReadCloser, cond
 			}
 		}
 
+		if cond.stream != nil {
+			if err := cond.stream.writeRow(string(name), times, values); err != nil {
+				return err
+			}
+			continue
+		}
+
+		metricID = pp.MetricIDBytes(name)
 		for i := range times {
 			pp.AppendPoint(metricID, values[i], times[i], timestamps[i])
 		}
@@ -3,6 +3,7 @@ package data
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"testing"
@@ -106,7 +107,7 @@ func TestUnaggregatedDataParse(t *testing.T) {
 			for j := 0; j < len(table[i]); j++ {
 				for m := 0; m < len(table[i][j].PointValues.Times); m++ {
 					assert.Equal(t, table[i][j].Metric, d.Points.MetricName(d.Points.List()[p].MetricID))
-					assert.Equal(t, table[i][j].PointValues.Times[m], d.Points.List()[p].Time)
+					assert.Equal(t, int64(table[i][j].PointValues.Times[m]), d.Points.List()[p].Time)
 					assert.Equal(t, table[i][j].PointValues.Values[m], d.Points.List()[p].Value)
 					assert.Equal(t, table[i][j].PointValues.Timestamps[m], d.Points.List()[p].Timestamp)
 					p++
@@ -131,7 +132,7 @@ func TestUnaggregatedDataParse(t *testing.T) {
 			for j := 0; j < len(table[i]); j++ {
 				for m := 0; m < len(table[i][j].PointValues.Times); m++ {
 					assert.Equal(t, table[i][j].Metric, reverse.String(d.Points.MetricName(d.Points.List()[p].MetricID)))
-					assert.Equal(t, table[i][j].PointValues.Times[m], d.Points.List()[p].Time)
+					assert.Equal(t, int64(table[i][j].PointValues.Times[m]), d.Points.List()[p].Time)
 					assert.Equal(t, table[i][j].PointValues.Values[m], d.Points.List()[p].Value)
 					assert.Equal(t, table[i][j].PointValues.Timestamps[m], d.Points.List()[p].Timestamp)
 					p++
@@ -445,3 +446,36 @@ func TestAsyncDataParse(t *testing.T) {
 		assert.ErrorIs(t, err, clickhouse.ErrClickHouseResponse, "err %v is not expected", err)
 	})
 }
+
+func TestDataParseHighPrecisionTime(t *testing.T) {
+	ctx := context.Background()
+	times := []uint64{1520056686000, 1520056686500}
+	values := []float64{42.1, 43}
+	buf := new(bytes.Buffer)
+	w := RowBinary.NewEncoder(buf)
+	w.String("hello.world")
+	buf.Write(binary.AppendUvarint(nil, uint64(len(times))))
+	for _, tm := range times {
+		w.Uint64(tm)
+	}
+	w.Float64List(values)
+
+	cond := &conditions{Targets: &Targets{highPrecisionTime: "DateTime64"}, aggregated: true}
+	d := prepareData(ctx, 1, testCarbonlinkReaderNil)
+	err := d.parseResponse(ctx, io.NopCloser(bytes.NewReader(buf.Bytes())), cond)
+	assert.NoError(t, err)
+	assert.NoError(t, d.wait(ctx))
+	// the time is the version of aggregated points
+	assert.Equal(t, []point.Point{
+		{MetricID: 1, Value: 42.1, Time: 1520056686000, Timestamp: uint32(times[0])},
+		{MetricID: 1, Value: 43, Time: 1520056686500, Timestamp: uint32(times[1])},
+	}, d.Points.List())
+
+	// the step and times are converted to seconds, the latest of duplicates is kept
+	d.CommonStep = 1000
+	d.Data.timeToSeconds()
+	assert.Equal(t, []point.Point{
+		{MetricID: 1, Value: 43, Time: 1520056686, Timestamp: uint32(times[1])},
+	}, d.Points.List())
+	assert.Equal(t, int64(1), d.CommonStep)
+}
@@ -0,0 +1,107 @@
+package data
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"time"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/pkg/dry"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// TimeFramePlan describes how the metrics of the time frame are fetched, see MultiTarget.Explain
+type TimeFramePlan struct {
+	From          int64    `json:"from"`
+	Until         int64    `json:"until"`
+	MaxDataPoints int64    `json:"max_data_points"`
+	Targets       []string `json:"targets"`
+	// Table is the data table chosen for the time frame or its part, when data tables are stitched
+	Table             string `json:"table"`
+	Reverse           bool   `json:"reverse,omitempty"`
+	HighPrecisionTime string `json:"high_precision_time,omitempty"`
+	Aggregated        bool   `json:"aggregated"`
+	// Step is LCM(steps) for aggregated requests and max(steps) for the rest, in the time units of the table
+	Step    int64        `json:"step"`
+	Metrics []MetricPlan `json:"metrics"`
+}
+
+// MetricPlan contains the rollup rules of the metric
+type MetricPlan struct {
+	Metric       string  `json:"metric"`
+	Precision    uint32  `json:"precision"`
+	Function     string  `json:"function"`
+	XFilesFactor float32 `json:"xFilesFactor,omitempty"`
+	// RetentionRule and FunctionRule are regexps of the matched rollup patterns
+	RetentionRule string `json:"retention_rule,omitempty"`
+	FunctionRule  string `json:"function_rule,omitempty"`
+}
+
+// Explain runs all planning steps of Fetch, but queries aren't sent to ClickHouse. It returns the plans of
+// time frames, the queries could be collected by clickhouse.WithQueryLog
+func (m *MultiTarget) Explain(ctx context.Context, cfg *config.Config, chContext string) ([]TimeFramePlan, error) {
+	var queueDuration time.Duration
+	query, _, err := m.fetch(scope.WithDryRun(ctx), cfg, chContext, limiter.NoopLimiter{}, &queueDuration, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	plans := make([]TimeFramePlan, 0, len(query.conds))
+	for _, cond := range query.conds {
+		plans = append(plans, cond.plan())
+	}
+	slices.SortFunc(plans, func(a, b TimeFramePlan) int {
+		if c := cmp.Compare(a.From, b.From); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Until, b.Until)
+	})
+	return plans, nil
+}
+
+// plan returns the plan of the executed conditions
+func (c *conditions) plan() TimeFramePlan {
+	p := TimeFramePlan{
+		From:              c.From,
+		Until:             c.Until,
+		MaxDataPoints:     c.MaxDataPoints,
+		Targets:           c.List,
+		Table:             c.pointsTable,
+		Reverse:           c.isReverse,
+		HighPrecisionTime: c.highPrecisionTime,
+		Aggregated:        c.aggregated,
+		Step:              c.step,
+		Metrics:           make([]MetricPlan, 0, len(c.metricsXFilesFactor)),
+	}
+
+	functions := make(map[string]string)
+	for agg, metrics := range c.aggregations {
+		for _, m := range metrics {
+			functions[m] = agg
+		}
+	}
+	age := uint32(dry.Max(0, time.Now().Unix()-c.From))
+	// metricsXFilesFactor is filled only for the looked up metrics
+	for i := range c.metricsXFilesFactor {
+		mp := MetricPlan{
+			Metric:       c.metricsUnreverse[i],
+			Precision:    c.metricsXFilesFactor[i].precision,
+			Function:     functions[c.metricsUnreverse[i]],
+			XFilesFactor: c.metricsXFilesFactor[i].ratio,
+		}
+		_, ag, aggrPattern, retentionPattern := c.rollupRules.Lookup(c.metricsLookup[i], age, true)
+		if mp.Function == "" {
+			// metrics aggregated across series aren't in aggregations
+			mp.Function = ag.Name()
+		}
+		if retentionPattern != nil {
+			mp.RetentionRule = retentionPattern.Regexp
+		}
+		if aggrPattern != nil {
+			mp.FunctionRule = aggrPattern.Regexp
+		}
+		p.Metrics = append(p.Metrics, mp)
+	}
+	return p
+}
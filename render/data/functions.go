@@ -0,0 +1,239 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/go-graphite/carbonapi/pkg/parser"
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+)
+
+// ErrPushdownArguments is returned when the function could not be evaluated in ClickHouse with the given arguments
+var ErrPushdownArguments = errors.New("unsupported arguments for function pushdown")
+
+// pushdownFunction builds ClickHouse expression, which evaluates the graphite function over the array of values.
+// The array contains values for every interval from `from` with `step`, and nan for absent values.
+// It returns the expression and the step of the resulting array.
+type pushdownFunction func(values string, args []string, from, step int64) (string, int64, error)
+
+// pushdownFunctions contains graphite functions, which could be evaluated by ClickHouse in aggregated queries
+var pushdownFunctions = map[string]pushdownFunction{
+	"scale":                 pushdownScale,
+	"offset":                pushdownOffset,
+	"absolute":              pushdownAbsolute,
+	"removeBelowValue":      pushdownRemoveBelowValue,
+	"removeAboveValue":      pushdownRemoveAboveValue,
+	"perSecond":             pushdownPerSecond,
+	"nonNegativeDerivative": pushdownNonNegativeDerivative,
+	"summarize":             pushdownSummarize,
+	"keepLastValue":         pushdownKeepLastValue,
+}
+
+// summarizeFunctions maps the summarize aggregation to ClickHouse aggregate function
+var summarizeFunctions = map[string]string{
+	"sum":     "sum",
+	"total":   "sum",
+	"avg":     "avg",
+	"average": "avg",
+	"max":     "max",
+	"min":     "min",
+	"last":    "anyLast",
+	"first":   "any",
+	"count":   "count",
+}
+
+func unquote(arg string) string {
+	return strings.Trim(arg, `"'`)
+}
+
+// numberArg parses the finite number argument and formats it for the query
+func numberArg(arg string) (string, error) {
+	f, err := strconv.ParseFloat(unquote(arg), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", ErrPushdownArguments
+	}
+	return "(" + strconv.FormatFloat(f, 'g', -1, 64) + ")", nil
+}
+
+func oneNumberArg(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", ErrPushdownArguments
+	}
+	return numberArg(args[0])
+}
+
+func pushdownScale(values string, args []string, from, step int64) (string, int64, error) {
+	factor, err := oneNumberArg(args)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("arrayMap(v->v*%s, %s)", factor, values), step, nil
+}
+
+func pushdownOffset(values string, args []string, from, step int64) (string, int64, error) {
+	factor, err := oneNumberArg(args)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("arrayMap(v->v+%s, %s)", factor, values), step, nil
+}
+
+func pushdownAbsolute(values string, args []string, from, step int64) (string, int64, error) {
+	if len(args) != 0 {
+		return "", 0, ErrPushdownArguments
+	}
+	return fmt.Sprintf("arrayMap(v->abs(v), %s)", values), step, nil
+}
+
+func pushdownRemoveBelowValue(values string, args []string, from, step int64) (string, int64, error) {
+	n, err := oneNumberArg(args)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("arrayMap(v->if(v<%s, nan, v), %s)", n, values), step, nil
+}
+
+func pushdownRemoveAboveValue(values string, args []string, from, step int64) (string, int64, error) {
+	n, err := oneNumberArg(args)
+	if err != nil {
+		return "", 0, err
+	}
+	return fmt.Sprintf("arrayMap(v->if(v>%s, nan, v), %s)", n, values), step, nil
+}
+
+// nonNegativeDelta is the same as graphite's _nonNegativeDelta: the delta with the previous value,
+// counter wrap is handled only with maxValue. Values above maxValue are ignored.
+func nonNegativeDelta(values string, args []string, divider string) (string, error) {
+	prev := fmt.Sprintf("arrayPushFront(arrayPopBack(%s), nan)", values)
+	switch len(args) {
+	case 0:
+		return fmt.Sprintf("arrayMap((v,p)->if(v-p>=0, (v-p)%s, nan), %s, %s)", divider, values, prev), nil
+	case 1:
+		maxValue, err := numberArg(args[0])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf(
+			"arrayMap((v,p)->if(v>%[1]s OR p>%[1]s OR isNaN(v-p), nan, if(v-p>=0, v-p, %[1]s+(v-p)+1)%[2]s), %[3]s, %[4]s)",
+			maxValue, divider, values, prev,
+		), nil
+	default:
+		return "", ErrPushdownArguments
+	}
+}
+
+func pushdownNonNegativeDerivative(values string, args []string, from, step int64) (string, int64, error) {
+	expr, err := nonNegativeDelta(values, args, "")
+	return expr, step, err
+}
+
+func pushdownPerSecond(values string, args []string, from, step int64) (string, int64, error) {
+	expr, err := nonNegativeDelta(values, args, "/"+strconv.FormatInt(step, 10))
+	return expr, step, err
+}
+
+// pushdownSummarize is supported only when the interval is a multiple of the step and the buckets start at `from`,
+// then both alignToFrom=true and alignToFrom=false produce the same buckets
+func pushdownSummarize(values string, args []string, from, step int64) (string, int64, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return "", 0, ErrPushdownArguments
+	}
+	interval, err := parser.IntervalString(unquote(args[0]), 1)
+	if err != nil || interval <= 0 {
+		return "", 0, ErrPushdownArguments
+	}
+	newStep := int64(interval)
+	if newStep%step != 0 || from%newStep != 0 {
+		return "", 0, ErrPushdownArguments
+	}
+	function := "sum"
+	if len(args) > 1 {
+		var ok bool
+		if function, ok = summarizeFunctions[unquote(args[1])]; !ok {
+			return "", 0, ErrPushdownArguments
+		}
+	}
+	if len(args) > 2 {
+		if _, err = strconv.ParseBool(unquote(args[2])); err != nil {
+			return "", 0, ErrPushdownArguments
+		}
+	}
+	k := newStep / step
+	return fmt.Sprintf(
+		"arrayMap(b->toFloat64(ifNull(arrayReduce('%[1]sOrNull', arrayFilter(v->NOT isNaN(v), arraySlice(%[2]s, b*%[3]d+1, %[3]d))), nan)), range(toUInt64(ceil(length(%[2]s)/%[3]d))))",
+		function, values, k,
+	), newStep, nil
+}
+
+// pushdownKeepLastValue is supported only without limit
+func pushdownKeepLastValue(values string, args []string, from, step int64) (string, int64, error) {
+	if len(args) > 1 {
+		return "", 0, ErrPushdownArguments
+	}
+	if len(args) == 1 {
+		if limit := strings.ToLower(unquote(args[0])); limit != "inf" && limit != "none" {
+			return "", 0, ErrPushdownArguments
+		}
+	}
+	return fmt.Sprintf("arrayFill(v->NOT isNaN(v), %s)", values), step, nil
+}
+
+// pushdown contains the functions, evaluated by ClickHouse for the metrics with the same aggregation
+type pushdown struct {
+	agg       string
+	functions []*v3pb.FilteringFunction
+	metrics   []string
+	// exprs are ClickHouse expressions for every applied function, they are built when the step is known
+	exprs []string
+	step  int64
+}
+
+// pushdownKey returns the string, identifying the functions chain
+func pushdownKey(functions []*v3pb.FilteringFunction) string {
+	var sb strings.Builder
+	for i, f := range functions {
+		if i > 0 {
+			sb.WriteByte(';')
+		}
+		sb.WriteString(f.GetName())
+		sb.WriteByte('(')
+		sb.WriteString(strings.Join(f.GetArguments(), ","))
+		sb.WriteByte(')')
+	}
+	return sb.String()
+}
+
+// build builds expressions for the longest chain of functions, which could be evaluated with the query step
+func (p *pushdown) build(from, step int64) {
+	p.exprs = make([]string, 0, len(p.functions))
+	p.step = step
+	for i, f := range p.functions {
+		expr, newStep, err := pushdownFunctions[f.GetName()](fmt.Sprintf("f%d", i), f.GetArguments(), from, p.step)
+		if err != nil {
+			p.functions = p.functions[:i]
+			return
+		}
+		p.exprs = append(p.exprs, expr)
+		p.step = newStep
+	}
+}
+
+// GetPushdownFunctions returns the functions from the chain of the target, which could be evaluated by ClickHouse.
+// Functions are taken in the requested order until the first unsupported one. consolidateBy and setXFilesFactor
+// are skipped, since they are applied with the aggregation.
+func (tt *Targets) GetPushdownFunctions(target string) []*v3pb.FilteringFunction {
+	var functions []*v3pb.FilteringFunction
+	for _, f := range tt.filteringFunctionsByTarget[target] {
+		if isAggregationFunction(f.GetName()) {
+			continue
+		}
+		if _, ok := pushdownFunctions[f.GetName()]; !ok {
+			break
+		}
+		functions = append(functions, f)
+	}
+	return functions
+}
@@ -0,0 +1,161 @@
+package data
+
+import (
+	"sort"
+	"testing"
+
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/helper/date"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+)
+
+func TestPushdownFunctions(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		from     int64
+		step     int64
+		wantExpr string
+		wantStep int64
+		wantErr  bool
+	}{
+		{name: "scale", args: []string{"2.5"}, step: 60, wantExpr: "arrayMap(v->v*(2.5), f0)", wantStep: 60},
+		{name: "scale", args: []string{"-1e3"}, step: 60, wantExpr: "arrayMap(v->v*(-1000), f0)", wantStep: 60},
+		{name: "scale", args: []string{"inf"}, step: 60, wantErr: true},
+		{name: "scale", args: []string{"1); DROP TABLE x; --"}, step: 60, wantErr: true},
+		{name: "offset", args: []string{"10"}, step: 60, wantExpr: "arrayMap(v->v+(10), f0)", wantStep: 60},
+		{name: "offset", args: []string{}, step: 60, wantErr: true},
+		{name: "absolute", step: 60, wantExpr: "arrayMap(v->abs(v), f0)", wantStep: 60},
+		{name: "removeBelowValue", args: []string{"0"}, step: 60, wantExpr: "arrayMap(v->if(v<(0), nan, v), f0)", wantStep: 60},
+		{name: "removeAboveValue", args: []string{"100"}, step: 60, wantExpr: "arrayMap(v->if(v>(100), nan, v), f0)", wantStep: 60},
+		{
+			name: "nonNegativeDerivative", step: 60, wantStep: 60,
+			wantExpr: "arrayMap((v,p)->if(v-p>=0, (v-p), nan), f0, arrayPushFront(arrayPopBack(f0), nan))",
+		},
+		{
+			name: "nonNegativeDerivative", args: []string{"255"}, step: 60, wantStep: 60,
+			wantExpr: "arrayMap((v,p)->if(v>(255) OR p>(255) OR isNaN(v-p), nan, if(v-p>=0, v-p, (255)+(v-p)+1)), f0, arrayPushFront(arrayPopBack(f0), nan))",
+		},
+		{
+			name: "perSecond", step: 60, wantStep: 60,
+			wantExpr: "arrayMap((v,p)->if(v-p>=0, (v-p)/60, nan), f0, arrayPushFront(arrayPopBack(f0), nan))",
+		},
+		{name: "perSecond", args: []string{"255", "0"}, step: 60, wantErr: true},
+		{
+			name: "summarize", args: []string{"'5min'", "'max'"}, from: 1200, step: 60, wantStep: 300,
+			wantExpr: "arrayMap(b->toFloat64(ifNull(arrayReduce('maxOrNull', arrayFilter(v->NOT isNaN(v), arraySlice(f0, b*5+1, 5))), nan)), range(toUInt64(ceil(length(f0)/5))))",
+		},
+		{
+			name: "summarize", args: []string{"1h"}, from: 3600, step: 60, wantStep: 3600,
+			wantExpr: "arrayMap(b->toFloat64(ifNull(arrayReduce('sumOrNull', arrayFilter(v->NOT isNaN(v), arraySlice(f0, b*60+1, 60))), nan)), range(toUInt64(ceil(length(f0)/60))))",
+		},
+		// from is not aligned to interval
+		{name: "summarize", args: []string{"5min"}, from: 60, step: 60, wantErr: true},
+		// interval is not a multiple of step
+		{name: "summarize", args: []string{"90s"}, from: 0, step: 60, wantErr: true},
+		{name: "summarize", args: []string{"5min", "median"}, from: 0, step: 60, wantErr: true},
+		{name: "keepLastValue", step: 60, wantExpr: "arrayFill(v->NOT isNaN(v), f0)", wantStep: 60},
+		{name: "keepLastValue", args: []string{"INF"}, step: 60, wantExpr: "arrayFill(v->NOT isNaN(v), f0)", wantStep: 60},
+		{name: "keepLastValue", args: []string{"3"}, step: 60, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, step, err := pushdownFunctions[tt.name]("f0", tt.args, tt.from, tt.step)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrPushdownArguments)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantExpr, expr)
+			assert.Equal(t, tt.wantStep, step)
+		})
+	}
+}
+
+func TestPushdownLookup(t *testing.T) {
+	cond := newCondition(5400, 1800, 5)
+	cond.aggregated = true
+	cond.SetFilteringFunctions("*.name.*", []*v3pb.FilteringFunction{
+		{Name: "consolidateBy", Arguments: []string{"max"}},
+		{Name: "scale", Arguments: []string{"2"}},
+		{Name: "summarize", Arguments: []string{"10min"}},
+		{Name: "aliasByNode", Arguments: []string{"1"}},
+		{Name: "offset", Arguments: []string{"1"}},
+	})
+	cond.prepareMetricsLists()
+	require.NoError(t, cond.prepareLookup())
+
+	key := "max|scale(2);summarize(10min)"
+	assert.Equal(t, []string{key}, mapKeys(cond.extDataBodies))
+	require.Contains(t, cond.pushdowns, key)
+	metrics := cond.pushdowns[key].metrics
+	sort.Strings(metrics)
+	assert.Equal(t, []string{"10_min.name.any", "1_min.name.avg", "5_min.name.min", "5_sec.name.max"}, metrics)
+
+	cond.from, cond.until, cond.step = 1200, 2399, 60
+	cond.pointsTable = "graphite.table"
+	cond.setPushdowns()
+	cond.setPrewhere()
+	cond.setWhere()
+	assert.Equal(t, map[string][]string{"*.name.*": {"scale", "summarize", "consolidateBy"}}, cond.appliedFunctions)
+	assert.Equal(t, map[uint32][]string{600: metrics}, cond.pushdownSteps)
+	assert.Equal(t,
+		"WITH anyResample(1200, 2399, 60)(toUInt32(intDiv(Time, 60)*60), Time) AS mask,\n"+
+			" arrayMap((v,m)->if(m=0, nan, v), maxResample(1200, 2399, 60)(Value, Time), mask) AS f0,\n"+
+			" arrayMap(v->v*(2), f0) AS f1,\n"+
+			" arrayMap(b->toFloat64(ifNull(arrayReduce('sumOrNull', arrayFilter(v->NOT isNaN(v), arraySlice(f1, b*10+1, 10))), nan)), range(toUInt64(ceil(length(f1)/10)))) AS f2\n"+
+			"SELECT Path,\n"+
+			" arrayFilter((t,v)->NOT isNaN(v), arrayMap(i->toUInt32(1200+i*600), range(length(f2))), f2) AS times,\n"+
+			" arrayFilter(v->NOT isNaN(v), f2) AS values\n"+
+			"FROM graphite.table\n"+
+			"PREWHERE Date >= '"+date.FromTimestampToDaysFormat(1200)+"' AND Date <= '"+date.UntilTimestampToDaysFormat(2399)+"'\n"+
+			"WHERE (Path in metrics_list) AND (Time >= 1200 AND Time <= 2399)\n"+
+			"GROUP BY Path\n"+
+			"FORMAT RowBinary",
+		cond.generateQuery(key),
+	)
+
+	// summarize is not aligned to from, only scale is applied
+	cond.appliedFunctions = map[string][]string{"*.name.*": {"consolidateBy"}}
+	cond.from = 1260
+	cond.setPushdowns()
+	assert.Equal(t, map[string][]string{"*.name.*": {"scale", "consolidateBy"}}, cond.appliedFunctions)
+	assert.Empty(t, cond.pushdownSteps)
+	assert.Equal(t, []string{"arrayMap(v->v*(2), f0)"}, cond.pushdowns[key].exprs)
+}
+
+func TestPushdownLookupConflict(t *testing.T) {
+	am := alias.New()
+	am.Add("a.b", alias.Value{Target: "a.*", DisplayName: "a.b"})
+	am.Add("a.c", alias.Value{Target: "a.*", DisplayName: "a.c"}, alias.Value{Target: "*.c", DisplayName: "a.c"})
+	am.Add("b.c", alias.Value{Target: "*.c", DisplayName: "b.c"}, alias.Value{Target: "b.c", DisplayName: "b.c"})
+	am.Add("d.e", alias.Value{Target: "d.e", DisplayName: "d.e"})
+
+	cond := newCondition(5400, 1800, 5)
+	cond.AM = am
+	cond.aggregated = true
+	scale := []*v3pb.FilteringFunction{{Name: "scale", Arguments: []string{"2"}}}
+	cond.SetFilteringFunctions("a.*", scale)
+	cond.SetFilteringFunctions("*.c", scale)
+	cond.SetFilteringFunctions("b.c", []*v3pb.FilteringFunction{{Name: "absolute"}})
+	cond.SetFilteringFunctions("d.e", scale)
+	cond.prepareMetricsLists()
+	require.NoError(t, cond.prepareLookup())
+
+	// b.c conflicts with *.c, so a.* is excluded too
+	assert.Equal(t, []string{"avg", "avg|scale(2)"}, mapKeys(cond.extDataBodies))
+	assert.Equal(t, "d.e\n", cond.extDataBodies["avg|scale(2)"].String())
+	assert.Equal(t, []string{"d.e"}, cond.pushdowns["avg|scale(2)"].metrics)
+}
+
+func mapKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -11,6 +11,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
 	"github.com/lomik/graphite-clickhouse/helper/errs"
 	"github.com/lomik/graphite-clickhouse/limiter"
 	"github.com/lomik/graphite-clickhouse/pkg/alias"
@@ -37,11 +38,18 @@ func MFRToMultiTarget(v3Request *v3pb.MultiFetchRequest) MultiTarget {
 				Until:         m.StopTime,
 				MaxDataPoints: m.MaxDataPoints,
 			}
+			// timestamps are in milliseconds, the time frame is in seconds
+			if m.HighPrecisionTimestamps {
+				tf.From, tf.Until = tf.From/1000, tf.Until/1000
+			}
 			if _, ok := multiTarget[tf]; ok {
 				target := multiTarget[tf]
 				target.Append(m.PathExpression)
+				// points are returned in milliseconds only when all targets of the time frame support it
+				target.HighPrecisionTimestamps = target.HighPrecisionTimestamps && m.HighPrecisionTimestamps
 			} else {
 				multiTarget[tf] = NewTargetsOne(m.PathExpression, len(v3Request.Metrics), alias.New())
+				multiTarget[tf].HighPrecisionTimestamps = m.HighPrecisionTimestamps
 			}
 			if len(m.FilterFunctions) > 0 {
 				multiTarget[tf].SetFilteringFunctions(m.PathExpression, m.FilterFunctions)
@@ -64,6 +72,62 @@ func (m *MultiTarget) checkMetricsLimitExceeded(num int) error {
 	return nil
 }
 
+// dropMetricsLimitExceeded removes the metrics of the targets, which exceed the limit, and returns the errors
+// of the targets. When the time frame still exceeds the limit, all its targets are dropped
+func (m *MultiTarget) dropMetricsLimitExceeded(num int) (failed []TargetError) {
+	if num <= 0 {
+		// zero or negative means unlimited
+		return nil
+	}
+	for _, t := range *m {
+		series := t.AM.Series(false)
+		counts := make(map[string]int, len(t.List))
+		for _, metric := range series {
+			for _, v := range t.AM.Get(metric) {
+				counts[v.Target]++
+			}
+		}
+		dropped := make(map[string]bool)
+		for _, target := range t.List {
+			if num < counts[target] {
+				dropped[target] = true
+				failed = append(failed, TargetError{
+					Target: target,
+					Err:    errs.NewErrorWithCode(fmt.Sprintf("metrics limit exceeded: %d < %d", num, counts[target]), http.StatusForbidden),
+				})
+			}
+		}
+		if len(dropped) == 0 && num >= len(series) {
+			continue
+		}
+		for _, metric := range series {
+			values := t.AM.Get(metric)
+			kept := make([]alias.Value, 0, len(values))
+			for _, v := range values {
+				if !dropped[v.Target] {
+					kept = append(kept, v)
+				}
+			}
+			t.AM.Delete(metric)
+			if len(kept) != 0 {
+				t.AM.Add(metric, kept...)
+			}
+		}
+		if n := t.AM.Len(); num < n {
+			err := errs.NewErrorWithCode(fmt.Sprintf("metrics limit exceeded: %d < %d", num, n), http.StatusForbidden)
+			for _, target := range t.List {
+				if !dropped[target] {
+					failed = append(failed, TargetError{Target: target, Err: err})
+				}
+			}
+			for _, metric := range t.AM.Series(false) {
+				t.AM.Delete(metric)
+			}
+		}
+	}
+	return failed
+}
+
 func getDataTimeout(cfg *config.Config, m *MultiTarget) time.Duration {
 	dataTimeout := cfg.ClickHouse.DataTimeout
 	if len(cfg.ClickHouse.QueryParams) > 1 {
@@ -138,20 +202,79 @@ func GetQueryParam(username string, cfg *config.Config, m *MultiTarget) (*config
 	return &cfg.ClickHouse.QueryParams[n], n
 }
 
+// TargetError is the error of the target, which is dropped from the partial response
+type TargetError struct {
+	Target string
+	Err    error
+}
+
+func (e TargetError) Error() string {
+	return e.Target + ": " + e.Err.Error()
+}
+
 // Fetch fetches the parsed ClickHouse data returns CHResponses
 func (m *MultiTarget) Fetch(ctx context.Context, cfg *config.Config, chContext string, qlimiter limiter.ServerLimiter, queueDuration *time.Duration) (CHResponses, error) {
+	if cfg.Common.CoalesceRequests && !clickhouse.Explaining(ctx) {
+		responses, _, err := m.fetchShared(ctx, cfg, chContext, qlimiter, queueDuration, false)
+		if err != nil {
+			return EmptyResponse(), err
+		}
+		return responses, nil
+	}
+	query, _, err := m.fetch(ctx, cfg, chContext, qlimiter, queueDuration, nil, false)
+	if err != nil {
+		return EmptyResponse(), err
+	}
+	return query.CHResponses, nil
+}
+
+// FetchPartial is like Fetch, but the failed time frames are dropped from the response instead of failing it.
+// The targets of the failed time frames are returned with their errors. The error is returned only when all
+// time frames are failed or the request is rejected as a whole
+func (m *MultiTarget) FetchPartial(ctx context.Context, cfg *config.Config, chContext string, qlimiter limiter.ServerLimiter, queueDuration *time.Duration) (CHResponses, []TargetError, error) {
+	if cfg.Common.CoalesceRequests && !clickhouse.Explaining(ctx) {
+		responses, failed, err := m.fetchShared(ctx, cfg, chContext, qlimiter, queueDuration, true)
+		if err != nil {
+			return EmptyResponse(), failed, err
+		}
+		return responses, failed, nil
+	}
+	query, failed, err := m.fetch(ctx, cfg, chContext, qlimiter, queueDuration, nil, true)
+	if err != nil {
+		return EmptyResponse(), failed, err
+	}
+	return query.CHResponses, failed, nil
+}
+
+// Stream fetches ClickHouse data and writes series to w as soon as they are read, see SeriesWriter.
+// It returns the count of written points
+func (m *MultiTarget) Stream(ctx context.Context, cfg *config.Config, chContext string, qlimiter limiter.ServerLimiter, queueDuration *time.Duration, w SeriesWriter) (int64, error) {
+	query, _, err := m.fetch(ctx, cfg, chContext, qlimiter, queueDuration, w, false)
+	if err != nil {
+		return 0, err
+	}
+	return query.streamedPoints, nil
+}
+
+func (m *MultiTarget) fetch(ctx context.Context, cfg *config.Config, chContext string, qlimiter limiter.ServerLimiter, queueDuration *time.Duration, w SeriesWriter, partial bool) (*query, []TargetError, error) {
 	var (
 		lock    sync.RWMutex
 		wg      sync.WaitGroup
 		entered int
+		failed  []TargetError
 	)
 	logger := scope.Logger(ctx)
 	setCarbonlinkClient(&cfg.Carbonlink)
 
-	err := m.checkMetricsLimitExceeded(cfg.Common.MaxMetricsPerTarget)
-	if err != nil {
+	var err error
+	if partial {
+		failed = m.dropMetricsLimitExceeded(cfg.Common.MaxMetricsPerTarget)
+		for _, e := range failed {
+			logger.Warn("data fetch", zap.String("target", e.Target), zap.Error(e.Err))
+		}
+	} else if err = m.checkMetricsLimitExceeded(cfg.Common.MaxMetricsPerTarget); err != nil {
 		logger.Error("data fetch", zap.Error(err))
-		return nil, err
+		return nil, nil, err
 	}
 
 	dataTimeout := getDataTimeout(cfg, m)
@@ -166,25 +289,40 @@ func (m *MultiTarget) Fetch(ctx context.Context, cfg *config.Config, chContext s
 
 	errors := make([]error, 0, len(*m))
 	query := newQuery(cfg, len(*m))
+	query.writer = w
 
+TimeFrameLoop:
 	for tf, targets := range *m {
 		tf, targets := tf, targets
 		cond := &conditions{TimeFrame: &tf,
 			Targets:           targets,
-			aggregated:        cfg.ClickHouse.InternalAggregation,
+			aggregated:        cfg.ClickHouse.InternalAggregation && !targets.Raw,
 			appendEmptySeries: cfg.Common.AppendEmptySeries,
 		}
 		if cond.MaxDataPoints <= 0 || int64(cfg.ClickHouse.MaxDataPoints) < cond.MaxDataPoints {
 			cond.MaxDataPoints = int64(cfg.ClickHouse.MaxDataPoints)
 		}
-		err := cond.selectDataTable(cfg, cond.TimeFrame, chContext)
-		if err != nil {
-			lock.Lock()
-			errors = append(errors, err)
-			lock.Unlock()
-			logger.Error("data tables is not specified", zap.Error(err))
-			return EmptyResponse(), err
+		var conds []*conditions
+		if cfg.ClickHouse.StitchDataTables && cond.aggregated && w == nil {
+			conds = cond.stitchConditions(cfg, chContext)
+		}
+		if len(conds) == 0 {
+			err := cond.selectDataTable(cfg, cond.TimeFrame, chContext)
+			if err != nil {
+				lock.Lock()
+				errors = append(errors, err)
+				lock.Unlock()
+				logger.Error("data tables is not specified", zap.Error(err))
+				return nil, nil, err
+			}
+			conds = []*conditions{cond}
+		} else {
+			// every part of the time frame takes part in the common step
+			query.cStep.addTargets(len(conds) - 1)
+			logger.Debug("stitch data tables", zap.Int64("from", tf.From), zap.Int64("until", tf.Until), zap.Int("parts", len(conds)))
 		}
+		query.conds = append(query.conds, conds...)
+		// the parts of the stitched time frame share one slot of the limiter
 		if qlimiter.Enabled() {
 			start := time.Now()
 			err = qlimiter.Enter(ctxTimeout, "render")
@@ -196,26 +334,40 @@ func (m *MultiTarget) Fetch(ctx context.Context, cfg *config.Config, chContext s
 				lock.Lock()
 				errors = append(errors, err)
 				lock.Unlock()
-				break
+				break TimeFrameLoop
 			}
 			entered++
 		}
-		wg.Add(1)
-		go func(cond *conditions) {
-			defer wg.Done()
-			err := query.getDataPoints(ctxTimeout, cond)
-			if err != nil {
-				lock.Lock()
-				errors = append(errors, err)
-				lock.Unlock()
-				return
-			}
-		}(cond)
+		for _, cond := range conds {
+			wg.Add(1)
+			go func(cond *conditions) {
+				defer wg.Done()
+				err := query.getDataPoints(ctxTimeout, cond)
+				if err != nil {
+					lock.Lock()
+					if !partial {
+						errors = append(errors, err)
+					} else if cond.stitch == nil || cond.stitch.fail() {
+						// the failed time frame is reported once for all its parts
+						logger.Warn("data fetch", zap.Strings("targets", cond.List), zap.Error(err))
+						for _, target := range cond.List {
+							failed = append(failed, TargetError{Target: target, Err: err})
+						}
+					}
+					lock.Unlock()
+					return
+				}
+			}(cond)
+		}
 	}
 	wg.Wait()
 	for len(errors) != 0 {
-		return EmptyResponse(), errors[0]
+		return nil, failed, errors[0]
+	}
+	if len(failed) != 0 && len(query.CHResponses) == 0 {
+		// nothing to return
+		return nil, failed, failed[0].Err
 	}
 
-	return query.CHResponses, nil
+	return query, failed, nil
 }
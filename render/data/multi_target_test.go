@@ -1,10 +1,24 @@
 package data
 
 import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
 	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/helper/rollup"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
 )
 
 func Test_getDataTimeout(t *testing.T) {
@@ -152,3 +166,102 @@ func Test_getDataTimeout(t *testing.T) {
 		})
 	}
 }
+
+func TestMFRToMultiTargetHighPrecisionTimestamps(t *testing.T) {
+	m := MFRToMultiTarget(&v3pb.MultiFetchRequest{Metrics: []v3pb.FetchRequest{
+		{PathExpression: "a.*", StartTime: 1647198000500, StopTime: 1647234000999, HighPrecisionTimestamps: true},
+		{PathExpression: "b.*", StartTime: 1647198000, StopTime: 1647234000},
+		{PathExpression: "c.*", StartTime: 1647198001000, StopTime: 1647234001000, HighPrecisionTimestamps: true},
+	}})
+	// timestamps in milliseconds are converted to seconds, and targets in seconds disable high precision
+	require.Len(t, m, 2)
+	targets := m[TimeFrame{From: 1647198000, Until: 1647234000}]
+	require.NotNil(t, targets)
+	assert.Equal(t, []string{"a.*", "b.*"}, targets.List)
+	assert.False(t, targets.HighPrecisionTimestamps)
+	targets = m[TimeFrame{From: 1647198001, Until: 1647234001}]
+	require.NotNil(t, targets)
+	assert.True(t, targets.HighPrecisionTimestamps)
+}
+
+func TestFetchPartial(t *testing.T) {
+	metrics.DisableMetrics()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "fail.metric") {
+			http.Error(w, "Code: 241. DB::Exception: Memory limit exceeded", http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.ClickHouse.QueryParams = []config.QueryParam{{URL: srv.URL, DataTimeout: cfg.ClickHouse.DataTimeout, Limiter: limiter.NoopLimiter{}}}
+	r, err := rollup.NewDefault(60, "avg")
+	require.NoError(t, err)
+	cfg.DataTable = []config.DataTable{
+		{
+			Table:        "graphite_data",
+			ContextMap:   map[string]bool{config.ContextGraphite: true},
+			Rollup:       r,
+			QueryMetrics: metrics.InitQueryMetrics("graphite_data", &cfg.Metrics),
+		},
+	}
+
+	newMultiTarget := func(metricsNames ...string) MultiTarget {
+		m := make(MultiTarget)
+		for i, name := range metricsNames {
+			targets := NewTargetsOne(name, 1, alias.New())
+			targets.AM.MergeTarget(finder.NewMockFinder([][]byte{[]byte(name)}), name, false)
+			m[TimeFrame{From: 1669453200 + int64(i)*60, Until: 1669456800}] = targets
+		}
+		return m
+	}
+	var queueDuration time.Duration
+
+	t.Run("failed time frame is dropped", func(t *testing.T) {
+		m := newMultiTarget("ok.metric", "fail.metric")
+		_, err := m.Fetch(context.Background(), cfg, config.ContextGraphite, limiter.NoopLimiter{}, &queueDuration)
+		require.Error(t, err)
+
+		reply, failed, err := m.FetchPartial(context.Background(), cfg, config.ContextGraphite, limiter.NoopLimiter{}, &queueDuration)
+		require.NoError(t, err)
+		require.Len(t, reply, 1)
+		assert.Equal(t, []string{"ok.metric"}, reply[0].Data.AM.Series(false))
+		require.Len(t, failed, 1)
+		assert.Equal(t, "fail.metric", failed[0].Target)
+		assert.Contains(t, failed[0].Error(), "Memory limit exceeded")
+	})
+
+	t.Run("all time frames are failed", func(t *testing.T) {
+		m := newMultiTarget("fail.metric")
+		_, failed, err := m.FetchPartial(context.Background(), cfg, config.ContextGraphite, limiter.NoopLimiter{}, &queueDuration)
+		require.Error(t, err)
+		assert.Len(t, failed, 1)
+	})
+
+	t.Run("target over the metrics limit is dropped", func(t *testing.T) {
+		cfg.Common.MaxMetricsPerTarget = 2
+		defer func() { cfg.Common.MaxMetricsPerTarget = 0 }()
+
+		newMultiTarget := func() MultiTarget {
+			targets := NewTargets([]string{"few.*", "many.*"}, alias.New())
+			targets.AM.MergeTarget(finder.NewMockFinder([][]byte{[]byte("few.a")}), "few.*", false)
+			targets.AM.MergeTarget(finder.NewMockFinder([][]byte{[]byte("many.a"), []byte("many.b"), []byte("many.c")}), "many.*", false)
+			return MultiTarget{TimeFrame{From: 1669453200, Until: 1669456800}: targets}
+		}
+
+		m := newMultiTarget()
+		_, err := m.Fetch(context.Background(), cfg, config.ContextGraphite, limiter.NoopLimiter{}, &queueDuration)
+		require.Error(t, err)
+
+		m = newMultiTarget()
+		reply, failed, err := m.FetchPartial(context.Background(), cfg, config.ContextGraphite, limiter.NoopLimiter{}, &queueDuration)
+		require.NoError(t, err)
+		require.Len(t, reply, 1)
+		assert.Equal(t, []string{"few.a"}, reply[0].Data.AM.Series(false))
+		require.Len(t, failed, 1)
+		assert.Equal(t, "many.*", failed[0].Target)
+		assert.Contains(t, failed[0].Error(), "metrics limit exceeded: 2 < 3")
+	})
+}
@@ -5,13 +5,16 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
 	"go.uber.org/zap"
 
 	"github.com/lomik/graphite-clickhouse/config"
@@ -25,24 +28,45 @@ import (
 	"github.com/lomik/graphite-clickhouse/pkg/where"
 )
 
-// from, until, step, function, table, prewhere, where
-// arrayFilter(x->isNotNull(x)) - do not pass nulls to client
-// -Resample - group time and values by time intervals and apply aggregation function
-// -OrNull - if there aren't points in an interval, null will be returned
+// from, until, step, time, time type
+// mask contains the interval start for intervals with points and 0 for the rest
 // intDiv(Time, x)*x - round Time down to step multiplier
-// TODO: support custom aggregating functions
-const queryAggregated = `WITH anyResample(%[1]d, %[2]d, %[3]d)(toUInt32(intDiv(Time, %[3]d)*%[3]d), Time) AS mask
+const queryMask = `anyResample(%[1]d, %[2]d, %[3]d)(to%[5]s(intDiv(%[4]s, %[3]d)*%[3]d), %[4]s)`
+
+// from, until, step, time, time type, min points
+// It's queryMask, where intervals with less than min points are masked out, see xFilesFactor
+const queryMaskXFilesFactor = `arrayMap((m,n)->if(n<%[6]d, 0, m), ` + queryMask + `, countResample(%[1]d, %[2]d, %[3]d)(%[4]s))`
+
+// from, until, step, resampled values, table, prewhere, where, mask
+// arrayFilter(x->isNotNull(x)) - do not pass nulls to client
+// resampled values - values grouped by time intervals and aggregated by the function, see rollup.Aggr.Resample
+const queryAggregated = `WITH %[8]s AS mask
 SELECT Path,
  arrayFilter(m->m!=0, mask) AS times,
- arrayFilter((v,m)->m!=0, %[4]sResample(%[1]d, %[2]d, %[3]d)(Value, Time), mask) AS values
+ arrayFilter((v,m)->m!=0, %[4]s, mask) AS values
 FROM %[5]s
 %[6]s
 %[7]s
 GROUP BY Path
 FORMAT RowBinary`
 
-// table, prewhere, where
-const queryUnaggregated = `SELECT Path, groupArray(Time), groupArray(Value), groupArray(Timestamp)
+// from, until, step, resampled values, table, prewhere, where, functions, result step, result index, mask
+// It's queryAggregated with graphite functions evaluated over values, see pushdownFunctions.
+// f0 contains values for every interval and nan for intervals without points, every function
+// builds fN from f(N-1), and the last one is returned without nan values
+const queryPushdown = `WITH %[11]s AS mask,
+ arrayMap((v,m)->if(m=0, nan, v), %[4]s, mask) AS f0%[8]s
+SELECT Path,
+ arrayFilter((t,v)->NOT isNaN(v), arrayMap(i->toUInt32(%[1]d+i*%[9]d), range(length(f%[10]d))), f%[10]d) AS times,
+ arrayFilter(v->NOT isNaN(v), f%[10]d) AS values
+FROM %[5]s
+%[6]s
+%[7]s
+GROUP BY Path
+FORMAT RowBinary`
+
+// time, table, prewhere, where
+const queryUnaggregated = `SELECT Path, groupArray(%s), groupArray(Value), groupArray(Timestamp)
 FROM %s
 %s
 %s
@@ -57,11 +81,17 @@ type query struct {
 	cStep         *commonStep
 	chTLSConfig   *tls.Config
 	chQueryParams []config.QueryParam
+	chUserLimits  map[string]config.UserLimits
 
 	chConnectTimeout time.Duration
 	debugDir         string
 	debugExtDataPerm os.FileMode
 	lock             sync.RWMutex
+	// writer is set for streaming requests, series are written to it instead of CHResponses
+	writer         SeriesWriter
+	streamedPoints int64
+	// conds contains the conditions of all queried time frames, they are used to explain the request
+	conds []*conditions
 }
 
 type conditions struct {
@@ -70,7 +100,7 @@ type conditions struct {
 	// aggregated shows is it request with ClickHouse aggregation or not
 	aggregated bool
 	// step is used in requests for proper until/from calculation. It's max(steps) for non-aggregated
-	// requests and LCM(steps) for aggregated requests
+	// requests and LCM(steps) for aggregated requests. Like from and until, it's in the time units of the table
 	step int64
 	// from is aligned to step
 	from int64
@@ -86,12 +116,40 @@ type conditions struct {
 	appendEmptySeries bool
 	// metricUnreversed grouped by aggregating function
 	aggregations map[string][]string
-	// External-data bodies grouped by aggregatig function. For non-aggregated requests "" used as a key
+	// metricUnreversed grouped by xFilesFactor
+	xFilesFactors map[float32][]string
+	// metricsXFilesFactor contains xFilesFactor of metricsRequested with the same indexes
+	metricsXFilesFactor []xFilesFactor
+	// queryXFilesFactors contains xFilesFactor of aggregated queries, the keys are the same as for extDataBodies
+	queryXFilesFactors map[string]xFilesFactor
+	// External-data bodies grouped by aggregatig function and pushed down functions. For non-aggregated requests "" used as a key
 	extDataBodies    map[string]*strings.Builder
 	metricsRequested []string
 	metricsUnreverse []string
 	metricsLookup    []string
 	appliedFunctions map[string][]string
+	// pushdowns contains functions evaluated by ClickHouse, the keys are the same as for extDataBodies
+	pushdowns map[string]*pushdown
+	// metricUnreversed grouped by step, changed by pushed down functions
+	pushdownSteps map[uint32][]string
+	// seriesAggregations contains targets aggregated across series by ClickHouse
+	seriesAggregations []*seriesAggregation
+	// stream is used to write series of aggregated queries as soon as they are parsed
+	stream *stream
+	// stitch merges the responses, when the time frame is split between data tables
+	stitch *stitch
+}
+
+// xFilesFactor is the minimal ratio of known points in the aggregated intervals of the metric
+type xFilesFactor struct {
+	ratio float32
+	// precision of the stored points, it's used to calculate the expected count of points in the interval
+	precision uint32
+}
+
+// key identifies queries for metrics with the same xFilesFactor
+func (x xFilesFactor) key() string {
+	return fmt.Sprintf("xFilesFactor(%g,%d)", x.ratio, x.precision)
 }
 
 func newQuery(cfg *config.Config, targets int) *query {
@@ -110,6 +168,7 @@ func newQuery(cfg *config.Config, targets int) *query {
 		CHResponses:      make([]CHResponse, 0, targets),
 		cStep:            cStep,
 		chQueryParams:    cfg.ClickHouse.QueryParams,
+		chUserLimits:     cfg.ClickHouse.UserLimits,
 		chConnectTimeout: cfg.ClickHouse.ConnectTimeout,
 		chTLSConfig:      cfg.ClickHouse.TLSConfig,
 		debugDir:         cfg.Debug.Directory,
@@ -134,6 +193,15 @@ func (q *query) getParam(from, until int64) (string, time.Duration) {
 	return q.chQueryParams[n].URL, q.chQueryParams[n].DataTimeout
 }
 
+// getEstimateLimits returns the thresholds of EXPLAIN ESTIMATE for the user of ctx and the query params of from/until
+func (q *query) getEstimateLimits(ctx context.Context, from, until int64) clickhouse.EstimateLimits {
+	duration := time.Second * time.Duration(until-from)
+
+	n := config.GetQueryParam(q.chQueryParams, duration)
+
+	return config.GetEstimateLimits(q.chUserLimits, scope.User(ctx), q.chQueryParams[n].MaxEstimatedRows, q.chQueryParams[n].MaxEstimatedMarks)
+}
+
 func (q *query) getDataPoints(ctx context.Context, cond *conditions) error {
 	logger := scope.Logger(ctx)
 	var err error
@@ -145,11 +213,16 @@ func (q *query) getDataPoints(ctx context.Context, cond *conditions) error {
 	}
 
 	// carbonlink request
-	carbonlinkResponseRead := queryCarbonlink(ctx, carbonlink, cond.metricsUnreverse)
+	unit := cond.timeUnit()
+	carbonlinkResponseRead := queryCarbonlink(ctx, carbonlink, cond.metricsUnreverse, unit)
 
 	err = cond.prepareLookup()
 	if err != nil {
 		logger.Error("prepare_lookup", zap.Error(err))
+		if cond.aggregated {
+			// don't make other time frames wait for the common step of the failed one
+			q.cStep.doneTarget()
+		}
 		return errs.NewErrorWithCode(err.Error(), http.StatusBadRequest)
 	}
 	cond.setStep(q.cStep)
@@ -157,51 +230,71 @@ func (q *query) getDataPoints(ctx context.Context, cond *conditions) error {
 		return ErrSetStepTimeout
 	}
 	cond.setFromUntil()
+	cond.setPushdowns()
 	cond.setPrewhere()
 	cond.setWhere()
 
+	// Points of non-aggregated requests and from carbonlink are processed after all of them are read,
+	// so they are written to the stream only at the end
+	if q.writer != nil && cond.aggregated && carbonlink == nil {
+		cond.stream = newStream(q.writer, cond)
+	}
+
 	queryContext, queryCancel := context.WithCancel(ctx)
 	defer queryCancel()
-	data := prepareData(queryContext, len(cond.extDataBodies), carbonlinkResponseRead)
+	data := prepareData(queryContext, len(cond.extDataBodies)+len(cond.seriesAggregations), carbonlinkResponseRead)
 
 	var ch_read_bytes, ch_read_rows int64
-	for agg, extTableBody := range cond.extDataBodies {
-		extData := q.metricsListExtData(extTableBody)
-		query := cond.generateQuery(agg)
-		data.wg.Add(1)
-		go func() {
-			defer data.wg.Done()
-			chURL, chDataTimeout := q.getParam(cond.from, cond.until)
-			body, err := clickhouse.Reader(
-				scope.WithTable(ctx, cond.pointsTable),
-				chURL,
-				query,
-				clickhouse.Options{
-					Timeout:        chDataTimeout,
-					ConnectTimeout: q.chConnectTimeout,
-					TLSConfig:      q.chTLSConfig,
-				},
-				extData,
-			)
-			if err == nil {
-				atomic.AddInt64(&ch_read_bytes, body.ChReadBytes())
-				atomic.AddInt64(&ch_read_rows, body.ChReadRows())
-				err = data.parseResponse(queryContext, body, cond)
-				if err != nil {
-					logger.Error("reader", zap.Error(err))
-					data.e <- err
-					queryCancel()
-				}
-			} else {
+	read := func(query string, extData *clickhouse.ExternalData, parse func(io.ReadCloser) error) {
+		defer data.wg.Done()
+		chURL, chDataTimeout := q.getParam(cond.from/unit, cond.until/unit)
+		body, err := clickhouse.Reader(
+			scope.WithTable(ctx, cond.pointsTable),
+			chURL,
+			query,
+			clickhouse.Options{
+				Timeout:        chDataTimeout,
+				ConnectTimeout: q.chConnectTimeout,
+				TLSConfig:      q.chTLSConfig,
+				Estimate:       q.getEstimateLimits(ctx, cond.from/unit, cond.until/unit),
+			},
+			extData,
+		)
+		if err == nil {
+			atomic.AddInt64(&ch_read_bytes, body.ChReadBytes())
+			atomic.AddInt64(&ch_read_rows, body.ChReadRows())
+			err = parse(body)
+			if err != nil {
 				logger.Error("reader", zap.Error(err))
 				data.e <- err
 				queryCancel()
 			}
-		}()
+		} else {
+			logger.Error("reader", zap.Error(err))
+			data.e <- err
+			queryCancel()
+		}
+	}
+	for agg, extTableBody := range cond.extDataBodies {
+		data.wg.Add(1)
+		go read(cond.generateQuery(agg), q.metricsListExtData(extTableBody), func(body io.ReadCloser) error {
+			return data.parseResponse(queryContext, body, cond)
+		})
+	}
+	for _, sa := range cond.seriesAggregations {
+		sa := sa
+		data.wg.Add(1)
+		go read(cond.generateSeriesQuery(sa), q.metricsListExtData(&sa.extDataBody), func(body io.ReadCloser) error {
+			return sa.parseResponse(queryContext, body, cond)
+		})
 	}
 
 	err = data.wait(queryContext)
-	metrics.SendQueryRead(cond.queryMetrics, cond.from, cond.until, data.spent.Milliseconds(), int64(data.Points.Len()), int64(data.length), ch_read_rows, ch_read_bytes, err != nil)
+	readPoints := int64(data.Points.Len())
+	if cond.stream != nil {
+		readPoints += cond.stream.points
+	}
+	metrics.SendQueryRead(cond.queryMetrics, cond.from/unit, cond.until/unit, data.spent.Milliseconds(), readPoints, int64(data.length), ch_read_rows, ch_read_bytes, err != nil)
 	if err != nil {
 		logger.Error(
 			"data_parser", zap.Error(err), zap.Int("read_bytes", data.length),
@@ -214,8 +307,10 @@ func (q *query) getDataPoints(ctx context.Context, cond *conditions) error {
 		zap.String("runtime", data.spent.String()), zap.Duration("runtime_ns", data.spent),
 	)
 
+	cond.mergeSeriesAggregations(data)
 	data.setSteps(cond)
 	data.Points.SetAggregations(cond.aggregations)
+	data.Points.SetXFilesFactors(cond.xFilesFactors)
 
 	// ClickHouse returns sorted and uniq values, when internal aggregation is used
 	// But if carbonlink is used, we still need to sort, filter and rollup points
@@ -226,29 +321,63 @@ func (q *query) getDataPoints(ctx context.Context, cond *conditions) error {
 		logger.Debug("sort", zap.String("runtime", d.String()), zap.Duration("runtime_ns", d))
 
 		data.Points.Uniq()
-		rollupStart := time.Now()
-		err = cond.rollupRules.RollupPoints(data.Points, cond.From, data.CommonStep)
-		if err != nil {
-			logger.Error("rollup failed", zap.Error(err))
-			return err
+		// raw requests return points as they are stored, without rollup
+		if !cond.Raw {
+			rollupStart := time.Now()
+			err = cond.rollupRules.RollupPoints(data.Points, cond.From, data.CommonStep)
+			if err != nil {
+				logger.Error("rollup failed", zap.Error(err))
+				return err
+			}
+			rollupTime := time.Since(rollupStart)
+			logger.Debug(
+				"rollup",
+				zap.String("runtime", rollupTime.String()),
+				zap.Duration("runtime_ns", rollupTime),
+			)
 		}
-		rollupTime := time.Since(rollupStart)
-		logger.Debug(
-			"rollup",
-			zap.String("runtime", rollupTime.String()),
-			zap.Duration("runtime_ns", rollupTime),
-		)
 	}
 
 	data.AM = cond.AM
 
-	q.appendReply(CHResponse{
-		Data:                 data.Data,
-		From:                 cond.From,
-		Until:                cond.Until,
-		AppendOutEmptySeries: cond.appendEmptySeries,
-		AppliedFunctions:     cond.appliedFunctions,
-	})
+	from, until := cond.From, cond.Until
+	if cond.highPrecision() {
+		from, until = cond.From*unit, cond.Until*unit+unit-1
+	} else if unit != 1 {
+		data.timeToSeconds()
+	}
+
+	chr := CHResponse{
+		Data:                    data.Data,
+		From:                    from,
+		Until:                   until,
+		AppendOutEmptySeries:    cond.appendEmptySeries,
+		AppliedFunctions:        cond.appliedFunctions,
+		HighPrecisionTimestamps: cond.highPrecision(),
+	}
+	if !cond.aggregated {
+		chr.MaxDataPoints = cond.MaxDataPoints
+	}
+	if q.writer != nil {
+		var written map[string]struct{}
+		if cond.stream != nil {
+			written = cond.stream.written
+			atomic.AddInt64(&q.streamedPoints, cond.stream.points)
+		}
+		pointsCount, err := chr.stream(q.writer, written)
+		atomic.AddInt64(&q.streamedPoints, pointsCount)
+		if err != nil {
+			logger.Error("stream", zap.Error(err))
+		}
+		return err
+	}
+	if cond.stitch != nil {
+		var merged bool
+		if chr, merged = cond.stitch.add(chr); !merged {
+			return nil
+		}
+	}
+	q.appendReply(chr)
 	return nil
 }
 
@@ -288,13 +417,36 @@ func (c *conditions) prepareMetricsLists() {
 func (c *conditions) prepareLookup() error {
 	age := uint32(dry.Max(0, time.Now().Unix()-c.From))
 	c.aggregations = make(map[string][]string)
+	c.xFilesFactors = make(map[float32][]string)
+	c.metricsXFilesFactor = make([]xFilesFactor, len(c.metricsRequested))
+	c.queryXFilesFactors = make(map[string]xFilesFactor)
 	c.appliedFunctions = make(map[string][]string)
 	c.extDataBodies = make(map[string]*strings.Builder)
 	c.steps = make(map[uint32][]string)
-	aggName := ""
+	c.pushdowns = make(map[string]*pushdown)
+	c.seriesAggregations = nil
+
+	// Functions are evaluated by ClickHouse only over aggregated values.
+	// Points from carbonlink are merged and rolled up after the query.
+	// Functions like perSecond and summarize expect steps in seconds, so they aren't pushed down for milliseconds.
+	var (
+		chains map[string][]*v3pb.FilteringFunction
+		series map[string]*seriesAggregation
+	)
+	if c.aggregated && carbonlink == nil {
+		// functions over the part of the time frame could return wrong values at the boundaries.
+		// Series aggregations rewrite the aliases map, which is shared by the stitched parts
+		if c.stitch == nil {
+			if c.timeUnit() == 1 {
+				chains = c.pushdownChains()
+			}
+			series = c.prepareSeriesAggregations()
+		}
+	}
 
 	for i := range c.metricsRequested {
 		step, agg, _, _ := c.rollupRules.Lookup(c.metricsLookup[i], age, false)
+		xff := agg.XFilesFactor()
 
 		// Override agregation with an argument of consolidateBy function.
 		// consolidateBy with its argument is passed through FilteringFunctions field of carbonapi_v3_pb protocol.
@@ -306,12 +458,29 @@ func (c *conditions) prepareLookup() error {
 				return fmt.Errorf("failed to choose appropriate aggregation for '%s': %s", alias.Target, err.Error())
 			}
 			if requestedAgg != "" {
-				agg = rollup.AggrMap[requestedAgg]
+				agg, _ = rollup.GetAggr(requestedAgg)
 				c.appliedFunctions[alias.Target] = []string{graphiteConsolidationFunction}
 				break
 			}
 		}
 
+		// Override xFilesFactor of the rollup rules with an argument of setXFilesFactor function the same way.
+		for _, alias := range c.AM.Get(c.metricsUnreverse[i]) {
+			requestedXFilesFactor, name, err := c.GetRequestedXFilesFactor(alias.Target)
+			if err != nil {
+				return fmt.Errorf("failed to choose appropriate xFilesFactor for '%s': %s", alias.Target, err.Error())
+			}
+			if name != "" {
+				xff = requestedXFilesFactor
+				if !slices.Contains(c.appliedFunctions[alias.Target], name) {
+					c.appliedFunctions[alias.Target] = append(c.appliedFunctions[alias.Target], name)
+				}
+				break
+			}
+		}
+		c.metricsXFilesFactor[i] = xFilesFactor{ratio: xff, precision: step}
+		c.xFilesFactors[xff] = append(c.xFilesFactors[xff], c.metricsUnreverse[i])
+
 		if _, ok := c.steps[step]; !ok {
 			c.steps[step] = make([]string, 0)
 		}
@@ -321,46 +490,83 @@ func (c *conditions) prepareLookup() error {
 			c.steps[step] = append(c.steps[step], c.metricsUnreverse[i])
 		}
 
-		// Fill up metric names for aggregations
-		if mm, ok := c.aggregations[agg.Name()]; ok {
-			c.aggregations[agg.Name()] = append(mm, c.metricsUnreverse[i])
-		} else {
-			c.aggregations[agg.Name()] = []string{c.metricsUnreverse[i]}
+		// Metrics aggregated across series are added after all aggregations are known
+		if sa, ok := series[c.metricsUnreverse[i]]; ok {
+			sa.add(i, agg.Name(), c.metricsXFilesFactor[i])
+			continue
 		}
+		c.addLookup(i, agg.Name(), chains)
+	}
 
-		// Build external-data bodies. For non-aggregated requests there is only one request
-		if c.aggregated {
-			aggName = agg.Name()
+	c.setSeriesAggregations(chains)
+	return nil
+}
+
+// addLookup adds the metric with index i to aggregations and external-data bodies
+func (c *conditions) addLookup(i int, agg string, chains map[string][]*v3pb.FilteringFunction) {
+	// Fill up metric names for aggregations
+	if mm, ok := c.aggregations[agg]; ok {
+		c.aggregations[agg] = append(mm, c.metricsUnreverse[i])
+	} else {
+		c.aggregations[agg] = []string{c.metricsUnreverse[i]}
+	}
+
+	// Build external-data bodies. For non-aggregated requests there is only one request
+	aggName := ""
+	if c.aggregated {
+		aggName = agg
+		// all targets of the metric have the same chain, see pushdownChains
+		var functions []*v3pb.FilteringFunction
+		if aliases := c.AM.Get(c.metricsUnreverse[i]); len(aliases) > 0 {
+			functions = chains[aliases[0].Target]
 		}
-		if mm, ok := c.extDataBodies[aggName]; ok {
-			mm.WriteString(c.metricsRequested[i] + "\n")
-		} else {
-			var mm strings.Builder
-			c.extDataBodies[aggName] = &mm
-			mm.WriteString(c.metricsRequested[i] + "\n")
+		if len(functions) > 0 {
+			aggName += "|" + pushdownKey(functions)
+		}
+		// intervals with not enough points are filtered by the query
+		if x := c.metricsXFilesFactor[i]; x.ratio > 0 {
+			aggName += "|" + x.key()
+			c.queryXFilesFactors[aggName] = x
+		}
+		if len(functions) > 0 {
+			p, ok := c.pushdowns[aggName]
+			if !ok {
+				p = &pushdown{agg: agg, functions: functions}
+				c.pushdowns[aggName] = p
+			}
+			p.metrics = append(p.metrics, c.metricsUnreverse[i])
 		}
 	}
-	return nil
+	if mm, ok := c.extDataBodies[aggName]; ok {
+		mm.WriteString(c.metricsRequested[i] + "\n")
+	} else {
+		var mm strings.Builder
+		c.extDataBodies[aggName] = &mm
+		mm.WriteString(c.metricsRequested[i] + "\n")
+	}
 }
 
 var ErrSetStepTimeout = errors.New("unexpected error, setStep timeout")
 
 func (c *conditions) setStep(cStep *commonStep) {
 	step := int64(0)
+	minStep := c.minStep()
 	if !c.aggregated {
 		// Use max(steps)
 		for s := range c.steps {
 			step = dry.Max(step, int64(s))
 		}
-		c.step = step
+		c.step = dry.CeilToMultiplier(step, minStep)
 		return
 	}
 
 	// Use LCM(steps)
 	// XXX: This could cause problems, when MutliFetchRequest uses different MaxDataPoints,
 	// but currently (2021-04-22) it's not possible
+	// The common step is calculated in milliseconds, so tables with seconds and milliseconds could be mixed
+	msInUnit := 1000 / c.timeUnit()
 	for s := range c.steps {
-		step = cStep.calculateUnsafe(step, int64(s))
+		step = cStep.calculateUnsafe(step, dry.CeilToMultiplier(int64(s), minStep)*msInUnit)
 	}
 	cStep.calculate(step)
 	rStep := cStep.getResult()
@@ -368,26 +574,158 @@ func (c *conditions) setStep(cStep *commonStep) {
 		c.step = -1
 		return
 	}
-	step = dry.Max(rStep, dry.Ceil(c.Until-c.From, c.MaxDataPoints))
+	rStep = dry.CeilToMultiplier(dry.Ceil(rStep, msInUnit), minStep)
+	// parts of the stitched time frame must have the same step
+	from, until := c.From, c.Until
+	if c.stitch != nil {
+		from, until = c.stitch.From, c.stitch.Until
+	}
+	step = dry.Max(rStep, dry.Ceil((until-from)*c.timeUnit(), c.MaxDataPoints))
 	c.step = dry.CeilToMultiplier(step, rStep)
 	return
 }
 
 func (c *conditions) setFromUntil() {
-	c.from = dry.CeilToMultiplier(c.From, c.step)
-	c.until = dry.FloorToMultiplier(c.Until, c.step) + c.step - 1
+	unit := c.timeUnit()
+	if c.Targets != nil && c.Raw {
+		c.from, c.until = c.From*unit, c.Until*unit+unit-1
+		return
+	}
+	c.from = dry.CeilToMultiplier(c.From*unit, c.step)
+	c.until = dry.FloorToMultiplier(c.Until*unit+unit-1, c.step) + c.step - 1
+}
+
+// timeUnit returns the count of the time units of the table in a second
+func (c *conditions) timeUnit() int64 {
+	if c.Targets != nil && c.highPrecisionTime != "" {
+		return 1000
+	}
+	return 1
+}
+
+// highPrecision returns true when points of the table are returned in milliseconds
+func (c *conditions) highPrecision() bool {
+	return c.timeUnit() != 1 && c.HighPrecisionTimestamps
+}
+
+// minStep returns the minimal step in the time units of the table. Points in milliseconds are returned in
+// seconds when the client doesn't support high precision timestamps, so the step must be a multiple of a second
+func (c *conditions) minStep() int64 {
+	if c.timeUnit() != 1 && !c.highPrecision() {
+		return c.timeUnit()
+	}
+	return 1
+}
+
+// timeColumn returns ClickHouse expression for the Time column in the time units of the table
+func (c *conditions) timeColumn() string {
+	if c.Targets != nil && c.highPrecisionTime == config.HighPrecisionTimeDateTime64 {
+		return "toUnixTimestamp64Milli(Time)"
+	}
+	return "Time"
+}
+
+// timeType returns ClickHouse type of the times
+func (c *conditions) timeType() string {
+	if c.timeUnit() != 1 {
+		return "UInt64"
+	}
+	return "UInt32"
+}
+
+// pushdownChains returns the functions, which could be evaluated by ClickHouse, for the targets.
+// Points of a metric are shared by all targets matching it, so targets with different chains sharing
+// the same metric are excluded, and so are the other targets sharing metrics with excluded ones.
+func (c *conditions) pushdownChains() map[string][]*v3pb.FilteringFunction {
+	chains := make(map[string][]*v3pb.FilteringFunction)
+	keys := make(map[string]string)
+	for _, m := range c.metricsUnreverse {
+		for _, a := range c.AM.Get(m) {
+			if _, ok := keys[a.Target]; ok {
+				continue
+			}
+			functions := c.GetPushdownFunctions(a.Target)
+			keys[a.Target] = pushdownKey(functions)
+			if len(functions) > 0 {
+				chains[a.Target] = functions
+			}
+		}
+	}
+
+	for changed := len(chains) > 0; changed; {
+		changed = false
+		for _, m := range c.metricsUnreverse {
+			aliases := c.AM.Get(m)
+			conflict := false
+			for _, a := range aliases[1:] {
+				if keys[a.Target] != keys[aliases[0].Target] {
+					conflict = true
+					break
+				}
+			}
+			if !conflict {
+				continue
+			}
+			for _, a := range aliases {
+				if _, ok := chains[a.Target]; ok {
+					delete(chains, a.Target)
+					keys[a.Target] = ""
+					changed = true
+				}
+			}
+		}
+	}
+	return chains
+}
+
+// setPushdowns builds expressions for pushed down functions and sets applied functions and steps for their targets.
+// It must be called after setFromUntil
+func (c *conditions) setPushdowns() {
+	c.pushdownSteps = make(map[uint32][]string)
+	done := make(map[string]bool)
+	for _, p := range c.pushdowns {
+		p.build(c.from, c.step)
+		if len(p.functions) == 0 {
+			continue
+		}
+		if p.step != c.step {
+			c.pushdownSteps[uint32(p.step)] = append(c.pushdownSteps[uint32(p.step)], p.metrics...)
+		}
+		for _, m := range p.metrics {
+			for _, a := range c.AM.Get(m) {
+				if done[a.Target] {
+					continue
+				}
+				done[a.Target] = true
+				applied := make([]string, 0, len(p.functions)+1)
+				for _, f := range p.functions {
+					applied = append(applied, f.GetName())
+				}
+				// consolidateBy is set by prepareLookup
+				c.appliedFunctions[a.Target] = append(applied, c.appliedFunctions[a.Target]...)
+			}
+		}
+	}
 }
 
 func (c *conditions) setPrewhere() {
 	pw := where.New()
-	pw.And(where.DateBetween("Date", c.from, c.until))
+	pw.And(where.DateBetween("Date", c.from/c.timeUnit(), c.until/c.timeUnit()))
 	c.prewhere = pw.PreWhereSQL()
 }
 
 func (c *conditions) setWhere() {
 	wr := where.New()
 	wr.And(where.InTable("Path", extTableName))
-	wr.And(where.TimestampBetween("Time", c.from, c.until))
+	if c.Targets != nil && c.highPrecisionTime == config.HighPrecisionTimeDateTime64 {
+		// the condition on the column itself allows to use the primary key
+		wr.And(fmt.Sprintf(
+			"Time >= fromUnixTimestamp64Milli(toInt64(%d)) AND Time <= fromUnixTimestamp64Milli(toInt64(%d))",
+			c.from, c.until,
+		))
+	} else {
+		wr.And(where.TimestampBetween("Time", c.from, c.until))
+	}
 	c.where = wr.SQL()
 }
 
@@ -398,14 +736,47 @@ func (c *conditions) generateQuery(agg string) string {
 	return c.generateQueryUnaggregated()
 }
 
-func (c *conditions) generateQueryaAggregated(agg string) string {
+// mask returns ClickHouse expression for the intervals mask, intervals with less points than required by
+// xFilesFactor are masked out
+func (c *conditions) mask(x xFilesFactor) string {
+	if minPoints := rollup.MinPoints(x.ratio, uint32(c.step), x.precision); minPoints > 1 {
+		return fmt.Sprintf(queryMaskXFilesFactor, c.from, c.until, c.step, c.timeColumn(), c.timeType(), minPoints)
+	}
+	return fmt.Sprintf(queryMask, c.from, c.until, c.step, c.timeColumn(), c.timeType())
+}
+
+// resample returns ClickHouse expression for values of the intervals, aggregated by the aggregating function
+func (c *conditions) resample(agg string) string {
+	if ag, ok := rollup.GetAggr(agg); ok {
+		return ag.Resample(c.from, c.until, c.step, c.timeColumn())
+	}
+	return fmt.Sprintf("%sResample(%d, %d, %d)(Value, %s)", agg, c.from, c.until, c.step, c.timeColumn())
+}
+
+func (c *conditions) generateQueryaAggregated(key string) string {
+	// the key is the aggregating function with optional pushed down functions and xFilesFactor, see addLookup
+	agg, _, _ := strings.Cut(key, "|")
+	values := c.resample(agg)
+	mask := c.mask(c.queryXFilesFactors[key])
+	if p, ok := c.pushdowns[key]; ok && len(p.exprs) != 0 {
+		var functions strings.Builder
+		for i, expr := range p.exprs {
+			fmt.Fprintf(&functions, ",\n %s AS f%d", expr, i+1)
+		}
+		return fmt.Sprintf(
+			queryPushdown,
+			c.from, c.until, c.step, values,
+			c.pointsTable, c.prewhere, c.where,
+			functions.String(), p.step, len(p.exprs), mask,
+		)
+	}
 	return fmt.Sprintf(
 		queryAggregated,
-		c.from, c.until, c.step, agg,
-		c.pointsTable, c.prewhere, c.where,
+		c.from, c.until, c.step, values,
+		c.pointsTable, c.prewhere, c.where, mask,
 	)
 }
 
 func (c *conditions) generateQueryUnaggregated() string {
-	return fmt.Sprintf(queryUnaggregated, c.pointsTable, c.prewhere, c.where)
+	return fmt.Sprintf(queryUnaggregated, c.timeColumn(), c.pointsTable, c.prewhere, c.where)
 }
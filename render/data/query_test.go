@@ -525,3 +525,197 @@ func TestGenerateQuery(t *testing.T) {
 		})
 	}
 }
+
+func TestGenerateQueryHighPrecisionTime(t *testing.T) {
+	prewhere := "PREWHERE Date >= '" + date.FromTimestampToDaysFormat(1668124800) + "' AND Date <= '" + date.UntilTimestampToDaysFormat(1668124859) + "'\n"
+	tests := []struct {
+		highPrecisionTime string
+		aggregated        string
+		unaggregated      string
+	}{
+		{
+			highPrecisionTime: "DateTime64",
+			aggregated: ("WITH anyResample(1668124800000, 1668124859999, 500)(toUInt64(intDiv(toUnixTimestamp64Milli(Time), 500)*500), toUnixTimestamp64Milli(Time)) AS mask\n" +
+				"SELECT Path,\n arrayFilter(m->m!=0, mask) AS times,\n" +
+				" arrayFilter((v,m)->m!=0, avgResample(1668124800000, 1668124859999, 500)(Value, toUnixTimestamp64Milli(Time)), mask) AS values\n" +
+				"FROM graphite.table\n" +
+				prewhere +
+				"WHERE (Path in metrics_list) AND (Time >= fromUnixTimestamp64Milli(toInt64(1668124800000)) AND Time <= fromUnixTimestamp64Milli(toInt64(1668124859999)))\n" +
+				"GROUP BY Path\n" +
+				"FORMAT RowBinary"),
+			unaggregated: ("SELECT Path, groupArray(toUnixTimestamp64Milli(Time)), groupArray(Value), groupArray(Timestamp)\n" +
+				"FROM graphite.table\n" +
+				prewhere +
+				"WHERE (Path in metrics_list) AND (Time >= fromUnixTimestamp64Milli(toInt64(1668124800000)) AND Time <= fromUnixTimestamp64Milli(toInt64(1668124859999)))\n" +
+				"GROUP BY Path\n" +
+				"FORMAT RowBinary"),
+		},
+		{
+			highPrecisionTime: "UInt64",
+			aggregated: ("WITH anyResample(1668124800000, 1668124859999, 500)(toUInt64(intDiv(Time, 500)*500), Time) AS mask\n" +
+				"SELECT Path,\n arrayFilter(m->m!=0, mask) AS times,\n" +
+				" arrayFilter((v,m)->m!=0, avgResample(1668124800000, 1668124859999, 500)(Value, Time), mask) AS values\n" +
+				"FROM graphite.table\n" +
+				prewhere +
+				"WHERE (Path in metrics_list) AND (Time >= 1668124800000 AND Time <= 1668124859999)\n" +
+				"GROUP BY Path\n" +
+				"FORMAT RowBinary"),
+			unaggregated: ("SELECT Path, groupArray(Time), groupArray(Value), groupArray(Timestamp)\n" +
+				"FROM graphite.table\n" +
+				prewhere +
+				"WHERE (Path in metrics_list) AND (Time >= 1668124800000 AND Time <= 1668124859999)\n" +
+				"GROUP BY Path\n" +
+				"FORMAT RowBinary"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.highPrecisionTime, func(t *testing.T) {
+			cond := &conditions{
+				TimeFrame: &TimeFrame{From: 1668124800, Until: 1668124859},
+				Targets:   &Targets{pointsTable: "graphite.table", highPrecisionTime: test.highPrecisionTime},
+				step:      500,
+			}
+			cond.setFromUntil()
+			cond.setPrewhere()
+			cond.setWhere()
+			assert.Equal(t, test.unaggregated, cond.generateQuery("avg"))
+			cond.aggregated = true
+			assert.Equal(t, test.aggregated, cond.generateQuery("avg"))
+		})
+	}
+}
+
+func TestSetStepHighPrecisionTime(t *testing.T) {
+	newHighPrecisionCondition := func(highPrecisionTimestamps bool) *conditions {
+		cond := newCondition(1800, 0, 1000)
+		cond.highPrecisionTime = "UInt64"
+		cond.HighPrecisionTimestamps = highPrecisionTimestamps
+		cond.steps = map[uint32][]string{100: {}, 250: {}}
+		return cond
+	}
+
+	// max(steps) is rounded to seconds, when points are returned in seconds
+	cond := newHighPrecisionCondition(false)
+	cond.setStep(nil)
+	assert.Equal(t, int64(1000), cond.step)
+	assert.Equal(t, int64(1000), cond.minStep())
+	cond = newHighPrecisionCondition(true)
+	cond.setStep(nil)
+	assert.Equal(t, int64(250), cond.step)
+	assert.Equal(t, int64(1), cond.minStep())
+
+	// the common step is calculated in milliseconds, so it's shared with tables in seconds
+	cStep := &commonStep{}
+	cStep.addTargets(2)
+	cond = newHighPrecisionCondition(true)
+	cond.aggregated = true
+	secondsCond := newCondition(1800, 0, 1000)
+	secondsCond.aggregated = true
+	secondsCond.steps = map[uint32][]string{3: {}}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		secondsCond.setStep(cStep)
+	}()
+	cond.setStep(cStep)
+	wg.Wait()
+	// LCM(100ms, 250ms, 3s) = 3s, 1800s/1000 points is 1.8s
+	assert.Equal(t, int64(3000), cond.step)
+	assert.Equal(t, int64(3), secondsCond.step)
+
+	cStep = &commonStep{}
+	cStep.addTargets(1)
+	cond = newHighPrecisionCondition(true)
+	cond.aggregated = true
+	cond.MaxDataPoints = 10000
+	cond.setStep(cStep)
+	// LCM(100ms, 250ms) = 500ms, 1800s/10000 points is 180ms
+	assert.Equal(t, int64(500), cond.step)
+}
+
+func TestPrepareLookupXFilesFactor(t *testing.T) {
+	cond := newCondition(5400, 1800, 5)
+	cond.aggregated = true
+	cond.isReverse = false
+	cond.prepareMetricsLists()
+	cond.SetFilteringFunctions(
+		"*.name.*",
+		[]*v3pb.FilteringFunction{{Name: "setXFilesFactor", Arguments: []string{"0.5"}}},
+	)
+	assert.NoError(t, cond.prepareLookup())
+	for x := range cond.xFilesFactors {
+		sort.Strings(cond.xFilesFactors[x])
+	}
+	assert.Equal(t, map[float32][]string{
+		0.5: {"10_min.name.any", "1_min.name.avg", "5_min.name.min", "5_sec.name.max"},
+	}, cond.xFilesFactors)
+	assert.Equal(t, map[string][]string{"*.name.*": {"setXFilesFactor"}}, cond.appliedFunctions)
+	assert.Equal(t, map[string]string{
+		"avg|xFilesFactor(0.5,30)":   "10_min.name.any\n",
+		"avg|xFilesFactor(0.5,300)":  "1_min.name.avg\n",
+		"max|xFilesFactor(0.5,60)":   "5_sec.name.max\n",
+		"min|xFilesFactor(0.5,1200)": "5_min.name.min\n",
+	}, extTableString(cond.extDataBodies))
+
+	cond.from, cond.until, cond.step = 1200, 4799, 1200
+	cond.setPrewhere()
+	cond.setWhere()
+	assert.Contains(t, cond.generateQuery("max|xFilesFactor(0.5,60)"),
+		"WITH arrayMap((m,n)->if(n<10, 0, m), anyResample(1200, 4799, 1200)(toUInt32(intDiv(Time, 1200)*1200), Time), countResample(1200, 4799, 1200)(Time)) AS mask\n",
+	)
+	assert.Contains(t, cond.generateQuery("max|xFilesFactor(0.5,60)"), "maxResample(1200, 4799, 1200)(Value, Time)")
+	// the stored points have the precision of the step, every interval with a point is valid
+	assert.Contains(t, cond.generateQuery("min|xFilesFactor(0.5,1200)"),
+		"WITH anyResample(1200, 4799, 1200)(toUInt32(intDiv(Time, 1200)*1200), Time) AS mask\n",
+	)
+
+	cond.SetFilteringFunctions(
+		"*.name.*",
+		[]*v3pb.FilteringFunction{{Name: "setXFilesFactor", Arguments: []string{"2"}}},
+	)
+	assert.Error(t, cond.prepareLookup())
+}
+
+func TestPrepareLookupAggregationFunctions(t *testing.T) {
+	cond := newCondition(5400, 1800, 5)
+	cond.aggregated = true
+	cond.prepareMetricsLists()
+	cond.from, cond.until, cond.step = 1200, 4799, 1200
+	cond.setPrewhere()
+	cond.setWhere()
+
+	tests := []struct {
+		argument string
+		agg      string
+		values   string
+	}{
+		{"median", "median", "quantileExactInclusiveResample(0.5, 1200, 4799, 1200)(Value, Time)"},
+		{"p95", "p95", "quantileExactInclusiveResample(0.95, 1200, 4799, 1200)(Value, Time)"},
+		{"count", "count", "arrayMap(x->toFloat64(x), countResample(1200, 4799, 1200)(Value, Time))"},
+		{"stddev", "stddev", "stddevPopResample(1200, 4799, 1200)(Value, Time)"},
+		{"rangeOf", "range", "arrayMap((a,b)->a-b, maxResample(1200, 4799, 1200)(Value, Time), minResample(1200, 4799, 1200)(Value, Time))"},
+		{"multiply", "multiply", "arrayMap(a->arrayProduct(a), groupArrayResample(1200, 4799, 1200)(Value, Time))"},
+		{"last", "anyLast", "anyLastResample(1200, 4799, 1200)(Value, Time)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.argument, func(t *testing.T) {
+			cond.SetFilteringFunctions(
+				"*.name.*",
+				[]*v3pb.FilteringFunction{{Name: "consolidateBy", Arguments: []string{tt.argument}}},
+			)
+			assert.NoError(t, cond.prepareLookup())
+			assert.Len(t, cond.aggregations, 1)
+			assert.Len(t, cond.aggregations[tt.agg], 4)
+			assert.Contains(t, cond.generateQuery(tt.agg), " arrayFilter((v,m)->m!=0, "+tt.values+", mask) AS values\n")
+		})
+	}
+
+	for _, argument := range []string{"p101", "diff", "any"} {
+		cond.SetFilteringFunctions(
+			"*.name.*",
+			[]*v3pb.FilteringFunction{{Name: "consolidateBy", Arguments: []string{argument}}},
+		)
+		assert.Error(t, cond.prepareLookup(), argument)
+	}
+}
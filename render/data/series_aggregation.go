@@ -0,0 +1,352 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+)
+
+// from, until, step, resampled values, table, prewhere, where, group expression, series function, mask, time type
+// Values of every series are aggregated as in queryAggregated, and then values of all series with the same
+// group expression are aggregated by the series function
+const querySeriesAggregated = `SELECT Name,
+ arrayFilter((t,v)->isNotNull(v), arrayMap(i->to%[11]s(%[1]d+i*%[3]d), range(length(s))), s) AS times,
+ arrayMap(v->toFloat64(assumeNotNull(v)), arrayFilter(v->isNotNull(v), s)) AS values
+FROM (
+ SELECT %[8]s AS Name, %[9]sOrNullForEach(a) AS s
+ FROM (
+  WITH %[10]s AS mask
+  SELECT Path, arrayMap((v,m)->if(m=0, NULL, v), %[4]s, mask) AS a
+  FROM %[5]s
+  %[6]s
+  %[7]s
+  GROUP BY Path
+ )
+ GROUP BY Name
+)
+FORMAT RowBinary`
+
+// seriesFunctions maps graphite functions aggregating all series to ClickHouse aggregate functions.
+// countSeries isn't here: it's the constant count of series, not the count of values at every point
+var seriesFunctions = map[string]string{
+	"sumSeries":     "sum",
+	"sum":           "sum",
+	"averageSeries": "avg",
+	"avg":           "avg",
+	"minSeries":     "min",
+	"maxSeries":     "max",
+}
+
+// seriesNames contains names of the result series for seriesFunctions
+var seriesNames = map[string]string{
+	"sum": "sumSeries",
+	"avg": "averageSeries",
+	"min": "minSeries",
+	"max": "maxSeries",
+}
+
+// seriesCallbacks maps aggregate and groupByNode callbacks to ClickHouse aggregate functions
+var seriesCallbacks = map[string]string{
+	"sum":     "sum",
+	"total":   "sum",
+	"avg":     "avg",
+	"average": "avg",
+	"min":     "min",
+	"max":     "max",
+	"count":   "count",
+}
+
+// seriesAggregation is a graphite function aggregating all series of the target, evaluated by ClickHouse
+type seriesAggregation struct {
+	target string
+	// function is the requested graphite function
+	function string
+	// chFunction is ClickHouse aggregate function, applied to values of all series
+	chFunction string
+	// name is the name of the result series, when series are not grouped by nodes
+	name string
+	// nodes are ClickHouse indexes of path nodes to group series by
+	nodes []int
+	// indexes, aggs and xFilesFactors are indexes of requested metrics, their aggregating functions and xFilesFactors
+	indexes       []int
+	aggs          []string
+	xFilesFactors []xFilesFactor
+	extDataBody   strings.Builder
+	points        *data
+}
+
+func seriesCallback(callback string) (string, bool) {
+	callback = unquote(callback)
+	if callback == "countSeries" {
+		// countSeries callback is the constant count of series in the group, unlike count
+		return "", false
+	}
+	f, ok := seriesCallbacks[strings.TrimSuffix(callback, "Series")]
+	return f, ok
+}
+
+// nodeIndex converts graphite node number to ClickHouse array index, negative numbers are counted from the end
+func nodeIndex(arg string) (int, error) {
+	n, err := strconv.Atoi(unquote(arg))
+	if err != nil {
+		return 0, err
+	}
+	if n >= 0 {
+		n++
+	}
+	return n, nil
+}
+
+// newSeriesAggregation returns seriesAggregation, if the first function of the target, except consolidateBy and
+// setXFilesFactor, aggregates all series and could be evaluated by ClickHouse
+func newSeriesAggregation(target string, functions []*v3pb.FilteringFunction) *seriesAggregation {
+	var f *v3pb.FilteringFunction
+	for _, ff := range functions {
+		if !isAggregationFunction(ff.GetName()) {
+			f = ff
+			break
+		}
+	}
+	if f == nil {
+		return nil
+	}
+
+	sa := &seriesAggregation{target: target, function: f.GetName()}
+	args := f.GetArguments()
+	var ok bool
+	switch sa.function {
+	case "aggregate":
+		// aggregate(seriesList, func, xFilesFactor=None)
+		if len(args) != 1 {
+			return nil
+		}
+		if sa.chFunction, ok = seriesCallback(args[0]); !ok {
+			return nil
+		}
+		sa.name = unquote(args[0]) + "Series(" + target + ")"
+	case "groupByNode":
+		// groupByNode(seriesList, nodeNum, callback='average')
+		if len(args) < 1 || len(args) > 2 {
+			return nil
+		}
+		n, err := nodeIndex(args[0])
+		if err != nil {
+			return nil
+		}
+		sa.nodes = []int{n}
+		sa.chFunction = "avg"
+		if len(args) == 2 {
+			if sa.chFunction, ok = seriesCallback(args[1]); !ok {
+				return nil
+			}
+		}
+	case "groupByNodes":
+		// groupByNodes(seriesList, callback, *nodes), tags as nodes are not supported
+		if len(args) < 2 {
+			return nil
+		}
+		if sa.chFunction, ok = seriesCallback(args[0]); !ok {
+			return nil
+		}
+		for _, arg := range args[1:] {
+			n, err := nodeIndex(arg)
+			if err != nil {
+				return nil
+			}
+			sa.nodes = append(sa.nodes, n)
+		}
+	default:
+		if len(args) != 0 {
+			return nil
+		}
+		if sa.chFunction, ok = seriesFunctions[sa.function]; !ok {
+			return nil
+		}
+		// graphite names aliases like the main function, e.g. sum(a.*) is sumSeries(a.*)
+		sa.name = seriesNames[sa.chFunction] + "(" + target + ")"
+	}
+	return sa
+}
+
+func (sa *seriesAggregation) add(i int, agg string, xff xFilesFactor) {
+	sa.indexes = append(sa.indexes, i)
+	sa.aggs = append(sa.aggs, agg)
+	sa.xFilesFactors = append(sa.xFilesFactors, xff)
+}
+
+// valid returns true when all series have the same aggregating function and xFilesFactor
+func (sa *seriesAggregation) valid() bool {
+	for n, agg := range sa.aggs {
+		if agg != sa.aggs[0] || sa.xFilesFactors[n] != sa.xFilesFactors[0] {
+			return false
+		}
+	}
+	return len(sa.aggs) > 0
+}
+
+// groupExpression returns ClickHouse expression for the name of the group of the series
+func (sa *seriesAggregation) groupExpression(isReverse bool) string {
+	if len(sa.nodes) == 0 {
+		return "''"
+	}
+	nodes := "splitByChar('.', Path)"
+	if isReverse {
+		nodes = "arrayReverse(" + nodes + ")"
+	}
+	indexes := make([]string, len(sa.nodes))
+	for i, n := range sa.nodes {
+		indexes[i] = strconv.Itoa(n)
+	}
+	return fmt.Sprintf("arrayStringConcat(arrayMap(n->%s[n], [%s]), '.')", nodes, strings.Join(indexes, ","))
+}
+
+// metric returns the name of the result metric and the name of the result series for the group
+func (sa *seriesAggregation) metric(group string) (string, string) {
+	if len(sa.nodes) == 0 {
+		return sa.name, sa.name
+	}
+	// the metric should not clash with the real metrics of the request
+	return sa.function + "(" + sa.target + ")." + group, group
+}
+
+// parseResponse reads the ClickHouse body into points. Group names are built by the query and never reversed
+func (sa *seriesAggregation) parseResponse(ctx context.Context, bodyReader io.ReadCloser, cond *conditions) error {
+	sa.points = &data{Data: &Data{Points: point.NewPoints()}, b: make(chan io.ReadCloser, 1)}
+	targets := &Targets{highPrecisionTime: cond.highPrecisionTime}
+	return sa.points.parseResponse(ctx, bodyReader, &conditions{Targets: targets, aggregated: true})
+}
+
+// prepareSeriesAggregations returns series aggregations for metrics. Metrics of the aggregated target must not
+// match any other target
+func (c *conditions) prepareSeriesAggregations() map[string]*seriesAggregation {
+	byTarget := make(map[string]*seriesAggregation)
+	checked := make(map[string]bool)
+	c.seriesAggregations = c.seriesAggregations[:0]
+	for _, m := range c.metricsUnreverse {
+		for _, a := range c.AM.Get(m) {
+			if checked[a.Target] {
+				continue
+			}
+			checked[a.Target] = true
+			if sa := newSeriesAggregation(a.Target, c.GetFilteringFunctions(a.Target)); sa != nil {
+				byTarget[a.Target] = sa
+				c.seriesAggregations = append(c.seriesAggregations, sa)
+			}
+		}
+	}
+	if len(byTarget) == 0 {
+		return nil
+	}
+
+	excluded := make(map[string]bool)
+	for _, m := range c.metricsUnreverse {
+		aliases := c.AM.Get(m)
+		for _, a := range aliases {
+			sa, ok := byTarget[a.Target]
+			if !ok {
+				continue
+			}
+			// nodes of tagged series are tags, it's not supported
+			if len(sa.nodes) != 0 && strings.IndexByte(m, '?') >= 0 {
+				excluded[a.Target] = true
+			}
+			for _, other := range aliases {
+				if other.Target != a.Target {
+					excluded[a.Target] = true
+				}
+			}
+		}
+	}
+
+	series := make(map[string]*seriesAggregation)
+	valid := c.seriesAggregations[:0]
+	for _, sa := range c.seriesAggregations {
+		if !excluded[sa.target] {
+			valid = append(valid, sa)
+		}
+	}
+	c.seriesAggregations = valid
+	for _, m := range c.metricsUnreverse {
+		if aliases := c.AM.Get(m); len(aliases) > 0 && !excluded[aliases[0].Target] {
+			if sa, ok := byTarget[aliases[0].Target]; ok {
+				series[m] = sa
+			}
+		}
+	}
+	return series
+}
+
+// setSeriesAggregations keeps only aggregations of metrics with the same aggregating function, the metrics of
+// the rest are fetched as usual. It builds external-data bodies and sets applied functions
+func (c *conditions) setSeriesAggregations(chains map[string][]*v3pb.FilteringFunction) {
+	valid := c.seriesAggregations[:0]
+	for _, sa := range c.seriesAggregations {
+		if !sa.valid() {
+			for n, i := range sa.indexes {
+				c.addLookup(i, sa.aggs[n], chains)
+			}
+			continue
+		}
+		for _, i := range sa.indexes {
+			sa.extDataBody.WriteString(c.metricsRequested[i] + "\n")
+		}
+		// consolidateBy is set in prepareLookup
+		c.appliedFunctions[sa.target] = append([]string{sa.function}, c.appliedFunctions[sa.target]...)
+		valid = append(valid, sa)
+	}
+	c.seriesAggregations = valid
+}
+
+func (c *conditions) generateSeriesQuery(sa *seriesAggregation) string {
+	return fmt.Sprintf(
+		querySeriesAggregated,
+		c.from, c.until, c.step, c.resample(sa.aggs[0]),
+		c.pointsTable, c.prewhere, c.where,
+		sa.groupExpression(c.isReverse), sa.chFunction, c.mask(sa.xFilesFactors[0]), c.timeType(),
+	)
+}
+
+// mergeSeriesAggregations replaces the aggregated metrics in the aliases map by the result series and adds
+// the result points to data. It must be called after all responses are parsed
+func (c *conditions) mergeSeriesAggregations(d *data) {
+	for _, sa := range c.seriesAggregations {
+		for _, i := range sa.indexes {
+			c.AM.Delete(c.metricsUnreverse[i])
+		}
+		agg, xff := sa.aggs[0], sa.xFilesFactors[0].ratio
+		// the series without groups is returned even without points
+		if len(sa.nodes) == 0 {
+			c.AM.Add(sa.name, alias.Value{Target: sa.target, DisplayName: sa.name})
+			c.aggregations[agg] = append(c.aggregations[agg], sa.name)
+			c.xFilesFactors[xff] = append(c.xFilesFactors[xff], sa.name)
+		}
+		if sa.points == nil {
+			continue
+		}
+		list := sa.points.Points.List()
+		var (
+			id      uint32
+			groupID uint32
+		)
+		for n := range list {
+			if n == 0 || list[n].MetricID != groupID {
+				groupID = list[n].MetricID
+				metric, name := sa.metric(sa.points.Points.MetricName(groupID))
+				id = d.Points.MetricID(metric)
+				if len(sa.nodes) != 0 {
+					c.AM.Add(metric, alias.Value{Target: sa.target, DisplayName: name})
+					c.aggregations[agg] = append(c.aggregations[agg], metric)
+					c.xFilesFactors[xff] = append(c.xFilesFactors[xff], metric)
+				}
+			}
+			d.Points.AppendPoint(id, list[n].Value, list[n].Time, list[n].Timestamp)
+		}
+	}
+}
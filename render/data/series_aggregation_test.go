@@ -0,0 +1,224 @@
+package data
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/helper/date"
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+)
+
+func TestNewSeriesAggregation(t *testing.T) {
+	tests := []struct {
+		function   *v3pb.FilteringFunction
+		chFunction string
+		name       string
+		nodes      []int
+		unknown    bool
+	}{
+		{function: &v3pb.FilteringFunction{Name: "sumSeries"}, chFunction: "sum", name: "sumSeries(a.*)"},
+		{function: &v3pb.FilteringFunction{Name: "sum"}, chFunction: "sum", name: "sumSeries(a.*)"},
+		{function: &v3pb.FilteringFunction{Name: "averageSeries"}, chFunction: "avg", name: "averageSeries(a.*)"},
+		{function: &v3pb.FilteringFunction{Name: "avg"}, chFunction: "avg", name: "averageSeries(a.*)"},
+		{function: &v3pb.FilteringFunction{Name: "minSeries"}, chFunction: "min", name: "minSeries(a.*)"},
+		{function: &v3pb.FilteringFunction{Name: "maxSeries"}, chFunction: "max", name: "maxSeries(a.*)"},
+		{function: &v3pb.FilteringFunction{Name: "aggregate", Arguments: []string{"'count'"}}, chFunction: "count", name: "countSeries(a.*)"},
+		{function: &v3pb.FilteringFunction{Name: "aggregate", Arguments: []string{"median"}}, unknown: true},
+		{function: &v3pb.FilteringFunction{Name: "aggregate", Arguments: []string{"sum", "0.5"}}, unknown: true},
+		{function: &v3pb.FilteringFunction{Name: "groupByNode", Arguments: []string{"1"}}, chFunction: "avg", nodes: []int{2}},
+		{function: &v3pb.FilteringFunction{Name: "groupByNode", Arguments: []string{"-1", "sumSeries"}}, chFunction: "sum", nodes: []int{-1}},
+		{function: &v3pb.FilteringFunction{Name: "groupByNode", Arguments: []string{"1", "median"}}, unknown: true},
+		{function: &v3pb.FilteringFunction{Name: "groupByNodes", Arguments: []string{"'max'", "0", "2"}}, chFunction: "max", nodes: []int{1, 3}},
+		{function: &v3pb.FilteringFunction{Name: "groupByNodes", Arguments: []string{"max", "dc"}}, unknown: true},
+		{function: &v3pb.FilteringFunction{Name: "countSeries"}, unknown: true},
+		{function: &v3pb.FilteringFunction{Name: "groupByNode", Arguments: []string{"1", "countSeries"}}, unknown: true},
+		{function: &v3pb.FilteringFunction{Name: "scale", Arguments: []string{"2"}}, unknown: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.function.String(), func(t *testing.T) {
+			sa := newSeriesAggregation("a.*", []*v3pb.FilteringFunction{
+				{Name: "consolidateBy", Arguments: []string{"max"}},
+				tt.function,
+			})
+			if tt.unknown {
+				assert.Nil(t, sa)
+				return
+			}
+			require.NotNil(t, sa)
+			assert.Equal(t, tt.function.Name, sa.function)
+			assert.Equal(t, tt.chFunction, sa.chFunction)
+			assert.Equal(t, tt.name, sa.name)
+			assert.Equal(t, tt.nodes, sa.nodes)
+		})
+	}
+}
+
+// newSeriesCondition returns conditions with servers.s3.cpu matched by two targets, if shared is true
+func newSeriesCondition(shared bool) *conditions {
+	am := alias.New()
+	am.Add("servers.s1.cpu", alias.Value{Target: "servers.*.cpu", DisplayName: "servers.s1.cpu"})
+	am.Add("servers.s2.cpu", alias.Value{Target: "servers.*.cpu", DisplayName: "servers.s2.cpu"})
+	if shared {
+		am.Add("servers.s3.cpu", alias.Value{Target: "servers.*.cpu", DisplayName: "servers.s3.cpu"}, alias.Value{Target: "servers.s3.*", DisplayName: "servers.s3.cpu"})
+	}
+	am.Add("servers.s3.mem", alias.Value{Target: "servers.s3.*", DisplayName: "servers.s3.mem"})
+	am.Add("dc.d1.cpu", alias.Value{Target: "dc.*.cpu", DisplayName: "dc.d1.cpu"})
+	am.Add("dc.d2.cpu", alias.Value{Target: "dc.*.cpu", DisplayName: "dc.d2.cpu"})
+
+	cond := newCondition(5400, 1800, 5)
+	cond.AM = am
+	cond.aggregated = true
+	cond.pointsTable = "graphite.table"
+	cond.SetFilteringFunctions("dc.*.cpu", []*v3pb.FilteringFunction{{Name: "sumSeries"}, {Name: "scale", Arguments: []string{"2"}}})
+	cond.SetFilteringFunctions("servers.*.cpu", []*v3pb.FilteringFunction{{Name: "groupByNode", Arguments: []string{"1", "max"}}})
+	cond.SetFilteringFunctions("servers.s3.*", []*v3pb.FilteringFunction{{Name: "sumSeries"}})
+	cond.prepareMetricsLists()
+	return cond
+}
+
+func TestSeriesAggregationLookup(t *testing.T) {
+	cond := newSeriesCondition(true)
+	require.NoError(t, cond.prepareLookup())
+
+	// servers.* targets share servers.s3.cpu, so they are fetched as usual
+	require.Len(t, cond.seriesAggregations, 1)
+	sa := cond.seriesAggregations[0]
+	assert.Equal(t, "dc.*.cpu", sa.target)
+	assert.Equal(t, []string{"sumSeries"}, cond.appliedFunctions["dc.*.cpu"])
+	assert.NotContains(t, cond.appliedFunctions, "servers.*.cpu")
+	assert.Equal(t, []string{"avg"}, mapKeys(cond.extDataBodies))
+	assert.NotContains(t, cond.extDataBodies["avg"].String(), "dc.")
+	assert.ElementsMatch(t, []string{"dc.d1.cpu", "dc.d2.cpu"}, strings.Fields(sa.extDataBody.String()))
+
+	cond.from, cond.until, cond.step = 1200, 2399, 60
+	cond.setPrewhere()
+	cond.setWhere()
+	assert.Equal(t,
+		"SELECT Name,\n"+
+			" arrayFilter((t,v)->isNotNull(v), arrayMap(i->toUInt32(1200+i*60), range(length(s))), s) AS times,\n"+
+			" arrayMap(v->toFloat64(assumeNotNull(v)), arrayFilter(v->isNotNull(v), s)) AS values\n"+
+			"FROM (\n"+
+			" SELECT '' AS Name, sumOrNullForEach(a) AS s\n"+
+			" FROM (\n"+
+			"  WITH anyResample(1200, 2399, 60)(toUInt32(intDiv(Time, 60)*60), Time) AS mask\n"+
+			"  SELECT Path, arrayMap((v,m)->if(m=0, NULL, v), avgResample(1200, 2399, 60)(Value, Time), mask) AS a\n"+
+			"  FROM graphite.table\n"+
+			"  PREWHERE Date >= '"+date.FromTimestampToDaysFormat(1200)+"' AND Date <= '"+date.UntilTimestampToDaysFormat(2399)+"'\n"+
+			"  WHERE (Path in metrics_list) AND (Time >= 1200 AND Time <= 2399)\n"+
+			"  GROUP BY Path\n"+
+			" )\n"+
+			" GROUP BY Name\n"+
+			")\n"+
+			"FORMAT RowBinary",
+		cond.generateSeriesQuery(sa),
+	)
+
+	sa.nodes = []int{2, -1}
+	assert.Equal(t, "arrayStringConcat(arrayMap(n->splitByChar('.', Path)[n], [2,-1]), '.')", sa.groupExpression(false))
+	assert.Equal(t, "arrayStringConcat(arrayMap(n->arrayReverse(splitByChar('.', Path))[n], [2,-1]), '.')", sa.groupExpression(true))
+}
+
+func TestMergeSeriesAggregations(t *testing.T) {
+	cond := newSeriesCondition(false)
+	cond.SetFilteringFunctions("servers.s3.*", nil)
+	require.NoError(t, cond.prepareLookup())
+	require.Len(t, cond.seriesAggregations, 2)
+
+	d := prepareData(context.Background(), 1, func() *point.Points { return nil })
+	require.NoError(t, d.wait(context.Background()))
+	for _, sa := range cond.seriesAggregations {
+		sa.points = &data{Data: &Data{Points: point.NewPoints()}, b: make(chan io.ReadCloser, 1)}
+		if sa.target == "servers.*.cpu" {
+			sa.points.Points.AppendPoint(sa.points.Points.MetricID("s1"), 1, 1200, 1200)
+			sa.points.Points.AppendPoint(sa.points.Points.MetricID("s1"), 2, 1260, 1260)
+			sa.points.Points.AppendPoint(sa.points.Points.MetricID("s2"), 3, 1200, 1200)
+		}
+	}
+	cond.mergeSeriesAggregations(d)
+
+	assert.ElementsMatch(t, []string{
+		"sumSeries(dc.*.cpu)",
+		"groupByNode(servers.*.cpu).s1",
+		"groupByNode(servers.*.cpu).s2",
+		"servers.s3.mem",
+	}, cond.AM.Series(false))
+	assert.Equal(t, []alias.Value{{Target: "dc.*.cpu", DisplayName: "sumSeries(dc.*.cpu)"}}, cond.AM.Get("sumSeries(dc.*.cpu)"))
+	assert.Equal(t, []alias.Value{{Target: "servers.*.cpu", DisplayName: "s1"}}, cond.AM.Get("groupByNode(servers.*.cpu).s1"))
+	assert.Equal(t, 3, d.Points.Len())
+	assert.Equal(t, "groupByNode(servers.*.cpu).s1", d.Points.MetricName(d.Points.List()[0].MetricID))
+	assert.Equal(t, "groupByNode(servers.*.cpu).s2", d.Points.MetricName(d.Points.List()[2].MetricID))
+	// rollup aggregation is used for the result series
+	assert.ElementsMatch(t, []string{
+		"servers.s3.mem",
+		"sumSeries(dc.*.cpu)",
+		"groupByNode(servers.*.cpu).s1",
+		"groupByNode(servers.*.cpu).s2",
+	}, cond.aggregations["avg"])
+}
+
+func TestFetchCountSeries(t *testing.T) {
+	metrics.DisableMetrics()
+	now := time.Now().Unix()
+	var (
+		lock    sync.Mutex
+		queries []string
+	)
+	tm := uint32(now - 3600)
+	tm -= tm % 60
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		if query == "" {
+			body, _ := io.ReadAll(r.Body)
+			query = string(body)
+		}
+		lock.Lock()
+		queries = append(queries, query)
+		lock.Unlock()
+		w.Write(makeAggregatedBody([]testPoint{
+			// a.b has a gap at the second point
+			{Metric: "a.b", PointValues: &pointValues{Times: []uint32{tm, tm + 120}, Values: []float64{1, 3}}},
+			{Metric: "a.c", PointValues: &pointValues{Times: []uint32{tm, tm + 60, tm + 120}, Values: []float64{1, 2, 3}}},
+		}))
+	}))
+	defer srv.Close()
+
+	cfg := stitchConfig(t, srv.URL)
+	cfg.ClickHouse.StitchDataTables = false
+	tf := TimeFrame{From: now - 7200, Until: now, MaxDataPoints: 1000}
+	targets := NewTargetsOne("a.*", 1, alias.New())
+	targets.AM.MergeTarget(finder.NewMockFinder([][]byte{[]byte("a.b"), []byte("a.c")}), "a.*", false)
+	targets.SetFilteringFunctions("a.*", []*v3pb.FilteringFunction{{Name: "countSeries"}})
+	m := MultiTarget{tf: targets}
+
+	var queueDuration time.Duration
+	reply, err := m.Fetch(context.Background(), cfg, config.ContextGraphite, limiter.NoopLimiter{}, &queueDuration)
+	require.NoError(t, err)
+	require.Len(t, reply, 1)
+
+	// countSeries is the constant count of series, so it's evaluated by carbonapi over the fetched series
+	require.Len(t, queries, 1)
+	assert.NotContains(t, queries[0], "countOrNullForEach")
+	assert.ElementsMatch(t, []string{"a.b", "a.c"}, reply[0].Data.AM.Series(false))
+
+	points := make(map[string]int)
+	next := reply[0].Data.GroupByMetric()
+	for p := next(); len(p) != 0; p = next() {
+		points[reply[0].Data.MetricName(p[0].MetricID)] = len(p)
+	}
+	assert.Equal(t, map[string]int{"a.b": 2, "a.c": 3}, points)
+}
@@ -0,0 +1,118 @@
+package data
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/point"
+)
+
+// stitch collects the responses for parts of the time frame, which are read from different data tables,
+// and merges them into one response with one series per metric
+type stitch struct {
+	TimeFrame
+	parts     int
+	lock      sync.Mutex
+	responses []CHResponse
+	failed    bool
+}
+
+// stitchConditions returns conditions for every part of the time frame, which is served by its own data table,
+// see Targets.splitByDataTables. It returns nil, when the time frame isn't split
+func (c *conditions) stitchConditions(cfg *config.Config, context string) []*conditions {
+	segments := c.splitByDataTables(cfg, c.TimeFrame, context)
+	if len(segments) == 0 {
+		return nil
+	}
+	s := &stitch{TimeFrame: *c.TimeFrame, parts: len(segments)}
+	conds := make([]*conditions, 0, len(segments))
+	for i := range segments {
+		conds = append(conds, &conditions{
+			TimeFrame:         &segments[i].TimeFrame,
+			Targets:           segments[i].targets,
+			aggregated:        c.aggregated,
+			appendEmptySeries: c.appendEmptySeries,
+			stitch:            s,
+		})
+	}
+	return conds
+}
+
+// fail marks the stitched response as failed, it returns true only for the first failed part
+func (s *stitch) fail() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	first := !s.failed
+	s.failed = true
+	return first
+}
+
+// add adds the response of one part. When responses of all parts are added, it returns the merged one and true
+func (s *stitch) add(chr CHResponse) (CHResponse, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.responses = append(s.responses, chr)
+	if len(s.responses) < s.parts {
+		return CHResponse{}, false
+	}
+	return s.merge(), true
+}
+
+// merge joins the points of the parts. Aggregating functions and xFilesFactors of the most recent part win
+func (s *stitch) merge() CHResponse {
+	slices.SortFunc(s.responses, func(a, b CHResponse) int { return cmp.Compare(a.From, b.From) })
+	first := s.responses[0]
+	merged := CHResponse{
+		Data:                    &Data{Points: point.NewPoints(), AM: first.Data.AM, CommonStep: first.Data.CommonStep},
+		From:                    s.From,
+		Until:                   s.Until,
+		AppendOutEmptySeries:    first.AppendOutEmptySeries,
+		AppliedFunctions:        make(map[string][]string),
+		HighPrecisionTimestamps: first.HighPrecisionTimestamps,
+	}
+	if merged.HighPrecisionTimestamps {
+		merged.From, merged.Until = s.From*1000, s.Until*1000+999
+	}
+
+	aggregations := make(map[string]string)
+	xFilesFactors := make(map[string]float32)
+	for _, chr := range s.responses {
+		pp := chr.Data.Points
+		for _, p := range pp.List() {
+			merged.Data.Points.AppendPoint(merged.Data.Points.MetricID(pp.MetricName(p.MetricID)), p.Value, p.Time, p.Timestamp)
+		}
+		for id := uint32(1); pp.MetricName(id) != ""; id++ {
+			name := pp.MetricName(id)
+			if agg, err := pp.GetAggregation(id); err == nil {
+				aggregations[name] = agg
+			}
+			if xff, err := pp.GetXFilesFactor(id); err == nil {
+				xFilesFactors[name] = xff
+			}
+		}
+		for target, functions := range chr.AppliedFunctions {
+			for _, f := range functions {
+				if !slices.Contains(merged.AppliedFunctions[target], f) {
+					merged.AppliedFunctions[target] = append(merged.AppliedFunctions[target], f)
+				}
+			}
+		}
+	}
+	// points at the boundaries could be read from both tables, e.g. from carbonlink
+	merged.Data.Points.Sort()
+	merged.Data.Points.Uniq()
+
+	byAggregation := make(map[string][]string)
+	for name, agg := range aggregations {
+		byAggregation[agg] = append(byAggregation[agg], name)
+	}
+	merged.Data.Points.SetAggregations(byAggregation)
+	byXFilesFactor := make(map[float32][]string)
+	for name, xff := range xFilesFactors {
+		byXFilesFactor[xff] = append(byXFilesFactor[xff], name)
+	}
+	merged.Data.Points.SetXFilesFactors(byXFilesFactor)
+	return merged
+}
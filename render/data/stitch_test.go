@@ -0,0 +1,260 @@
+package data
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/helper/rollup"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+)
+
+func stitchConfig(t *testing.T, url string) *config.Config {
+	cfg := config.New()
+	cfg.ClickHouse.URL = url
+	cfg.ClickHouse.QueryParams = []config.QueryParam{{URL: url, DataTimeout: cfg.ClickHouse.DataTimeout, Limiter: limiter.NoopLimiter{}}}
+	cfg.ClickHouse.StitchDataTables = true
+	raw, err := rollup.NewDefault(60, "avg")
+	require.NoError(t, err)
+	coarse, err := rollup.NewDefault(3600, "avg")
+	require.NoError(t, err)
+	cfg.DataTable = []config.DataTable{
+		{
+			Table:        "graphite_data_raw",
+			MaxAge:       48 * time.Hour,
+			ContextMap:   map[string]bool{config.ContextGraphite: true},
+			Rollup:       raw,
+			QueryMetrics: metrics.InitQueryMetrics("graphite_data_raw", &cfg.Metrics),
+		},
+		{
+			Table:        "graphite_data",
+			ContextMap:   map[string]bool{config.ContextGraphite: true},
+			Rollup:       coarse,
+			QueryMetrics: metrics.InitQueryMetrics("graphite_data", &cfg.Metrics),
+		},
+	}
+	return cfg
+}
+
+func TestSplitByDataTables(t *testing.T) {
+	metrics.DisableMetrics()
+	cfg := stitchConfig(t, "http://localhost:8123/")
+	now := time.Now().Unix()
+	targets := NewTargets([]string{"metric"}, alias.New())
+
+	tf := &TimeFrame{From: now - 30*86400, Until: now, MaxDataPoints: 1000}
+	segments := targets.splitByDataTables(cfg, tf, config.ContextGraphite)
+	require.Len(t, segments, 2)
+	assert.Equal(t, "graphite_data", segments[0].targets.pointsTable)
+	assert.Equal(t, "graphite_data_raw", segments[1].targets.pointsTable)
+	assert.Equal(t, tf.From, segments[0].From)
+	assert.Equal(t, segments[0].Until+1, segments[1].From)
+	assert.InDelta(t, now-2*86400, segments[1].From, 2)
+	assert.Equal(t, tf.Until, segments[1].Until)
+	assert.Equal(t, int64(1000), segments[1].MaxDataPoints)
+	assert.Empty(t, targets.pointsTable, "the original targets must not be changed")
+
+	// the whole time frame is served by one table
+	assert.Nil(t, targets.splitByDataTables(cfg, &TimeFrame{From: now - 86400, Until: now}, config.ContextGraphite))
+	assert.Nil(t, targets.splitByDataTables(cfg, &TimeFrame{From: now - 30*86400, Until: now - 7*86400}, config.ContextGraphite))
+	// no table for the context
+	assert.Nil(t, targets.splitByDataTables(cfg, tf, config.ContextPrometheus))
+}
+
+func TestStitchMerge(t *testing.T) {
+	am := alias.New()
+	type namedPoint struct {
+		name  string
+		time  int64
+		value float64
+	}
+	response := func(from, until int64, points ...namedPoint) CHResponse {
+		pp := point.NewPoints()
+		for _, p := range points {
+			pp.AppendPoint(pp.MetricID(p.name), p.value, p.time, 0)
+		}
+		pp.SetAggregations(map[string][]string{"avg": {"a", "b"}})
+		return CHResponse{
+			Data:             &Data{Points: pp, AM: am, CommonStep: 60},
+			From:             from,
+			Until:            until,
+			AppliedFunctions: map[string][]string{"a": {"consolidateBy"}},
+		}
+	}
+	s := &stitch{TimeFrame: TimeFrame{From: 0, Until: 299}, parts: 2}
+
+	_, merged := s.add(response(180, 299, namedPoint{"a", 180, 4}, namedPoint{"b", 240, 5}))
+	assert.False(t, merged)
+	chr, merged := s.add(response(0, 179, namedPoint{"b", 0, 1}, namedPoint{"a", 60, 2}, namedPoint{"a", 120, 3}))
+	require.True(t, merged)
+
+	assert.Equal(t, int64(0), chr.From)
+	assert.Equal(t, int64(299), chr.Until)
+	assert.Equal(t, int64(60), chr.Data.CommonStep)
+	assert.Equal(t, map[string][]string{"a": {"consolidateBy"}}, chr.AppliedFunctions)
+
+	series := make(map[string][]float64)
+	next := chr.Data.GroupByMetric()
+	for points := next(); len(points) != 0; points = next() {
+		name := chr.Data.MetricName(points[0].MetricID)
+		for _, p := range points {
+			series[name] = append(series[name], p.Value)
+		}
+		agg, err := chr.Data.GetAggregation(points[0].MetricID)
+		require.NoError(t, err)
+		assert.Equal(t, "avg", agg)
+	}
+	assert.Equal(t, map[string][]float64{"a": {2, 3, 4}, "b": {1, 5}}, series)
+}
+
+func TestFetchStitched(t *testing.T) {
+	metrics.DisableMetrics()
+	var (
+		lock    sync.Mutex
+		queries = make(map[string]string)
+	)
+	tableRe := regexp.MustCompile(`FROM (\w+)`)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// queries with external data are passed in the url
+		query := r.URL.Query().Get("query")
+		if query == "" {
+			body, _ := io.ReadAll(r.Body)
+			query = string(body)
+		}
+		if m := tableRe.FindStringSubmatch(query); m != nil {
+			lock.Lock()
+			queries[m[1]] = query
+			lock.Unlock()
+		}
+	}))
+	defer srv.Close()
+
+	cfg := stitchConfig(t, srv.URL)
+	now := time.Now().Unix()
+	tf := TimeFrame{From: now - 30*86400, Until: now, MaxDataPoints: 1000}
+	targets := NewTargetsOne("metric", 1, alias.New())
+	targets.AM.MergeTarget(finder.NewMockFinder([][]byte{[]byte("metric")}), "metric", false)
+	m := MultiTarget{tf: targets}
+
+	var queueDuration time.Duration
+	reply, err := m.Fetch(context.Background(), cfg, config.ContextGraphite, limiter.NoopLimiter{}, &queueDuration)
+	require.NoError(t, err)
+	require.Len(t, reply, 1, "parts are merged into one response")
+	assert.Equal(t, tf.From, reply[0].From)
+	assert.Equal(t, tf.Until, reply[0].Until)
+	assert.Equal(t, int64(3600), reply[0].Data.CommonStep)
+
+	require.Len(t, queries, 2)
+	stepRe := regexp.MustCompile(`anyResample\((\d+), (\d+), (\d+)\)`)
+	old := stepRe.FindStringSubmatch(queries["graphite_data"])
+	recent := stepRe.FindStringSubmatch(queries["graphite_data_raw"])
+	require.NotNil(t, old)
+	require.NotNil(t, recent)
+	assert.Equal(t, "3600", old[3])
+	assert.Equal(t, "3600", recent[3], "the step is common for all parts")
+	oldUntil, _ := strconv.ParseInt(old[2], 10, 64)
+	recentFrom, _ := strconv.ParseInt(recent[1], 10, 64)
+	assert.Equal(t, oldUntil+1, recentFrom, "parts are adjacent")
+
+	// without stitching the coarse table serves the whole time frame
+	cfg.ClickHouse.StitchDataTables = false
+	queries = make(map[string]string)
+	_, err = m.Fetch(context.Background(), cfg, config.ContextGraphite, limiter.NoopLimiter{}, &queueDuration)
+	require.NoError(t, err)
+	assert.Len(t, queries, 1)
+	assert.Contains(t, queries, "graphite_data")
+}
+
+func TestFetchStitchedSeriesAggregation(t *testing.T) {
+	metrics.DisableMetrics()
+	now := time.Now().Unix()
+	var (
+		lock    sync.Mutex
+		queries []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		if query == "" {
+			body, _ := io.ReadAll(r.Body)
+			query = string(body)
+		}
+		lock.Lock()
+		queries = append(queries, query)
+		lock.Unlock()
+		tm := uint32(now - 20*86400)
+		if strings.Contains(query, "graphite_data_raw") {
+			tm = uint32(now - 3600)
+		}
+		tm -= tm % 3600
+		w.Write(makeAggregatedBody([]testPoint{
+			{Metric: "a.b", PointValues: &pointValues{Times: []uint32{tm}, Values: []float64{1}}},
+			{Metric: "a.c", PointValues: &pointValues{Times: []uint32{tm}, Values: []float64{2}}},
+		}))
+	}))
+	defer srv.Close()
+
+	cfg := stitchConfig(t, srv.URL)
+	tf := TimeFrame{From: now - 30*86400, Until: now, MaxDataPoints: 1000}
+	targets := NewTargetsOne("a.*", 1, alias.New())
+	targets.AM.MergeTarget(finder.NewMockFinder([][]byte{[]byte("a.b"), []byte("a.c")}), "a.*", false)
+	targets.SetFilteringFunctions("a.*", []*v3pb.FilteringFunction{{Name: "sumSeries"}})
+	m := MultiTarget{tf: targets}
+
+	var queueDuration time.Duration
+	reply, err := m.Fetch(context.Background(), cfg, config.ContextGraphite, limiter.NoopLimiter{}, &queueDuration)
+	require.NoError(t, err)
+	require.Len(t, reply, 1)
+
+	// series are aggregated by carbonapi, the aliases map isn't rewritten by the parts
+	require.Len(t, queries, 2)
+	for _, q := range queries {
+		assert.NotContains(t, q, "sumOrNullForEach")
+	}
+	assert.ElementsMatch(t, []string{"a.b", "a.c"}, reply[0].Data.AM.Series(false))
+	assert.Equal(t, []alias.Value{{Target: "a.*", DisplayName: "a.b"}}, reply[0].Data.AM.Get("a.b"))
+
+	series := make(map[string]int)
+	next := reply[0].Data.GroupByMetric()
+	for points := next(); len(points) != 0; points = next() {
+		series[reply[0].Data.MetricName(points[0].MetricID)]++
+		assert.Len(t, points, 2, "points of both parts")
+	}
+	assert.Equal(t, map[string]int{"a.b": 1, "a.c": 1}, series)
+}
+
+func TestFetchStitchedLimiter(t *testing.T) {
+	metrics.DisableMetrics()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	cfg := stitchConfig(t, srv.URL)
+	cfg.ClickHouse.DataTimeout = time.Second
+	now := time.Now().Unix()
+	tf := TimeFrame{From: now - 30*86400, Until: now, MaxDataPoints: 1000}
+	targets := NewTargetsOne("metric", 1, alias.New())
+	targets.AM.MergeTarget(finder.NewMockFinder([][]byte{[]byte("metric")}), "metric", false)
+	m := MultiTarget{tf: targets}
+
+	// the parts of the time frame take one slot, so the request fits the limiter with one slot
+	qlimiter := limiter.NewWLimiter(1, 1, false, "render", "")
+	var queueDuration time.Duration
+	reply, err := m.Fetch(context.Background(), cfg, config.ContextGraphite, qlimiter, &queueDuration)
+	require.NoError(t, err)
+	require.Len(t, reply, 1)
+}
@@ -0,0 +1,151 @@
+package data
+
+import (
+	"github.com/lomik/graphite-clickhouse/helper/point"
+)
+
+// SeriesWriter writes series to the client as soon as they are read. It must be safe for concurrent use,
+// series of different time frames are written concurrently. The times and step are in milliseconds, when
+// highPrecisionTimestamps is set.
+type SeriesWriter interface {
+	WriteSeries(target, name, function string, xFilesFactor float32, from, until, step int64, highPrecisionTimestamps bool, points []point.Point, appliedFunctions []string) error
+}
+
+// stream writes series of aggregated queries directly from parseResponse without storing points. Every metric of
+// the aggregated query is returned by ClickHouse in the single row, so the row contains the complete series.
+type stream struct {
+	w       SeriesWriter
+	cond    *conditions
+	steps   map[string]uint32
+	aggs    map[string]string
+	xffs    map[string]float32
+	written map[string]struct{}
+	points  int64
+	// from and until of the response, divisor converts times of the table to the response ones
+	from    int64
+	until   int64
+	divisor int64
+}
+
+// newStream prepares steps and aggregations of the metrics. It must be called after setPushdowns
+func newStream(w SeriesWriter, cond *conditions) *stream {
+	s := &stream{
+		w:       w,
+		cond:    cond,
+		steps:   make(map[string]uint32),
+		aggs:    make(map[string]string),
+		xffs:    make(map[string]float32),
+		written: make(map[string]struct{}),
+		from:    cond.From,
+		until:   cond.Until,
+		divisor: cond.timeUnit(),
+	}
+	if cond.highPrecision() {
+		s.from, s.until = cond.From*s.divisor, cond.Until*s.divisor+s.divisor-1
+		s.divisor = 1
+	}
+	for step, metrics := range cond.pushdownSteps {
+		for _, m := range metrics {
+			s.steps[m] = step
+		}
+	}
+	for agg, metrics := range cond.aggregations {
+		for _, m := range metrics {
+			s.aggs[m] = agg
+		}
+	}
+	for xff, metrics := range cond.xFilesFactors {
+		for _, m := range metrics {
+			s.xffs[m] = xff
+		}
+	}
+	return s
+}
+
+// writeRow writes the series of the metric. Rows are parsed sequentially, so it's not protected by a lock
+func (s *stream) writeRow(metric string, times []int64, values []float64) error {
+	step, ok := s.steps[metric]
+	if !ok {
+		step = uint32(s.cond.step)
+	}
+	points := make([]point.Point, len(times))
+	for i := range times {
+		points[i] = point.Point{Value: values[i], Time: times[i] / s.divisor, Timestamp: uint32(times[i])}
+	}
+	s.written[metric] = struct{}{}
+	s.points += int64(len(points))
+	for _, a := range s.cond.AM.Get(metric) {
+		err := s.w.WriteSeries(
+			a.Target, a.DisplayName, graphiteAggregation(s.aggs[metric]), s.xffs[metric],
+			s.from, s.until, int64(step)/s.divisor, s.cond.highPrecision(), points,
+			s.cond.appliedFunctions[a.Target],
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stream writes all series of the response to w
+func (c *CHResponse) Stream(w SeriesWriter) (int64, error) {
+	return c.stream(w, nil)
+}
+
+// stream writes series of the response to w, series of metrics from written are already written
+func (c *CHResponse) stream(w SeriesWriter, written map[string]struct{}) (int64, error) {
+	data := c.Data
+	var pointsCount int64
+
+	nextMetric := data.GroupByMetric()
+	for {
+		points := nextMetric()
+		if len(points) == 0 {
+			break
+		}
+		id := points[0].MetricID
+		metricName := data.MetricName(id)
+		step, err := data.GetStep(id)
+		if err != nil {
+			return pointsCount, err
+		}
+		function, err := data.GetAggregation(id)
+		if err != nil {
+			return pointsCount, err
+		}
+		xFilesFactor, _ := data.GetXFilesFactor(id)
+		for _, a := range data.AM.Get(metricName) {
+			err := w.WriteSeries(
+				a.Target, a.DisplayName, function, xFilesFactor, c.From, c.Until, int64(step), c.HighPrecisionTimestamps,
+				points, c.AppliedFunctions[a.Target],
+			)
+			if err != nil {
+				return pointsCount, err
+			}
+		}
+		pointsCount += int64(len(points))
+		if written == nil {
+			written = make(map[string]struct{})
+		}
+		written[metricName] = struct{}{}
+	}
+
+	// fill metrics without points with NaN
+	if c.AppendOutEmptySeries && len(written) < data.AM.Len() && data.CommonStep > 0 {
+		for _, metricName := range data.AM.Series(false) {
+			if _, done := written[metricName]; done {
+				continue
+			}
+			for _, a := range data.AM.Get(metricName) {
+				err := w.WriteSeries(
+					a.Target, a.DisplayName, "any", 0, c.From, c.Until, data.CommonStep, c.HighPrecisionTimestamps,
+					[]point.Point{}, c.AppliedFunctions[a.Target],
+				)
+				if err != nil {
+					return pointsCount, err
+				}
+			}
+		}
+	}
+	return pointsCount, nil
+}
@@ -0,0 +1,130 @@
+package data
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+)
+
+type testSeries struct {
+	target           string
+	name             string
+	function         string
+	step             int64
+	points           []point.Point
+	appliedFunctions []string
+}
+
+type testSeriesWriter struct {
+	sync.Mutex
+	series []testSeries
+	// from, until and highPrecisionTimestamps of the last series
+	from                    int64
+	until                   int64
+	highPrecisionTimestamps bool
+}
+
+func (w *testSeriesWriter) WriteSeries(target, name, function string, xFilesFactor float32, from, until, step int64, highPrecisionTimestamps bool, points []point.Point, appliedFunctions []string) error {
+	w.Lock()
+	defer w.Unlock()
+	w.series = append(w.series, testSeries{target, name, function, step, points, appliedFunctions})
+	w.from, w.until, w.highPrecisionTimestamps = from, until, highPrecisionTimestamps
+	return nil
+}
+
+func TestStreamWriteRow(t *testing.T) {
+	am := alias.New()
+	am.Add("a.b", alias.Value{Target: "a.*", DisplayName: "a.b"}, alias.Value{Target: "*.b", DisplayName: "a.b"})
+	am.Add("a.c", alias.Value{Target: "a.*", DisplayName: "a.c"})
+	cond := newCondition(5400, 1800, 5)
+	cond.AM = am
+	cond.step = 60
+	cond.aggregations = map[string][]string{"any": {"a.b"}, "max": {"a.c"}}
+	cond.pushdownSteps = map[uint32][]string{600: {"a.c"}}
+	cond.appliedFunctions = map[string][]string{"a.*": {"scale"}}
+
+	w := &testSeriesWriter{}
+	s := newStream(w, cond)
+	require.NoError(t, s.writeRow("a.b", []int64{1200, 1260}, []float64{1, 2}))
+	require.NoError(t, s.writeRow("a.c", []int64{1200}, []float64{3}))
+
+	assert.Equal(t, int64(3), s.points)
+	assert.Equal(t, map[string]struct{}{"a.b": {}, "a.c": {}}, s.written)
+	assert.ElementsMatch(t, []testSeries{
+		{"a.*", "a.b", "first", 60, []point.Point{{Value: 1, Time: 1200, Timestamp: 1200}, {Value: 2, Time: 1260, Timestamp: 1260}}, []string{"scale"}},
+		{"*.b", "a.b", "first", 60, []point.Point{{Value: 1, Time: 1200, Timestamp: 1200}, {Value: 2, Time: 1260, Timestamp: 1260}}, nil},
+		{"a.*", "a.c", "max", 600, []point.Point{{Value: 3, Time: 1200, Timestamp: 1200}}, []string{"scale"}},
+	}, w.series)
+}
+
+func TestStreamWriteRowMilliseconds(t *testing.T) {
+	am := alias.New()
+	am.Add("a.b", alias.Value{Target: "a.*", DisplayName: "a.b"})
+	cond := newCondition(5400, 1800, 5)
+	cond.AM = am
+	cond.highPrecisionTime = "UInt64"
+	cond.aggregations = map[string][]string{"any": {"a.b"}}
+
+	// milliseconds are converted to seconds
+	cond.step = 2000
+	w := &testSeriesWriter{}
+	s := newStream(w, cond)
+	require.NoError(t, s.writeRow("a.b", []int64{1200000, 1202000}, []float64{1, 2}))
+	assert.Equal(t, []testSeries{
+		{"a.*", "a.b", "first", 2, []point.Point{{Value: 1, Time: 1200, Timestamp: 1200000}, {Value: 2, Time: 1202, Timestamp: 1202000}}, nil},
+	}, w.series)
+	assert.Equal(t, cond.From, w.from)
+	assert.Equal(t, cond.Until, w.until)
+	assert.False(t, w.highPrecisionTimestamps)
+
+	// the client supports high precision timestamps
+	cond.HighPrecisionTimestamps = true
+	cond.step = 500
+	w = &testSeriesWriter{}
+	s = newStream(w, cond)
+	require.NoError(t, s.writeRow("a.b", []int64{1200000, 1200500}, []float64{1, 2}))
+	assert.Equal(t, []testSeries{
+		{"a.*", "a.b", "first", 500, []point.Point{{Value: 1, Time: 1200000, Timestamp: 1200000}, {Value: 2, Time: 1200500, Timestamp: 1200500}}, nil},
+	}, w.series)
+	assert.Equal(t, cond.From*1000, w.from)
+	assert.Equal(t, cond.Until*1000+999, w.until)
+	assert.True(t, w.highPrecisionTimestamps)
+}
+
+func TestCHResponseStream(t *testing.T) {
+	am := alias.New()
+	am.Add("a.b", alias.Value{Target: "a.*", DisplayName: "a.b"})
+	am.Add("a.c", alias.Value{Target: "a.*", DisplayName: "a.c"})
+	am.Add("a.d", alias.Value{Target: "a.*", DisplayName: "a.d"})
+	points := point.NewPoints()
+	points.AppendPoint(points.MetricID("a.b"), 1, 1200, 1200)
+	points.AppendPoint(points.MetricID("a.b"), 2, 1260, 1260)
+	points.SetAggregations(map[string][]string{"avg": {"a.b"}})
+	chr := CHResponse{
+		Data:                 &Data{Points: points, AM: am, CommonStep: 60},
+		From:                 1200,
+		Until:                1319,
+		AppendOutEmptySeries: true,
+	}
+
+	w := &testSeriesWriter{}
+	n, err := chr.Stream(w)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.Equal(t, testSeries{"a.*", "a.b", "avg", 60, points.List(), nil}, w.series[0])
+	assert.ElementsMatch(t, []testSeries{
+		{"a.*", "a.c", "any", 60, []point.Point{}, nil},
+		{"a.*", "a.d", "any", 60, []point.Point{}, nil},
+	}, w.series[1:])
+
+	// series of written metrics are skipped
+	w = &testSeriesWriter{}
+	_, err = chr.stream(w, map[string]struct{}{"a.c": {}, "a.d": {}})
+	require.NoError(t, err)
+	assert.Len(t, w.series, 1)
+}
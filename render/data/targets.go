@@ -2,6 +2,9 @@ package data
 
 import (
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
@@ -13,6 +16,14 @@ import (
 
 const graphiteConsolidationFunction = "consolidateBy"
 
+// graphiteXFilesFactorFunctions set xFilesFactor of the series, xFilesFactor is an alias of setXFilesFactor
+var graphiteXFilesFactorFunctions = map[string]bool{"setXFilesFactor": true, "xFilesFactor": true}
+
+// isAggregationFunction returns true for functions, which are applied as parameters of the aggregation
+func isAggregationFunction(name string) bool {
+	return name == graphiteConsolidationFunction || graphiteXFilesFactorFunctions[name]
+}
+
 type FilteringFunctionsByTarget map[string][]*v3pb.FilteringFunction
 type Cache struct {
 	Cached     bool
@@ -30,12 +41,18 @@ type Targets struct {
 	Cache  []Cache
 	Cached bool // all is cached
 	// AM stores found expanded metrics
-	AM                         *alias.Map
+	AM *alias.Map
+	// Raw disables aggregation and rollup, points are returned as they are stored
+	Raw bool
+	// HighPrecisionTimestamps allows to return points of tables with high-precision-time in milliseconds,
+	// otherwise they are returned in seconds
+	HighPrecisionTimestamps    bool
 	filteringFunctionsByTarget FilteringFunctionsByTarget
 	pointsTable                string
 	isReverse                  bool
 	rollupRules                *rollup.Rules
 	rollupUseReverted          bool
+	highPrecisionTime          string
 	queryMetrics               *metrics.QueryMetrics
 }
 
@@ -70,9 +87,17 @@ func (tt *Targets) SetFilteringFunctions(target string, filteringFunctions []*v3
 	tt.filteringFunctionsByTarget[target] = filteringFunctions
 }
 
+// GetFilteringFunctions returns filtering functions, requested for the target
+func (tt *Targets) GetFilteringFunctions(target string) []*v3pb.FilteringFunction {
+	return tt.filteringFunctionsByTarget[target]
+}
+
 func (tt *Targets) selectDataTable(cfg *config.Config, tf *TimeFrame, context string) error {
-	now := time.Now().Unix()
+	return tt.selectDataTableAt(cfg, tf, context, time.Now().Unix())
+}
 
+// selectDataTableAt selects the data table for the time frame, max-age and min-age are counted from now
+func (tt *Targets) selectDataTableAt(cfg *config.Config, tf *TimeFrame, context string, now int64) error {
 TableLoop:
 	for i := 0; i < len(cfg.DataTable); i++ {
 		t := &cfg.DataTable[i]
@@ -123,6 +148,7 @@ TableLoop:
 		tt.pointsTable = t.Table
 		tt.isReverse = t.Reverse
 		tt.rollupUseReverted = t.RollupUseReverted
+		tt.highPrecisionTime = t.HighPrecisionTime
 		tt.rollupRules = t.Rollup.Rules()
 		tt.queryMetrics = t.QueryMetrics
 		return nil
@@ -131,6 +157,89 @@ TableLoop:
 	return fmt.Errorf("data tables is not specified for %v", tt.List[0])
 }
 
+// segment is a part of the time frame served by one data table
+type segment struct {
+	TimeFrame
+	targets *Targets
+}
+
+// splitByDataTables splits the time frame at max-age and min-age boundaries of the data tables and selects
+// the data table for every part. Adjacent parts of the same table are joined. It returns nil, when the time
+// frame is served by one table or some part has no table
+func (tt *Targets) splitByDataTables(cfg *config.Config, tf *TimeFrame, context string) []segment {
+	now := time.Now().Unix()
+
+	// the first second of the time frame parts
+	starts := make([]int64, 0, 2*len(cfg.DataTable))
+	for i := 0; i < len(cfg.DataTable); i++ {
+		t := &cfg.DataTable[i]
+		if !t.ContextMap[context] {
+			continue
+		}
+		if t.MaxAge != 0 {
+			starts = append(starts, now-int64(t.MaxAge.Seconds()))
+		}
+		if t.MinAge != 0 {
+			starts = append(starts, now-int64(t.MinAge.Seconds())+1)
+		}
+	}
+	slices.Sort(starts)
+	starts = slices.Compact(starts)
+
+	segments := make([]segment, 0, len(starts)+1)
+	add := func(from, until int64) bool {
+		s := segment{
+			TimeFrame: TimeFrame{From: from, Until: until, MaxDataPoints: tf.MaxDataPoints},
+			targets:   tt.copy(),
+		}
+		if err := s.targets.selectDataTableAt(cfg, &s.TimeFrame, context, now); err != nil {
+			return false
+		}
+		if n := len(segments); n != 0 && segments[n-1].targets.sameDataTable(s.targets) {
+			segments[n-1].Until = until
+			return true
+		}
+		segments = append(segments, s)
+		return true
+	}
+	from := tf.From
+	for _, start := range starts {
+		if start <= from || start > tf.Until {
+			continue
+		}
+		if !add(from, start-1) {
+			return nil
+		}
+		from = start
+	}
+	if !add(from, tf.Until) || len(segments) < 2 {
+		return nil
+	}
+
+	// points are returned in milliseconds only when all parts support it
+	for i := range segments {
+		if segments[i].targets.highPrecisionTime != segments[0].targets.highPrecisionTime {
+			for j := range segments {
+				segments[j].targets.HighPrecisionTimestamps = false
+			}
+			break
+		}
+	}
+	return segments
+}
+
+// copy returns a copy of targets sharing the list, filtering functions and found metrics
+func (tt *Targets) copy() *Targets {
+	c := *tt
+	return &c
+}
+
+// sameDataTable returns true if both targets are selected for the same data table
+func (tt *Targets) sameDataTable(other *Targets) bool {
+	return tt.pointsTable == other.pointsTable && tt.isReverse == other.isReverse &&
+		tt.rollupRules == other.rollupRules && tt.highPrecisionTime == other.highPrecisionTime
+}
+
 func (tt *Targets) GetRequestedAggregation(target string) (string, error) {
 	if ffs, ok := tt.filteringFunctionsByTarget[target]; !ok {
 		return "", nil
@@ -162,10 +271,19 @@ func (tt *Targets) GetRequestedAggregation(target string) (string, error) {
 			// avg, sum, max, min have the same name in clickhouse
 			case "avg", "sum", "max", "min":
 				return ffArgs[0], nil
+			// the rest are implemented by rollup.AggrMap
+			case "median", "count", "stddev", "range", "multiply":
+				return ffArgs[0], nil
+			case "rangeOf":
+				return "range", nil
 			default:
+				// percentiles like p50 or p99.9
+				if _, ok := rollup.GetAggr(ffArgs[0]); ok && strings.HasPrefix(ffArgs[0], "p") {
+					return ffArgs[0], nil
+				}
 				return "",
 					fmt.Errorf(
-						"unknown \"%s\" argument function (allowed argumets are: 'avg', 'average', 'sum', 'max', 'min', 'last', 'first'): recieved %s",
+						"unknown \"%s\" argument function (allowed argumets are: 'avg', 'average', 'sum', 'max', 'min', 'last', 'first', 'median', 'count', 'stddev', 'range', 'multiply', 'pN'): recieved %s",
 						graphiteConsolidationFunction,
 						ffArgs[0],
 					)
@@ -175,3 +293,24 @@ func (tt *Targets) GetRequestedAggregation(target string) (string, error) {
 	}
 	return "", nil
 }
+
+// GetRequestedXFilesFactor returns xFilesFactor and the function name, if it's set for the target by
+// setXFilesFactor function
+func (tt *Targets) GetRequestedXFilesFactor(target string) (float32, string, error) {
+	for _, filteringFunc := range tt.filteringFunctionsByTarget[target] {
+		ffName := filteringFunc.GetName()
+		if !graphiteXFilesFactorFunctions[ffName] {
+			continue
+		}
+		ffArgs := filteringFunc.GetArguments()
+		if len(ffArgs) < 1 {
+			return 0, "", fmt.Errorf("no argumets were provided to %s function", ffName)
+		}
+		xFilesFactor, err := strconv.ParseFloat(ffArgs[0], 32)
+		if err != nil || xFilesFactor < 0 || xFilesFactor > 1 {
+			return 0, "", fmt.Errorf("invalid \"%s\" argument, a number in [0, 1] range is expected: recieved %s", ffName, ffArgs[0])
+		}
+		return float32(xFilesFactor), ffName, nil
+	}
+	return 0, "", nil
+}
@@ -0,0 +1,255 @@
+// Package eval evaluates graphite functions of /render targets in-process with the carbonapi functions library.
+// The series of the targets are found and fetched by graphite-clickhouse itself.
+package eval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-graphite/carbonapi/expr"
+	"github.com/go-graphite/carbonapi/expr/functions"
+	"github.com/go-graphite/carbonapi/expr/helper"
+	"github.com/go-graphite/carbonapi/expr/metadata"
+	"github.com/go-graphite/carbonapi/expr/tags"
+	"github.com/go-graphite/carbonapi/expr/types"
+	"github.com/go-graphite/carbonapi/pkg/parser"
+
+	"github.com/lomik/graphite-clickhouse/helper/errs"
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+	"github.com/lomik/graphite-clickhouse/render/data"
+)
+
+// ErrNoFetcher is returned when the context of the evaluation does not contain FetchFunc
+var ErrNoFetcher = errors.New("fetcher is not set for the evaluation")
+
+// FetchFunc finds and fetches the series of plain targets. The returned responses must have From and Until of
+// the requested time frames
+type FetchFunc func(ctx context.Context, fetchRequests data.MultiTarget) (data.CHResponses, error)
+
+type fetcherKey struct{}
+
+type fetcher struct {
+	fetch         FetchFunc
+	maxDataPoints int64
+}
+
+func withFetcher(ctx context.Context, fetch FetchFunc, maxDataPoints int64) context.Context {
+	return context.WithValue(ctx, fetcherKey{}, fetcher{fetch: fetch, maxDataPoints: maxDataPoints})
+}
+
+// evaluator implements interfaces.Evaluator of carbonapi. It's set for all functions, because some of them
+// fetch series by themselves, e.g. timeShift or applyByNode
+type evaluator struct{}
+
+func init() {
+	functions.New(nil)
+	metadata.SetEvaluator(evaluator{})
+	helper.SetEvaluator(evaluator{})
+}
+
+// isPlain returns true for targets, which are processed by finder without evaluation
+func isPlain(target string) bool {
+	e, _, err := parser.ParseExpr(target)
+	if err != nil {
+		// the invalid expression is processed as usual target
+		return true
+	}
+	return e.IsName() || (e.IsFunc() && e.Target() == "seriesByTag")
+}
+
+// NeedsEvaluation returns true if any target of the request contains graphite functions
+func NeedsEvaluation(fetchRequests data.MultiTarget) bool {
+	for _, targets := range fetchRequests {
+		for _, target := range targets.List {
+			if !isPlain(target) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Fetch finds and fetches series of the plain targets of expressions, which are not in values yet. It returns
+// values of the expressions
+func (evaluator) Fetch(ctx context.Context, exprs []parser.Expr, from, until int64, values map[parser.MetricRequest][]*types.MetricData) (map[parser.MetricRequest][]*types.MetricData, error) {
+	f, ok := ctx.Value(fetcherKey{}).(fetcher)
+	if !ok {
+		return nil, ErrNoFetcher
+	}
+
+	targetValues := make(map[parser.MetricRequest][]*types.MetricData)
+	fetchRequests := make(data.MultiTarget)
+	for _, e := range exprs {
+		for _, m := range e.Metrics(from, until) {
+			mr := parser.MetricRequest{Metric: m.Metric, From: m.From, Until: m.Until}
+			if _, ok := targetValues[mr]; ok {
+				continue
+			}
+			targetValues[mr] = nil
+			if _, ok := values[mr]; ok {
+				continue
+			}
+			tf := data.TimeFrame{From: m.From, Until: m.Until, MaxDataPoints: f.maxDataPoints}
+			if targets, ok := fetchRequests[tf]; ok {
+				targets.Append(m.Metric)
+			} else {
+				fetchRequests[tf] = data.NewTargetsOne(m.Metric, 1, alias.New())
+			}
+		}
+	}
+
+	if len(fetchRequests) != 0 {
+		responses, err := f.fetch(ctx, fetchRequests)
+		if err != nil {
+			return nil, err
+		}
+		fetched := make(map[parser.MetricRequest][]*types.MetricData)
+		for i := range responses {
+			mfr, err := responses[i].ToMultiFetchResponseV3()
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range mfr.Metrics {
+				mr := parser.MetricRequest{Metric: m.PathExpression, From: responses[i].From, Until: responses[i].Until}
+				// values are shared by aliases of the same metric, and functions may change them
+				m.Values = append([]float64(nil), m.Values...)
+				fetched[mr] = append(fetched[mr], &types.MetricData{FetchResponse: m, Tags: tags.ExtractTags(m.Name)})
+			}
+		}
+		for mr := range targetValues {
+			if _, ok := values[mr]; ok {
+				continue
+			}
+			sort.Sort(helper.ByNameNatural(fetched[mr]))
+			values[mr] = fetched[mr]
+		}
+	}
+
+	for mr := range targetValues {
+		targetValues[mr] = values[mr]
+	}
+	return targetValues, nil
+}
+
+// Eval evaluates the expression, the rewriting functions like applyByNode are expanded and evaluated too
+func (ev evaluator) Eval(ctx context.Context, e parser.Expr, from, until int64, values map[parser.MetricRequest][]*types.MetricData) ([]*types.MetricData, error) {
+	rewritten, targets, err := expr.RewriteExpr(ctx, e, from, until, values)
+	if err != nil {
+		return nil, err
+	}
+	if !rewritten {
+		return expr.EvalExpr(ctx, e, from, until, values)
+	}
+	var results []*types.MetricData
+	for _, target := range targets {
+		e, _, err := parser.ParseExpr(target)
+		if err != nil {
+			return nil, err
+		}
+		targetValues, err := ev.Fetch(ctx, []parser.Expr{e}, from, until, values)
+		if err != nil {
+			return nil, err
+		}
+		result, err := ev.Eval(ctx, e, from, until, targetValues)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result...)
+	}
+	return results, nil
+}
+
+// Render evaluates targets of the time frame and returns the result series as CHResponse. Series are fetched
+// with fetch. Errors of fetch are returned as they are, other errors are invalid expressions with 400 code
+func Render(ctx context.Context, tf data.TimeFrame, targets []string, fetch FetchFunc) (data.CHResponse, error) {
+	var fetchErr error
+	ctx = withFetcher(ctx, func(ctx context.Context, fetchRequests data.MultiTarget) (data.CHResponses, error) {
+		responses, err := fetch(ctx, fetchRequests)
+		if err != nil {
+			fetchErr = err
+		}
+		return responses, err
+	}, tf.MaxDataPoints)
+	evalError := func(err error) error {
+		if fetchErr != nil {
+			return fetchErr
+		}
+		return errs.NewErrorWithCode(err.Error(), http.StatusBadRequest)
+	}
+
+	ev := evaluator{}
+	values := make(map[parser.MetricRequest][]*types.MetricData)
+	results := make([]*types.MetricData, 0)
+	resultTargets := make([]string, 0)
+	for _, target := range targets {
+		e, _, err := parser.ParseExpr(target)
+		if err != nil {
+			return data.CHResponse{}, evalError(err)
+		}
+		targetValues, err := ev.Fetch(ctx, []parser.Expr{e}, tf.From, tf.Until, values)
+		if err != nil {
+			return data.CHResponse{}, evalError(err)
+		}
+		result, err := ev.Eval(ctx, e, tf.From, tf.Until, targetValues)
+		if err != nil {
+			return data.CHResponse{}, evalError(err)
+		}
+		for range result {
+			resultTargets = append(resultTargets, target)
+		}
+		results = append(results, result...)
+	}
+	return response(tf, resultTargets, results)
+}
+
+// response converts evaluated series to CHResponse. Every series is stored as a separate metric, so series
+// with the same names are returned as they are. Series with non-positive step can't be converted to points
+func response(tf data.TimeFrame, targets []string, results []*types.MetricData) (data.CHResponse, error) {
+	am := alias.New()
+	points := point.NewPoints()
+	steps := make(map[uint32][]string)
+	aggregations := make(map[string][]string)
+	from, until := tf.From, tf.Until
+	var commonStep int64
+	for i, r := range results {
+		if r.StepTime <= 0 {
+			return data.CHResponse{}, fmt.Errorf("series %q of target %q has non-positive step %d", r.Name, targets[i], r.StepTime)
+		}
+		metric := strconv.Itoa(i)
+		am.Add(metric, alias.Value{Target: targets[i], DisplayName: r.Name})
+		id := points.MetricID(metric)
+		for j, v := range r.Values {
+			if math.IsNaN(v) {
+				continue
+			}
+			t := r.StartTime + int64(j)*r.StepTime
+			points.AppendPoint(id, v, t, uint32(t))
+		}
+		steps[uint32(r.StepTime)] = append(steps[uint32(r.StepTime)], metric)
+		function := r.ConsolidationFunc
+		if function == "" {
+			function = "avg"
+		}
+		aggregations[function] = append(aggregations[function], metric)
+		// consolidating functions like summarize align the series to the bucket start
+		from = min(from, r.StartTime)
+		until = max(until, r.StopTime-1)
+		if commonStep == 0 {
+			commonStep = r.StepTime
+		}
+	}
+	points.SetSteps(steps)
+	points.SetAggregations(aggregations)
+	return data.CHResponse{
+		Data:                 &data.Data{Points: points, AM: am, CommonStep: commonStep},
+		From:                 from,
+		Until:                until,
+		AppendOutEmptySeries: true,
+	}, nil
+}
@@ -0,0 +1,173 @@
+package eval
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"testing"
+
+	"github.com/go-graphite/carbonapi/expr/types"
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/helper/errs"
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+	"github.com/lomik/graphite-clickhouse/render/data"
+)
+
+var testPoints = map[string][]float64{
+	"test.metric1": {1, 2, 3},
+	"test.metric2": {10, 20, 30},
+	"test.metric3": {5, 5, 5},
+}
+
+// testFetch matches targets as globs against testPoints, the points start at 60 with 60 seconds step
+func testFetch(requests *[]data.MultiTarget) FetchFunc {
+	return func(ctx context.Context, fetchRequests data.MultiTarget) (data.CHResponses, error) {
+		*requests = append(*requests, fetchRequests)
+		responses := make(data.CHResponses, 0, len(fetchRequests))
+		for tf, targets := range fetchRequests {
+			points := point.NewPoints()
+			metrics := make([]string, 0)
+			for _, target := range targets.List {
+				for metric, values := range testPoints {
+					if ok, _ := path.Match(target, metric); !ok {
+						continue
+					}
+					targets.AM.Add(metric, alias.Value{Target: target, DisplayName: metric})
+					metrics = append(metrics, metric)
+					id := points.MetricID(metric)
+					for i, v := range values {
+						t := int64(60 * (i + 1))
+						points.AppendPoint(id, v, t, uint32(t))
+					}
+				}
+			}
+			points.SetAggregations(map[string][]string{"avg": metrics})
+			points.Sort()
+			responses = append(responses, data.CHResponse{
+				Data:  &data.Data{Points: points, AM: targets.AM, CommonStep: 60},
+				From:  tf.From,
+				Until: tf.Until,
+			})
+		}
+		return responses, nil
+	}
+}
+
+func TestNeedsEvaluation(t *testing.T) {
+	tests := []struct {
+		target   string
+		expected bool
+	}{
+		{"test.*", false},
+		{"test.{a,b}.c", false},
+		{"seriesByTag('name=cpu')", false},
+		{"sumSeries(test.*)", true},
+		{"aliasByNode(seriesByTag('name=cpu'), 0)", true},
+		{"invalid(", false},
+	}
+	for _, tt := range tests {
+		fetchRequests := data.MultiTarget{
+			data.TimeFrame{From: 60, Until: 240}: data.NewTargets([]string{"a.b", tt.target}, alias.New()),
+		}
+		assert.Equal(t, tt.expected, NeedsEvaluation(fetchRequests), tt.target)
+	}
+}
+
+func TestRender(t *testing.T) {
+	tf := data.TimeFrame{From: 60, Until: 239, MaxDataPoints: 100}
+	var requests []data.MultiTarget
+	chr, err := Render(context.Background(), tf, []string{
+		"aliasByNode(sumSeries(test.metric[12]), 0)",
+		"scale(test.metric3, 2)",
+		"test.metric1",
+	}, testFetch(&requests))
+	require.NoError(t, err)
+
+	// the plain targets of every expression are fetched by a separate request
+	require.Len(t, requests, 3)
+	for _, r := range requests {
+		for rtf := range r {
+			assert.Equal(t, tf, rtf)
+		}
+	}
+
+	mfr, err := chr.ToMultiFetchResponseV3()
+	require.NoError(t, err)
+	require.Len(t, mfr.Metrics, 3)
+
+	assert.Equal(t, "test", mfr.Metrics[0].Name)
+	assert.Equal(t, "aliasByNode(sumSeries(test.metric[12]), 0)", mfr.Metrics[0].PathExpression)
+	assert.Equal(t, []float64{11, 22, 33}, mfr.Metrics[0].Values)
+	assert.Equal(t, int64(60), mfr.Metrics[0].StepTime)
+
+	assert.Equal(t, "scale(test.metric3,2)", mfr.Metrics[1].Name)
+	assert.Equal(t, []float64{10, 10, 10}, mfr.Metrics[1].Values)
+
+	assert.Equal(t, "test.metric1", mfr.Metrics[2].Name)
+	assert.Equal(t, []float64{1, 2, 3}, mfr.Metrics[2].Values)
+}
+
+func TestRenderSeriesWithSameName(t *testing.T) {
+	tf := data.TimeFrame{From: 60, Until: 239}
+	var requests []data.MultiTarget
+	chr, err := Render(context.Background(), tf, []string{"aliasByNode(test.*, 0)"}, testFetch(&requests))
+	require.NoError(t, err)
+
+	mfr, err := chr.ToMultiFetchResponseV3()
+	require.NoError(t, err)
+	require.Len(t, mfr.Metrics, 3)
+	for i, values := range [][]float64{{1, 2, 3}, {10, 20, 30}, {5, 5, 5}} {
+		assert.Equal(t, "test", mfr.Metrics[i].Name)
+		assert.Equal(t, values, mfr.Metrics[i].Values)
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	tf := data.TimeFrame{From: 60, Until: 239}
+	var requests []data.MultiTarget
+
+	_, err := Render(context.Background(), tf, []string{"unknownFunction(test.*)"}, testFetch(&requests))
+	var errWithCode errs.ErrorWithCode
+	require.ErrorAs(t, err, &errWithCode)
+	assert.Equal(t, http.StatusBadRequest, errWithCode.Code)
+
+	fetchErr := errors.New("fetch error")
+	_, err = Render(context.Background(), tf, []string{"sumSeries(test.*)"}, func(context.Context, data.MultiTarget) (data.CHResponses, error) {
+		return nil, fetchErr
+	})
+	assert.Equal(t, fetchErr, err)
+
+	_, err = evaluator{}.Fetch(context.Background(), nil, 0, 0, nil)
+	assert.Equal(t, ErrNoFetcher, err)
+}
+
+func TestRenderWithoutMetrics(t *testing.T) {
+	tf := data.TimeFrame{From: 60, Until: 239}
+	var requests []data.MultiTarget
+	chr, err := Render(context.Background(), tf, []string{"constantLine(42)"}, testFetch(&requests))
+	require.NoError(t, err)
+	assert.Empty(t, requests)
+
+	mfr, err := chr.ToMultiFetchResponseV3()
+	require.NoError(t, err)
+	require.Len(t, mfr.Metrics, 1)
+	assert.Equal(t, "42", mfr.Metrics[0].Name)
+}
+
+func TestResponseNonPositiveStep(t *testing.T) {
+	tf := data.TimeFrame{From: 60, Until: 239}
+	results := []*types.MetricData{
+		{FetchResponse: v3pb.FetchResponse{Name: "a", StartTime: 60, StopTime: 240, StepTime: 60, Values: []float64{1, 2, 3}}},
+		{FetchResponse: v3pb.FetchResponse{Name: "b", StartTime: 60, StopTime: 240, Values: []float64{1}}},
+	}
+	_, err := response(tf, []string{"a", "b"}, results)
+	assert.EqualError(t, err, `series "b" of target "b" has non-positive step 0`)
+
+	_, err = response(tf, []string{"a"}, results[:1])
+	assert.NoError(t, err)
+}
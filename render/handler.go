@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -21,9 +22,13 @@ import (
 	"github.com/lomik/graphite-clickhouse/metrics"
 	"github.com/lomik/graphite-clickhouse/pkg/scope"
 	"github.com/lomik/graphite-clickhouse/render/data"
+	"github.com/lomik/graphite-clickhouse/render/eval"
 	"github.com/lomik/graphite-clickhouse/render/reply"
 )
 
+// partialErrorsHeader contains the failed targets of the partial response, one header value per target
+const partialErrorsHeader = "X-Partial-Errors"
+
 // Handler serves /render requests
 type Handler struct {
 	config *config.Config
@@ -42,16 +47,123 @@ func targetKey(from, until int64, target, ttl string) string {
 	return time.Unix(from, 0).Format("2006-01-02") + ";" + time.Unix(until, 0).Format("2006-01-02") + ";" + target + ";ttl=" + ttl
 }
 
-func getCacheTimeout(now time.Time, from, until int64, cacheConfig *config.CacheConfig) (int32, string, *metrics.CacheMetric) {
+func dataKey(tf data.TimeFrame, targets *data.Targets, ttl string) string {
+	var sb strings.Builder
+	sb.WriteString(strconv.FormatInt(tf.From, 10))
+	sb.WriteString(";")
+	sb.WriteString(strconv.FormatInt(tf.Until, 10))
+	sb.WriteString(";mdp=")
+	sb.WriteString(strconv.FormatInt(tf.MaxDataPoints, 10))
+	// responses in milliseconds differ from the ones in seconds
+	if targets.HighPrecisionTimestamps {
+		sb.WriteString(";hp")
+	}
+	for _, target := range targets.List {
+		sb.WriteString(";")
+		sb.WriteString(target)
+		for _, f := range targets.GetFilteringFunctions(target) {
+			sb.WriteString("|")
+			sb.WriteString(f.GetName())
+			sb.WriteString("(")
+			sb.WriteString(strings.Join(f.GetArguments(), ","))
+			sb.WriteString(")")
+		}
+	}
+	sb.WriteString(";ttl=")
+	sb.WriteString(ttl)
+	return sb.String()
+}
+
+// isShortCacheTimeout returns true if the short cache ttl should be used for from/until
+func isShortCacheTimeout(now time.Time, from, until int64, cacheConfig *config.CacheConfig) bool {
 	if cacheConfig.ShortDuration == 0 {
-		return cacheConfig.DefaultTimeoutSec, cacheConfig.DefaultTimeoutStr, metrics.DefaultCacheMetrics
+		return false
 	}
 	duration := time.Second * time.Duration(until-from)
 	if duration > cacheConfig.ShortDuration || now.Unix()-until > cacheConfig.ShortUntilOffsetSec {
-		return cacheConfig.DefaultTimeoutSec, cacheConfig.DefaultTimeoutStr, metrics.DefaultCacheMetrics
+		return false
+	}
+	return true
+}
+
+func getCacheTimeout(now time.Time, from, until int64, cacheConfig *config.CacheConfig) (int32, string, *metrics.CacheMetric) {
+	if isShortCacheTimeout(now, from, until, cacheConfig) {
+		return cacheConfig.ShortTimeoutSec, cacheConfig.ShortTimeoutStr, metrics.ShortCacheMetrics
+	}
+	return cacheConfig.DefaultTimeoutSec, cacheConfig.DefaultTimeoutStr, metrics.DefaultCacheMetrics
+}
+
+func getRenderCacheTimeout(now time.Time, from, until int64, cacheConfig *config.CacheConfig) (int32, string, *metrics.CacheMetric) {
+	if isShortCacheTimeout(now, from, until, cacheConfig) {
+		return cacheConfig.ShortTimeoutSec, cacheConfig.ShortTimeoutStr, metrics.RenderShortCacheMetrics
+	}
+	return cacheConfig.DefaultTimeoutSec, cacheConfig.DefaultTimeoutStr, metrics.RenderDefaultCacheMetrics
+}
+
+// try to fetch cached render responses, the cached time frames are removed from fetchRequests
+func (h *Handler) renderCached(ts time.Time, fetchRequests data.MultiTarget, dataCache map[data.TimeFrame]*data.Cache, logger *zap.Logger) (cachedReply data.CHResponses, maxCacheTimeoutStr string) {
+	var maxCacheTimeout int32
+	for tf, targets := range fetchRequests {
+		c := &data.Cache{}
+		c.Timeout, c.TimeoutStr, c.M = getRenderCacheTimeout(ts, tf.From, tf.Until, &h.config.Common.RenderCacheConfig)
+		if c.Timeout <= 0 {
+			continue
+		}
+		c.TS = utils.TimestampTruncate(ts.Unix(), time.Duration(c.Timeout)*time.Second)
+		c.Key = dataKey(tf, targets, c.TimeoutStr)
+		dataCache[tf] = c
+
+		body, err := h.config.Common.RenderCache.Get(c.Key)
+		if err != nil || len(body) == 0 {
+			continue
+		}
+		reply, err := data.NewCachedCHResponse(body)
+		if err != nil {
+			logger.Error("render_cache", zap.String("get_cache", c.Key), zap.Error(err))
+			continue
+		}
+		c.M.CacheHits.Add(1)
+		c.Cached = true
+		if maxCacheTimeout < c.Timeout {
+			maxCacheTimeout = c.Timeout
+			maxCacheTimeoutStr = c.TimeoutStr
+		}
+		cachedReply = append(cachedReply, reply)
+		delete(fetchRequests, tf)
+
+		logger.Info("render", zap.String("get_cache", c.Key), zap.Time("timestamp_cached", time.Unix(c.TS, 0)),
+			zap.Int("metrics", reply.Data.AM.Len()), zap.Bool("render_cached", true),
+			zap.String("ttl", c.TimeoutStr),
+			zap.Int64("from", tf.From), zap.Int64("until", tf.Until))
+	}
+	return
+}
+
+// store fetched responses in render cache
+func (h *Handler) renderCacheSet(fetchRequests data.MultiTarget, dataCache map[data.TimeFrame]*data.Cache, reply data.CHResponses, logger *zap.Logger) {
+	for tf, targets := range fetchRequests {
+		c, ok := dataCache[tf]
+		if !ok || c.Cached {
+			continue
+		}
+		for i := range reply {
+			if reply[i].Data.AM != targets.AM {
+				continue
+			}
+			body, err := reply[i].Bytes()
+			if err != nil {
+				logger.Error("render_cache", zap.String("set_cache", c.Key), zap.Error(err))
+				break
+			}
+			c.M.CacheMisses.Add(1)
+			h.config.Common.RenderCache.Set(c.Key, body, c.Timeout)
+			logger.Info("render", zap.String("set_cache", c.Key), zap.Time("timestamp_cached", time.Unix(c.TS, 0)),
+				zap.Int("metrics", targets.AM.Len()), zap.Bool("render_cached", false),
+				zap.String("ttl", c.TimeoutStr),
+				zap.Int64("from", tf.From), zap.Int64("until", tf.Until))
+			break
+		}
 	}
-	// short cache ttl
-	return cacheConfig.ShortTimeoutSec, cacheConfig.ShortTimeoutStr, metrics.ShortCacheMetrics
 }
 
 // try to fetch cached finder queries
@@ -124,8 +236,24 @@ func (h *Handler) finderCached(ts time.Time, fetchRequests data.MultiTarget, log
 	return
 }
 
-// try to fetch finder queries
-func (h *Handler) finder(fetchRequests data.MultiTarget, ctx context.Context, logger *zap.Logger, qlimiter limiter.ServerLimiter, metricsLen *int, queueDuration *time.Duration, useCache bool) (maxDuration int64, err error) {
+// partialResults returns true if the series of succeeded targets should be returned when other targets are failed
+func (h *Handler) partialResults(r *http.Request) bool {
+	if v := r.FormValue("partialResults"); v != "" {
+		return parser.TruthyBool(v)
+	}
+	return h.config.Common.PartialResults
+}
+
+// setPartialErrors adds the errors of failed targets to the response headers
+func setPartialErrors(w http.ResponseWriter, failed []data.TargetError) {
+	for _, e := range failed {
+		// header values can't contain line breaks
+		w.Header().Add(partialErrorsHeader, strings.Join(strings.Fields(e.Error()), " "))
+	}
+}
+
+// try to fetch finder queries. With partial, the failed targets are dropped and returned instead of the error
+func (h *Handler) finder(fetchRequests data.MultiTarget, ctx context.Context, logger *zap.Logger, qlimiter limiter.ServerLimiter, metricsLen *int, queueDuration *time.Duration, useCache, partial bool) (maxDuration int64, failed []data.TargetError, err error) {
 	var (
 		wg       sync.WaitGroup
 		lock     sync.RWMutex
@@ -180,9 +308,13 @@ func (h *Handler) finder(fetchRequests data.MultiTarget, ctx context.Context, lo
 				d := time.Since(fStart).Milliseconds()
 				if err != nil {
 					metrics.SendQueryReadByTable(stat.Table, tf.From, tf.Until, d, 0, 0, stat.ChReadRows, stat.ChReadBytes, true)
-					logger.Error("find", zap.Error(err))
+					logger.Error("find", zap.String("target", target), zap.Error(err))
 					lock.Lock()
-					errors = append(errors, err)
+					if partial {
+						failed = append(failed, data.TargetError{Target: target, Err: err})
+					} else {
+						errors = append(errors, err)
+					}
 					lock.Unlock()
 					return
 				}
@@ -221,11 +353,13 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		pointsCount   int64
 		fetchStart    time.Time
 		cachedFind    bool
+		cachedReply   data.CHResponses
 		queueFail     bool
 		queueDuration time.Duration
 		err           error
 		fetchRequests data.MultiTarget
 		luser         string
+		failed        []data.TargetError
 	)
 	start := time.Now()
 	status := http.StatusOK
@@ -251,7 +385,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		end := time.Now()
 		logs.AccessLog(accessLogger, h.config, r, status, end.Sub(start), queueDuration, cachedFind, queueFail)
 		qlimiter.SendDuration(queueDuration.Milliseconds())
-		metrics.SendRenderMetrics(metrics.RenderRequestMetric, status, start, fetchStart, end, maxDuration, h.config.Metrics.ExtendedStat, int64(metricsLen), pointsCount)
+		partial := len(failed) != 0 && (status == http.StatusOK || status == http.StatusNotFound)
+		metrics.SendRenderMetrics(metrics.RenderRequestMetric, status, start, fetchStart, end, maxDuration, h.config.Metrics.ExtendedStat, partial, int64(metricsLen), pointsCount)
 	}()
 
 	r.ParseMultipartForm(1024 * 1024)
@@ -283,8 +418,47 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	luser, qlimiter = data.GetQueryLimiter(username, h.config, &fetchRequests)
 	logger.Debug("use user limiter", zap.String("username", username), zap.String("luser", luser))
 
+	partialResults := h.partialResults(r)
+
+	if clickhouse.ExplainRequested(r) {
+		status = h.renderExplain(w, r, fetchRequests, qlimiter, &queueDuration, &metricsLen, logger)
+		return
+	}
+
+	if h.config.Common.EvaluateFunctions && eval.NeedsEvaluation(fetchRequests) {
+		// evaluated series are neither cached nor streamed, the targets are found and fetched during evaluation
+		fetchStart = time.Now()
+		maxDuration, pointsCount, status, queueFail, failed = h.renderEval(w, r, formatter, fetchRequests, qlimiter, &queueDuration, &metricsLen, partialResults, logger)
+		return
+	}
+
+	noCache := parser.TruthyBool(r.FormValue("noCache"))
+
+	useRenderCache := h.config.Common.RenderCache != nil && !noCache
+	dataCache := make(map[data.TimeFrame]*data.Cache)
+	if useRenderCache {
+		var maxRenderCacheTimeoutStr string
+		cachedReply, maxRenderCacheTimeoutStr = h.renderCached(start, fetchRequests, dataCache, logger)
+		if len(cachedReply) > 0 {
+			w.Header().Set("X-Cached-Render", maxRenderCacheTimeoutStr)
+			targetsLen = 0
+			for _, targets := range fetchRequests {
+				targetsLen += len(targets.List)
+			}
+			if len(fetchRequests) == 0 {
+				// all from cache
+				for i := range cachedReply {
+					metricsLen += cachedReply[i].Data.AM.Len()
+					pointsCount += int64(cachedReply[i].Data.Len())
+				}
+				formatter.Reply(w, r, cachedReply)
+				return
+			}
+		}
+	}
+
 	var maxCacheTimeoutStr string
-	useCache := h.config.Common.FindCache != nil && !parser.TruthyBool(r.FormValue("noCache"))
+	useCache := h.config.Common.FindCache != nil && !noCache
 
 	if useCache {
 		var cached int
@@ -294,7 +468,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if cached > 0 {
-			if cached == targetsLen && metricsLen == 0 {
+			if cached == targetsLen && metricsLen == 0 && len(cachedReply) == 0 {
 				// all from cache and no metric
 				status = http.StatusNotFound
 				formatter.Reply(w, r, data.EmptyResponse())
@@ -304,11 +478,16 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	maxDuration, err = h.finder(fetchRequests, r.Context(), logger, qlimiter, &metricsLen, &queueDuration, useCache)
+	maxDuration, failed, err = h.finder(fetchRequests, r.Context(), logger, qlimiter, &metricsLen, &queueDuration, useCache, partialResults)
+	if err == nil && len(failed) != 0 && len(failed) == targetsLen && len(cachedReply) == 0 {
+		// nothing succeeded
+		err = failed[0].Err
+	}
 	if err != nil {
 		status, queueFail = clickhouse.HandleError(w, err)
 		return
 	}
+	setPartialErrors(w, failed)
 
 	logger.Info("finder", zap.Int("metrics", metricsLen), zap.Bool("find_cached", cachedFind))
 
@@ -316,6 +495,10 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Cached-Find", maxCacheTimeoutStr)
 	}
 	if metricsLen == 0 {
+		if len(cachedReply) > 0 {
+			formatter.Reply(w, r, cachedReply)
+			return
+		}
 		status = http.StatusNotFound
 		formatter.Reply(w, r, data.EmptyResponse())
 		return
@@ -323,12 +506,38 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	fetchStart = time.Now()
 
-	reply, err := fetchRequests.Fetch(r.Context(), h.config, config.ContextGraphite, qlimiter, &queueDuration)
+	if streamer, ok := reply.GetStreamer(r, formatter); ok {
+		// streamed points are not stored, so the render cache is not filled
+		var written int64
+		written, status, queueFail = h.renderStream(w, r, streamer, fetchRequests, cachedReply, qlimiter, &queueDuration, logger)
+		pointsCount += written
+		return
+	}
+
+	var reply data.CHResponses
+	if partialResults {
+		var fetchFailed []data.TargetError
+		reply, fetchFailed, err = fetchRequests.FetchPartial(r.Context(), h.config, config.ContextGraphite, qlimiter, &queueDuration)
+		failed = append(failed, fetchFailed...)
+		if err == nil {
+			setPartialErrors(w, fetchFailed)
+		}
+	} else {
+		reply, err = fetchRequests.Fetch(r.Context(), h.config, config.ContextGraphite, qlimiter, &queueDuration)
+	}
 	if err != nil {
 		status, queueFail = clickhouse.HandleError(w, err)
 		return
 	}
 
+	if useRenderCache {
+		// the partial responses are not cached
+		if len(failed) == 0 {
+			h.renderCacheSet(fetchRequests, dataCache, reply, logger)
+		}
+		reply = append(reply, cachedReply...)
+	}
+
 	if len(reply) == 0 {
 		status = http.StatusNotFound
 		formatter.Reply(w, r, reply)
@@ -343,3 +552,156 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	d := time.Since(rStart)
 	logger.Debug("reply", zap.String("runtime", d.String()), zap.Duration("runtime_ns", d))
 }
+
+// renderEval evaluates graphite functions of the targets, the series of plain targets are found and fetched
+// by the evaluator
+func (h *Handler) renderEval(
+	w http.ResponseWriter, r *http.Request, formatter reply.Formatter, fetchRequests data.MultiTarget,
+	qlimiter limiter.ServerLimiter, queueDuration *time.Duration, metricsLen *int, partial bool, logger *zap.Logger,
+) (maxDuration, pointsCount int64, status int, queueFail bool, failed []data.TargetError) {
+	status = http.StatusOK
+	// with partial results, the failed series are evaluated as not found
+	fetch := func(ctx context.Context, fetchRequests data.MultiTarget) (data.CHResponses, error) {
+		d, findFailed, err := h.finder(fetchRequests, ctx, logger, qlimiter, metricsLen, queueDuration, false, partial)
+		if err != nil {
+			return nil, err
+		}
+		failed = append(failed, findFailed...)
+		maxDuration = max(maxDuration, d)
+		if !partial {
+			return fetchRequests.Fetch(ctx, h.config, config.ContextGraphite, qlimiter, queueDuration)
+		}
+		reply, fetchFailed, err := fetchRequests.FetchPartial(ctx, h.config, config.ContextGraphite, qlimiter, queueDuration)
+		if err != nil && len(fetchFailed) != 0 {
+			// all time frames are failed
+			reply, err = data.EmptyResponse(), nil
+		}
+		failed = append(failed, fetchFailed...)
+		return reply, err
+	}
+
+	var series int
+	reply := make(data.CHResponses, 0, len(fetchRequests))
+	for tf, targets := range fetchRequests {
+		chr, err := eval.Render(r.Context(), tf, targets.List, fetch)
+		if err != nil {
+			logger.Error("eval", zap.Error(err))
+			status, queueFail = clickhouse.HandleError(w, err)
+			return
+		}
+		pointsCount += int64(chr.Data.Len())
+		series += chr.Data.AM.Len()
+		reply = append(reply, chr)
+	}
+	logger.Info("finder", zap.Int("metrics", *metricsLen), zap.Bool("find_cached", false))
+	setPartialErrors(w, failed)
+
+	// functions like constantLine return series without fetched metrics
+	if *metricsLen == 0 && series == 0 {
+		status = http.StatusNotFound
+		formatter.Reply(w, r, data.EmptyResponse())
+		return
+	}
+	rStart := time.Now()
+	formatter.Reply(w, r, reply)
+	d := time.Since(rStart)
+	logger.Debug("reply", zap.String("runtime", d.String()), zap.Duration("runtime_ns", d))
+	return
+}
+
+// explainPlan is the response of the explain request
+type explainPlan struct {
+	Targets    []*finder.Plan           `json:"targets"`
+	TimeFrames []data.TimeFramePlan     `json:"time_frames"`
+	Queries    []clickhouse.LoggedQuery `json:"queries"`
+}
+
+// renderExplain writes the plan of the request instead of the series: the finders of the targets, the chosen
+// data tables, rollup rules and steps, and the queries to ClickHouse. Only the index tables are queried
+func (h *Handler) renderExplain(
+	w http.ResponseWriter, r *http.Request, fetchRequests data.MultiTarget,
+	qlimiter limiter.ServerLimiter, queueDuration *time.Duration, metricsLen *int, logger *zap.Logger,
+) (status int) {
+	var (
+		plan     explainPlan
+		queryLog clickhouse.QueryLog
+	)
+	ctx := clickhouse.WithQueryLog(r.Context(), &queryLog)
+	explain := func(ctx context.Context, fetchRequests data.MultiTarget) (data.CHResponses, error) {
+		for tf, targets := range fetchRequests {
+			for _, target := range targets.List {
+				// the queries of the finder are logged once, when they are executed
+				p, err := finder.Explain(clickhouse.WithQueryLog(ctx, nil), h.config, target, tf.From, tf.Until)
+				if err != nil {
+					return nil, err
+				}
+				plan.Targets = append(plan.Targets, p)
+			}
+		}
+		_, _, err := h.finder(fetchRequests, ctx, logger, qlimiter, metricsLen, queueDuration, false, false)
+		if err != nil {
+			return nil, err
+		}
+		timeFrames, err := fetchRequests.Explain(ctx, h.config, config.ContextGraphite)
+		if err != nil {
+			return nil, err
+		}
+		plan.TimeFrames = append(plan.TimeFrames, timeFrames...)
+		return data.EmptyResponse(), nil
+	}
+
+	var err error
+	if h.config.Common.EvaluateFunctions && eval.NeedsEvaluation(fetchRequests) {
+		// the plain targets are explained by the evaluator
+		for tf, targets := range fetchRequests {
+			if _, err = eval.Render(ctx, tf, targets.List, explain); err != nil {
+				break
+			}
+		}
+	} else {
+		_, err = explain(ctx, fetchRequests)
+	}
+	if err != nil {
+		logger.Error("explain", zap.Error(err))
+		status, _ = clickhouse.HandleError(w, err)
+		return
+	}
+	plan.Queries = queryLog.Queries()
+	return clickhouse.WriteExplain(w, plan)
+}
+
+// renderStream writes cached and fetched series to the client as soon as they are ready
+func (h *Handler) renderStream(
+	w http.ResponseWriter, r *http.Request, streamer reply.Streamer, fetchRequests data.MultiTarget, cachedReply data.CHResponses,
+	qlimiter limiter.ServerLimiter, queueDuration *time.Duration, logger *zap.Logger,
+) (pointsCount int64, status int, queueFail bool) {
+	status = http.StatusOK
+	sw := streamer.Stream(w, r)
+	var err error
+	for i := range cachedReply {
+		var n int64
+		n, err = cachedReply[i].Stream(sw)
+		pointsCount += n
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		var n int64
+		n, err = fetchRequests.Stream(r.Context(), h.config, config.ContextGraphite, qlimiter, queueDuration, sw)
+		pointsCount += n
+	}
+	if err == nil {
+		err = sw.Close()
+	}
+	if err != nil {
+		if !sw.Started() {
+			status, queueFail = clickhouse.HandleError(w, err)
+			return
+		}
+		// the response is already started with 200 status, the client detects the broken stream by the absent
+		// final frame
+		logger.Error("stream aborted", zap.Error(err), zap.Int64("points", pointsCount))
+	}
+	return
+}
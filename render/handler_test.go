@@ -1,11 +1,26 @@
 package render
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
 	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	"github.com/lomik/graphite-clickhouse/helper/rollup"
+	"github.com/lomik/graphite-clickhouse/limiter"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+	"github.com/lomik/graphite-clickhouse/render/data"
 )
 
 func Test_getCacheTimeout(t *testing.T) {
@@ -89,3 +104,167 @@ func Test_getCacheTimeout(t *testing.T) {
 		})
 	}
 }
+
+func Test_dataKey(t *testing.T) {
+	tf := data.TimeFrame{From: 1636984418, Until: 1636985018, MaxDataPoints: 100}
+
+	targets := data.NewTargets([]string{"a.*", "b.c"}, alias.New())
+	assert.Equal(t, "1636984418;1636985018;mdp=100;a.*;b.c;ttl=60", dataKey(tf, targets, "60"))
+
+	targets.SetFilteringFunctions("a.*", []*v3pb.FilteringFunction{{Name: "consolidateBy", Arguments: []string{"max"}}})
+	assert.Equal(t, "1636984418;1636985018;mdp=100;a.*|consolidateBy(max);b.c;ttl=60", dataKey(tf, targets, "60"))
+
+	targets.HighPrecisionTimestamps = true
+	assert.Equal(t, "1636984418;1636985018;mdp=100;hp;a.*|consolidateBy(max);b.c;ttl=60", dataKey(tf, targets, "60"))
+
+	// different absolute time ranges don't share the key
+	shifted := data.TimeFrame{From: tf.From + 20, Until: tf.Until + 20, MaxDataPoints: 100}
+	assert.NotEqual(t, dataKey(tf, targets, "60"), dataKey(shifted, targets, "60"))
+}
+
+func TestPartialResults(t *testing.T) {
+	metrics.DisableMetrics()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		query := string(body) + r.URL.Query().Get("query")
+		switch {
+		case strings.Contains(query, "fail.metric"):
+			http.Error(w, "Code: 1000. DB::Exception: Unexpected error\n", http.StatusInternalServerError)
+		case strings.Contains(query, "graphite_index"):
+			w.Write([]byte("ok.metric\n"))
+		}
+	}))
+	defer srv.Close()
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.Common.AppendEmptySeries = true
+	cfg.ClickHouse.QueryParams = []config.QueryParam{{URL: srv.URL, DataTimeout: cfg.ClickHouse.DataTimeout, Limiter: limiter.NoopLimiter{}}}
+	r, err := rollup.NewDefault(60, "avg")
+	require.NoError(t, err)
+	cfg.DataTable = []config.DataTable{
+		{
+			Table:        "graphite_data",
+			ContextMap:   map[string]bool{config.ContextGraphite: true},
+			Rollup:       r,
+			QueryMetrics: metrics.InitQueryMetrics("graphite_data", &cfg.Metrics),
+		},
+	}
+	h := NewHandler(cfg)
+
+	render := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/render/?format=json&from=1669453200&until=1669456800&target=ok.metric&target=fail.metric"+query, nil))
+		return w
+	}
+
+	w := render("")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, w.Body.String())
+	assert.Empty(t, w.Header().Values(partialErrorsHeader))
+
+	w = render("&partialResults=1")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{"fail.metric: clickhouse response status 500: Code: 1000. DB::Exception: Unexpected error"}, w.Header().Values(partialErrorsHeader))
+	assert.Contains(t, w.Body.String(), `"target":"ok.metric"`)
+	assert.NotContains(t, w.Body.String(), `"target":"fail.metric"`)
+
+	cfg.Common.PartialResults = true
+	w = render("")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	w = render("&partialResults=0")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, w.Body.String())
+}
+
+func TestRenderExplain(t *testing.T) {
+	metrics.DisableMetrics()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		query := string(body) + r.URL.Query().Get("query")
+		switch {
+		case strings.Contains(query, "graphite_data"):
+			http.Error(w, "Code: 1000. DB::Exception: data table must not be queried\n", http.StatusInternalServerError)
+		case strings.Contains(query, "graphite_index"):
+			w.Write([]byte("ok.metric\n"))
+		}
+	}))
+	defer srv.Close()
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.ClickHouse.QueryParams = []config.QueryParam{{URL: srv.URL, DataTimeout: cfg.ClickHouse.DataTimeout, Limiter: limiter.NoopLimiter{}}}
+	r, err := rollup.NewDefault(60, "avg")
+	require.NoError(t, err)
+	cfg.DataTable = []config.DataTable{
+		{
+			Table:        "graphite_data",
+			ContextMap:   map[string]bool{config.ContextGraphite: true},
+			Rollup:       r,
+			QueryMetrics: metrics.InitQueryMetrics("graphite_data", &cfg.Metrics),
+		},
+	}
+	h := NewHandler(cfg)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/render/?format=json&from=1669453200&until=1669456800&target=ok.*", nil)
+	req.Header.Set(clickhouse.ExplainHeader, "1")
+	h.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var plan explainPlan
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &plan))
+	require.Len(t, plan.Targets, 1)
+	assert.Equal(t, []string{"index"}, plan.Targets[0].Finders)
+	assert.Equal(t, "direct", plan.Targets[0].Index)
+
+	require.Len(t, plan.TimeFrames, 1)
+	tf := plan.TimeFrames[0]
+	assert.Equal(t, "graphite_data", tf.Table)
+	assert.Equal(t, []string{"ok.*"}, tf.Targets)
+	assert.Equal(t, int64(60), tf.Step)
+	assert.Equal(t, []data.MetricPlan{{Metric: "ok.metric", Precision: 60, Function: "avg", RetentionRule: ".*", FunctionRule: ".*"}}, tf.Metrics)
+
+	require.Len(t, plan.Queries, 2)
+	assert.Equal(t, "graphite_index", plan.Queries[0].Table)
+	assert.True(t, plan.Queries[0].Executed)
+	assert.Equal(t, "graphite_data", plan.Queries[1].Table)
+	assert.False(t, plan.Queries[1].Executed)
+	assert.Equal(t, len("ok.metric\n"), plan.Queries[1].ExternalDataBytes)
+	assert.Contains(t, plan.Queries[1].Query, "FROM graphite_data")
+}
+
+func TestRenderEvalWithoutMetrics(t *testing.T) {
+	metrics.DisableMetrics()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.Common.EvaluateFunctions = true
+	cfg.ClickHouse.QueryParams = []config.QueryParam{{URL: srv.URL, DataTimeout: cfg.ClickHouse.DataTimeout, Limiter: limiter.NoopLimiter{}}}
+	r, err := rollup.NewDefault(60, "avg")
+	require.NoError(t, err)
+	cfg.DataTable = []config.DataTable{
+		{
+			Table:        "graphite_data",
+			ContextMap:   map[string]bool{config.ContextGraphite: true},
+			Rollup:       r,
+			QueryMetrics: metrics.InitQueryMetrics("graphite_data", &cfg.Metrics),
+		},
+	}
+	h := NewHandler(cfg)
+
+	render := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/render/?format=json&from=1669453200&until=1669456800&target="+target, nil))
+		return w
+	}
+
+	// no metrics are fetched for constantLine
+	w := render("constantLine(42)")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"target":"42"`)
+
+	w = render("sumSeries(missing.*)")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "[]", w.Body.String())
+}
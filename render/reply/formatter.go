@@ -33,17 +33,20 @@ func GetFormatter(r *http.Request) (Formatter, error) {
 		return &V2PB{}, nil
 	case "carbonapi_v2_pb":
 		return &V2PB{}, nil
-	}
-	err := fmt.Errorf("format %v is not supported, supported formats: carbonapi_v3_pb, pickle, protobuf (aka carbonapi_v2_pb)", format)
-	if !scope.Debug(r.Context(), "Output") {
-		return nil, err
-	}
-	switch format {
 	case "json":
-		return &JSON{}, nil
+		if scope.Debug(r.Context(), "Output") {
+			// JSON representation of carbonapi_v3_pb for debugging
+			return &JSON{}, nil
+		}
+		return &GraphiteJSON{}, nil
+	case "csv":
+		return &CSV{}, nil
+	case "raw":
+		return &Raw{}, nil
+	case "msgpack":
+		return &Msgpack{}, nil
 	}
-	err = fmt.Errorf("%w\n(formats available for output debug: json)", err)
-	return nil, err
+	return nil, fmt.Errorf("format %v is not supported, supported formats: carbonapi_v3_pb, pickle, protobuf (aka carbonapi_v2_pb), json, csv, raw, msgpack", format)
 }
 
 func parseRequestForms(r *http.Request) (data.MultiTarget, error) {
@@ -0,0 +1,387 @@
+package reply
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-graphite/carbonapi/date"
+	"github.com/go-graphite/carbonapi/pkg/parser"
+	"go.uber.org/zap"
+
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/helper/rollup"
+	"github.com/lomik/graphite-clickhouse/pkg/alias"
+	"github.com/lomik/graphite-clickhouse/pkg/dry"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/lomik/graphite-clickhouse/render/data"
+)
+
+// jsonpCallback is a valid JavaScript function name, it prevents injections into the response
+var jsonpCallback = regexp.MustCompile(`^[a-zA-Z_$][0-9a-zA-Z_$.]*$`)
+
+// graphiteSeries is a series of graphite-web compatible formats
+type graphiteSeries struct {
+	name           string
+	pathExpression string
+	start          int64
+	stop           int64
+	step           int64
+	xFilesFactor   float32
+	values         []float64
+}
+
+// parseGraphiteForms parses target/from/until/maxDataPoints URL forms values like graphite-web does. The relative
+// and absolute dates are accepted, the default interval is the last 24 hours
+func parseGraphiteForms(r *http.Request) (data.MultiTarget, error) {
+	now := time.Now().Unix()
+	tz := r.FormValue("tz")
+	from := date.DateParamToEpoch(r.FormValue("from"), tz, now-86400, time.Local)
+	until := date.DateParamToEpoch(r.FormValue("until"), tz, now, time.Local)
+
+	maxDataPoints, err := strconv.ParseInt(r.FormValue("maxDataPoints"), 10, 64)
+	if err != nil || maxDataPoints <= 0 {
+		maxDataPoints = int64(math.MaxInt64)
+	}
+
+	targets := dry.RemoveEmptyStrings(r.Form["target"])
+	tf := data.TimeFrame{
+		From:          from,
+		Until:         until,
+		MaxDataPoints: maxDataPoints,
+	}
+	multiTarget := make(data.MultiTarget)
+	multiTarget[tf] = data.NewTargets(targets, alias.New())
+
+	logger := scope.Logger(r.Context()).Named("graphite_parser")
+	for _, t := range targets {
+		logger.Info(
+			"target",
+			zap.Int64("from", tf.From),
+			zap.Int64("until", tf.Until),
+			zap.Int64("maxDataPoints", tf.MaxDataPoints),
+			zap.String("target", t),
+		)
+	}
+
+	return multiTarget, nil
+}
+
+// graphiteSeriesList converts responses to series with filled nulls. Values are consolidated to MaxDataPoints
+// by the consolidation function of the series, if the step is not adjusted by ClickHouse
+func graphiteSeriesList(multiData data.CHResponses) ([]graphiteSeries, error) {
+	series := make([]graphiteSeries, 0)
+	for i := range multiData {
+		mfr, err := multiData[i].ToMultiFetchResponseV3()
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range mfr.Metrics {
+			s := graphiteSeries{
+				name:           m.Name,
+				pathExpression: m.PathExpression,
+				start:          m.StartTime,
+				stop:           m.StopTime,
+				step:           m.StepTime,
+				xFilesFactor:   m.XFilesFactor,
+				values:         m.Values,
+			}
+			if maxDataPoints := multiData[i].MaxDataPoints; 0 < maxDataPoints && maxDataPoints < int64(len(s.values)) {
+				s.consolidate(dry.Ceil(int64(len(s.values)), maxDataPoints), m.ConsolidationFunc)
+			}
+			series = append(series, s)
+		}
+	}
+	return series, nil
+}
+
+// consolidate aggregates every valuesPerPoint values into one by the function. The point is null if the ratio of
+// non-null values is less than xFilesFactor of the series. Values are shared between aliases, so the new slice is
+// allocated
+func (s *graphiteSeries) consolidate(valuesPerPoint int64, function string) {
+	n := int(valuesPerPoint)
+	values := make([]float64, 0, (len(s.values)+n-1)/n)
+	for i := 0; i < len(s.values); i += n {
+		chunk := s.values[i:min(i+n, len(s.values))]
+		if s.xFilesFactor > 0 && float32(countNonNaN(chunk)) < s.xFilesFactor*float32(len(chunk)) {
+			values = append(values, math.NaN())
+			continue
+		}
+		values = append(values, consolidateValues(chunk, function))
+	}
+	s.values = values
+	s.step *= valuesPerPoint
+	s.stop = s.start + int64(len(values))*s.step
+}
+
+// consolidateValues aggregates non-NaN values, NaN is returned if there are no values. Besides avg, sum, min, max,
+// first and last, the functions of rollup like median, multiply or percentiles are supported. The series without
+// the function are consolidated by average like in graphite-web
+func consolidateValues(values []float64, function string) float64 {
+	switch function {
+	case "", "avg", "sum", "min", "max", "first", "last":
+	default:
+		if ag, ok := rollup.GetAggr(function); ok {
+			points := make([]point.Point, 0, len(values))
+			for _, v := range values {
+				if !math.IsNaN(v) {
+					points = append(points, point.Point{Value: v})
+				}
+			}
+			if len(points) == 0 {
+				return math.NaN()
+			}
+			return ag.Do(points)
+		}
+	}
+
+	result := math.NaN()
+	count := 0
+	for _, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		count++
+		if count == 1 {
+			result = v
+			continue
+		}
+		switch function {
+		case "min":
+			result = math.Min(result, v)
+		case "max":
+			result = math.Max(result, v)
+		case "first":
+		case "last":
+			result = v
+		default:
+			result += v
+		}
+	}
+	switch function {
+	case "sum", "min", "max", "first", "last":
+		return result
+	}
+	if count > 1 {
+		result /= float64(count)
+	}
+	return result
+}
+
+func countNonNaN(values []float64) int {
+	count := 0
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			count++
+		}
+	}
+	return count
+}
+
+// graphiteTags returns tags of the series, the name is the `name` tag for untagged series
+func graphiteTags(name string) map[string]string {
+	parts := strings.Split(name, ";")
+	tags := map[string]string{"name": parts[0]}
+	for _, tag := range parts[1:] {
+		if k, v, ok := strings.Cut(tag, "="); ok {
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+func graphiteSeriesError(w http.ResponseWriter, r *http.Request, err error) {
+	scope.Logger(r.Context()).Error("graphite series", zap.Error(err))
+	http.Error(w, fmt.Sprintf("failed to convert response: %v", err), http.StatusInternalServerError)
+}
+
+// GraphiteJSON is a formatter for graphite-web compatible JSON with datapoints
+type GraphiteJSON struct{}
+
+// ParseRequest parses graphite-web URL forms values and checks the jsonp callback name
+func (*GraphiteJSON) ParseRequest(r *http.Request) (data.MultiTarget, error) {
+	if jsonp := r.FormValue("jsonp"); jsonp != "" && !jsonpCallback.MatchString(jsonp) {
+		return nil, fmt.Errorf("invalid jsonp callback %q", jsonp)
+	}
+	return parseGraphiteForms(r)
+}
+
+// Reply serializes ClickHouse response to the list of {"target", "tags", "datapoints"} objects. Null points are
+// skipped with noNullPoints, and the response is wrapped into the jsonp function
+func (*GraphiteJSON) Reply(w http.ResponseWriter, r *http.Request, multiData data.CHResponses) {
+	series, err := graphiteSeriesList(multiData)
+	if err != nil {
+		graphiteSeriesError(w, r, err)
+		return
+	}
+	noNullPoints := parser.TruthyBool(r.FormValue("noNullPoints"))
+	jsonp := r.FormValue("jsonp")
+
+	if jsonp != "" {
+		w.Header().Set("Content-Type", "text/javascript")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	writer := bufio.NewWriterSize(w, 1024*1024)
+	defer writer.Flush()
+
+	if jsonp != "" {
+		writer.WriteString(jsonp + "(")
+	}
+	writer.WriteByte('[')
+	var buf []byte
+	first := true
+	for _, s := range series {
+		buf = buf[:0]
+		points := 0
+		for i, v := range s.values {
+			if math.IsNaN(v) && noNullPoints {
+				continue
+			}
+			if points != 0 {
+				buf = append(buf, ',')
+			}
+			points++
+			buf = append(buf, '[')
+			buf = appendJSONValue(buf, v)
+			buf = append(buf, ',')
+			buf = strconv.AppendInt(buf, s.start+int64(i)*s.step, 10)
+			buf = append(buf, ']')
+		}
+		if points == 0 && noNullPoints {
+			continue
+		}
+		if !first {
+			writer.WriteByte(',')
+		}
+		first = false
+		writer.WriteString(`{"target":`)
+		writeJSONString(writer, s.name)
+		writer.WriteString(`,"tags":`)
+		tags, _ := json.Marshal(graphiteTags(s.name))
+		writer.Write(tags)
+		writer.WriteString(`,"datapoints":[`)
+		writer.Write(buf)
+		writer.WriteString("]}")
+	}
+	writer.WriteByte(']')
+	if jsonp != "" {
+		writer.WriteByte(')')
+	}
+}
+
+// appendJSONValue appends null for NaN and the same values as graphite-web for infinities
+func appendJSONValue(buf []byte, v float64) []byte {
+	switch {
+	case math.IsNaN(v):
+		return append(buf, "null"...)
+	case math.IsInf(v, 1):
+		return append(buf, "1e9999"...)
+	case math.IsInf(v, -1):
+		return append(buf, "-1e9999"...)
+	}
+	return strconv.AppendFloat(buf, v, 'f', -1, 64)
+}
+
+func writeJSONString(writer *bufio.Writer, s string) {
+	b, _ := json.Marshal(s)
+	writer.Write(b)
+}
+
+// CSV is a formatter for graphite-web compatible CSV, every point is a `name,YYYY-MM-DD HH:MM:SS,value` line
+type CSV struct{}
+
+// ParseRequest parses graphite-web URL forms values
+func (*CSV) ParseRequest(r *http.Request) (data.MultiTarget, error) {
+	return parseGraphiteForms(r)
+}
+
+// Reply serializes ClickHouse response to CSV, the time is formatted in `tz` location or in the local one
+func (*CSV) Reply(w http.ResponseWriter, r *http.Request, multiData data.CHResponses) {
+	series, err := graphiteSeriesList(multiData)
+	if err != nil {
+		graphiteSeriesError(w, r, err)
+		return
+	}
+	location := time.Local
+	if tz := r.FormValue("tz"); tz != "" {
+		if l, err := time.LoadLocation(tz); err == nil {
+			location = l
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	writer := bufio.NewWriterSize(w, 1024*1024)
+	defer writer.Flush()
+
+	var buf []byte
+	for _, s := range series {
+		name := csvString(s.name)
+		for i, v := range s.values {
+			buf = append(buf[:0], name...)
+			buf = append(buf, ',')
+			buf = time.Unix(s.start+int64(i)*s.step, 0).In(location).AppendFormat(buf, "2006-01-02 15:04:05")
+			buf = append(buf, ',')
+			if !math.IsNaN(v) {
+				buf = strconv.AppendFloat(buf, v, 'f', -1, 64)
+			}
+			buf = append(buf, '\r', '\n')
+			writer.Write(buf)
+		}
+	}
+}
+
+// csvString quotes the field, if it contains special characters
+func csvString(s string) string {
+	if !strings.ContainsAny(s, "\",\r\n") {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// Raw is a formatter for graphite-web compatible raw format, every series is a `name,start,end,step|values` line
+type Raw struct{}
+
+// ParseRequest parses graphite-web URL forms values
+func (*Raw) ParseRequest(r *http.Request) (data.MultiTarget, error) {
+	return parseGraphiteForms(r)
+}
+
+// Reply serializes ClickHouse response to raw format, nulls are written as None
+func (*Raw) Reply(w http.ResponseWriter, r *http.Request, multiData data.CHResponses) {
+	series, err := graphiteSeriesList(multiData)
+	if err != nil {
+		graphiteSeriesError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	writer := bufio.NewWriterSize(w, 1024*1024)
+	defer writer.Flush()
+
+	buf := bytes.Buffer{}
+	for _, s := range series {
+		buf.Reset()
+		buf.WriteString(s.name)
+		fmt.Fprintf(&buf, ",%d,%d,%d|", s.start, s.stop, s.step)
+		for i, v := range s.values {
+			if i != 0 {
+				buf.WriteByte(',')
+			}
+			if math.IsNaN(v) {
+				buf.WriteString("None")
+				continue
+			}
+			buf.Write(strconv.AppendFloat(nil, v, 'f', -1, 64))
+		}
+		buf.WriteByte('\n')
+		writer.Write(buf.Bytes())
+	}
+}
@@ -0,0 +1,200 @@
+package reply
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+	"github.com/lomik/graphite-clickhouse/render/data"
+)
+
+func graphiteResponses() data.CHResponses {
+	return prepareCHResponses(1688990000, 1688990219,
+		[][]byte{[]byte("test.metric1"), []byte("test.metric2")},
+		map[string][]point.Point{
+			"test.metric1": {{Value: 3, Time: 1688990160, Timestamp: 1688990204}},
+		},
+	)
+}
+
+func graphiteReply(t *testing.T, formatter Formatter, query string, multiData data.CHResponses) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/render/?"+query, nil)
+	require.NoError(t, r.ParseForm())
+	formatter.Reply(w, r, multiData)
+	require.Equal(t, http.StatusOK, w.Code)
+	return w
+}
+
+func TestGetFormatterGraphite(t *testing.T) {
+	tests := []struct {
+		format   string
+		debug    bool
+		expected Formatter
+	}{
+		{format: "json", expected: &GraphiteJSON{}},
+		{format: "json", debug: true, expected: &JSON{}},
+		{format: "csv", expected: &CSV{}},
+		{format: "raw", expected: &Raw{}},
+		{format: "msgpack", expected: &Msgpack{}},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		if tt.debug {
+			ctx = scope.WithDebug(ctx, "Output")
+		}
+		r := httptest.NewRequest(http.MethodGet, "/render/?format="+tt.format, nil).WithContext(ctx)
+		f, err := GetFormatter(r)
+		require.NoError(t, err)
+		assert.IsType(t, tt.expected, f, tt.format)
+	}
+	_, err := GetFormatter(httptest.NewRequest(http.MethodGet, "/render/?format=svg", nil))
+	assert.Error(t, err)
+}
+
+func TestParseGraphiteForms(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/render/?target=a.*&target=&from=1688990000&until=now&maxDataPoints=100", nil)
+	require.NoError(t, r.ParseForm())
+	mt, err := (&CSV{}).ParseRequest(r)
+	require.NoError(t, err)
+	require.Len(t, mt, 1)
+	for tf, targets := range mt {
+		assert.Equal(t, int64(1688990000), tf.From)
+		assert.InDelta(t, float64(tf.Until), float64(time.Now().Unix()), 5)
+		assert.Equal(t, int64(100), tf.MaxDataPoints)
+		assert.Equal(t, []string{"a.*"}, targets.List)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/render/?target=a.*&from=-1h", nil)
+	require.NoError(t, r.ParseForm())
+	mt, err = (&Raw{}).ParseRequest(r)
+	require.NoError(t, err)
+	for tf := range mt {
+		assert.Equal(t, int64(3600), tf.Until-tf.From)
+		assert.Equal(t, int64(math.MaxInt64), tf.MaxDataPoints)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/render/?target=a.*&jsonp=alert%281%29%3Bx", nil)
+	require.NoError(t, r.ParseForm())
+	_, err = (&GraphiteJSON{}).ParseRequest(r)
+	assert.Error(t, err)
+}
+
+func TestGraphiteJSONReply(t *testing.T) {
+	w := graphiteReply(t, &GraphiteJSON{}, "", graphiteResponses())
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t,
+		`[{"target":"test.metric1","tags":{"name":"test.metric1"},"datapoints":[[null,1688990040],[null,1688990100],[3,1688990160]]}]`,
+		w.Body.String(),
+	)
+
+	multiData := graphiteResponses()
+	multiData[0].AppendOutEmptySeries = true
+	w = graphiteReply(t, &GraphiteJSON{}, "noNullPoints=1&jsonp=cb", multiData)
+	assert.Equal(t, "text/javascript", w.Header().Get("Content-Type"))
+	assert.Equal(t,
+		`cb([{"target":"test.metric1","tags":{"name":"test.metric1"},"datapoints":[[3,1688990160]]}])`,
+		w.Body.String(),
+	)
+
+	w = graphiteReply(t, &GraphiteJSON{}, "", data.EmptyResponse())
+	assert.Equal(t, "[]", w.Body.String())
+}
+
+func TestGraphiteTags(t *testing.T) {
+	assert.Equal(t, map[string]string{"name": "a.b"}, graphiteTags("a.b"))
+	assert.Equal(t, map[string]string{"name": "cpu", "dc": "x", "host": "h1"}, graphiteTags("cpu;dc=x;host=h1"))
+}
+
+func TestCSVReply(t *testing.T) {
+	w := graphiteReply(t, &CSV{}, "tz=UTC", graphiteResponses())
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	assert.Equal(t,
+		"test.metric1,2023-07-10 11:54:00,\r\n"+
+			"test.metric1,2023-07-10 11:55:00,\r\n"+
+			"test.metric1,2023-07-10 11:56:00,3\r\n",
+		w.Body.String(),
+	)
+	assert.Equal(t, `"a,""b"`, csvString(`a,"b`))
+}
+
+func TestRawReply(t *testing.T) {
+	multiData := graphiteResponses()
+	multiData[0].AppendOutEmptySeries = true
+	w := graphiteReply(t, &Raw{}, "", multiData)
+	assert.Equal(t,
+		"test.metric1,1688990040,1688990220,60|None,None,3\n"+
+			"test.metric2,1688990040,1688990220,60|None,None,None\n",
+		w.Body.String(),
+	)
+}
+
+func TestMsgpackReply(t *testing.T) {
+	w := graphiteReply(t, &Msgpack{}, "", graphiteResponses())
+	expected := []byte{
+		0x91, 0x86,
+		0xa4, 'n', 'a', 'm', 'e', 0xac, 't', 'e', 's', 't', '.', 'm', 'e', 't', 'r', 'i', 'c', '1',
+		0xae, 'p', 'a', 't', 'h', 'E', 'x', 'p', 'r', 'e', 's', 's', 'i', 'o', 'n', 0xa6, 't', 'e', 's', 't', '.', '*',
+		0xa5, 's', 't', 'a', 'r', 't', 0xce, 0x64, 0xab, 0xf1, 0x58,
+		0xa3, 'e', 'n', 'd', 0xce, 0x64, 0xab, 0xf2, 0x0c,
+		0xa4, 's', 't', 'e', 'p', 0x3c,
+		0xa6, 'v', 'a', 'l', 'u', 'e', 's', 0x93, 0xc0, 0xc0, 0xcb, 0x40, 0x08, 0, 0, 0, 0, 0, 0,
+	}
+	assert.Equal(t, expected, w.Body.Bytes())
+}
+
+func TestConsolidate(t *testing.T) {
+	nan := math.NaN()
+	values := []float64{1, 2, nan, 4, nan, nan, 7}
+	tests := []struct {
+		function string
+		expected []float64
+	}{
+		{"avg", []float64{1.5, 4, 7}},
+		{"sum", []float64{3, 4, 7}},
+		{"min", []float64{1, 4, 7}},
+		{"max", []float64{2, 4, 7}},
+		{"first", []float64{1, 4, 7}},
+		{"last", []float64{2, 4, 7}},
+		{"median", []float64{1.5, 4, 7}},
+		{"multiply", []float64{2, 4, 7}},
+		{"count", []float64{2, 1, 1}},
+		{"range", []float64{1, 0, 0}},
+		{"p100", []float64{2, 4, 7}},
+	}
+	for _, tt := range tests {
+		s := graphiteSeries{start: 60, stop: 480, step: 60, values: values}
+		s.consolidate(3, tt.function)
+		assert.Equal(t, tt.expected, s.values, tt.function)
+		assert.Equal(t, int64(180), s.step)
+		assert.Equal(t, int64(600), s.stop)
+	}
+	// values are shared between series and must not be changed
+	assert.Equal(t, 1.0, values[0])
+
+	s := graphiteSeries{start: 60, stop: 480, step: 60, xFilesFactor: 0.5, values: values}
+	s.consolidate(3, "sum")
+	assert.Equal(t, 3.0, s.values[0])
+	assert.True(t, math.IsNaN(s.values[1]))
+	assert.Equal(t, 7.0, s.values[2])
+
+	assert.True(t, math.IsNaN(consolidateValues([]float64{nan, nan}, "sum")))
+	assert.True(t, math.IsNaN(consolidateValues([]float64{nan, nan}, "median")))
+
+	multiData := graphiteResponses()
+	multiData[0].MaxDataPoints = 2
+	series, err := graphiteSeriesList(multiData)
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	assert.Equal(t, int64(120), series[0].step)
+	assert.True(t, math.IsNaN(series[0].values[0]))
+	assert.Equal(t, 3.0, series[0].values[1])
+}
@@ -0,0 +1,113 @@
+package reply
+
+import (
+	"bufio"
+	"encoding/binary"
+	"math"
+	"net/http"
+
+	"github.com/lomik/graphite-clickhouse/render/data"
+)
+
+// Msgpack is a formatter for graphite-web compatible msgpack format. The response is the same list of dicts as
+// for pickle format
+type Msgpack struct{}
+
+// ParseRequest parses graphite-web URL forms values
+func (*Msgpack) ParseRequest(r *http.Request) (data.MultiTarget, error) {
+	return parseGraphiteForms(r)
+}
+
+// Reply serializes ClickHouse response to msgpack format
+func (*Msgpack) Reply(w http.ResponseWriter, r *http.Request, multiData data.CHResponses) {
+	series, err := graphiteSeriesList(multiData)
+	if err != nil {
+		graphiteSeriesError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-msgpack")
+	writer := bufio.NewWriterSize(w, 1024*1024)
+	defer writer.Flush()
+
+	msgpackHeader(writer, 0x90, 0xdc, len(series))
+	for _, s := range series {
+		msgpackHeader(writer, 0x80, 0xde, 6)
+
+		msgpackString(writer, "name")
+		msgpackString(writer, s.name)
+
+		msgpackString(writer, "pathExpression")
+		msgpackString(writer, s.pathExpression)
+
+		msgpackString(writer, "start")
+		msgpackInt(writer, s.start)
+
+		msgpackString(writer, "end")
+		msgpackInt(writer, s.stop)
+
+		msgpackString(writer, "step")
+		msgpackInt(writer, s.step)
+
+		msgpackString(writer, "values")
+		msgpackHeader(writer, 0x90, 0xdc, len(s.values))
+		for _, v := range s.values {
+			if math.IsNaN(v) {
+				// nil
+				writer.WriteByte(0xc0)
+				continue
+			}
+			msgpackFloat64(writer, v)
+		}
+	}
+}
+
+// msgpackHeader writes the header of array or map: the fix type for up to 15 elements, or 16 and 32 bits types
+func msgpackHeader(writer *bufio.Writer, fix, type16 byte, n int) {
+	switch {
+	case n < 16:
+		writer.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		writer.WriteByte(type16)
+		writer.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		writer.WriteByte(type16 + 1)
+		writer.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
+
+func msgpackString(writer *bufio.Writer, s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		writer.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		writer.WriteByte(0xd9)
+		writer.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		writer.WriteByte(0xda)
+		writer.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		writer.WriteByte(0xdb)
+		writer.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+	writer.WriteString(s)
+}
+
+func msgpackInt(writer *bufio.Writer, i int64) {
+	switch {
+	case 0 <= i && i < 128:
+		writer.WriteByte(byte(i))
+	case 0 <= i && i <= math.MaxUint32:
+		writer.WriteByte(0xce)
+		writer.Write(binary.BigEndian.AppendUint32(nil, uint32(i)))
+	default:
+		writer.WriteByte(0xd3)
+		writer.Write(binary.BigEndian.AppendUint64(nil, uint64(i)))
+	}
+}
+
+func msgpackFloat64(writer *bufio.Writer, v float64) {
+	writer.WriteByte(0xcb)
+	writer.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(v)))
+}
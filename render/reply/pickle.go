@@ -29,8 +29,8 @@ func (*Pickle) Reply(w http.ResponseWriter, r *http.Request, multiData data.CHRe
 	var pickleTime time.Duration
 	// Pickle format always contain single request/response
 	data := multiData[0].Data
-	from := uint32(multiData[0].From)
-	until := uint32(multiData[0].Until)
+	from := multiData[0].From
+	until := multiData[0].Until
 
 	logger := scope.Logger(r.Context())
 
@@ -68,7 +68,7 @@ func (*Pickle) Reply(w http.ResponseWriter, r *http.Request, multiData data.CHRe
 		p.Uint32(step)
 		p.SetItem()
 
-		start, end, _, getValue := point.FillNulls(points, from, until, step)
+		start, end, _, getValue := point.FillNulls(points, from, until, int64(step))
 
 		p.String("values")
 		p.List()
@@ -90,11 +90,11 @@ func (*Pickle) Reply(w http.ResponseWriter, r *http.Request, multiData data.CHRe
 		p.SetItem()
 
 		p.String("start")
-		p.Uint32(start)
+		p.Uint32(uint32(start))
 		p.SetItem()
 
 		p.String("end")
-		p.Uint32(end)
+		p.Uint32(uint32(end))
 		p.SetItem()
 
 		p.Append()
@@ -25,7 +25,7 @@ const (
 
 type pb interface {
 	initBuffer()
-	writeBody(writer *bufio.Writer, target, name, function string, from, until, step uint32, points []point.Point)
+	writeBody(writer *bufio.Writer, target, name, function string, xFilesFactor float32, from, until, step int64, highPrecisionTimestamps bool, points []point.Point, appliedFunctions []string)
 }
 
 func replyProtobuf(p pb, w http.ResponseWriter, r *http.Request, multiData data.CHResponses) {
@@ -40,8 +40,6 @@ func replyProtobuf(p pb, w http.ResponseWriter, r *http.Request, multiData data.
 	totalWritten := 0
 	for _, d := range multiData {
 		data := d.Data
-		from := uint32(d.From)
-		until := uint32(d.Until)
 
 		totalWritten++
 
@@ -68,9 +66,13 @@ func replyProtobuf(p pb, w http.ResponseWriter, r *http.Request, multiData data.
 				http.Error(w, fmt.Sprintf("failed to get function for metric: %v", data.MetricName(points[0].MetricID)), http.StatusInternalServerError)
 				return
 			}
+			xFilesFactor, _ := data.GetXFilesFactor(points[0].MetricID)
 
 			for _, a := range data.AM.Get(metricName) {
-				p.writeBody(writer, a.Target, a.DisplayName, function, from, until, step, points)
+				p.writeBody(
+					writer, a.Target, a.DisplayName, function, xFilesFactor, d.From, d.Until, int64(step), d.HighPrecisionTimestamps,
+					points, d.AppliedFunctions[a.Target],
+				)
 			}
 		}
 
@@ -79,7 +81,10 @@ func replyProtobuf(p pb, w http.ResponseWriter, r *http.Request, multiData data.
 			for _, metricName := range data.AM.Series(false) {
 				if _, done := writtenMetrics[metricName]; !done {
 					for _, a := range data.AM.Get(metricName) {
-						p.writeBody(writer, a.Target, a.DisplayName, "any", from, until, uint32(data.CommonStep), []point.Point{})
+						p.writeBody(
+							writer, a.Target, a.DisplayName, "any", 0, d.From, d.Until, data.CommonStep, d.HighPrecisionTimestamps,
+							[]point.Point{}, d.AppliedFunctions[a.Target],
+						)
 					}
 				}
 			}
@@ -0,0 +1,94 @@
+package reply
+
+import (
+	"bufio"
+	"net/http"
+	"sync"
+
+	"github.com/go-graphite/carbonapi/pkg/parser"
+
+	"github.com/lomik/graphite-clickhouse/helper/point"
+	"github.com/lomik/graphite-clickhouse/render/data"
+)
+
+// Streamer is implemented by formatters, which are able to write series as soon as they are fetched
+type Streamer interface {
+	// Stream returns the writer of series to w
+	Stream(w http.ResponseWriter, r *http.Request) StreamWriter
+}
+
+// StreamWriter writes series to the client, it's safe for concurrent use
+type StreamWriter interface {
+	data.SeriesWriter
+	// Started returns true if anything is written to the client
+	Started() bool
+	// Close finishes the response
+	Close() error
+}
+
+// GetStreamer returns Streamer, if the streaming response is requested by `stream=1` and supported by the format
+func GetStreamer(r *http.Request, formatter Formatter) (Streamer, bool) {
+	if !parser.TruthyBool(r.FormValue("stream")) {
+		return nil, false
+	}
+	s, ok := formatter.(Streamer)
+	return s, ok
+}
+
+// Stream returns the writer of length-prefixed frames. Every frame is a uvarint length and the
+// carbonapi_v3_pb.MultiFetchResponse with a single series. The response is finished by a zero-length frame,
+// so a broken stream could be detected by the client
+func (*V3PB) Stream(w http.ResponseWriter, r *http.Request) StreamWriter {
+	// headers are sent with the first frame
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	s := &v3pbStream{w: w, writer: bufio.NewWriterSize(w, 1024*1024)}
+	s.v.initBuffer()
+	return s
+}
+
+type v3pbStream struct {
+	sync.Mutex
+	v       V3PB
+	w       http.ResponseWriter
+	writer  *bufio.Writer
+	started bool
+}
+
+func (s *v3pbStream) WriteSeries(target, name, function string, xFilesFactor float32, from, until, step int64, highPrecisionTimestamps bool, points []point.Point, appliedFunctions []string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.v.encodeBody(target, name, function, xFilesFactor, from, until, step, highPrecisionTimestamps, points, appliedFunctions); err != nil {
+		return err
+	}
+	s.started = true
+
+	// frame length, then repeated FetchResponse metrics = 1;
+	size := uint64(s.v.b.Len())
+	VarintWrite(s.writer, VarintLen((1<<3)+2)+VarintLen(size)+size)
+	VarintWrite(s.writer, (1<<3)+2)
+	VarintWrite(s.writer, size)
+	_, err := s.writer.Write(s.v.b.Bytes())
+	return err
+}
+
+func (s *v3pbStream) Started() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.started
+}
+
+func (s *v3pbStream) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.started = true
+	VarintWrite(s.writer, 0)
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
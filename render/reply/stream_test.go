@@ -0,0 +1,71 @@
+package reply
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/helper/point"
+)
+
+func TestGetStreamer(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/render/?format=carbonapi_v3_pb&stream=1", nil)
+	_, ok := GetStreamer(r, &V3PB{})
+	assert.True(t, ok)
+	// buffered mode is used by other formats
+	_, ok = GetStreamer(r, &V2PB{})
+	assert.False(t, ok)
+	_, ok = GetStreamer(r, &Pickle{})
+	assert.False(t, ok)
+
+	r = httptest.NewRequest(http.MethodGet, "/render/?format=carbonapi_v3_pb", nil)
+	_, ok = GetStreamer(r, &V3PB{})
+	assert.False(t, ok)
+}
+
+func TestV3PBStream(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/render/?format=carbonapi_v3_pb&stream=1", nil)
+	sw := (&V3PB{}).Stream(w, r)
+	assert.False(t, sw.Started())
+	assert.Equal(t, "application/x-protobuf", w.Header().Get("Content-Type"))
+
+	points := []point.Point{{Value: 1, Time: 1200}, {Value: 2, Time: 1260}}
+	require.NoError(t, sw.WriteSeries("a.*", "a.b", "avg", 0, 1200, 1319, 60, false, points, []string{"scale"}))
+	require.NoError(t, sw.WriteSeries("a.*", "a.c", "max", 0, 1200, 1319, 60, false, points[:1], nil))
+	assert.True(t, sw.Started())
+	require.NoError(t, sw.Close())
+	assert.True(t, w.Flushed)
+
+	reader := bufio.NewReader(w.Body)
+	var names []string
+	for {
+		size, err := binary.ReadUvarint(reader)
+		require.NoError(t, err)
+		if size == 0 {
+			break
+		}
+		frame := make([]byte, size)
+		_, err = io.ReadFull(reader, frame)
+		require.NoError(t, err)
+		var resp v3pb.MultiFetchResponse
+		require.NoError(t, resp.Unmarshal(frame))
+		require.Len(t, resp.Metrics, 1)
+		names = append(names, resp.Metrics[0].Name)
+		if resp.Metrics[0].Name == "a.b" {
+			assert.Equal(t, []float64{1, 2}, resp.Metrics[0].Values)
+			assert.Equal(t, []string{"scale"}, resp.Metrics[0].AppliedFunctions)
+			assert.Equal(t, "avg", resp.Metrics[0].ConsolidationFunc)
+		}
+	}
+	assert.Equal(t, []string{"a.b", "a.c"}, names)
+	_, err := reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
@@ -16,9 +16,9 @@ type testV2PB struct {
 	target   string
 	function string
 	response v2pb.MultiFetchResponse
-	from     uint32
-	until    uint32
-	step     uint32
+	from     int64
+	until    int64
+	step     int64
 	points   []point.Point
 }
 
@@ -105,7 +105,7 @@ func TestV2PBWriteBody(t *testing.T) {
 
 			v := &V2PB{}
 			v.initBuffer()
-			v.writeBody(w, tt.target, tt.name, tt.function, tt.from, tt.until, tt.step, tt.points)
+			v.writeBody(w, tt.target, tt.name, tt.function, 0, tt.from, tt.until, tt.step, false, tt.points, nil)
 
 			w.Flush()
 
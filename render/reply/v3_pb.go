@@ -84,7 +84,22 @@ func (v *V3PB) replyDebug(w http.ResponseWriter, r *http.Request, multiData data
 	w.Write(response)
 }
 
-func (v *V3PB) writeBody(writer *bufio.Writer, target, name, function string, from, until, step uint32, points []point.Point) {
+func (v *V3PB) writeBody(writer *bufio.Writer, target, name, function string, xFilesFactor float32, from, until, step int64, highPrecisionTimestamps bool, points []point.Point, appliedFunctions []string) {
+	if err := v.encodeBody(target, name, function, xFilesFactor, from, until, step, highPrecisionTimestamps, points, appliedFunctions); err != nil {
+		return
+	}
+
+	// start write to output
+	// repeated FetchResponse metrics = 1;
+	// write tag and len
+	VarintWrite(writer, (1<<3)+2)
+	VarintWrite(writer, uint64(v.b.Len()))
+
+	writer.Write(v.b.Bytes())
+}
+
+// encodeBody encodes FetchResponse into the buffer
+func (v *V3PB) encodeBody(target, name, function string, xFilesFactor float32, from, until, step int64, highPrecisionTimestamps bool, points []point.Point, appliedFunctions []string) error {
 	start, stop, count, getValue := point.FillNulls(points, from, until, step)
 
 	v.b.Reset()
@@ -120,11 +135,15 @@ func (v *V3PB) writeBody(writer *bufio.Writer, target, name, function string, fr
 
 	// xFilesFactor
 	VarintWrite(v.b, (7<<3)+flt32) // tag
-	ProtobufWriteSingle(v.b, 0.0)
+	ProtobufWriteSingle(v.b, xFilesFactor)
 
 	// highPrecisionTimestamps
 	VarintWrite(v.b, 8<<3) // tag
-	v.b.WriteByte('\x00')  // False
+	if highPrecisionTimestamps {
+		v.b.WriteByte('\x01') // True
+	} else {
+		v.b.WriteByte('\x00') // False
+	}
 
 	// Values header
 	VarintWrite(v.b, (9<<3)+repeated) // tag
@@ -136,18 +155,19 @@ func (v *V3PB) writeBody(writer *bufio.Writer, target, name, function string, fr
 				break
 			}
 			// if err is not point.ErrTimeGreaterStop, the points are corrupted
-			return
+			return err
 		}
 		ProtobufWriteDouble(v.b, value)
 	}
 
 	// rest fields, that goes after values
 
-	// Fields with default values are skipped, so this should be uncommented if support for appliedFunctions will be
-	// implemented
 	// appliedFunctions
-	//VarintWrite(mb2, (10<<3)+Repeated)  // tag
-	//VarintWrite(mb2, VarintLen(0)) // currently not supported
+	for _, f := range appliedFunctions {
+		VarintWrite(v.b, (10<<3)+repeated) // tag
+		VarintWrite(v.b, uint64(len(f)))
+		v.b.WriteString(f)
+	}
 
 	// requestStartTime
 	VarintWrite(v.b, 11<<3)
@@ -157,11 +177,5 @@ func (v *V3PB) writeBody(writer *bufio.Writer, target, name, function string, fr
 	VarintWrite(v.b, 12<<3)
 	VarintWrite(v.b, uint64(until))
 
-	// start write to output
-	// repeated FetchResponse metrics = 1;
-	// write tag and len
-	VarintWrite(writer, (1<<3)+2)
-	VarintWrite(writer, uint64(v.b.Len()))
-
-	writer.Write(v.b.Bytes())
+	return nil
 }
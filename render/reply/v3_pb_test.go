@@ -17,10 +17,14 @@ type testV3PB struct {
 	target   string
 	function string
 	response v3pb.MultiFetchResponse
-	from     uint32
-	until    uint32
-	step     uint32
+	from     int64
+	until    int64
+	step     int64
 	points   []point.Point
+	// appliedFunctions are passed to writeBody
+	appliedFunctions []string
+	// highPrecisionTimestamps is passed to writeBody
+	highPrecisionTimestamps bool
 }
 
 func TestV3PBWriteBody(t *testing.T) {
@@ -103,6 +107,75 @@ func TestV3PBWriteBody(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:             "appliedFunctions",
+			function:         "avg",
+			from:             4,
+			until:            13,
+			step:             5,
+			target:           "scale(appliedFunctions, 2)",
+			appliedFunctions: []string{"scale", "consolidateBy"},
+			points: []point.Point{
+				{
+					MetricID:  0,
+					Value:     2.0,
+					Time:      5,
+					Timestamp: 5,
+				},
+			},
+			response: v3pb.MultiFetchResponse{
+				Metrics: []v3pb.FetchResponse{
+					{
+						Name:                    "appliedFunctions",
+						PathExpression:          "scale(appliedFunctions, 2)",
+						ConsolidationFunc:       "avg",
+						XFilesFactor:            0,
+						HighPrecisionTimestamps: false,
+						StartTime:               5,
+						StopTime:                10,
+						Values:                  []float64{2.0},
+						AppliedFunctions:        []string{"scale", "consolidateBy"},
+						RequestStartTime:        4,
+						RequestStopTime:         13,
+					},
+				},
+			},
+		},
+		{
+			name:                    "highPrecisionTimestamps",
+			function:                "avg",
+			from:                    4000,
+			until:                   5999,
+			step:                    500,
+			target:                  "*",
+			highPrecisionTimestamps: true,
+			points: []point.Point{
+				{
+					MetricID:  0,
+					Value:     1.0,
+					Time:      4500,
+					Timestamp: 4500,
+				},
+			},
+			response: v3pb.MultiFetchResponse{
+				Metrics: []v3pb.FetchResponse{
+					{
+						Name:                    "highPrecisionTimestamps",
+						PathExpression:          "*",
+						ConsolidationFunc:       "avg",
+						StepTime:                500,
+						XFilesFactor:            0,
+						HighPrecisionTimestamps: true,
+						StartTime:               4000,
+						StopTime:                6000,
+						Values:                  []float64{math.NaN(), 1.0, math.NaN(), math.NaN()},
+						AppliedFunctions:        []string{},
+						RequestStartTime:        4000,
+						RequestStopTime:         5999,
+					},
+				},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -116,7 +189,7 @@ func TestV3PBWriteBody(t *testing.T) {
 
 			v := &V3PB{}
 			v.initBuffer()
-			v.writeBody(w, tt.target, tt.name, tt.function, tt.from, tt.until, tt.step, tt.points)
+			v.writeBody(w, tt.target, tt.name, tt.function, 0, tt.from, tt.until, tt.step, tt.highPrecisionTimestamps, tt.points, tt.appliedFunctions)
 
 			w.Flush()
 
@@ -141,6 +214,14 @@ func TestV3PBWriteBody(t *testing.T) {
 			}
 
 			for i := range resp.Metrics {
+				if resp.Metrics[i].HighPrecisionTimestamps != tt.highPrecisionTimestamps ||
+					(tt.highPrecisionTimestamps && resp.Metrics[i].StopTime != tt.response.Metrics[i].StopTime) {
+					t.Fatalf("high precision timestamps are not same.\ngot:\n%+v\n\nexpected:\n%+v", resp.Metrics[i], tt.response.Metrics[i])
+				}
+				if len(resp.Metrics[i].AppliedFunctions) != len(tt.appliedFunctions) ||
+					(len(tt.appliedFunctions) > 0 && !reflect.DeepEqual(resp.Metrics[i].AppliedFunctions, tt.appliedFunctions)) {
+					t.Fatalf("applied functions are not same.\ngot:\n%v\n\nexpected:\n%v", resp.Metrics[i].AppliedFunctions, tt.appliedFunctions)
+				}
 				if resp.Metrics[i].Name != tt.response.Metrics[i].Name {
 					if !reflect.DeepEqual(resp.Metrics[i], tt.response.Metrics[i]) {
 						t.Fatalf(
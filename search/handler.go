@@ -0,0 +1,267 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-graphite/carbonapi/date"
+	"github.com/go-graphite/carbonapi/pkg/parser"
+	"github.com/gogo/protobuf/proto"
+	"go.uber.org/zap"
+
+	v2pb "github.com/go-graphite/protocol/carbonapi_v2_pb"
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/find"
+	"github.com/lomik/graphite-clickhouse/finder"
+	"github.com/lomik/graphite-clickhouse/helper/clickhouse"
+	chdate "github.com/lomik/graphite-clickhouse/helper/date"
+	"github.com/lomik/graphite-clickhouse/helper/utils"
+	"github.com/lomik/graphite-clickhouse/logs"
+	"github.com/lomik/graphite-clickhouse/metrics"
+	"github.com/lomik/graphite-clickhouse/pkg/scope"
+)
+
+// DefaultLimit is the size of the page, when limit isn't set by the request or max-metrics-in-find-answer
+const DefaultLimit = 10000
+
+// Handler serves /metrics/search requests, which find metrics by substrings or regular expression
+type Handler struct {
+	config *config.Config
+}
+
+func NewHandler(config *config.Config) *Handler {
+	return &Handler{
+		config: config,
+	}
+}
+
+// jsonResponse is the response in json format
+type jsonResponse struct {
+	Metrics []string `json:"metrics"`
+	// Next is the cursor of the next page, it's set when there are more results
+	Next string `json:"next,omitempty"`
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status := http.StatusOK
+	accessLogger := scope.LoggerWithHeaders(r.Context(), r, h.config.Common.HeadersToLog).Named("http")
+	logger := scope.LoggerWithHeaders(r.Context(), r, h.config.Common.HeadersToLog).Named("metrics-search")
+	r = r.WithContext(scope.WithLogger(r.Context(), logger))
+
+	var (
+		metricsCount  int64
+		stat          finder.FinderStat
+		queueFail     bool
+		queueDuration time.Duration
+		findCache     bool
+	)
+
+	username := r.Header.Get("X-Forwarded-User")
+	limiter := h.config.GetUserTagsLimiter(username)
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			status = http.StatusInternalServerError
+			logger.Error("panic during eval:",
+				zap.String("requestID", scope.String(r.Context(), "requestID")),
+				zap.Any("reason", rec),
+				zap.Stack("stack"),
+			)
+			answer := fmt.Sprintf("%v\nStack trace: %v", rec, zap.Stack("").String)
+			http.Error(w, answer, status)
+		}
+		d := time.Since(start)
+		dMS := d.Milliseconds()
+		logs.AccessLog(accessLogger, h.config, r, status, d, queueDuration, findCache, queueFail)
+		limiter.SendDuration(queueDuration.Milliseconds())
+		// search requests are accounted as find ones
+		metrics.SendFindMetrics(metrics.FindRequestMetric, status, dMS, 0, h.config.Metrics.ExtendedStat, metricsCount)
+		if stat.ChReadRows > 0 && stat.ChReadBytes > 0 {
+			errored := status != http.StatusOK && status != http.StatusNotFound
+			metrics.SendQueryRead(metrics.FindQMetric, 0, 0, dMS, metricsCount, stat.ReadBytes, stat.ChReadRows, stat.ChReadBytes, errored)
+		}
+	}()
+
+	r.ParseMultipartForm(1024 * 1024)
+
+	format := r.FormValue("format")
+	switch format {
+	case "":
+		format = "json"
+	case "json", "protobuf", "carbonapi_v3_pb":
+	default:
+		status = http.StatusBadRequest
+		http.Error(w, "Failed to parse request: unsupported formatter", status)
+		return
+	}
+
+	query := r.FormValue("query")
+	kind := r.FormValue("type")
+	if kind == "" {
+		kind = finder.SearchSubstring
+	}
+	tz := r.FormValue("tz")
+	from := date.DateParamToEpoch(r.FormValue("from"), tz, 0, time.Local)
+	until := date.DateParamToEpoch(r.FormValue("until"), tz, 0, time.Local)
+
+	page, err := h.parsePage(r)
+	if err != nil {
+		status = http.StatusBadRequest
+		http.Error(w, err.Error(), status)
+		return
+	}
+	ctx := finder.WithPage(r.Context(), page)
+
+	var (
+		result finder.Result
+		key    string
+	)
+	useCache := h.config.Common.FindCache != nil && h.config.Common.FindCacheConfig.FindTimeoutSec > 0 && !parser.TruthyBool(r.FormValue("noCache"))
+	if useCache {
+		ts := utils.TimestampTruncate(time.Now().Unix(), time.Duration(h.config.Common.FindCacheConfig.FindTimeoutSec)*time.Second)
+		key = searchCacheKey(kind, query, from, until, ts, page)
+		body, err := h.config.Common.FindCache.Get(key)
+		if err == nil {
+			if metrics.FinderCacheMetrics != nil {
+				metrics.FinderCacheMetrics.CacheHits.Add(1)
+			}
+			findCache = true
+			w.Header().Set("X-Cached-Find", strconv.Itoa(int(h.config.Common.FindCacheConfig.FindTimeoutSec)))
+			result = finder.NewCachedIndex(body)
+			logger.Info("finder", zap.String("get_cache", key),
+				zap.Int("metrics", len(result.List())), zap.Bool("find_cached", true),
+				zap.Int32("ttl", h.config.Common.FindCacheConfig.FindTimeoutSec))
+		}
+	}
+
+	if result == nil {
+		var (
+			entered  bool
+			limitCtx context.Context
+			cancel   context.CancelFunc
+		)
+		if limiter.Enabled() {
+			limitCtx, cancel = context.WithTimeout(context.Background(), h.config.ClickHouse.IndexTimeout)
+			defer cancel()
+
+			err := limiter.Enter(limitCtx, "find")
+			queueDuration = time.Since(start)
+			if err != nil {
+				status = http.StatusServiceUnavailable
+				queueFail = true
+				logger.Error(err.Error())
+				http.Error(w, err.Error(), status)
+				return
+			}
+			entered = true
+			defer func() {
+				if entered {
+					limiter.Leave(limitCtx, "find")
+					entered = false
+				}
+			}()
+		}
+
+		result, err = finder.Search(ctx, h.config, kind, query, from, until, &stat)
+
+		if entered {
+			// release early as possible
+			limiter.Leave(limitCtx, "find")
+			entered = false
+		}
+
+		if err != nil {
+			status, _ = clickhouse.HandleError(w, err)
+			return
+		}
+
+		if useCache {
+			if body, err := result.Bytes(); err == nil {
+				if metrics.FinderCacheMetrics != nil {
+					metrics.FinderCacheMetrics.CacheMisses.Add(1)
+				}
+				h.config.Common.FindCache.Set(key, body, h.config.Common.FindCacheConfig.FindTimeoutSec)
+				logger.Info("finder", zap.String("set_cache", key),
+					zap.Int("metrics", len(result.List())), zap.Bool("find_cached", false),
+					zap.Int32("ttl", h.config.Common.FindCacheConfig.FindTimeoutSec))
+			}
+		}
+	}
+
+	rows, more := page.Apply(result.List())
+	metricsCount = int64(len(rows))
+	var next string
+	if more {
+		next = find.EncodeCursor(rows[len(rows)-1])
+		w.Header().Set(find.NextCursorHeader, next)
+	}
+
+	var body []byte
+	switch format {
+	case "json":
+		resp := jsonResponse{Metrics: make([]string, 0, len(rows)), Next: next}
+		for _, row := range rows {
+			resp.Metrics = append(resp.Metrics, string(row))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		body, err = json.Marshal(resp)
+	case "protobuf":
+		resp := v2pb.GlobResponse{Name: query, Matches: make([]v2pb.GlobMatch, 0, len(rows))}
+		for _, row := range rows {
+			resp.Matches = append(resp.Matches, v2pb.GlobMatch{Path: string(row), IsLeaf: true})
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		body, err = proto.Marshal(&resp)
+	case "carbonapi_v3_pb":
+		resp := v3pb.GlobResponse{Name: query, Matches: make([]v3pb.GlobMatch, 0, len(rows))}
+		for _, row := range rows {
+			resp.Matches = append(resp.Matches, v3pb.GlobMatch{Path: string(row), IsLeaf: true})
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		body, err = proto.Marshal(&v3pb.MultiGlobResponse{Metrics: []v3pb.GlobResponse{resp}})
+	}
+	if err != nil {
+		status = http.StatusInternalServerError
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Write(body)
+}
+
+// parsePage returns the page requested by limit and cursor parameters. The limit is capped by
+// Common.MaxMetricsInFindAnswer, DefaultLimit is used when both aren't set
+func (h *Handler) parsePage(r *http.Request) (*finder.Page, error) {
+	p := &finder.Page{Limit: DefaultLimit, LeavesOnly: true}
+	if maxMetrics := h.config.Common.MaxMetricsInFindAnswer; maxMetrics > 0 {
+		p.Limit = maxMetrics
+	}
+	if limit := r.FormValue("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid limit: %q", limit)
+		}
+		p.Limit = min(p.Limit, n)
+	}
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		var err error
+		if p.After, err = find.DecodeCursor(cursor); err != nil {
+			return nil, fmt.Errorf("invalid cursor: %q", cursor)
+		}
+	}
+	return p, nil
+}
+
+// searchCacheKey returns the key of the finder cache, the days of from and until are used for the daily index
+func searchCacheKey(kind, query string, from, until, ts int64, page *finder.Page) string {
+	days := "1970-02-12"
+	if from > 0 && until > 0 {
+		days = chdate.FromTimestampToDaysFormat(from) + ";" + chdate.UntilTimestampToDaysFormat(until)
+	}
+	return "search;type=" + kind + ";" + days + page.Key() + ";query=" + query + ";ts=" + strconv.FormatInt(ts, 10)
+}
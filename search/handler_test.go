@@ -0,0 +1,65 @@
+package search
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v3pb "github.com/go-graphite/protocol/carbonapi_v3_pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/lomik/graphite-clickhouse/config"
+	"github.com/lomik/graphite-clickhouse/find"
+	"github.com/lomik/graphite-clickhouse/metrics"
+)
+
+func TestSearch(t *testing.T) {
+	metrics.DisableMetrics()
+	requestLog := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requestLog <- string(body)
+		w.Write([]byte("a.cpu.idle\nb.cpu.idle\nc.cpu.idle\n"))
+	}))
+	defer srv.Close()
+
+	cfg := config.New()
+	cfg.ClickHouse.URL = srv.URL
+	cfg.ClickHouse.IndexTable = "graphite_index"
+	handler := NewHandler(cfg)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/metrics/search/?query=cpu&limit=2", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, <-requestLog, "(position(Path, 'cpu') > 0) GROUP BY Metric ORDER BY Metric LIMIT 3 ")
+	var resp jsonResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, []string{"a.cpu.idle", "b.cpu.idle"}, resp.Metrics)
+	require.NotEmpty(t, resp.Next)
+	assert.Equal(t, resp.Next, w.Header().Get(find.NextCursorHeader))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/metrics/search/?format=carbonapi_v3_pb&type=regex&query=%5Ea%5C..%2A&limit=2&cursor="+resp.Next, nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, <-requestLog, "AND (Path>'b.cpu.idle') GROUP BY Metric")
+	assert.Empty(t, w.Header().Get(find.NextCursorHeader), "the last page")
+	var v3 v3pb.MultiGlobResponse
+	require.NoError(t, v3.Unmarshal(w.Body.Bytes()))
+	require.Len(t, v3.Metrics, 1)
+	assert.Equal(t, `^a\..*`, v3.Metrics[0].Name)
+	assert.Equal(t, []v3pb.GlobMatch{{Path: "c.cpu.idle", IsLeaf: true}}, v3.Metrics[0].Matches)
+
+	for _, params := range []string{"query=", "type=glob&query=a", "type=regex&query=%28", "query=a&limit=x", "query=a&cursor=%21%21", "query=a&format=pickle"} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/metrics/search/?"+params, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, params)
+	}
+
+	cfg.ClickHouse.IndexTable = ""
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost/metrics/search/?query=cpu", nil))
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}